@@ -0,0 +1,131 @@
+package socks6
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/studentmain/socks6/common/lg"
+)
+
+// AcceptLimit protect server from connection floods, connections over limit are reset before reading request.
+// Zero field means no limit on it
+type AcceptLimit struct {
+	// ConnectionsPerSecond is max new connections accepted from one source IP per second,
+	// short burst up to 1 second of rate is allowed
+	ConnectionsPerSecond int
+	// BanDuration is how long a source exceeded ConnectionsPerSecond is banned, all its new connections are reset.
+	// 0 means only excess connections are reset
+	BanDuration time.Duration
+	// MaxPendingHandshake is max connections which are still sending request or authenticating
+	MaxPendingHandshake int
+}
+
+// acceptRateLimiter is token bucket of a source IP
+type acceptRateLimiter struct {
+	mtx    sync.Mutex
+	bucket tokenBucket
+}
+
+func (l *acceptRateLimiter) allow(now time.Time) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.bucket.fill(now)
+	if !l.bucket.enough(1) {
+		return false
+	}
+	l.bucket.take(1)
+	return true
+}
+
+// idle check whether bucket is full, i.e. forgetting it doesn't change anything
+func (l *acceptRateLimiter) idle(now time.Time) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.bucket.fill(now)
+	return l.bucket.tokens >= l.bucket.rate
+}
+
+// admitStream check accept limit of a new stream connection, reset connection when it's not admitted.
+// done must be called after handshake finished
+func (s *ServerWorker) admitStream(conn net.Conn) (done func(), ok bool) {
+	limit := s.AcceptLimit
+	if limit.ConnectionsPerSecond > 0 {
+		now := time.Now()
+		ip := addrIP(conn.RemoteAddr())
+		if until, banned := s.acceptBan.Load(ip); banned && now.Before(until) {
+			resetConn(conn)
+			return nil, false
+		}
+		l, _ := s.acceptLimiter.LoadOrStore(ip, &acceptRateLimiter{
+			bucket: newTokenBucket(limit.ConnectionsPerSecond, now),
+		})
+		if !l.allow(now) {
+			if limit.BanDuration > 0 {
+				lg.Warning(conn3Tuple(conn), "connection flood, ban source for", limit.BanDuration)
+				s.acceptBan.Store(ip, now.Add(limit.BanDuration))
+			} else {
+				lg.Debug(conn3Tuple(conn), "connection rate limit exceeded")
+			}
+			resetConn(conn)
+			return nil, false
+		}
+	}
+	if limit.MaxPendingHandshake <= 0 {
+		return func() {}, true
+	}
+	if atomic.AddInt32(&s.pendingHandshake, 1) > int32(limit.MaxPendingHandshake) {
+		atomic.AddInt32(&s.pendingHandshake, -1)
+		lg.Debug(conn3Tuple(conn), "too many pending handshakes")
+		resetConn(conn)
+		return nil, false
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { atomic.AddInt32(&s.pendingHandshake, -1) })
+	}, true
+}
+
+// clearAcceptLimit forget expired bans and rate limiters of quiet sources
+func (s *ServerWorker) clearAcceptLimit() {
+	now := time.Now()
+	s.acceptBan.Range(func(key string, value time.Time) bool {
+		if now.After(value) {
+			s.acceptBan.Delete(key)
+		}
+		return true
+	})
+	s.acceptLimiter.Range(func(key string, value *acceptRateLimiter) bool {
+		if value.idle(now) {
+			s.acceptLimiter.Delete(key)
+		}
+		return true
+	})
+}
+
+// addrIP return IP of address as string, or whole address when it's not an IP address
+func addrIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// resetConn close connection with RST when possible, so no TIME_WAIT state is kept for abusive client
+func resetConn(conn net.Conn) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
@@ -51,6 +51,9 @@ func NewClientAuthenticationChannels() *ClientAuthenticationChannels {
 	}
 }
 
+// ClientAuthenticationMethod is authentication method used by client.
+// Authenticate write request data to Data, then wait for 1st authentication reply.
+// ctx is cancelled when method is not selected by proxy, method should return without writing to other channels.
 type ClientAuthenticationMethod interface {
 	Authenticate(
 		ctx context.Context,
@@ -3,6 +3,8 @@ package auth
 import (
 	"context"
 	"net"
+
+	"github.com/studentmain/socks6/message"
 )
 
 const authIdNone byte = 0
@@ -33,7 +35,12 @@ func (f NoneClientAuthenticationMethod) Authenticate(
 	cac ClientAuthenticationChannels,
 ) {
 	cac.Data <- []byte{}
-	rep1 := <-cac.FirstAuthReply
+	var rep1 *message.AuthenticationReply
+	select {
+	case rep1 = <-cac.FirstAuthReply:
+	case <-ctx.Done():
+		return
+	}
 	cac.FinalAuthReply <- rep1
 	cac.Error <- nil
 }
@@ -113,7 +113,12 @@ func (p PasswordClientAuthenticationMethod) Authenticate(
 	cac.Data <- b.Bytes()
 
 	// data is ignored
-	rep1 := <-cac.FirstAuthReply
+	var rep1 *message.AuthenticationReply
+	select {
+	case rep1 = <-cac.FirstAuthReply:
+	case <-ctx.Done():
+		return
+	}
 	cac.FinalAuthReply <- rep1
 	cac.Error <- nil
 }
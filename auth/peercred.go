@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/studentmain/socks6/internal/socket"
+)
+
+// PeerCred is credential of local client process connected by unix socket
+type PeerCred = socket.PeerCred
+
+// PeerCredServerAuthenticationMethod authenticate local client by its peer credential (SO_PEERCRED) of unix socket,
+// so local applications get per-user policy without password. It replace method 0, client doesn't send anything.
+// Connection other than unix socket is rejected, only supported on linux
+type PeerCredServerAuthenticationMethod struct {
+	// ClientName map credential to client name, return false to reject client.
+	// nil means accept everyone as "uid:<uid>"
+	ClientName func(cred PeerCred) (string, bool)
+}
+
+func (p PeerCredServerAuthenticationMethod) Authenticate(
+	ctx context.Context,
+	conn net.Conn,
+	data []byte,
+	sac *ServerAuthenticationChannels,
+) {
+	cred, err := socket.GetPeerCred(conn)
+	if err != nil {
+		sac.Result <- ServerAuthenticationResult{Success: false}
+		sac.Err <- err
+		return
+	}
+	name, ok := fmt.Sprintf("uid:%d", cred.UID), true
+	if p.ClientName != nil {
+		name, ok = p.ClientName(*cred)
+	}
+	sac.Result <- ServerAuthenticationResult{
+		Success:    ok,
+		ClientName: name,
+	}
+	sac.Err <- nil
+}
+func (p PeerCredServerAuthenticationMethod) ID() byte {
+	return authIdNone
+}
@@ -60,20 +60,14 @@ func (d *DefaultServerAuthenticator) Authenticate(
 	*ServerAuthenticationResult,
 	*ServerAuthenticationChannels,
 ) {
-	if sessionData, useSession := req.Options.GetData(message.OptionKindSessionID); useSession {
-		sid := sessionData.(message.SessionIDOptionData).ID
-		return d.sessionCheck(req, sid), NewServerAuthenticationChannels()
+	if sr := message.GetSessionRequest(req.Options); sr.ID != nil {
+		return d.sessionCheck(sr), NewServerAuthenticationChannels()
 	}
 	order := []byte{0}
-	if orderData, ok := req.Options.GetData(message.OptionKindAuthenticationMethodAdvertisement); ok {
-		order = append(order, orderData.(message.AuthenticationMethodAdvertisementOptionData).Methods...)
-	}
-	authData := map[byte][]byte{}
-	ads := req.Options.GetKind(message.OptionKindAuthenticationData)
-	for _, v := range ads {
-		data := v.Data.(message.AuthenticationDataOptionData)
-		authData[data.Method] = data.Data
+	if orderData, ok := message.GetTyped[message.AuthenticationMethodAdvertisementOptionData](req.Options, message.OptionKindAuthenticationMethodAdvertisement); ok {
+		order = append(order, orderData.Methods...)
 	}
+	authData := message.GetAllAuthenticationData(req.Options)
 	r, c := d.pickMethod(ctx, conn, authData, order)
 	return d.tryStartSesstion(r, req), c
 }
@@ -144,17 +138,13 @@ func (d *DefaultServerAuthenticator) AddMethod(method ServerAuthenticationMethod
 	d.Methods[method.ID()] = method
 }
 
-func (d *DefaultServerAuthenticator) sessionCheck(
-	req message.Request,
-	sid []byte,
-) *ServerAuthenticationResult {
+func (d *DefaultServerAuthenticator) sessionCheck(sr message.SessionRequest) *ServerAuthenticationResult {
+	sid := sr.ID
 	sessionInvalid := ServerAuthenticationResult{
 		Success:  false,
 		Continue: false,
 
-		AdditionalOptions: []message.Option{
-			{Kind: message.OptionKindSessionInvalid, Data: message.SessionInvalidOptionData{}},
-		},
+		AdditionalOptions: message.SessionReply{Invalid: true}.Options(),
 	}
 	if d.DisableSession {
 		return &sessionInvalid
@@ -169,90 +159,54 @@ func (d *DefaultServerAuthenticator) sessionCheck(
 	}
 
 	// requested teardown
-	if _, teardown := req.Options.GetData(message.OptionKindSessionTeardown); teardown {
+	if sr.Teardown {
 		d.sessions.Delete(sk)
 		return &sessionInvalid
 	}
 	// session success
+	session.connCount++
 	sar := ServerAuthenticationResult{
-		Continue: false,
-
+		Continue:  false,
 		SessionID: sid,
-		AdditionalOptions: []message.Option{
-			{Kind: message.OptionKindSessionOK, Data: message.SessionOKOptionData{}},
-		},
 	}
+	rep := message.SessionReply{OK: true}
 	// token request
-	windowRequestData, requested := req.Options.GetData(message.OptionKindTokenRequest)
+	requested := sr.TokenWindow > 0 && !d.DisableToken
 	windowRequest := uint32(0)
-	// requested window
-	if requested && !d.DisableToken {
-		windowRequest = windowRequestData.(message.TokenRequestOptionData).WindowSize
-		// allocate when no window
-		if session.window.Length() == 0 {
-			if windowRequest > 2048 {
-				windowRequest = 2048
-			}
-			alloc, base, size := session.allocateWindow(uint32(windowRequest))
-			if alloc {
-				sar.AdditionalOptions = append(sar.AdditionalOptions, message.Option{
-					Kind: message.OptionKindIdempotenceWindow,
-					Data: message.IdempotenceWindowOptionData{
-						WindowBase: base,
-						WindowSize: size,
-					},
-				})
-			}
+	if requested {
+		windowRequest = sr.TokenWindow
+		if windowRequest > 2048 {
+			windowRequest = 2048
 		}
 	}
 
 	// token check
-	tokenData, spend := req.Options.GetData(message.OptionKindIdempotenceExpenditure)
-	if !spend {
-		// not used
-		sar.Success = true
-		return &sar
-	}
-	// spending token
-	if d.DisableToken {
-		sar.Success = false
-		sar.AdditionalOptions = append(sar.AdditionalOptions, message.Option{
-			Kind: message.OptionKindIdempotenceRejected,
-			Data: message.IdempotenceRejectedOptionData{},
-		})
-		return &sar
-	}
-
-	token := tokenData.(message.IdempotenceExpenditureOptionData).Token
-	if !session.checkToken(token) {
-		// token fail
-		sar.Success = false
-		sar.AdditionalOptions = append(sar.AdditionalOptions, message.Option{
-			Kind: message.OptionKindIdempotenceRejected,
-			Data: message.IdempotenceRejectedOptionData{},
-		})
-		return &sar
+	spend := sr.SpendToken
+	if spend {
+		// spending token
+		if d.DisableToken || !session.checkToken(sr.Token) {
+			// token fail
+			sar.Success = false
+			rep.TokenRejected = true
+			sar.AdditionalOptions = rep.Options()
+			return &sar
+		}
+		// token success
+		rep.TokenAccepted = true
 	}
-
-	// token success
 	sar.Success = true
-	sar.AdditionalOptions = append(sar.AdditionalOptions, message.Option{
-		Kind: message.OptionKindIdempotenceAccepted,
-		Data: message.IdempotenceAcceptedOptionData{},
-	})
 
-	// allocate when necessary/requested
-	alloc, base, size := session.allocateWindow(uint32(windowRequest))
-	if alloc {
-		sar.AdditionalOptions = append(sar.AdditionalOptions, message.Option{
-			Kind: message.OptionKindIdempotenceWindow,
-			Data: message.IdempotenceWindowOptionData{
-				WindowBase: base,
-				WindowSize: size,
-			},
-		})
+	// allocate when requested, move window when token spent
+	if requested || spend {
+		alloc, base, size := session.allocateWindow(windowRequest)
+		// requested window is always sent, client may have dropped it
+		if alloc || (requested && size > 0) {
+			rep.Window = true
+			rep.WindowBase = base
+			rep.WindowSize = size
+		}
 	}
-
+	sar.AdditionalOptions = rep.Options()
 	return &sar
 }
 
@@ -263,34 +217,21 @@ func (d *DefaultServerAuthenticator) tryStartSesstion(
 	if !result.Success {
 		return result
 	}
-	if _, requested := req.Options.GetData(message.OptionKindSessionRequest); !requested {
+	sr := message.GetSessionRequest(req.Options)
+	if !sr.Request {
 		return result
 	}
 	s := newServerSession(8)
-	result.AdditionalOptions = append(result.AdditionalOptions, message.Option{
-		Kind: message.OptionKindSessionID,
-		Data: message.SessionIDOptionData{ID: s.id},
-	})
-	result.AdditionalOptions = append(result.AdditionalOptions, message.Option{
-		Kind: message.OptionKindSessionOK,
-		Data: message.SessionOKOptionData{},
-	})
+	s.connCount++
+	d.sessions.Store(base64.RawStdEncoding.EncodeToString(s.id), s)
+	rep := message.SessionReply{ID: s.id, OK: true}
 	result.SessionID = s.id
 
-	if tokenData, requestToken := req.Options.GetData(message.OptionKindTokenRequest); requestToken {
+	if sr.TokenWindow > 0 {
 		// token
-		windowRequest := tokenData.(message.TokenRequestOptionData).WindowSize
-		alloc, base, size := s.allocateWindow(uint32(windowRequest))
-		if alloc {
-			result.AdditionalOptions = append(result.AdditionalOptions, message.Option{
-				Kind: message.OptionKindIdempotenceWindow,
-				Data: message.IdempotenceWindowOptionData{
-					WindowBase: base,
-					WindowSize: size,
-				},
-			})
-		}
+		rep.Window, rep.WindowBase, rep.WindowSize = s.allocateWindow(sr.TokenWindow)
 	}
+	result.AdditionalOptions = append(result.AdditionalOptions, rep.Options()...)
 	return result
 }
 
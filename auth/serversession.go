@@ -1,7 +1,7 @@
 package auth
 
 import (
-	"math"
+	"sync"
 
 	"github.com/studentmain/socks6/common/arrayx"
 	"github.com/studentmain/socks6/common/rnd"
@@ -9,6 +9,7 @@ import (
 
 type serverSession struct {
 	id         []byte
+	mtx        sync.Mutex // protect token window
 	windowBase uint32
 	window     arrayx.BoolArr
 	popcnt     int
@@ -23,8 +24,10 @@ func newServerSession(idSize int) *serverSession {
 }
 
 func (s *serverSession) checkToken(t uint32) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
 	offset := t - s.windowBase
-	if offset > uint32(s.window.Length()) {
+	if offset >= uint32(s.window.Length()) {
 		return false
 	}
 
@@ -38,33 +41,36 @@ func (s *serverSession) checkToken(t uint32) bool {
 }
 
 func (s *serverSession) allocateWindow(size uint32) (bool, uint32, uint32) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
 	origSize := s.window.Length()
 	// zero window, alloc new window
 	if origSize == 0 {
+		if size == 0 {
+			return false, 0, 0
+		}
 		s.windowBase = rnd.RandUint32()
 		s.window = arrayx.NewBoolArr(int(size))
 		return true, s.windowBase, size
 	}
-	// first not spent, reject
-	if !s.window.Get(0) {
+	// slide window over leading spent tokens, 8 tokens a time
+	shift := 0
+	for shift < len(s.window) && s.window[shift] == 0xff {
+		shift++
+	}
+	// not moved and not enlarged, reject
+	if shift == 0 && size <= uint32(origSize) {
 		return false, s.windowBase, uint32(origSize)
 	}
 
-	// windowBase+=s.popcnt, align to 8
-	spentRatio := float64(s.popcnt) / float64(origSize)
-	baseOffsetF := math.Floor(spentRatio * float64(origSize))
-	baseOffset := arrayx.PaddedLen(int(baseOffsetF), 8) / 8
-	s.windowBase += uint32(baseOffset)
-	dst := s.window
-
-	// resize, alloc new
+	newSize := origSize
 	if size > uint32(origSize) {
-		dst = make(arrayx.BoolArr, size)
-	}
-	// resized or window shifted
-	if baseOffset > 0 || size > uint32(origSize) {
-		copy(dst, s.window[baseOffset:])
+		newSize = int(size)
 	}
+	dst := arrayx.NewBoolArr(newSize)
+	copy(dst, s.window[shift:])
+	s.windowBase += uint32(shift * 8)
+	s.popcnt -= shift * 8
 	s.window = dst
 	return true, s.windowBase, uint32(s.window.Length())
 }
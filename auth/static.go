@@ -0,0 +1,34 @@
+package auth
+
+import (
+	"context"
+	"net"
+
+	"github.com/studentmain/socks6/message"
+)
+
+// StaticClientAuthenticationMethod send fixed data in request, e.g. pre-shared token of a private method.
+// Only single stage authentication is supported.
+type StaticClientAuthenticationMethod struct {
+	Method byte
+	Data   []byte
+}
+
+func (s StaticClientAuthenticationMethod) Authenticate(
+	ctx context.Context,
+	conn net.Conn,
+	cac ClientAuthenticationChannels,
+) {
+	cac.Data <- s.Data
+	var rep1 *message.AuthenticationReply
+	select {
+	case rep1 = <-cac.FirstAuthReply:
+	case <-ctx.Done():
+		return
+	}
+	cac.FinalAuthReply <- rep1
+	cac.Error <- nil
+}
+func (s StaticClientAuthenticationMethod) ID() byte {
+	return s.Method
+}
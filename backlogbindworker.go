@@ -52,12 +52,9 @@ func (b *backlogBindWorker) handler(
 		cc.WriteReplyCode(message.OperationReplyServerFailure)
 	}
 	// write bind request reply 1 with listener addr
-	rep := message.NewOperationReplyWithCode(message.OperationReplySuccess)
-	rep.Endpoint = message.ConvertAddr(b.listener.Addr())
 	cc.WriteReplyAddr(message.OperationReplySuccess, b.listener.Addr())
 
 	// write bind request reply 2 with remote addr
-	rep.Endpoint = message.ConvertAddr(c.RemoteAddr())
 	cc.WriteReplyAddr(message.OperationReplySuccess, c.RemoteAddr())
 
 	// fwd
@@ -77,9 +74,6 @@ func (b *backlogBindWorker) accept(ctx context.Context) {
 	}
 	b.queue <- c
 	// notify client with operation reply
-	rep := message.NewOperationReplyWithCode(message.OperationReplySuccess)
-	rep.Endpoint = message.ParseAddr(c.RemoteAddr().String())
-
 	lg.Info(b.cc.ConnId(), "backlog accepted from", conn3Tuple(c))
 	if err := b.cc.WriteReplyAddr(message.OperationReplySuccess, c.RemoteAddr()); err != nil {
 		lg.Warning(b.cc.ConnId(), "backlog write reply fail", err)
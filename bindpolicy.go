@@ -0,0 +1,130 @@
+package socks6
+
+import (
+	"net"
+
+	"github.com/studentmain/socks6/common/rnd"
+	"github.com/studentmain/socks6/message"
+)
+
+// BindPolicy restrict local address and port used by BIND and UDP ASSOCIATE
+type BindPolicy struct {
+	// Addresses is allowed local addresses, empty means any address is allowed.
+	// When client requested an unspecified address, first address with same family is used.
+	Addresses []net.IP
+	// MinPort and MaxPort is allowed local port range (inclusive), 0 means no limit on that side.
+	// When client requested port 0, a port in range is selected.
+	MinPort uint16
+	MaxPort uint16
+}
+
+// maxBindAttempt is how many ports will be tried when client requested port 0
+const maxBindAttempt = 32
+
+func (p *BindPolicy) portLimited() bool {
+	return p.MinPort != 0 || p.MaxPort != 0
+}
+
+func (p *BindPolicy) portRange() (uint16, uint16) {
+	min, max := p.MinPort, p.MaxPort
+	if min == 0 {
+		min = 1
+	}
+	if max == 0 {
+		max = 65535
+	}
+	return min, max
+}
+
+// resolveAddr check requested address, return the address should be used
+func (p *BindPolicy) resolveAddr(addr *message.SocksAddr) (*message.SocksAddr, bool) {
+	if len(p.Addresses) == 0 {
+		return addr, true
+	}
+	if addr.AddressType == message.AddressTypeDomainName {
+		return nil, false
+	}
+	ip := net.IP(addr.Address)
+	if ip.IsUnspecified() {
+		for _, a := range p.Addresses {
+			if (a.To4() != nil) == (addr.AddressType == message.AddressTypeIPv4) {
+				ret := message.ConvertAddr(&net.TCPAddr{IP: a, Port: int(addr.Port)})
+				return ret, true
+			}
+		}
+		return nil, false
+	}
+	for _, a := range p.Addresses {
+		if a.Equal(ip) {
+			return addr, true
+		}
+	}
+	return nil, false
+}
+
+// Allowed check whether requested address is allowed by policy
+func (p *BindPolicy) Allowed(addr *message.SocksAddr) bool {
+	if _, ok := p.resolveAddr(addr); !ok {
+		return false
+	}
+	if addr.Port == 0 || !p.portLimited() {
+		return true
+	}
+	min, max := p.portRange()
+	return addr.Port >= min && addr.Port <= max
+}
+
+// candidates return addresses should be tried in order
+func (p *BindPolicy) candidates(addr *message.SocksAddr) []*message.SocksAddr {
+	a, ok := p.resolveAddr(addr)
+	if !ok {
+		return nil
+	}
+	if a.Port != 0 || !p.portLimited() {
+		return []*message.SocksAddr{a}
+	}
+	min, max := p.portRange()
+	size := int(max) - int(min) + 1
+	if size <= 0 {
+		return nil
+	}
+	n := size
+	if n > maxBindAttempt {
+		n = maxBindAttempt
+	}
+	// start at random port to avoid collide with other association
+	start := int(rnd.RandUint16()) % size
+	ret := make([]*message.SocksAddr, 0, n)
+	for i := 0; i < n; i++ {
+		ret = append(ret, &message.SocksAddr{
+			AddressType: a.AddressType,
+			Address:     a.Address,
+			Port:        uint16(int(min) + (start+i)%size),
+		})
+	}
+	return ret
+}
+
+// bindWithPolicy call fn with policy allowed addresses until success
+func bindWithPolicy[T any](
+	p *BindPolicy,
+	addr *message.SocksAddr,
+	fn func(addr *message.SocksAddr) (T, message.StackOptionInfo, error),
+) (T, message.StackOptionInfo, error) {
+	if p == nil {
+		return fn(addr)
+	}
+	var zero T
+	if !p.Allowed(addr) {
+		return zero, nil, ErrNotAllowedByRule
+	}
+	var lastErr error = ErrNotAllowedByRule
+	for _, a := range p.candidates(addr) {
+		r, opt, err := fn(a)
+		if err == nil {
+			return r, opt, nil
+		}
+		lastErr = err
+	}
+	return zero, nil, lastErr
+}
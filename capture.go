@@ -0,0 +1,129 @@
+package socks6
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// StartCapture write traffic relayed for owner to w in pcapng format, until returned stop function is called.
+// owner is in same format as UDPAssociationStats.Owner, e.g. "session 0123abcd" or "address 192.0.2.1".
+// All UDP associations of owner and CONNECT started after it are captured. w is not closed by stop.
+func (s *ServerWorker) StartCapture(owner string, w io.Writer) (stop func(), err error) {
+	// reserve owner before anything is written to w
+	if _, loaded := s.captures.LoadOrStore(owner, nil); loaded {
+		return nil, ErrCaptureInProgress
+	}
+	p, err := NewPcapWriter(w)
+	if err != nil {
+		s.captures.Delete(owner)
+		return nil, err
+	}
+	s.captures.Store(owner, p)
+	s.udpAssociation.Range(func(key uint64, value *udpAssociation) bool {
+		if value.alive && value.owner == owner {
+			value.setCapture(p)
+		}
+		return true
+	})
+	return func() {
+		s.captures.Delete(owner)
+		s.stopCapture(p)
+	}, nil
+}
+
+// StartUDPAssociationCapture write datagrams relayed by UDP association to w in pcapng format,
+// until returned stop function is called. w is not closed by stop.
+func (s *ServerWorker) StartUDPAssociationCapture(id uint64, w io.Writer) (stop func(), err error) {
+	ua, ok := s.udpAssociation.Load(id)
+	if !ok || !ua.alive {
+		return nil, ErrAssociationMismatch
+	}
+	if ua.capture() != nil {
+		return nil, ErrCaptureInProgress
+	}
+	p, err := NewPcapWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	// another capture may start while header is written
+	if !ua.setCaptureIfNone(p) {
+		return nil, ErrCaptureInProgress
+	}
+	return func() {
+		s.stopCapture(p)
+	}, nil
+}
+
+// stopCapture detach p from associations
+func (s *ServerWorker) stopCapture(p *PcapWriter) {
+	s.udpAssociation.Range(func(key uint64, value *udpAssociation) bool {
+		value.pcap.CompareAndSwap(p, (*PcapWriter)(nil))
+		return true
+	})
+}
+
+// captureOf return capture of cc's owner, nil if not captured
+func (s *ServerWorker) captureOf(cc SocksConn) *PcapWriter {
+	p, ok := s.captures.Load(udpAssociationOwner(cc))
+	if !ok {
+		return nil
+	}
+	return p
+}
+
+// captureConn record payload written to and read from remote connection
+type captureConn struct {
+	net.Conn
+	flow *pcapTCPFlow
+	once sync.Once
+}
+
+func newCaptureConn(rconn net.Conn, p *PcapWriter, client net.Addr) *captureConn {
+	return &captureConn{
+		Conn: rconn,
+		flow: newPcapTCPFlow(p, client, rconn.RemoteAddr()),
+	}
+}
+
+func (c *captureConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.flow.data(false, b[:n])
+	}
+	if err == io.EOF {
+		c.flow.fin(false)
+	}
+	return n, err
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.flow.data(true, b[:n])
+	}
+	return n, err
+}
+
+func (c *captureConn) Close() error {
+	c.once.Do(func() {
+		c.flow.fin(true)
+	})
+	return c.Conn.Close()
+}
+
+// capture return capture of association, nil if not captured
+func (u *udpAssociation) capture() *PcapWriter {
+	p, _ := u.pcap.Load().(*PcapWriter)
+	return p
+}
+
+func (u *udpAssociation) setCapture(p *PcapWriter) {
+	u.pcap.Store(p)
+}
+
+// setCaptureIfNone attach p when association is not captured, return false otherwise
+func (u *udpAssociation) setCaptureIfNone(p *PcapWriter) bool {
+	// pcap hold nothing before first capture, and typed nil after capture stopped
+	return u.pcap.CompareAndSwap(nil, p) || u.pcap.CompareAndSwap((*PcapWriter)(nil), p)
+}
@@ -0,0 +1,118 @@
+package socks6
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/studentmain/socks6/common/lg"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// CertificateSource provide server certificate on each TLS handshake, so long-running server can renew certificate without restart.
+// *autocert.Manager is a CertificateSource which obtain certificates by ACME, see NewACMECertificateSource
+type CertificateSource interface {
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// FileCertificateSource load certificate and key from PEM files, and reload them after files are modified.
+// When reload failed, e.g. files are being written, previous certificate is used.
+type FileCertificateSource struct {
+	CertFile string
+	KeyFile  string
+	// min interval between checking files' modification time, check on every handshake when it's 0
+	CheckInterval time.Duration
+
+	mtx     sync.Mutex
+	cert    *tls.Certificate
+	stamp   [2]time.Time
+	checked time.Time
+}
+
+// NewFileCertificateSource create a FileCertificateSource and load certificate from files, check files every 10s
+func NewFileCertificateSource(certFile, keyFile string) (*FileCertificateSource, error) {
+	f := &FileCertificateSource{
+		CertFile:      certFile,
+		KeyFile:       keyFile,
+		CheckInterval: 10 * time.Second,
+	}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// GetCertificate implements CertificateSource
+func (f *FileCertificateSource) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if time.Since(f.checked) >= f.CheckInterval {
+		f.checked = time.Now()
+		if stamp := f.fileStamp(); stamp != f.stamp || f.cert == nil {
+			if err := f.reload(stamp); err != nil {
+				lg.Warning("can't reload certificate", f.CertFile, err)
+			}
+		}
+	}
+	if f.cert == nil {
+		return nil, ErrNoCertificate
+	}
+	return f.cert, nil
+}
+
+// Reload load certificate from files immediately
+func (f *FileCertificateSource) Reload() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.checked = time.Now()
+	return f.reload(f.fileStamp())
+}
+
+func (f *FileCertificateSource) reload(stamp [2]time.Time) error {
+	cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return err
+	}
+	lg.Info("load certificate", f.CertFile)
+	f.cert = &cert
+	f.stamp = stamp
+	return nil
+}
+
+// fileStamp return modification time of certificate and key file, zero time when file is not accessible
+func (f *FileCertificateSource) fileStamp() [2]time.Time {
+	ret := [2]time.Time{}
+	for i, fn := range []string{f.CertFile, f.KeyFile} {
+		if fi, err := os.Stat(fn); err == nil {
+			ret[i] = fi.ModTime()
+		}
+	}
+	return ret
+}
+
+// NewACMECertificateSource create an ACME certificate source for hosts, which accept CA's terms of service,
+// and cache account key and certificates in cacheDir.
+// TLS-ALPN-01 challenge is answered by Server's TLS listener, so encrypted port must be reachable at port 443 of hosts.
+func NewACMECertificateSource(cacheDir string, email string, hosts ...string) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Email:      email,
+	}
+}
+
+// tlsConfig return TLS config of TLS and QUIC listener, which get certificate from CertificateSource when it's set.
+// Return nil when both TlsConfig and CertificateSource are nil
+func (s *Server) tlsConfig() *tls.Config {
+	if s.CertificateSource == nil {
+		return s.TlsConfig
+	}
+	conf := &tls.Config{}
+	if s.TlsConfig != nil {
+		conf = s.TlsConfig.Clone()
+	}
+	conf.GetCertificate = s.CertificateSource.GetCertificate
+	return conf
+}
@@ -1,14 +1,14 @@
 package socks6
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/binary"
 	"errors"
-	"io"
 	"net"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/lucas-clemente/quic-go"
 	"github.com/pion/dtls/v2"
@@ -16,6 +16,7 @@ import (
 	"github.com/studentmain/socks6/common"
 	"github.com/studentmain/socks6/common/lg"
 	"github.com/studentmain/socks6/common/nt"
+	"github.com/studentmain/socks6/internal/socket"
 	"github.com/studentmain/socks6/message"
 )
 
@@ -25,32 +26,104 @@ type Client struct {
 	Server string
 	// use TLS and DTLS when connect to server
 	Encrypted bool
-	// use QUIC
+	// TLS config used when Encrypted or QUIC is set, e.g. for private CA, client certificate and session cache.
+	// When nil or ServerName is empty, ServerName is host of Server
+	TlsConfig *tls.Config
+	// DTLS config used by datagram when Encrypted is set, e.g. for PSK, cipher suites and MTU.
+	// When nil, it's converted from TlsConfig
+	DatagramTLSConfig *dtls.Config
+	// tunnel SOCKS 6 by HTTP instead of connecting to Server, ws:// and wss:// use WebSocket,
+	// http:// and https:// use HTTP/1.1 Upgrade. UDP messages are always sent over stream
+	HTTPUpgradeURL string
+	// use QUIC, each request use a stream of one QUIC connection, UDP messages are sent as QUIC datagram.
+	// Set ZeroRTT or ClientSessionCache of TlsConfig to send request in 0-RTT data when reconnect
 	QUIC bool
+	// resume TLS session when reconnect, requests of QUIC are sent in 0-RTT data and TLS use abbreviated handshake.
+	// A session cache is created when TlsConfig has no ClientSessionCache.
+	// Proxy process 0-RTT request before handshake complete only when it spent a token, see UseSession and UseToken
+	ZeroRTT bool
+	// send datagram as SCTP messages over an SCTP association to Server instead of UDP,
+	// proxy must enable SCTP. Not used by QUIC, only supported on linux
+	SCTP bool
 	// send datagram over TCP, when use QUIC, send datagram over QUIC stream instead of QUIC datagram
 	UDPOverTCP bool
+	// send datagram over stream instead when proxy doesn't acknowledge UDP association in time,
+	// e.g. UDP to proxy is blocked, 0 to disable. Not used by QUIC
+	UDPFallbackTimeout time.Duration
+	// max UDP message size sent to server over datagram, longer datagram is fragmented, 0 to disable.
+	// Fragment is a non-standard experimental message type, proxy must be this implementation
+	UDPFragmentSize int
+	// max UDP payload size requested for association, proxy may apply a smaller one, 0 to accept proxy's limit
+	UDPMaxPayload int
+	// resolve domain name of requested address locally and send IP address to proxy,
+	// otherwise domain name is sent and resolved by proxy
+	ResolveLocally bool
 	// function to create underlying connection, net.Dial will used when it is nil
 	DialFunc func(ctx context.Context, network string, addr string) (net.Conn, error)
+	// Transport wrap stream connections dialed to Server, e.g. obfuscation, proxy must use same transport.
+	// TLS handshake is done over wrapped connection, not used by QUIC and HTTPUpgradeURL
+	Transport Transport
 	// authentication method to be used, can be nil
 	AuthenticationMethod auth.ClientAuthenticationMethod
+	// more authentication methods, advertised to proxy in order before AuthenticationMethod.
+	// Proxy select one of them, none method is always acceptable
+	AuthenticationMethods []auth.ClientAuthenticationMethod
+	// username and password, advertise username/password method after other methods when Username is not empty
+	Username string
+	Password string
 
 	// should client request session
 	UseSession bool
-	// how much token will requested
+	// multiplex CONNECT requests over one connection of session, require UseSession.
+	// Each request use a new connection when proxy doesn't support it
+	Multiplex bool
+	// MultiplexFunc create multiplexed connection when Multiplex is set,
+	// e.g. yamux client session wrapped by nt.WrapStreamSession, or smux client session wrapped by nt.WrapTypedStreamSession.
+	// Proxy must use same multiplexer.
+	// nil means nt.NewStreamMux
+	MultiplexFunc func(conn net.Conn) (nt.MultiplexedConn, error)
+	// authenticate again when session is expired, resume UDP associations when their connections are lost,
+	// operations interrupted by reconnection return temporary error. Require UseSession
+	AutoReconnect bool
+	// size of idempotence token window requested for session, 0 to disable, require UseSession.
+	// Tokens are spent by requests automatically, new window is requested before current one is exhausted
 	UseToken uint32
 	// suggested bind backlog
 	Backlog int
+	// interval of NOOP keepalive started by StartKeepAlive, 30s when it's 0
+	KeepAliveInterval time.Duration
+	// retry CONNECT requests failed with transient reply code, nil to disable
+	Retry *RetryPolicy
 
 	EnableICMP bool
+	// UDPErrorHandler is called when proxy relayed an error report of UDP association, require EnableICMP
+	UDPErrorHandler func(err *UDPError)
+	// Trace is called on requests and connections for monitoring, optional
+	Trace *ClientTrace
+	// Profile is draft revision used to talk with proxy, nil means message.DefaultProfile
+	Profile *message.Profile
+	// Padding round requests up to multiple of Padding bytes with padding options, 0 to disable
+	Padding int
+
+	tlsSessionOnce sync.Once
+	tlsSessions    tls.ClientSessionCache // created when ZeroRTT is set and TlsConfig has no cache
 
 	session  []byte
-	token    uint32
-	maxToken uint32
+	tokenMtx sync.Mutex // protect token and maxToken
+	token    uint32     // next token to spend
+	maxToken uint32     // end of token window, exclusive
 
+	qmtx     sync.Mutex // protect qc
 	qc       nt.DualModeMultiplexedConn
 	qudpconn common.SyncMap[uint64, *muxSeqPacket]
-	qbind    common.SyncMap[uint32, *ProxyTCPListener]
-	qsid     uint32
+
+	sidMtx     sync.Mutex                   // protect nextSid and muxBind
+	nextSid    uint32                       // next stream id attached to backlogged BIND
+	muxBindMap map[uint32]*ProxyTCPListener // backlogged listeners on multiplexed connections, by stream id
+
+	muxMtx         sync.Mutex
+	mux            nt.MultiplexedConn
+	muxUnsupported bool
 }
 
 type muxSeqPacket struct {
@@ -67,40 +140,110 @@ func (m *muxSeqPacket) NextDatagram() (nt.Datagram, error) {
 	return d, nil
 }
 
-func (c *Client) muxAccept() {
+// muxAccept accept streams opened by proxy on mc, which carry connections accepted by backlogged listeners,
+// and route them to listener by stream id. lost is called when mc is broken
+func (c *Client) muxAccept(mc nt.MultiplexedConn, lost func()) {
 	for {
-		conn, err := c.qc.Accept()
+		conn, err := mc.Accept()
 		if err != nil {
-			c.qc.Close()
-			c.qc = nil
+			lost()
 			return
 		}
-		buf := &bytes.Buffer{}
-		r := io.TeeReader(conn, buf)
+		go c.routeMuxStream(conn)
+	}
+}
 
-		rep, err := message.ParseOperationReplyFrom(r)
-		if err != nil {
-			continue
-		}
-		sidop, ok := rep.Options.GetData(message.OptionKindStreamID)
-		if !ok {
-			continue
-		}
-		sid := sidop.(message.StreamIDOptionData).ID
-		ptl, ok := c.qbind.Load(sid)
-		if !ok {
-			continue
-		}
-		ptl.qch <- nt.NewBufferPrefixedConn(conn, buf.Bytes())
+// routeMuxStream read reply on stream opened by proxy, and pass the stream to listener with stream id in reply
+func (c *Client) routeMuxStream(conn net.Conn) {
+	rep, err := c.parseConfig().ParseOperationReplyFrom(conn)
+	if err != nil {
+		lg.Warning("can't read reply of proxy opened stream", err)
+		conn.Close()
+		return
+	}
+	sidop, ok := message.GetTyped[message.StreamIDOptionData](rep.Options, message.OptionKindStreamID)
+	if !ok {
+		lg.Warning("proxy opened stream without stream id")
+		conn.Close()
+		return
+	}
+	sid := sidop.ID
+	ptl := c.muxBind(sid)
+	if ptl == nil {
+		lg.Warning("proxy opened stream for unknown stream id", sid)
+		conn.Close()
+		return
+	}
+	if err := convertReplyError(rep.ReplyCode); err != nil {
+		lg.Warning("backlogged bind failed", ptl.bind, err)
+		conn.Close()
+		return
+	}
+	pconn := &ProxyTCPConn{
+		netConn: conn,
+		addrPair: addrPair{
+			local:  ptl.bind,
+			remote: rep.Endpoint,
+		},
+		stackOpt: ptl.stackOpt,
+		replyOpt: ptl.replyOpt,
+		meter:    c.newTrafficMeter(message.CommandBind, rep.Endpoint),
 	}
+	select {
+	case ptl.ready <- pconn:
+	case <-ptl.closed:
+		conn.Close()
+	}
+}
+
+// allocStreamID allocate a stream id for backlogged BIND over multiplexed connection
+func (c *Client) allocStreamID() uint32 {
+	c.sidMtx.Lock()
+	defer c.sidMtx.Unlock()
+	sid := c.nextSid
+	c.nextSid++
+	return sid
 }
 
-func (c *Client) muxUdp() {
+// setMuxBind register listener l with stream id sid, nil l unregister it
+func (c *Client) setMuxBind(sid uint32, l *ProxyTCPListener) {
+	c.sidMtx.Lock()
+	defer c.sidMtx.Unlock()
+	if l == nil {
+		delete(c.muxBindMap, sid)
+		return
+	}
+	if c.muxBindMap == nil {
+		c.muxBindMap = map[uint32]*ProxyTCPListener{}
+	}
+	c.muxBindMap[sid] = l
+}
+
+// muxBind return listener registered with stream id sid, nil if not found
+func (c *Client) muxBind(sid uint32) *ProxyTCPListener {
+	c.sidMtx.Lock()
+	defer c.sidMtx.Unlock()
+	return c.muxBindMap[sid]
+}
+
+// useMux check whether request op sent with ctx is sent over a multiplexed connection
+func (c *Client) useMux(ctx context.Context, op message.CommandCode) bool {
+	if c.QUIC {
+		return true
+	}
+	return op != message.CommandUdpAssociate && c.useSession(ctx) && c.Multiplex
+}
+
+func (c *Client) muxUdp(qc nt.DualModeMultiplexedConn) {
 	for {
-		d, err := c.qc.NextDatagram()
+		d, err := qc.NextDatagram()
+		if errors.Is(err, nt.ErrQUICDatagramNotSupported) {
+			// streams still work, UDP association need UDPOverTCP
+			lg.Warning("proxy doesn't support QUIC datagram")
+			return
+		}
 		if err != nil {
-			c.qc.Close()
-			c.qc = nil
+			c.dropQuicConn(qc)
 			return
 		}
 		if len(d.Data()) < 12 {
@@ -117,43 +260,184 @@ func (c *Client) muxUdp() {
 
 // impl
 
+type requestOptionsKey struct{}
+
+// WithRequestOptions attach options to context, they are added to requests sent by
+// DialContext, ListenContext and ListenPacketContext with the context, e.g. vendor specific options.
+// Options already attached to ctx are kept.
+func WithRequestOptions(ctx context.Context, options ...message.Option) context.Context {
+	opset := message.NewOptionSet()
+	if prev := requestOptions(ctx); prev != nil {
+		opset = prev.Clone()
+	}
+	opset.AddMany(options)
+	return context.WithValue(ctx, requestOptionsKey{}, opset)
+}
+
+// WithStackOptions attach stack options for proxy-remote leg to context, see WithRequestOptions.
+// Values are in the types used by StackOptionInfo, e.g. uint8 for StackOptionIPTTL, uint16 for StackOptionTCPTFO.
+// Options applied by proxy can be read from returned connection's StackOptions method.
+func WithStackOptions(ctx context.Context, options message.StackOptionInfo) context.Context {
+	return WithRequestOptions(ctx, options.GetOptions(false, true)...)
+}
+
+type sessionBypassKey struct{}
+
+// WithoutSession let requests sent with the context bypass session even when UseSession is set,
+// they use a new connection and authenticate again, without session, token and multiplexing,
+// so proxy can't link them to other requests. QUIC connection is still shared.
+func WithoutSession(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sessionBypassKey{}, true)
+}
+
+// useSession check whether request sent with ctx use session
+func (c *Client) useSession(ctx context.Context) bool {
+	bypass, _ := ctx.Value(sessionBypassKey{}).(bool)
+	return c.UseSession && !bypass
+}
+
+var defaultClientParseConfig = &message.ParseConfig{}
+
+// parseConfig return config to parse messages from proxy, which accept Profile
+func (c *Client) parseConfig() *message.ParseConfig {
+	if c.Profile == nil {
+		return defaultClientParseConfig
+	}
+	return &message.ParseConfig{Profiles: []*message.Profile{c.Profile}}
+}
+
+// requestOptions return options attached by WithRequestOptions, nil if nothing is attached
+func requestOptions(ctx context.Context) *message.OptionSet {
+	opset, _ := ctx.Value(requestOptionsKey{}).(*message.OptionSet)
+	return opset
+}
+
+// DialContext connect to addr via proxy, like net.Dialer.DialContext.
+// ctx's cancellation and deadline apply to whole handshake, but not the returned connection.
 func (c *Client) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
-	sa := message.ParseAddr(addr)
-	if network[:3] == "udp" {
+	sa, err := message.NewAddr(addr)
+	if err == nil {
+		sa, err = c.resolveAddr(ctx, network, sa)
+	}
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return c.ConnectRequest(ctx, sa, nil, requestOptions(ctx))
+	case "udp", "udp4", "udp6":
 		la := message.AddrIPv4Zero
 		if sa.AddressType == message.AddressTypeIPv6 {
 			la = message.AddrIPv6Zero
 		}
-		a, e := c.UDPAssociateRequest(ctx, la, nil)
+		a, e := c.UDPAssociateRequest(ctx, la, requestOptions(ctx))
 		if e != nil {
 			return nil, e
 		}
 		a.expectAddr = sa
 		return a, nil
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
 	}
-	return c.ConnectRequest(ctx, sa, nil, nil)
 }
 
 func (c *Client) Dial(network string, addr string) (net.Conn, error) {
 	return c.DialContext(context.Background(), network, addr)
 }
 
+// DialWithInitialData connect to TCP addr via proxy, data is sent with request and written to remote
+// once connection is established, so it arrives remote one round trip sooner.
+// data is limited to common.MaxInitialDataLength bytes.
+func (c *Client) DialWithInitialData(ctx context.Context, addr string, data []byte) (net.Conn, error) {
+	sa, err := message.NewAddr(addr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: err}
+	}
+	if len(data) > common.MaxInitialDataLength {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Addr: sa, Err: ErrInitialDataTooLong}
+	}
+	return c.ConnectRequest(ctx, sa, data, requestOptions(ctx))
+}
+
 func (c *Client) ListenContext(ctx context.Context, network string, addr string) (net.Listener, error) {
-	return c.BindRequest(ctx, message.ParseAddr(addr), nil)
+	sa, err := c.resolveAddr(ctx, network, message.ParseAddr(addr))
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	return c.BindRequest(ctx, sa, requestOptions(ctx))
 }
 
 func (c *Client) Listen(network string, addr string) (net.Listener, error) {
 	return c.ListenContext(context.Background(), network, addr)
 }
 
+// ListenPacketContext start an UDP association and use it like an unconnected UDP socket,
+// datagram can be sent to and received from any destination.
+// addr is proxy side address, empty host or address let proxy choose.
 func (c *Client) ListenPacketContext(ctx context.Context, network string, addr string) (net.PacketConn, error) {
-	return c.UDPAssociateRequest(ctx, message.ParseAddr(addr), nil)
+	la, err := listenPacketAddr(network, addr)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	pc, err := c.UDPAssociateRequest(ctx, la, requestOptions(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
 }
 
 func (c *Client) ListenPacket(network string, addr string) (net.PacketConn, error) {
 	return c.ListenPacketContext(context.Background(), network, addr)
 }
 
+// resolveAddr resolve domain name of addr when ResolveLocally is set, address family is limited by network
+func (c *Client) resolveAddr(ctx context.Context, network string, addr *message.SocksAddr) (*message.SocksAddr, error) {
+	if !c.ResolveLocally || addr.AddressType != message.AddressTypeDomainName {
+		return addr, nil
+	}
+	ipNet := "ip"
+	switch network {
+	case "tcp4", "udp4":
+		ipNet = "ip4"
+	case "tcp6", "udp6":
+		ipNet = "ip6"
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, ipNet, string(addr.Address))
+	if err != nil {
+		return nil, err
+	}
+	return message.ConvertAddr(&net.TCPAddr{IP: ips[0], Port: int(addr.Port)}), nil
+}
+
+// listenPacketAddr convert network and address of ListenPacket to association's bind address
+func listenPacketAddr(network string, addr string) (*message.SocksAddr, error) {
+	zero := message.AddrIPv4Zero
+	switch network {
+	case "udp", "udp4":
+	case "udp6":
+		zero = message.AddrIPv6Zero
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	if addr == "" {
+		return zero, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	a, err := message.NewAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		z := *zero
+		z.Port = a.Port
+		return &z, nil
+	}
+	return a, nil
+}
+
 // raw requests
 
 func (c *Client) ConnectRequest(ctx context.Context, addr net.Addr, initData []byte, option *message.OptionSet) (net.Conn, error) {
@@ -167,13 +451,20 @@ func (c *Client) ConnectRequest(ctx context.Context, addr net.Addr, initData []b
 			local:  opr.Endpoint,
 			remote: addr,
 		},
+		stackOpt: message.GetStackOptionInfo(opr.Options, false),
+		replyOpt: opr.Options,
+		meter:    c.newTrafficMeter(message.CommandConnect, addr),
 	}, nil
 }
 
 func (c *Client) BindRequest(ctx context.Context, addr net.Addr, option *message.OptionSet) (*ProxyTCPListener, error) {
 	if option == nil {
 		option = message.NewOptionSet()
+	} else {
+		option = option.Clone()
 	}
+	// option is reused by accept, which add its own backlog and stream id option
+	acceptOption := option.Clone()
 	if c.Backlog > 0 {
 		option.Add(message.Option{
 			Kind: message.OptionKindStack,
@@ -187,15 +478,17 @@ func (c *Client) BindRequest(ctx context.Context, addr net.Addr, option *message
 				},
 			},
 		})
-		// quic downstream, streamid
-		if c.QUIC {
-			option.Add(message.Option{
-				Kind: message.OptionKindStreamID,
-				Data: message.StreamIDOptionData{
-					ID: c.qsid,
-				},
-			})
-		}
+	}
+	// proxy open stream for each backlogged connection, with stream id in reply
+	sid := uint32(0)
+	if c.Backlog > 0 && c.useMux(ctx, message.CommandBind) {
+		sid = c.allocStreamID()
+		option.Add(message.Option{
+			Kind: message.OptionKindStreamID,
+			Data: message.StreamIDOptionData{
+				ID: sid,
+			},
+		})
 	}
 
 	sconn, opr, err := c.handshake(ctx, message.CommandBind, addr, []byte{}, option)
@@ -203,28 +496,33 @@ func (c *Client) BindRequest(ctx context.Context, addr net.Addr, option *message
 		return nil, err
 	}
 	rso := message.GetStackOptionInfo(opr.Options, false)
-	backlog := uint16(0)
-	if ibl, ok := rso[message.StackOptionTCPBacklog]; ok {
-		backlog = ibl.(uint16)
-	}
+	backlog, _ := rso.Backlog()
 	ret := &ProxyTCPListener{
-		netConn: sconn,
-		backlog: backlog,
-		bind:    opr.Endpoint,
-		client:  c,
-		used:    false,
-		op:      option,
+		netConn:  sconn,
+		backlog:  backlog,
+		bind:     opr.Endpoint,
+		client:   c,
+		used:     false,
+		op:       acceptOption,
+		stackOpt: rso,
+		replyOpt: opr.Options,
+		// fallback to plain connection when proxy doesn't support multiplex
+		mux: c.QUIC || nt.IsMuxStream(sconn),
+		sid: sid,
 	}
-	if c.QUIC && ret.backlog > 0 {
-		ret.qch = make(chan net.Conn, ret.backlog)
-		c.qbind.Store(c.qsid, ret)
-		c.qsid++
+	ret.start()
+	if ret.mux && ret.backlog > 0 {
+		c.setMuxBind(sid, ret)
 	}
 	return ret, nil
 }
 
 func (c *Client) UDPAssociateRequest(ctx context.Context, addr net.Addr, option *message.OptionSet) (*ProxyUDPConn, error) {
 	opset := message.NewOptionSet()
+	if option != nil {
+		// e.g. multicast group to join
+		opset = option.Clone()
+	}
 	if c.EnableICMP {
 		opset.Add(message.Option{
 			Kind: message.OptionKindStack,
@@ -238,7 +536,67 @@ func (c *Client) UDPAssociateRequest(ctx context.Context, addr net.Addr, option
 			},
 		})
 	}
+	if c.UDPMaxPayload > 0 && c.UDPMaxPayload <= 0xffff {
+		opset.Add(message.Option{
+			Kind: message.OptionKindStack,
+			Data: message.BaseStackOptionData{
+				RemoteLeg: true,
+				Level:     message.StackOptionLevelUDP,
+				Code:      message.StackOptionCodeMaxPayload,
+				Data: &message.MaxPayloadOptionData{
+					MaxPayload: uint16(c.UDPMaxPayload),
+				},
+			},
+		})
+	}
 
+	sconn, dconn, opr, err := c.udpAssociate(ctx, addr, opset)
+	if err != nil {
+		return nil, err
+	}
+	pconn := ProxyUDPConn{
+		overTcp:  c.udpOverStream(),
+		origConn: sconn,
+		dataConn: dconn,
+		rbind:    opr.Endpoint,
+		reserved: reservedPairAddr(opr),
+		icmp:     c.EnableICMP && udpErrorAvailable(opr),
+		onError:  c.UDPErrorHandler,
+		udpErr:   common.NewSyncMap[string, *UDPError](),
+
+		reasm:        newUdpReassembler(),
+		fragmentSize: c.UDPFragmentSize,
+		maxPayload:   maxPayload(opr),
+		noSession:    !c.useSession(ctx),
+		stackOpt:     message.GetStackOptionInfo(opr.Options, false),
+		replyOpt:     opr.Options,
+		meter:        c.newTrafficMeter(message.CommandUdpAssociate, addr),
+
+		c: c,
+	}
+	stopWatch := watchContext(ctx, sconn)
+	err = pconn.init(sconn, dconn)
+	if cerr := stopWatch(); cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		pconn.Close()
+		return nil, &net.OpError{Op: "dial", Net: "socks6", Addr: addr, Source: pconn.LocalAddr(), Err: err}
+	}
+	return &pconn, nil
+}
+
+// udpOverStream check whether UDP messages are sent over stream of association
+func (c *Client) udpOverStream() bool {
+	return c.UDPOverTCP || c.HTTPUpgradeURL != ""
+}
+
+// udpAssociate send UDP ASSOCIATE request and create data connection of association
+func (c *Client) udpAssociate(
+	ctx context.Context,
+	addr net.Addr,
+	opset *message.OptionSet,
+) (net.Conn, nt.SeqPacket, *message.OperationReply, error) {
 	sconn, opr, err := c.handshake(
 		ctx,
 		message.CommandUdpAssociate,
@@ -247,27 +605,82 @@ func (c *Client) UDPAssociateRequest(ctx context.Context, addr net.Addr, option
 		opset,
 	)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
-	pconn := ProxyUDPConn{
-		overTcp:  c.UDPOverTCP,
-		origConn: sconn,
-		rbind:    opr.Endpoint,
+	if c.udpOverStream() {
+		return sconn, nt.WrapNetConnUDP(sconn), opr, nil
 	}
-	if pconn.overTcp {
-		pconn.dataConn = nt.WrapNetConnUDP(pconn.origConn)
-	} else {
-		dconn, err2 := c.connectDatagram(ctx)
-		if err2 != nil {
-			return nil, &net.OpError{Op: "dial", Net: "socks6", Addr: addr, Err: err2}
-		}
-		pconn.dataConn = dconn
+	dconn, err := c.connectDatagram(ctx)
+	if err != nil {
+		sconn.Close()
+		return nil, nil, nil, &net.OpError{Op: "dial", Net: "socks6", Addr: addr, Err: err}
 	}
-	err = pconn.init()
+	return sconn, dconn, opr, nil
+}
+
+// ResumeUDPAssociation re-attach UDP association which lost its connection, NAT state on proxy is kept.
+// Association must be created by this client with session, and proxy must keep it long enough.
+func (c *Client) ResumeUDPAssociation(ctx context.Context, id uint64) (*ProxyUDPConn, error) {
+	if !c.useSession(ctx) {
+		return nil, &net.OpError{Op: "dial", Net: "socks6", Err: errors.New("resume require session")}
+	}
+	opset := message.NewOptionSet()
+	opset.Add(message.Option{
+		Kind: message.OptionKindUDPAssociationResume,
+		Data: message.UDPAssociationResumeOptionData{AssociationID: id},
+	})
+	pconn, err := c.UDPAssociateRequest(ctx, nil, opset)
 	if err != nil {
-		return nil, &net.OpError{Op: "dial", Net: "socks6", Addr: addr, Source: pconn.LocalAddr(), Err: err}
+		return nil, err
 	}
-	return &pconn, nil
+	if pconn.assocId != id {
+		pconn.Close()
+		return nil, &net.OpError{Op: "dial", Net: "socks6", Source: pconn.LocalAddr(), Err: ErrAssociationMismatch}
+	}
+	return pconn, nil
+}
+
+// ReservePortPair start an UDP association on even port and reserve next port, like RTP and RTCP,
+// reserved port is returned by ReservedAddr of returned connection
+func (c *Client) ReservePortPair(ctx context.Context, addr net.Addr) (*ProxyUDPConn, error) {
+	opset := message.NewOptionSet()
+	opset.AddMany(message.NewStackOptionBuilder().
+		PortParity(message.StackPortParityOptionParityEven, true).
+		Options(false, true))
+	return c.UDPAssociateRequest(ctx, addr, opset)
+}
+
+// udpErrorAvailable check whether proxy will relay error report
+func udpErrorAvailable(opr *message.OperationReply) bool {
+	iue, ok := message.GetStackOptionInfo(opr.Options, false).UDPError()
+	return ok && iue
+}
+
+// maxPayload read association's max payload size from reply, 0 means no limit
+func maxPayload(opr *message.OperationReply) int {
+	imp, ok := message.GetStackOptionInfo(opr.Options, false)[message.StackOptionUDPMaxPayload]
+	if !ok {
+		return 0
+	}
+	return int(imp.(uint16))
+}
+
+// reservedPairAddr calculate reserved port's address from port parity option in reply
+func reservedPairAddr(opr *message.OperationReply) net.Addr {
+	ippod, ok := message.GetStackOptionInfo(opr.Options, false)[message.StackOptionUDPPortParity]
+	if !ok || !ippod.(message.PortParityOptionData).Reserve {
+		return nil
+	}
+	if opr.Endpoint == nil {
+		return nil
+	}
+	a := *opr.Endpoint
+	if a.Port&1 == 0 {
+		a.Port++
+	} else {
+		a.Port--
+	}
+	return &a
 }
 
 // NoopRequest send a NOOP request
@@ -280,21 +693,94 @@ func (c *Client) NoopRequest(ctx context.Context) error {
 	return nil
 }
 
+// StartKeepAlive send NOOP request periodically until ctx is done, to keep session and NAT mappings alive.
+// NOOP is sent over the multiplexed connection when Multiplex is set.
+// Session is dropped when keepalive fails, and established again immediately when AutoReconnect is set,
+// otherwise by next request.
+func (c *Client) StartKeepAlive(ctx context.Context) {
+	interval := c.KeepAliveInterval
+	if interval == 0 {
+		interval = 30 * time.Second
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			err := c.keepAliveOnce(ctx, interval)
+			if err == nil || ctx.Err() != nil {
+				continue
+			}
+			lg.Info("keepalive failed", err)
+			c.dropSession()
+			if c.AutoReconnect {
+				if err := c.keepAliveOnce(ctx, interval); err != nil {
+					lg.Info("keepalive reconnect failed", err)
+				}
+			}
+		}
+	}()
+}
+
+// keepAliveOnce send a NOOP request, proxy refused it is not an error
+func (c *Client) keepAliveOnce(ctx context.Context, timeout time.Duration) error {
+	cctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := c.NoopRequest(cctx)
+	re := &ReplyError{}
+	if errors.As(err, &re) {
+		return nil
+	}
+	return err
+}
+
+// dropSession forget session, tokens and multiplexed connection
+func (c *Client) dropSession() {
+	c.session = []byte{}
+	c.tokenMtx.Lock()
+	c.maxToken = c.token
+	c.tokenMtx.Unlock()
+	c.muxMtx.Lock()
+	if c.mux != nil {
+		c.mux.Close()
+		c.mux = nil
+	}
+	c.muxMtx.Unlock()
+}
+
 // common
 
 func (c *Client) getQuicConn(ctx context.Context, addr string) (nt.DualModeMultiplexedConn, error) {
+	c.qmtx.Lock()
+	defer c.qmtx.Unlock()
 	if c.qc == nil {
-		q, err := quic.DialAddrEarlyContext(ctx, addr, &tls.Config{ServerName: c.Server}, nil)
+		q, err := quic.DialAddrEarlyContext(ctx, addr, quicTLSConfig(c.tlsConfig()), &quic.Config{EnableDatagrams: true})
 		if err != nil {
 			return nil, err
 		}
 		c.qc = nt.WrapQUICConn(q)
-		go c.muxAccept()
-		go c.muxUdp()
+		c.qudpconn = common.NewSyncMap[uint64, *muxSeqPacket]()
+		qc := c.qc
+		go c.muxAccept(qc, func() { c.dropQuicConn(qc) })
+		go c.muxUdp(qc)
 	}
 	return c.qc, nil
 }
 
+// dropQuicConn close lost QUIC connection, next request will create a new one
+func (c *Client) dropQuicConn(qc nt.DualModeMultiplexedConn) {
+	c.qmtx.Lock()
+	defer c.qmtx.Unlock()
+	qc.Close()
+	if c.qc == qc {
+		c.qc = nil
+	}
+}
+
 func (c *Client) dialQuicT(ctx context.Context, network, address string) (net.Conn, error) {
 	q, err := c.getQuicConn(ctx, address)
 	if err != nil {
@@ -303,37 +789,150 @@ func (c *Client) dialQuicT(ctx context.Context, network, address string) (net.Co
 	return q.Dial()
 }
 
+// tlsConfig return a copy of TlsConfig with ServerName filled, and session cache when ZeroRTT is set
+func (c *Client) tlsConfig() *tls.Config {
+	conf := &tls.Config{}
+	if c.TlsConfig != nil {
+		conf = c.TlsConfig.Clone()
+	}
+	if conf.ServerName == "" {
+		host, _, err := net.SplitHostPort(c.Server)
+		if err != nil {
+			host = c.Server
+		}
+		conf.ServerName = host
+	}
+	if c.ZeroRTT && conf.ClientSessionCache == nil {
+		c.tlsSessionOnce.Do(func() {
+			c.tlsSessions = tls.NewLRUClientSessionCache(0)
+		})
+		conf.ClientSessionCache = c.tlsSessions
+	}
+	return conf
+}
+
+// dtlsConfig return a copy of DatagramTLSConfig with ServerName filled, or config converted from TlsConfig
+func (c *Client) dtlsConfig() *dtls.Config {
+	if c.DatagramTLSConfig == nil {
+		conf := createDTLSConfig(*c.tlsConfig())
+		return &conf
+	}
+	conf := *c.DatagramTLSConfig
+	if conf.ServerName == "" {
+		conf.ServerName = c.tlsConfig().ServerName
+	}
+	return &conf
+}
+
 func (c *Client) dialEncrypted(ctx context.Context, network, address string) (net.Conn, error) {
 	switch network {
 	case "tcp", "tcp4", "tcp6":
-		d := tls.Dialer{NetDialer: &net.Dialer{}, Config: &tls.Config{ServerName: c.Server}}
-		return d.DialContext(ctx, network, address)
+		conn, err := c.dialTransport(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		tc := tls.Client(conn, c.tlsConfig())
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tc, nil
 	case "udp", "udp4", "udp6":
 		a, err := net.ResolveUDPAddr(network, address)
 		if err != nil {
 			return nil, err
 		}
-		return dtls.DialWithContext(ctx, network, a, &dtls.Config{ServerName: c.Server})
+		return dtls.DialWithContext(ctx, network, a, c.dtlsConfig())
 	default:
 		return nil, net.UnknownNetworkError(network)
 	}
 }
 
 func (c *Client) connectStream(ctx context.Context) (net.Conn, error) {
+	if c.HTTPUpgradeURL != "" {
+		return c.connectHTTPUpgrade(ctx)
+	}
+	dial := c.dialTransport
+	if c.DialFunc == nil {
+		if c.QUIC {
+			dial = c.dialQuicT
+		} else if c.Encrypted {
+			dial = c.dialEncrypted
+		}
+	}
+
+	conn, err := dial(ctx, "tcp", c.Server)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialTransport dial stream connection by DialFunc or net.Dialer, then wrap it by Transport
+func (c *Client) dialTransport(ctx context.Context, network, address string) (net.Conn, error) {
 	dial := (&net.Dialer{}).DialContext
 	if c.DialFunc != nil {
 		dial = c.DialFunc
-	} else if c.QUIC {
-		dial = c.dialQuicT
-	} else if c.Encrypted {
-		dial = c.dialEncrypted
 	}
+	conn, err := dial(ctx, network, address)
+	if err != nil || c.Transport == nil {
+		return conn, err
+	}
+	wc, err := c.Transport.WrapConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return wc, nil
+}
 
-	conn, err := dial(ctx, "tcp", c.Server)
+// muxStream open a stream on session's multiplexed connection, the connection is created by NOOP when necessary
+func (c *Client) muxStream(ctx context.Context) (net.Conn, error) {
+	c.muxMtx.Lock()
+	defer c.muxMtx.Unlock()
+	if c.muxUnsupported {
+		return c.connectStream(ctx)
+	}
+	if c.mux != nil {
+		if conn, err := c.mux.Dial(); err == nil {
+			return conn, nil
+		}
+		// connection lost
+		c.mux.Close()
+		c.mux = nil
+	}
+
+	sconn, err := c.connectStream(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return conn, nil
+	option := message.NewOptionSet()
+	option.Add(message.Option{Kind: message.OptionKindMultiplex, Data: message.MultiplexOptionData{}})
+	stopWatch := watchContext(ctx, sconn)
+	opr, err := c.handshakeConn(ctx, sconn, message.CommandNoop, message.DefaultAddr, []byte{}, option)
+	if cerr := stopWatch(); cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		sconn.Close()
+		return nil, err
+	}
+	if _, ok := opr.Options.GetData(message.OptionKindMultiplex); !ok {
+		lg.Warning("proxy doesn't support multiplex")
+		sconn.Close()
+		c.muxUnsupported = true
+		return c.connectStream(ctx)
+	}
+	var mc nt.MultiplexedConn
+	if c.MultiplexFunc == nil {
+		mc = nt.NewStreamMux(sconn, true)
+	} else if mc, err = c.MultiplexFunc(sconn); err != nil {
+		sconn.Close()
+		return nil, err
+	}
+	c.mux = mc
+	go c.muxAccept(c.mux, func() {})
+	return c.mux.Dial()
 }
 
 func (c *Client) connectDatagram(ctx context.Context) (nt.SeqPacket, error) {
@@ -343,6 +942,12 @@ func (c *Client) connectDatagram(ctx context.Context) (nt.SeqPacket, error) {
 	} else if c.QUIC {
 		// only udp assoc can setup demux param (assoc id)
 		return c.getQuicConn(ctx, c.Server)
+	} else if c.SCTP {
+		conn, err := socket.DialSCTP(ctx, c.Server)
+		if err != nil {
+			return nil, err
+		}
+		return nt.WrapSCTPConn(conn), nil
 	} else if c.Encrypted {
 		dial = c.dialEncrypted
 	}
@@ -354,65 +959,100 @@ func (c *Client) connectDatagram(ctx context.Context) (nt.SeqPacket, error) {
 	return nt.WrapNetConnUDP(conn), nil
 }
 
-func (c *Client) createAuthnOption(ctx context.Context, sconn net.Conn, id byte, dataLen int) ([]message.Option, *auth.ClientAuthenticationChannels) {
-	var cac *auth.ClientAuthenticationChannels
+// authnMethods return authentication methods advertised to proxy in preference order, none method is excluded
+func (c *Client) authnMethods() []auth.ClientAuthenticationMethod {
+	candidates := append([]auth.ClientAuthenticationMethod{}, c.AuthenticationMethods...)
+	if c.AuthenticationMethod != nil {
+		candidates = append(candidates, c.AuthenticationMethod)
+	}
+	if c.Username != "" {
+		candidates = append(candidates, auth.PasswordClientAuthenticationMethod{
+			Username: c.Username,
+			Password: c.Password,
+		})
+	}
+	methods := []auth.ClientAuthenticationMethod{}
+	seen := map[byte]bool{}
+	for _, m := range candidates {
+		id := m.ID()
+		if id == 6 {
+			lg.Panic("SSL authentication is prohibited")
+		}
+		if id == 0 || seen[id] {
+			continue
+		}
+		seen[id] = true
+		methods = append(methods, m)
+	}
+	return methods
+}
+
+func (c *Client) createAuthnOption(ctx context.Context, sconn net.Conn, dataLen int) ([]message.Option, map[byte]*auth.ClientAuthenticationChannels, error) {
+	cacs := map[byte]*auth.ClientAuthenticationChannels{}
 	opts := []message.Option{}
-	if len(c.session) > 0 {
+	if c.useSession(ctx) && len(c.session) > 0 {
 		// use session
-		opts = append(opts, message.Option{Kind: message.OptionKindSessionID, Data: message.SessionIDOptionData{ID: c.session}})
-		if c.maxToken-c.token > 0 {
-			// use token
-			opts = append(opts, message.Option{Kind: message.OptionKindIdempotenceExpenditure, Data: message.IdempotenceExpenditureOptionData{Token: c.token}})
-			c.token++
-			// request token when necessary
-			if c.maxToken-c.token < c.UseToken/8 {
-				opts = append(opts, message.Option{Kind: message.OptionKindTokenRequest, Data: message.TokenRequestOptionData{WindowSize: c.UseToken}})
-			}
+		sr := message.SessionRequest{ID: c.session}
+		c.spendToken(&sr)
+		opts = append(opts, sr.Options()...)
+		// no method is advertised, but initial data length is still needed
+		if dataLen > 0 {
+			opts = append(opts, message.Option{
+				Kind: message.OptionKindAuthenticationMethodAdvertisement,
+				Data: message.AuthenticationMethodAdvertisementOptionData{
+					InitialDataLength: uint16(dataLen),
+				},
+			})
 		}
 	} else {
-		// use original authn method
-		if dataLen > 0 || id != 0 {
+		// use original authn methods
+		methods := c.authnMethods()
+		ids := []byte{}
+		for _, m := range methods {
+			ids = append(ids, m.ID())
+		}
+		if dataLen > 0 || len(ids) > 0 {
 			opts = append(opts, message.Option{
 				Kind: message.OptionKindAuthenticationMethodAdvertisement,
 				Data: message.AuthenticationMethodAdvertisementOptionData{
 					InitialDataLength: uint16(dataLen),
-					Methods:           []byte{id},
+					Methods:           ids,
 				},
 			})
 		}
-		if id != 0 {
-			cac = auth.NewClientAuthenticationChannels()
-			go c.AuthenticationMethod.Authenticate(ctx, sconn, *cac)
-			data := <-cac.Data
-			if len(data) > 0 {
-				opts = append(opts, message.Option{Kind: message.OptionKindAuthenticationData, Data: message.AuthenticationDataOptionData{
-					Method: id,
-					Data:   data,
-				}})
+		// every advertised method can send data in request
+		for _, m := range methods {
+			cac := auth.NewClientAuthenticationChannels()
+			go m.Authenticate(ctx, sconn, *cac)
+			cacs[m.ID()] = cac
+			data, err := recvContext(ctx, cac.Data)
+			if err != nil {
+				return nil, nil, err
 			}
+			opts = append(opts, message.NewAuthenticationDataOptions(m.ID(), data)...)
 		}
 
 		// request session and token
-		if c.UseSession {
-			opts = append(opts, message.Option{Kind: message.OptionKindSessionRequest, Data: message.SessionRequestOptionData{}})
-			if c.UseToken != 0 {
-				opts = append(opts, message.Option{Kind: message.OptionKindTokenRequest, Data: message.TokenRequestOptionData{WindowSize: c.UseToken}})
-			}
+		if c.useSession(ctx) {
+			opts = append(opts, message.SessionRequest{Request: true, TokenWindow: c.UseToken}.Options()...)
 		}
 	}
-	return opts, cac
+	return opts, cacs, nil
 }
-
 func (c *Client) checkAuthnReply(finalRep *message.AuthenticationReply) error {
 	fail := finalRep.Type != message.AuthenticationReplySuccess
+	sr := message.GetSessionReply(finalRep.Options)
 
-	if _, f := finalRep.Options.GetData(message.OptionKindSessionInvalid); f {
+	if sr.Invalid {
 		c.session = []byte{}
-		fail = true
+		return ErrSessionInvalid
 	}
-	if _, f := finalRep.Options.GetData(message.OptionKindIdempotenceRejected); f {
-		c.maxToken = 0
-		fail = true
+	if sr.TokenRejected {
+		// drop window, retry without token
+		c.tokenMtx.Lock()
+		c.maxToken = c.token
+		c.tokenMtx.Unlock()
+		return ErrTokenRejected
 	}
 	if fail {
 		return errors.New("authn fail")
@@ -420,145 +1060,252 @@ func (c *Client) checkAuthnReply(finalRep *message.AuthenticationReply) error {
 	if !c.UseSession {
 		return nil
 	}
-	if _, f := finalRep.Options.GetData(message.OptionKindSessionOK); !f {
+	if !sr.OK {
 		// no session is not really a problem
 		return nil
 	}
 
-	if c.UseToken > 0 {
-		if _, f := finalRep.Options.GetData(message.OptionKindIdempotenceAccepted); !f {
-			return nil
-		}
-		if d, ok := finalRep.Options.GetData(message.OptionKindIdempotenceWindow); ok {
-			dd := d.(message.IdempotenceWindowOptionData)
-			c.token = dd.WindowBase
-			c.maxToken = dd.WindowSize
-		} else {
-			if c.maxToken == 0 {
-				return errors.New("token fail")
-			}
-		}
+	if c.UseToken > 0 && sr.Window {
+		c.updateTokenWindow(sr.WindowBase, sr.WindowSize)
 	}
 	return nil
 }
 
+// spendToken spend a token in sr when available, and request new window when current one is running out
+func (c *Client) spendToken(sr *message.SessionRequest) {
+	if c.UseToken == 0 {
+		return
+	}
+	c.tokenMtx.Lock()
+	defer c.tokenMtx.Unlock()
+	if c.maxToken-c.token > 0 {
+		sr.SpendToken = true
+		sr.Token = c.token
+		c.token++
+	}
+	if c.maxToken-c.token <= c.UseToken/8 {
+		sr.TokenWindow = c.UseToken
+	}
+}
+
+// updateTokenWindow apply window sent by proxy, tokens before current position are not spent again
+func (c *Client) updateTokenWindow(base, size uint32) {
+	c.tokenMtx.Lock()
+	defer c.tokenMtx.Unlock()
+	if c.token-base >= size {
+		c.token = base
+	}
+	c.maxToken = base + size
+}
+
 // authn running authentication in handshake
 func (c *Client) authn(ctx context.Context, req message.Request, sconn net.Conn, initData []byte) error {
-	if c.AuthenticationMethod == nil {
-		c.AuthenticationMethod = auth.NoneClientAuthenticationMethod{}
-	}
+	// methods not selected by proxy stop when authn is done
+	mctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	// add authn options
-	id := c.AuthenticationMethod.ID()
-	if id == 6 {
-		lg.Panic("SSL authentication is prohibited")
+	ops, cacs, err := c.createAuthnOption(mctx, sconn, len(initData))
+	if err != nil {
+		return err
 	}
-	ops, cac := c.createAuthnOption(ctx, sconn, id, len(initData))
 	req.Options.AddMany(ops)
-	// io
-	if _, err := sconn.Write(req.Marshal()); err != nil {
+	req.Pad(c.Padding)
+	// io, initial data follows request immediately
+	if _, err := sconn.Write(append(req.Marshal(), initData...)); err != nil {
 		return err
 	}
-	aurep1, err := message.ParseAuthenticationReplyFrom(sconn)
+	aurep1, err := c.parseConfig().ParseAuthenticationReplyFrom(sconn)
 	if err != nil {
 		return err
 	}
-	var finalRep *message.AuthenticationReply
 
-	if aurep1.Type == message.AuthenticationReplySuccess {
-		// success at stage 1
-		finalRep = aurep1
-	} else {
-		if d, s := aurep1.Options.GetData(message.OptionKindAuthenticationMethodSelection); !s {
-			// can't continue
-			finalRep = aurep1
-		} else if d.(message.AuthenticationMethodSelectionOptionData).Method != id {
-			// continue with different method, unsupported
-			finalRep = aurep1
-		}
+	// proxy selected a method other than none
+	d, selected := message.GetTyped[message.AuthenticationMethodSelectionOptionData](aurep1.Options, message.OptionKindAuthenticationMethodSelection)
+	if !selected {
+		return c.checkAuthnReply(aurep1)
+	}
+	cac, ok := cacs[d.Method]
+	if !ok {
+		return errors.New("proxy selected a method not advertised")
 	}
 
-	if finalRep == nil && cac == nil {
-		// need stage 2, but authn channel not exist
-		return errors.New("server wants 2 stage authn")
+	// let selected method process 1st reply, and run stage 2 if necessary
+	cac.FirstAuthReply <- aurep1
+	// method may wait for something other than connection, e.g. user input
+	err, cerr := recvContext(ctx, cac.Error)
+	if cerr != nil {
+		return cerr
 	}
-	if cac != nil {
-		// write 1st reply
-		cac.FirstAuthReply <- aurep1
-		// read error and reply
-		err := <-cac.Error
-		finalRep = <-cac.FinalAuthReply
-		if err != nil {
-			return err
-		}
+	finalRep, cerr := recvContext(ctx, cac.FinalAuthReply)
+	if cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		return err
+	}
+	if finalRep == nil {
+		return errors.New("authn fail")
 	}
-
 	// check final reply
 	return c.checkAuthnReply(finalRep)
 }
 
-// handshake handle the common handshake part of protocol
+// recvContext receive from ch, return ctx's error when ctx is done first
+func recvContext[T any](ctx context.Context, ch <-chan T) (T, error) {
+	select {
+	case v := <-ch:
+		return v, nil
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
 func (c *Client) handshake(
 	ctx context.Context,
 	op message.CommandCode,
 	addr net.Addr,
 	initData []byte,
 	option *message.OptionSet,
+) (net.Conn, *message.OperationReply, error) {
+	start := time.Now()
+	sconn, opr, err := c.handshakeOnce(ctx, op, addr, initData, option)
+	// request is not processed by proxy, retry with new session or without token
+	if err != nil && (errors.Is(err, ErrTokenRejected) || c.AutoReconnect && errors.Is(err, ErrSessionInvalid)) {
+		lg.Info("authenticate again", err)
+		sconn, opr, err = c.handshakeOnce(ctx, op, addr, initData, option)
+	}
+	// CONNECT is idempotent, retry when proxy can't reach remote temporarily
+	for i := 0; op == message.CommandConnect && c.Retry.retryable(err, i); i++ {
+		if !c.Retry.wait(ctx, i) {
+			break
+		}
+		lg.Info("retry request", addr, err)
+		sconn, opr, err = c.handshakeOnce(ctx, op, addr, initData, option)
+	}
+	c.traceRequest(op, addr, start, err)
+	return sconn, opr, err
+}
+func (c *Client) handshakeOnce(
+	ctx context.Context,
+	op message.CommandCode,
+	addr net.Addr,
+	initData []byte,
+	option *message.OptionSet,
 ) (net.Conn, *message.OperationReply, error) {
 	netErr := net.OpError{
 		Op:   "dial",
 		Net:  "socks6",
 		Addr: addr,
 	}
-	sconn, err := c.connectStream(ctx)
+	connect := c.connectStream
+	if !c.QUIC && c.useMux(ctx, op) {
+		connect = c.muxStream
+	}
+	sconn, err := connect(ctx)
 	if err != nil {
-		netErr.Source = sconn.LocalAddr()
+		netErr.Err = err
 		return nil, nil, &netErr
 	}
 	netErr.Source = sconn.LocalAddr()
 
-	cd := common.NewCancellableDefer(func() {
+	stopWatch := watchContext(ctx, sconn)
+	opr, err := c.handshakeConn(ctx, sconn, op, addr, initData, option)
+	// interrupted by context
+	if cerr := stopWatch(); cerr != nil {
+		err = cerr
+	}
+	if err != nil {
 		sconn.Close()
-	})
-	defer cd.Defer()
+		netErr.Err = err
+		return nil, nil, &netErr
+	}
+	return sconn, opr, nil
+}
 
+// handshakeConn send request and read reply on sconn
+func (c *Client) handshakeConn(
+	ctx context.Context,
+	sconn net.Conn,
+	op message.CommandCode,
+	addr net.Addr,
+	initData []byte,
+	option *message.OptionSet,
+) (*message.OperationReply, error) {
 	if option == nil {
 		option = message.NewOptionSet()
 	}
 	req := message.Request{
 		CommandCode: op,
 		Endpoint:    message.ConvertAddr(addr),
-		Options:     option,
+		// authn options are added to request
+		Options: option.Clone(),
+		Profile: c.Profile,
 	}
 
-	if err = c.authn(ctx, req, sconn, initData); err != nil {
-		netErr.Err = err
-		return nil, nil, &netErr
+	if err := c.authn(ctx, req, sconn, initData); err != nil {
+		return nil, err
 	}
 
-	opr, err := message.ParseOperationReplyFrom(sconn)
+	opr, err := c.parseConfig().ParseOperationReplyFrom(sconn)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	if opr.ReplyCode != 0 {
-		netErr.Err = convertReplyError(opr.ReplyCode)
-		return nil, nil, &netErr
+		return nil, convertReplyError(opr.ReplyCode)
 	}
-	if c.UseSession {
-		if d, ok := opr.Options.GetData(message.OptionKindSessionID); ok {
-			c.session = d.(message.SessionIDOptionData).ID
+	if c.useSession(ctx) {
+		if id := message.GetSessionReply(opr.Options).ID; id != nil {
+			c.session = id
 		} else {
 			if len(c.session) == 0 {
-				netErr.Err = errors.New("session fail")
-				return nil, nil, &netErr
+				return nil, errors.New("session fail")
 			}
 		}
 	}
+	return opr, nil
+}
 
-	cd.Cancel()
-	return sconn, opr, nil
+// watchContext apply ctx's deadline to conn and interrupt conn's I/O when ctx is done,
+// until returned function is called. The function return ctx's error if conn is interrupted.
+func watchContext(ctx context.Context, conn net.Conn) func() error {
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+	}
+	done := make(chan struct{})
+	interrupted := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// make pending and future I/O fail immediately
+			conn.SetDeadline(time.Unix(1, 0))
+			interrupted <- ctx.Err()
+		case <-done:
+			interrupted <- nil
+		}
+	}()
+	return func() error {
+		close(done)
+		if err := <-interrupted; err != nil {
+			return err
+		}
+		// deadline set on conn may expire before ctx is done
+		if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+			return context.DeadlineExceeded
+		}
+		conn.SetDeadline(time.Time{})
+		return nil
+	}
 }
 
 func convertReplyError(code message.ReplyCode) error {
+	if code == message.OperationReplySuccess {
+		return nil
+	}
+	return &ReplyError{Code: code, Err: replyCodeError(code)}
+}
+
+func replyCodeError(code message.ReplyCode) error {
 	switch code {
 	case message.OperationReplyCommandNotSupported:
 		return syscall.EOPNOTSUPP
@@ -575,8 +1322,6 @@ func convertReplyError(code message.ReplyCode) error {
 	case message.OperationReplyTimeout:
 		return syscall.ETIMEDOUT
 
-	case message.OperationReplySuccess:
-		return nil
 	case message.OperationReplyServerFailure:
 		return ErrServerFailure
 	case message.OperationReplyTTLExpired:
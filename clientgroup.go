@@ -0,0 +1,192 @@
+package socks6
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/studentmain/socks6/common/lg"
+)
+
+// ClientGroup send each request to the healthy proxy with lowest latency, and fail over to other proxies
+// when a proxy can't be reached. Proxies are probed with NOOP request after Start is called.
+// Requests failed by proxy's reply, e.g. connection refused by remote, are not retried.
+type ClientGroup struct {
+	// proxies, in preference order when latency is unknown
+	Clients []*Client
+	// interval of health check, 30s when it's 0
+	CheckInterval time.Duration
+	// timeout of health check request, 5s when it's 0
+	CheckTimeout time.Duration
+
+	mtx    sync.Mutex
+	status map[*Client]*ClientStatus
+}
+
+// ClientStatus is health check result of a proxy
+type ClientStatus struct {
+	Client *Client
+	// last request or health check succeeded
+	Healthy bool
+	// round trip time of last health check, 0 when not checked
+	Latency time.Duration
+	// time of last health check
+	CheckedAt time.Time
+}
+
+// Start run health check periodically until ctx is done
+func (g *ClientGroup) Start(ctx context.Context) {
+	interval := g.CheckInterval
+	if interval == 0 {
+		interval = 30 * time.Second
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			g.Check(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Check probe all proxies once and wait for results
+func (g *ClientGroup) Check(ctx context.Context) {
+	timeout := g.CheckTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	wg := sync.WaitGroup{}
+	for _, c := range g.Clients {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			cctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			start := time.Now()
+			err := c.NoopRequest(cctx)
+			if ctx.Err() != nil {
+				return
+			}
+			// NOOP refused by rule, but proxy is working
+			re := &ReplyError{}
+			healthy := err == nil || errors.As(err, &re)
+			if !healthy {
+				lg.Info("proxy", c.Server, "health check failed", err)
+			}
+			g.update(c, healthy, time.Since(start), true)
+		}(c)
+	}
+	wg.Wait()
+}
+
+// Status return current status of all proxies
+func (g *ClientGroup) Status() []ClientStatus {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	ret := []ClientStatus{}
+	for _, c := range g.Clients {
+		ret = append(ret, *g.statusOf(c))
+	}
+	return ret
+}
+
+func (g *ClientGroup) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return failover(ctx, g, func(c *Client) (net.Conn, error) {
+		return c.DialContext(ctx, network, addr)
+	})
+}
+
+func (g *ClientGroup) Dial(network string, addr string) (net.Conn, error) {
+	return g.DialContext(context.Background(), network, addr)
+}
+
+func (g *ClientGroup) ListenContext(ctx context.Context, network string, addr string) (net.Listener, error) {
+	return failover(ctx, g, func(c *Client) (net.Listener, error) {
+		return c.ListenContext(ctx, network, addr)
+	})
+}
+
+func (g *ClientGroup) Listen(network string, addr string) (net.Listener, error) {
+	return g.ListenContext(context.Background(), network, addr)
+}
+
+func (g *ClientGroup) ListenPacketContext(ctx context.Context, network string, addr string) (net.PacketConn, error) {
+	return failover(ctx, g, func(c *Client) (net.PacketConn, error) {
+		return c.ListenPacketContext(ctx, network, addr)
+	})
+}
+
+func (g *ClientGroup) ListenPacket(network string, addr string) (net.PacketConn, error) {
+	return g.ListenPacketContext(context.Background(), network, addr)
+}
+
+// failover try proxies in order of candidates until one of them processed the request
+func failover[T any](ctx context.Context, g *ClientGroup, fn func(c *Client) (T, error)) (T, error) {
+	var ret T
+	err := error(&net.OpError{Op: "dial", Net: "socks6", Err: errors.New("no proxy available")})
+	for _, c := range g.candidates() {
+		ret, err = fn(c)
+		if err == nil {
+			g.update(c, true, 0, false)
+			return ret, nil
+		}
+		// proxy is working, or caller gave up
+		re := &ReplyError{}
+		if errors.As(err, &re) || ctx.Err() != nil {
+			return ret, err
+		}
+		lg.Info("proxy", c.Server, "failed, try next proxy", err)
+		g.update(c, false, 0, false)
+	}
+	return ret, err
+}
+
+// candidates return healthy proxies ordered by latency, then unhealthy proxies as last resort
+func (g *ClientGroup) candidates() []*Client {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	ret := append([]*Client{}, g.Clients...)
+	sort.SliceStable(ret, func(i, j int) bool {
+		si, sj := g.statusOf(ret[i]), g.statusOf(ret[j])
+		if si.Healthy != sj.Healthy {
+			return si.Healthy
+		}
+		return si.Latency < sj.Latency
+	})
+	return ret
+}
+
+// statusOf return status of c, caller must hold mtx
+func (g *ClientGroup) statusOf(c *Client) *ClientStatus {
+	if g.status == nil {
+		g.status = map[*Client]*ClientStatus{}
+	}
+	s, ok := g.status[c]
+	if !ok {
+		// assume healthy before first check
+		s = &ClientStatus{Client: c, Healthy: true}
+		g.status[c] = s
+	}
+	return s
+}
+
+func (g *ClientGroup) update(c *Client, healthy bool, latency time.Duration, checked bool) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	s := g.statusOf(c)
+	s.Healthy = healthy
+	if checked {
+		s.CheckedAt = time.Now()
+		if healthy {
+			s.Latency = latency
+		}
+	}
+}
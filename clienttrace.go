@@ -0,0 +1,144 @@
+package socks6
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/studentmain/socks6/message"
+)
+
+// ClientTrace is a set of hooks called on client events, e.g. for monitoring proxy performance.
+// Any hook can be nil, hooks may be called concurrently.
+type ClientTrace struct {
+	// RequestDone is called when a request is replied or failed
+	RequestDone func(info RequestInfo)
+	// ConnClosed is called when a connection returned by request is closed
+	ConnClosed func(info ConnInfo)
+}
+
+// RequestInfo describe a finished request
+type RequestInfo struct {
+	Command message.CommandCode
+	Addr    net.Addr
+	// time used by request, including connecting and authentication
+	Duration time.Duration
+	// proxy replied ReplyCode, otherwise request failed before reply
+	Replied   bool
+	ReplyCode message.ReplyCode
+	Err       error
+}
+
+// ConnInfo describe a closed connection
+type ConnInfo struct {
+	Command message.CommandCode
+	Addr    net.Addr
+	// time between request done and connection closed
+	Duration time.Duration
+	ConnStats
+}
+
+// ConnStats is traffic counters of a connection returned by request, payload only, protocol overhead is not included
+type ConnStats struct {
+	BytesSent     uint64
+	BytesReceived uint64
+	// datagram count, only for UDP association
+	DatagramsSent     uint64
+	DatagramsReceived uint64
+}
+
+// traceRequest call RequestDone hook with result of request started at start
+func (c *Client) traceRequest(op message.CommandCode, addr net.Addr, start time.Time, err error) {
+	if c.Trace == nil || c.Trace.RequestDone == nil {
+		return
+	}
+	info := RequestInfo{
+		Command:  op,
+		Addr:     addr,
+		Duration: time.Since(start),
+		Err:      err,
+	}
+	re := &ReplyError{}
+	if err == nil {
+		info.Replied = true
+		info.ReplyCode = message.OperationReplySuccess
+	} else if errors.As(err, &re) {
+		info.Replied = true
+		info.ReplyCode = re.Code
+	}
+	c.Trace.RequestDone(info)
+}
+
+// trafficMeter count payload of a connection returned by request, and call ConnClosed hook on close
+type trafficMeter struct {
+	sent              uint64
+	received          uint64
+	sentDatagrams     uint64
+	receivedDatagrams uint64
+
+	trace *ClientTrace
+	info  ConnInfo
+	start time.Time
+	once  sync.Once
+}
+
+func (c *Client) newTrafficMeter(op message.CommandCode, addr net.Addr) *trafficMeter {
+	return &trafficMeter{
+		trace: c.Trace,
+		info:  ConnInfo{Command: op, Addr: addr},
+		start: time.Now(),
+	}
+}
+
+func (t *trafficMeter) addSent(n int) {
+	if t != nil && n > 0 {
+		atomic.AddUint64(&t.sent, uint64(n))
+	}
+}
+
+func (t *trafficMeter) addReceived(n int) {
+	if t != nil && n > 0 {
+		atomic.AddUint64(&t.received, uint64(n))
+	}
+}
+
+func (t *trafficMeter) addSentDatagram(n int) {
+	if t != nil {
+		atomic.AddUint64(&t.sentDatagrams, 1)
+		t.addSent(n)
+	}
+}
+
+func (t *trafficMeter) addReceivedDatagram(n int) {
+	if t != nil {
+		atomic.AddUint64(&t.receivedDatagrams, 1)
+		t.addReceived(n)
+	}
+}
+
+func (t *trafficMeter) stats() ConnStats {
+	if t == nil {
+		return ConnStats{}
+	}
+	return ConnStats{
+		BytesSent:         atomic.LoadUint64(&t.sent),
+		BytesReceived:     atomic.LoadUint64(&t.received),
+		DatagramsSent:     atomic.LoadUint64(&t.sentDatagrams),
+		DatagramsReceived: atomic.LoadUint64(&t.receivedDatagrams),
+	}
+}
+
+// closed call ConnClosed hook once
+func (t *trafficMeter) closed() {
+	if t == nil || t.trace == nil || t.trace.ConnClosed == nil {
+		return
+	}
+	t.once.Do(func() {
+		info := t.info
+		info.Duration = time.Since(t.start)
+		info.ConnStats = t.stats()
+		t.trace.ConnClosed(info)
+	})
+}
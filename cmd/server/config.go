@@ -3,10 +3,24 @@ package main
 type Config struct {
 	CleartextPort uint16
 	EncryptedPort uint16
+	QUICPort      uint16
+	HTTPPort      uint16
+	// listen SCTP on cleartext port for UDP messages
+	SCTP bool
 
-	Address  string
-	LogLevel int
+	Address string
+	// set SO_REUSEPORT on listeners, so multiple server processes can share ports
+	ReusePort bool
+	LogLevel  int
 
+	// certificate is reloaded after files are modified
 	CertFile string
 	KeyFile  string
+	// obtain certificate of these hosts by ACME when not empty, CertFile and KeyFile are ignored
+	ACMEHosts []string
+	ACMEEmail string
+	// account key and certificates are stored here, "acme" when empty
+	ACMECacheDir string
+	// require client certificate signed by CA in this file when not empty
+	ClientCAFile string
 }
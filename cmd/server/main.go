@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"flag"
 	"log"
@@ -87,21 +88,51 @@ func main() {
 	if err == nil {
 		json.Unmarshal(c, &c2)
 		s.Address = c2.Address
-		kp2, _ := tls.LoadX509KeyPair(c2.CertFile, c2.KeyFile)
-		s.TlsConfig.Certificates[0] = kp2
+		if len(c2.ACMEHosts) > 0 {
+			cacheDir := c2.ACMECacheDir
+			if cacheDir == "" {
+				cacheDir = "acme"
+			}
+			s.CertificateSource = socks6.NewACMECertificateSource(cacheDir, c2.ACMEEmail, c2.ACMEHosts...)
+		} else if c2.CertFile != "" {
+			cs, err := socks6.NewFileCertificateSource(c2.CertFile, c2.KeyFile)
+			if err != nil {
+				lg.Fatal("can't load certificate", err)
+			}
+			s.CertificateSource = cs
+		}
+		if c2.ClientCAFile != "" {
+			pem, err := os.ReadFile(c2.ClientCAFile)
+			if err != nil {
+				lg.Fatal("can't read client CA file", err)
+			}
+			s.TlsConfig.ClientCAs = x509.NewCertPool()
+			s.TlsConfig.ClientCAs.AppendCertsFromPEM(pem)
+			s.TlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
 		s.CleartextPort = c2.CleartextPort
 		s.EncryptedPort = c2.EncryptedPort
+		s.QUICPort = c2.QUICPort
+		s.HTTPPort = c2.HTTPPort
+		s.SCTP = c2.SCTP
+		s.ListenOption.ReusePort = c2.ReusePort
 		lg.MinimalLevel = lg.Level(c2.LogLevel)
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	s.Start(ctx)
+	if err := s.Start(context.Background()); err != nil {
+		lg.Fatal("can't start server", err)
+	}
 	lg.Info("server is running, close input stream (ctrl-d) to stop")
-	b := []byte{0}
-	for {
-		_, err := os.Stdin.Read(b)
-		if err != nil {
-			cancel()
-			break
+	go func() {
+		b := []byte{0}
+		for {
+			if _, err := os.Stdin.Read(b); err != nil {
+				s.Stop()
+				return
+			}
 		}
+	}()
+	<-s.Done()
+	if err := s.Err(); err != nil {
+		lg.Fatal("server stopped", err)
 	}
 }
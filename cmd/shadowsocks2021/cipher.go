@@ -0,0 +1,72 @@
+package shadowsocks2021
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// AEADFactory create AEAD with 32 bytes subkey, suite with shorter key use prefix of it
+type AEADFactory func(key [32]byte) (cipher.AEAD, error)
+
+// DefaultCipher is used by NewSSConn
+const DefaultCipher = "aes-256-gcm"
+
+var ErrUnknownCipher = errors.New("unknown cipher")
+
+var cipherMtx sync.RWMutex
+var ciphers = map[string]AEADFactory{
+	"aes-128-gcm": func(key [32]byte) (cipher.AEAD, error) {
+		return newGCM(key[:16])
+	},
+	"aes-256-gcm": func(key [32]byte) (cipher.AEAD, error) {
+		return newGCM(key[:])
+	},
+	"chacha20-poly1305": func(key [32]byte) (cipher.AEAD, error) {
+		return chacha20poly1305.New(key[:])
+	},
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	a, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(a)
+}
+
+// RegisterCipher make AEAD suite selectable by name, existing suite with same name is replaced.
+// set fn to nil to remove suite
+func RegisterCipher(name string, fn AEADFactory) {
+	cipherMtx.Lock()
+	defer cipherMtx.Unlock()
+	if fn == nil {
+		delete(ciphers, name)
+		return
+	}
+	ciphers[name] = fn
+}
+
+// LookupCipher find registered AEAD suite by name
+func LookupCipher(name string) (AEADFactory, bool) {
+	cipherMtx.RLock()
+	defer cipherMtx.RUnlock()
+	fn, ok := ciphers[name]
+	return fn, ok
+}
+
+// Ciphers return sorted names of registered AEAD suites
+func Ciphers() []string {
+	cipherMtx.RLock()
+	defer cipherMtx.RUnlock()
+	names := make([]string, 0, len(ciphers))
+	for name := range ciphers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,144 @@
+package shadowsocks2021_test
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6/cmd/shadowsocks2021"
+)
+
+var builtinCiphers = []string{"aes-128-gcm", "aes-256-gcm", "chacha20-poly1305"}
+
+func TestCipherRegistry(t *testing.T) {
+	assert.Equal(t, builtinCiphers, shadowsocks2021.Ciphers())
+	for _, name := range builtinCiphers {
+		fn, ok := shadowsocks2021.LookupCipher(name)
+		if assert.True(t, ok, name) {
+			a, err := fn([32]byte{})
+			assert.NoError(t, err, name)
+			assert.Equal(t, 12, a.NonceSize(), name)
+		}
+	}
+	_, ok := shadowsocks2021.LookupCipher("rc4-md5")
+	assert.False(t, ok)
+	_, err := shadowsocks2021.NewSSConnWithCipher(nil, []byte("123456"), nil, "rc4-md5")
+	assert.ErrorIs(t, err, shadowsocks2021.ErrUnknownCipher)
+
+	// register, replace and remove
+	errBadKey := errors.New("bad key")
+	aes256, _ := shadowsocks2021.LookupCipher("aes-256-gcm")
+	shadowsocks2021.RegisterCipher("test-suite", aes256)
+	assert.Contains(t, shadowsocks2021.Ciphers(), "test-suite")
+	_, err = shadowsocks2021.NewSSConnWithCipher(nil, []byte("123456"), nil, "test-suite")
+	assert.NoError(t, err)
+	shadowsocks2021.RegisterCipher("test-suite", func(key [32]byte) (cipher.AEAD, error) {
+		return nil, errBadKey
+	})
+	_, err = shadowsocks2021.NewSSConnWithCipher(nil, []byte("123456"), nil, "test-suite")
+	assert.ErrorIs(t, err, errBadKey)
+	shadowsocks2021.RegisterCipher("test-suite", nil)
+	_, ok = shadowsocks2021.LookupCipher("test-suite")
+	assert.False(t, ok)
+	assert.Equal(t, builtinCiphers, shadowsocks2021.Ciphers())
+}
+
+// tcpPair return both side of a loopback TCP connection
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c1, c2
+}
+
+func TestSSConnRoundTrip(t *testing.T) {
+	password := []byte("123456")
+	for _, name := range builtinCiphers {
+		c1, c2 := tcpPair(t)
+		client, err := shadowsocks2021.NewSSConnWithCipher(c1, password, nil, name)
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		cache, _ := lru.New(16)
+		server, err := shadowsocks2021.NewSSConnWithCipher(c2, password, cache, name)
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+
+		// first read on server expect IV is already received
+		req := bytes.Repeat([]byte{1, 2, 3}, 1000)
+		_, err = client.Write(req)
+		assert.NoError(t, err, name)
+		buf := make([]byte, len(req))
+		_, err = io.ReadFull(server, buf)
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, req, buf, name)
+		}
+
+		for _, rep := range [][]byte{{4}, bytes.Repeat([]byte{5}, 100)} {
+			_, err = server.Write(rep)
+			assert.NoError(t, err, name)
+			buf := make([]byte, len(rep))
+			_, err = io.ReadFull(client, buf)
+			if assert.NoError(t, err, name) {
+				assert.Equal(t, rep, buf, name)
+			}
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func TestSSConnCipherMismatch(t *testing.T) {
+	c1, c2 := tcpPair(t)
+	defer c1.Close()
+	defer c2.Close()
+	client, err := shadowsocks2021.NewSSConnWithCipher(c1, []byte("123456"), nil, "aes-128-gcm")
+	assert.NoError(t, err)
+	server, err := shadowsocks2021.NewSSConnWithCipher(c2, []byte("123456"), nil, "chacha20-poly1305")
+	assert.NoError(t, err)
+	_, err = client.Write([]byte{1})
+	assert.NoError(t, err)
+	_, err = server.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+func TestSSConnSubkeyError(t *testing.T) {
+	errBadKey := errors.New("bad key")
+	master := [32]byte{}
+	aes256, _ := shadowsocks2021.LookupCipher("aes-256-gcm")
+	// accept only the first key seen, which is the master key
+	shadowsocks2021.RegisterCipher("test-subkey", func(key [32]byte) (cipher.AEAD, error) {
+		if master == ([32]byte{}) {
+			master = key
+		}
+		if key != master {
+			return nil, errBadKey
+		}
+		return aes256(key)
+	})
+	defer shadowsocks2021.RegisterCipher("test-subkey", nil)
+
+	c1, c2 := tcpPair(t)
+	defer c1.Close()
+	defer c2.Close()
+	client, err := shadowsocks2021.NewSSConnWithCipher(c1, []byte("123456"), nil, "test-subkey")
+	assert.NoError(t, err)
+	_, err = client.Write([]byte{1})
+	assert.ErrorIs(t, err, errBadKey)
+}
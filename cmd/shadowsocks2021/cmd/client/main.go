@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"flag"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/studentmain/socks6"
@@ -159,16 +161,26 @@ func (h socks5Server) UDPHandle(s *socks5.Server, addr *net.UDPAddr, d *socks5.D
 	return nil
 }
 
+var cipherName = flag.String("cipher", shadowsocks2021.DefaultCipher, "AEAD cipher, one of "+strings.Join(shadowsocks2021.Ciphers(), ", "))
+
 func ssdial(ctx context.Context, network string, addr string) (net.Conn, error) {
 	c, err := net.Dial(network, addr)
 	if err != nil {
 		return nil, err
 	}
-	sc := shadowsocks2021.NewSSConn(c, []byte("123456"), nil)
+	sc, err := shadowsocks2021.NewSSConnWithCipher(c, []byte("123456"), nil, *cipherName)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
 	return sc, nil
 }
 
 func main() {
+	flag.Parse()
+	if _, ok := shadowsocks2021.LookupCipher(*cipherName); !ok {
+		panic(shadowsocks2021.ErrUnknownCipher)
+	}
 	c := socks6.Client{
 		Server:     "127.0.0.1:8388",
 		DialFunc:   ssdial,
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"flag"
 	"net"
+	"strings"
 	"time"
 
 	lru "github.com/hashicorp/golang-lru"
@@ -66,6 +68,12 @@ func (a *ssServerAuth) Authenticate(
 }
 
 func main() {
+	cipherName := flag.String("cipher", shadowsocks2021.DefaultCipher, "AEAD cipher, one of "+strings.Join(shadowsocks2021.Ciphers(), ", "))
+	flag.Parse()
+	if _, ok := shadowsocks2021.LookupCipher(*cipherName); !ok {
+		panic(shadowsocks2021.ErrUnknownCipher)
+	}
+
 	sw := socks6.NewServerWorker()
 	sw.IgnoreFragmentedRequest = true
 	sw.AddressDependentFiltering = true
@@ -82,7 +90,10 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
-		sc := shadowsocks2021.NewSSConn(c, []byte("123456"), lru)
+		sc, err := shadowsocks2021.NewSSConnWithCipher(c, []byte("123456"), lru, *cipherName)
+		if err != nil {
+			panic(err)
+		}
 		go sw.ServeStream(context.Background(), sc)
 	}
 }
@@ -74,7 +74,7 @@ type SSConn struct {
 	wc   cipher.AEAD
 	wctr []byte
 
-	factory func(key [32]byte) cipher.AEAD
+	factory AEADFactory
 }
 
 func (s *SSConn) Close() error {
@@ -93,8 +93,11 @@ func (s *SSConn) Close() error {
 
 func (s *SSConn) Read(b []byte) (int, error) {
 	if s.rc == nil {
-		l := s.factory(s.key).NonceSize()
-		s.rctr = make([]byte, l)
+		c, err := s.factory(s.key)
+		if err != nil {
+			return 0, err
+		}
+		s.rctr = make([]byte, c.NonceSize())
 		iv := new([32]byte)
 		ivs := iv[:]
 
@@ -107,23 +110,27 @@ func (s *SSConn) Read(b []byte) (int, error) {
 			return 0, err
 		}
 		if s.lru != nil {
-			found, _ := s.lru.ContainsOrAdd(iv, nil)
+			found, _ := s.lru.ContainsOrAdd(*iv, nil)
 			if found {
 				return 0, io.EOF
 			}
 		}
 
-		s.rc = s.factory(nckdf(s.key, *iv))
+		rc, err := s.factory(nckdf(s.key, *iv))
+		if err != nil {
+			return 0, err
+		}
+		s.rc = rc
 	} else {
 		s.ecm = false
 	}
 
-	for s.rb.Len() < len(b) {
-		b, err := s.readBlk()
+	for s.rb.Len() == 0 {
+		blk, err := s.readBlk()
 		if err != nil {
 			return 0, err
 		}
-		s.rb.Write(b)
+		s.rb.Write(blk)
 	}
 	return s.rb.Read(b)
 }
@@ -143,17 +150,21 @@ func (s *SSConn) readBlk() ([]byte, error) {
 	if _, err := io.ReadFull(s.Conn, buf); err != nil {
 		return nil, err
 	}
-	if _, err := s.rc.Open(buf[:0], s.rctr, buf, nil); err != nil {
+	p, err := s.rc.Open(buf[:0], s.rctr, buf, nil)
+	if err != nil {
 		return nil, err
 	}
 	increment(s.rctr)
-	return buf, nil
+	return p, nil
 }
 
 func (s *SSConn) Write(b []byte) (int, error) {
 	if s.wc == nil {
-		l := s.factory(s.key).NonceSize()
-		s.wctr = make([]byte, l)
+		c, err := s.factory(s.key)
+		if err != nil {
+			return 0, err
+		}
+		s.wctr = make([]byte, c.NonceSize())
 		iv := new([32]byte)
 		ivs := iv[:]
 		if _, err := rand.Read(ivs); err != nil {
@@ -163,7 +174,11 @@ func (s *SSConn) Write(b []byte) (int, error) {
 			return 0, err
 		}
 
-		s.wc = s.factory(nckdf(s.key, *iv))
+		wc, err := s.factory(nckdf(s.key, *iv))
+		if err != nil {
+			return 0, err
+		}
+		s.wc = wc
 	}
 	ll := 2
 	if len(b) > ll {
@@ -176,7 +191,7 @@ func (s *SSConn) Write(b []byte) (int, error) {
 		return 0, err
 	}
 	increment(s.wctr)
-	s.wc.Seal(b2, s.wctr, b, nil)
+	s.wc.Seal(b2[:0], s.wctr, b, nil)
 	if _, err := s.Conn.Write(b2[:len(b)+s.wc.Overhead()]); err != nil {
 		return 0, err
 	}
@@ -184,24 +199,29 @@ func (s *SSConn) Write(b []byte) (int, error) {
 	return len(b), nil
 }
 
+// NewSSConn wrap conn with DefaultCipher
 func NewSSConn(conn net.Conn, kk []byte, lru *lru.Cache) *SSConn {
+	return lo.Must(NewSSConnWithCipher(conn, kk, lru, DefaultCipher))
+}
+
+// NewSSConnWithCipher wrap conn with AEAD suite registered as name, both side must use same suite
+func NewSSConnWithCipher(conn net.Conn, kk []byte, lru *lru.Cache, name string) (*SSConn, error) {
+	fn, ok := LookupCipher(name)
+	if !ok {
+		return nil, ErrUnknownCipher
+	}
 	k := nhkdf(kk)
-	sc := SSConn{
-		Conn: conn,
-		key:  k,
+	// fail early when suite can't use key
+	if _, err := fn(k); err != nil {
+		return nil, err
 	}
-	sc.factory = func(key [32]byte) cipher.AEAD {
-		a, err := aes.NewCipher(key[:])
-		if err != nil {
-			panic(err)
-		}
-		g, err := cipher.NewGCM(a)
-		if err != nil {
-			panic(err)
-		}
-		return g
+	sc := SSConn{
+		Conn:    conn,
+		lru:     lru,
+		key:     k,
+		factory: fn,
 	}
-	return &sc
+	return &sc, nil
 }
 
 func nhkdf(password []byte) [32]byte {
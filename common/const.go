@@ -12,3 +12,19 @@ const (
 	// TODO: waiting for IANA consideration
 	EncryptedPort = 8389
 )
+
+// QUICProtocol is ALPN protocol ID of SOCKS 6 over QUIC
+//
+// TODO: waiting for IANA consideration
+const QUICProtocol = "socks6"
+
+// TLSProtocol is ALPN protocol ID of SOCKS 6 over TLS, connection without ALPN is also SOCKS 6
+//
+// TODO: waiting for IANA consideration
+const TLSProtocol = "socks6"
+
+// HTTPUpgradeProtocol is protocol name in HTTP Upgrade header when SOCKS 6 is tunneled by HTTP/1.1
+const HTTPUpgradeProtocol = "socks6"
+
+// MaxInitialDataLength is max length of initial data sent with request
+const MaxInitialDataLength = 16384
@@ -7,8 +7,11 @@ import (
 
 func UdpPortAvaliable(a net.Addr) bool {
 	p, err := net.ListenPacket("udp", a.String())
+	if err != nil {
+		return false
+	}
 	p.Close()
-	return err == nil
+	return true
 }
 
 func GuessDefaultIPv4() net.IP {
@@ -0,0 +1,165 @@
+package nt
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// ErrUpgradeRejected is returned when server doesn't switch to requested protocol
+var ErrUpgradeRejected = errors.New("HTTP upgrade rejected")
+
+// upgradedConn is a connection tunneled by HTTP, addresses are reported as underlying connection's
+type upgradedConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (u upgradedConn) LocalAddr() net.Addr {
+	return u.local
+}
+func (u upgradedConn) RemoteAddr() net.Addr {
+	return u.remote
+}
+
+// UpgradeWebSocket do WebSocket client handshake to u on conn, data is sent in binary frames
+func UpgradeWebSocket(conn net.Conn, u *url.URL) (net.Conn, error) {
+	origin := url.URL{Scheme: "http", Host: u.Host}
+	if u.Scheme == "wss" {
+		origin.Scheme = "https"
+	}
+	config, err := websocket.NewConfig(u.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return upgradedConn{Conn: ws, local: conn.LocalAddr(), remote: conn.RemoteAddr()}, nil
+}
+
+// UpgradeHTTP do HTTP/1.1 Upgrade to protocol on conn, connection is used as raw stream after 101 response
+func UpgradeHTTP(conn net.Conn, u *url.URL, protocol string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    u,
+		Host:   u.Host,
+		Header: http.Header{
+			"Connection": {"Upgrade"},
+			"Upgrade":    {protocol},
+		},
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || !strings.EqualFold(resp.Header.Get("Upgrade"), protocol) {
+		return nil, ErrUpgradeRejected
+	}
+	return bufferedConn(conn, br), nil
+}
+
+// NewHTTPUpgradeHandler accept WebSocket and HTTP/1.1 Upgrade to protocol, then pass tunneled connection to serve.
+// serve can return before connection is closed, e.g. it's used by another goroutine.
+func NewHTTPUpgradeHandler(protocol string, serve func(r *http.Request, conn net.Conn)) http.Handler {
+	// HTTP server close connection when handler returns, wait until it's closed by user
+	serveUntilClosed := func(r *http.Request, conn net.Conn) {
+		hc := &hijackedConn{Conn: conn, closed: make(chan struct{})}
+		serve(r, hc)
+		select {
+		case <-hc.closed:
+		case <-r.Context().Done():
+			hc.Close()
+		}
+	}
+	ws := websocket.Server{
+		// non-browser clients don't care origin
+		Handshake: func(c *websocket.Config, r *http.Request) error {
+			return nil
+		},
+		Handler: func(c *websocket.Conn) {
+			c.PayloadType = websocket.BinaryFrame
+			r := c.Request()
+			serveUntilClosed(r, upgradedConn{Conn: c, local: requestLocalAddr(r), remote: requestRemoteAddr(r)})
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			ws.ServeHTTP(w, r)
+			return
+		}
+		if !strings.EqualFold(r.Header.Get("Upgrade"), protocol) {
+			w.Header().Set("Upgrade", protocol)
+			http.Error(w, http.StatusText(http.StatusUpgradeRequired), http.StatusUpgradeRequired)
+			return
+		}
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "upgrade not supported", http.StatusInternalServerError)
+			return
+		}
+		conn, rw, err := hj.Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + protocol + "\r\n\r\n")
+		if err := rw.Flush(); err != nil {
+			return
+		}
+		serveUntilClosed(r, bufferedConn(conn, rw.Reader))
+	})
+}
+
+// hijackedConn notify handler when connection is closed
+type hijackedConn struct {
+	net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (h *hijackedConn) Close() error {
+	err := h.Conn.Close()
+	h.once.Do(func() {
+		close(h.closed)
+	})
+	return err
+}
+
+// bufferedConn return conn which read data buffered by br first
+func bufferedConn(conn net.Conn, br *bufio.Reader) net.Conn {
+	if br.Buffered() == 0 {
+		return conn
+	}
+	b, _ := br.Peek(br.Buffered())
+	return NewBufferPrefixedConn(conn, append([]byte{}, b...))
+}
+
+func requestLocalAddr(r *http.Request) net.Addr {
+	if a, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return a
+	}
+	return &net.TCPAddr{}
+}
+
+func requestRemoteAddr(r *http.Request) net.Addr {
+	a, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return a
+}
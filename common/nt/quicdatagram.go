@@ -0,0 +1,95 @@
+package nt
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// ErrQUICDatagramNotSupported is returned when DATAGRAM extension is not negotiated on QUIC connection,
+// both side must set quic.Config.EnableDatagrams
+var ErrQUICDatagramNotSupported = errors.New("QUIC datagram not supported")
+
+// quicSeqPacket send and receive datagrams as QUIC DATAGRAM frames,
+// which is encrypted and congestion controlled by QUIC but unreliable like UDP
+type quicSeqPacket struct {
+	conn quic.Connection
+}
+
+var _ SeqPacket = quicSeqPacket{}
+
+// WrapQUICDatagram use DATAGRAM frames of QUIC connection as SeqPacket.
+// Datagram longer than QUIC's max datagram frame size (usually ~1200 bytes) can't be sent.
+func WrapQUICDatagram(conn quic.Connection) SeqPacket {
+	return quicSeqPacket{conn: conn}
+}
+
+func (u quicSeqPacket) NextDatagram() (Datagram, error) {
+	if !u.supported() {
+		return nil, ErrQUICDatagramNotSupported
+	}
+	data, err := u.conn.ReceiveMessage()
+	if err != nil {
+		return nil, err
+	}
+	return quicDatagram{
+		data: data,
+		conn: u.conn,
+	}, nil
+}
+
+func (u quicSeqPacket) Reply(b []byte) error {
+	if !u.supported() {
+		return ErrQUICDatagramNotSupported
+	}
+	return u.conn.SendMessage(b)
+}
+
+func (u quicSeqPacket) supported() bool {
+	return u.conn.ConnectionState().SupportsDatagrams
+}
+
+// Close is noop, QUIC connection is shared with streams and should be closed by its owner
+func (u quicSeqPacket) Close() error {
+	return nil
+}
+func (u quicSeqPacket) LocalAddr() net.Addr {
+	return u.conn.LocalAddr()
+}
+func (u quicSeqPacket) RemoteAddr() net.Addr {
+	return u.conn.RemoteAddr()
+}
+
+// QUIC datagram can't be read with deadline
+
+func (u quicSeqPacket) SetDeadline(t time.Time) error {
+	return nil
+}
+func (u quicSeqPacket) SetReadDeadline(t time.Time) error {
+	return nil
+}
+func (u quicSeqPacket) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type quicDatagram struct {
+	data []byte
+	conn quic.Connection
+}
+
+var _ Datagram = quicDatagram{}
+
+func (u quicDatagram) Data() []byte {
+	return u.data
+}
+func (u quicDatagram) Reply(b []byte) error {
+	return u.conn.SendMessage(b)
+}
+func (u quicDatagram) LocalAddr() net.Addr {
+	return u.conn.LocalAddr()
+}
+func (u quicDatagram) RemoteAddr() net.Addr {
+	return u.conn.RemoteAddr()
+}
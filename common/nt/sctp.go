@@ -0,0 +1,34 @@
+package nt
+
+import (
+	"net"
+
+	"github.com/studentmain/socks6/common/arrayx"
+	"github.com/studentmain/socks6/internal"
+)
+
+// sctpSeqPacket send and receive datagrams as SCTP messages, SCTP keeps message boundary, so no framing is needed
+type sctpSeqPacket struct {
+	netConnSeqPacket
+}
+
+var _ SeqPacket = sctpSeqPacket{}
+
+// WrapSCTPConn use a one-to-one style SCTP association as SeqPacket, each message is a datagram
+func WrapSCTPConn(conn net.Conn) SeqPacket {
+	return sctpSeqPacket{netConnSeqPacket{conn: conn, netCommon: conn}}
+}
+
+func (u sctpSeqPacket) NextDatagram() (Datagram, error) {
+	// message larger than buffer is split by read, use a buffer large enough for any UDP message
+	buf := internal.BytesPool64k.Rent()
+	defer internal.BytesPool64k.Return(buf)
+	n, err := u.conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return dtlsDatagram{
+		data: arrayx.Dup(buf[:n]),
+		conn: u.conn,
+	}, nil
+}
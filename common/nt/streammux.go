@@ -0,0 +1,438 @@
+package nt
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// frame: stream id(u32) type(u8) length(u16) data
+const (
+	muxFrameOpen   byte = iota // open a stream
+	muxFrameData               // stream data
+	muxFrameFin                // sender won't write to stream any more
+	muxFrameReset              // stream is closed and can't be read
+	muxFrameWindow             // data is u32 receive window increment
+)
+
+const (
+	muxHeaderSize   = 7
+	muxMaxFrameData = 16384
+	muxWindowSize   = 256 * 1024 // receive window of each stream
+	muxAcceptQueue  = 64
+)
+
+var errMuxProtocol = errors.New("stream mux protocol error")
+
+// streamMux multiplex streams over a reliable connection, both side can open stream.
+// Each stream has its own receive window, so slow reader of one stream won't block others.
+type streamMux struct {
+	conn net.Conn
+
+	wmtx sync.Mutex // serialize frame write
+
+	mtx     sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+
+	acceptCh  chan *muxStream
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error // why mux is closed
+}
+
+var _ MultiplexedConn = &streamMux{}
+
+// NewStreamMux multiplex conn, client and server side must have different client value
+func NewStreamMux(conn net.Conn, client bool) MultiplexedConn {
+	m := &streamMux{
+		conn:     conn,
+		streams:  map[uint32]*muxStream{},
+		nextID:   2,
+		acceptCh: make(chan *muxStream, muxAcceptQueue),
+		closed:   make(chan struct{}),
+	}
+	// client use odd stream id
+	if client {
+		m.nextID = 1
+	}
+	go m.readLoop()
+	return m
+}
+
+func (m *streamMux) Accept() (net.Conn, error) {
+	select {
+	case s := <-m.acceptCh:
+		return s, nil
+	case <-m.closed:
+		return nil, m.err
+	}
+}
+
+func (m *streamMux) Dial() (net.Conn, error) {
+	m.mtx.Lock()
+	select {
+	case <-m.closed:
+		m.mtx.Unlock()
+		return nil, m.err
+	default:
+	}
+	id := m.nextID
+	m.nextID += 2
+	s := newMuxStream(m, id)
+	m.streams[id] = s
+	m.mtx.Unlock()
+
+	if err := m.writeFrame(id, muxFrameOpen, nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (m *streamMux) Close() error {
+	m.shutdown(net.ErrClosed)
+	return nil
+}
+
+func (m *streamMux) LocalAddr() net.Addr {
+	return m.conn.LocalAddr()
+}
+func (m *streamMux) RemoteAddr() net.Addr {
+	return m.conn.RemoteAddr()
+}
+func (m *streamMux) SetDeadline(t time.Time) error {
+	return m.conn.SetDeadline(t)
+}
+func (m *streamMux) SetReadDeadline(t time.Time) error {
+	return m.conn.SetReadDeadline(t)
+}
+func (m *streamMux) SetWriteDeadline(t time.Time) error {
+	return m.conn.SetWriteDeadline(t)
+}
+
+// shutdown close underlying connection and all streams
+func (m *streamMux) shutdown(err error) {
+	m.closeOnce.Do(func() {
+		m.mtx.Lock()
+		m.err = err
+		close(m.closed)
+		streams := m.streams
+		m.streams = map[uint32]*muxStream{}
+		m.mtx.Unlock()
+
+		m.conn.Close()
+		for _, s := range streams {
+			s.abort(err)
+		}
+	})
+}
+
+func (m *streamMux) writeFrame(id uint32, typ byte, data []byte) error {
+	b := make([]byte, muxHeaderSize+len(data))
+	binary.BigEndian.PutUint32(b, id)
+	b[4] = typ
+	binary.BigEndian.PutUint16(b[5:], uint16(len(data)))
+	copy(b[muxHeaderSize:], data)
+
+	m.wmtx.Lock()
+	defer m.wmtx.Unlock()
+	if _, err := m.conn.Write(b); err != nil {
+		go m.shutdown(err)
+		return err
+	}
+	return nil
+}
+
+func (m *streamMux) stream(id uint32) *muxStream {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.streams[id]
+}
+
+func (m *streamMux) removeStream(id uint32) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.streams, id)
+}
+
+func (m *streamMux) readLoop() {
+	hdr := make([]byte, muxHeaderSize)
+	buf := make([]byte, 0xffff)
+	for {
+		if _, err := io.ReadFull(m.conn, hdr); err != nil {
+			m.shutdown(err)
+			return
+		}
+		id := binary.BigEndian.Uint32(hdr)
+		typ := hdr[4]
+		data := buf[:binary.BigEndian.Uint16(hdr[5:])]
+		if _, err := io.ReadFull(m.conn, data); err != nil {
+			m.shutdown(err)
+			return
+		}
+		if err := m.handleFrame(id, typ, data); err != nil {
+			m.shutdown(err)
+			return
+		}
+	}
+}
+
+func (m *streamMux) handleFrame(id uint32, typ byte, data []byte) error {
+	if typ == muxFrameOpen {
+		m.mtx.Lock()
+		if _, exist := m.streams[id]; exist {
+			m.mtx.Unlock()
+			return errMuxProtocol
+		}
+		s := newMuxStream(m, id)
+		m.streams[id] = s
+		m.mtx.Unlock()
+		select {
+		case m.acceptCh <- s:
+		default:
+			// too many streams not accepted
+			m.removeStream(id)
+			return m.writeFrame(id, muxFrameReset, nil)
+		}
+		return nil
+	}
+
+	s := m.stream(id)
+	if s == nil {
+		// stream closed locally, tell peer stop writing
+		if typ == muxFrameData {
+			return m.writeFrame(id, muxFrameReset, nil)
+		}
+		return nil
+	}
+	switch typ {
+	case muxFrameData:
+		return s.receive(data)
+	case muxFrameFin:
+		s.receiveFin()
+	case muxFrameReset:
+		m.removeStream(id)
+		s.abort(syscall.ECONNRESET)
+	case muxFrameWindow:
+		if len(data) != 4 {
+			return errMuxProtocol
+		}
+		s.increaseWindow(int(binary.BigEndian.Uint32(data)))
+	default:
+		return errMuxProtocol
+	}
+	return nil
+}
+
+// muxStream is a stream of streamMux
+type muxStream struct {
+	id  uint32
+	mux *streamMux
+
+	mtx        sync.Mutex
+	cond       *sync.Cond
+	buf        []byte // received but not read
+	consumed   int    // read but not acknowledged by window update
+	sendWindow int    // bytes can be sent before window update
+
+	finReceived bool  // peer won't write
+	finSent     bool  // Close called
+	err         error // stream aborted
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+var _ net.Conn = &muxStream{}
+
+func newMuxStream(m *streamMux, id uint32) *muxStream {
+	s := &muxStream{
+		id:         id,
+		mux:        m,
+		sendWindow: muxWindowSize,
+	}
+	s.cond = sync.NewCond(&s.mtx)
+	return s
+}
+
+func (s *muxStream) Read(b []byte) (int, error) {
+	s.mtx.Lock()
+	for len(s.buf) == 0 {
+		if s.finSent {
+			s.mtx.Unlock()
+			return 0, net.ErrClosed
+		}
+		if s.err != nil {
+			s.mtx.Unlock()
+			return 0, s.err
+		}
+		if s.finReceived {
+			s.mtx.Unlock()
+			return 0, io.EOF
+		}
+		if expired(s.readDeadline) {
+			s.mtx.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		s.cond.Wait()
+	}
+	n := copy(b, s.buf)
+	s.buf = s.buf[n:]
+	s.consumed += n
+	update := 0
+	if s.consumed >= muxWindowSize/2 {
+		update = s.consumed
+		s.consumed = 0
+	}
+	s.mtx.Unlock()
+
+	if update > 0 {
+		wb := make([]byte, 4)
+		binary.BigEndian.PutUint32(wb, uint32(update))
+		s.mux.writeFrame(s.id, muxFrameWindow, wb)
+	}
+	return n, nil
+}
+
+func (s *muxStream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		s.mtx.Lock()
+		for s.sendWindow == 0 && !s.finSent && s.err == nil && !expired(s.writeDeadline) {
+			s.cond.Wait()
+		}
+		switch {
+		case s.finSent:
+			s.mtx.Unlock()
+			return written, net.ErrClosed
+		case s.err != nil:
+			s.mtx.Unlock()
+			return written, s.err
+		case s.sendWindow == 0:
+			s.mtx.Unlock()
+			return written, os.ErrDeadlineExceeded
+		}
+		n := len(b) - written
+		if n > s.sendWindow {
+			n = s.sendWindow
+		}
+		if n > muxMaxFrameData {
+			n = muxMaxFrameData
+		}
+		s.sendWindow -= n
+		s.mtx.Unlock()
+
+		if err := s.mux.writeFrame(s.id, muxFrameData, b[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close send FIN to peer, stream can't be read or written after it
+func (s *muxStream) Close() error {
+	s.mtx.Lock()
+	if s.finSent {
+		s.mtx.Unlock()
+		return nil
+	}
+	s.finSent = true
+	aborted := s.err != nil
+	s.cond.Broadcast()
+	s.mtx.Unlock()
+
+	s.mux.removeStream(s.id)
+	if aborted {
+		return nil
+	}
+	return s.mux.writeFrame(s.id, muxFrameFin, nil)
+}
+
+func (s *muxStream) receive(data []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.buf)+len(data) > muxWindowSize {
+		return errMuxProtocol
+	}
+	s.buf = append(s.buf, data...)
+	s.cond.Broadcast()
+	return nil
+}
+
+func (s *muxStream) receiveFin() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.finReceived = true
+	s.cond.Broadcast()
+}
+
+func (s *muxStream) increaseWindow(n int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.sendWindow += n
+	s.cond.Broadcast()
+}
+
+func (s *muxStream) abort(err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+}
+
+func (s *muxStream) LocalAddr() net.Addr {
+	return s.mux.LocalAddr()
+}
+func (s *muxStream) RemoteAddr() net.Addr {
+	return s.mux.RemoteAddr()
+}
+
+func (s *muxStream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+func (s *muxStream) SetReadDeadline(t time.Time) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.readDeadline = t
+	s.wakeAt(t)
+	return nil
+}
+func (s *muxStream) SetWriteDeadline(t time.Time) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.writeDeadline = t
+	s.wakeAt(t)
+	return nil
+}
+
+// wakeAt wake blocked Read and Write at t, so they can check deadline. caller must hold mtx
+func (s *muxStream) wakeAt(t time.Time) {
+	s.cond.Broadcast()
+	if t.IsZero() {
+		return
+	}
+	time.AfterFunc(time.Until(t), func() {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		s.cond.Broadcast()
+	})
+}
+
+func expired(t time.Time) bool {
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+// IsMuxStream check whether conn is a stream created by NewStreamMux
+func IsMuxStream(conn net.Conn) bool {
+	_, ok := conn.(*muxStream)
+	return ok
+}
@@ -0,0 +1,91 @@
+package nt
+
+import (
+	"net"
+	"time"
+)
+
+// StreamSession is a stream multiplexer session over a connection, e.g. *yamux.Session
+type StreamSession interface {
+	Open() (net.Conn, error)
+	Accept() (net.Conn, error)
+	Close() error
+	addrPair
+}
+
+// TypedStreamSession is a stream multiplexer session returning its own stream type,
+// e.g. *smux.Session with T = *smux.Stream, *yamux.Session with T = *yamux.Stream
+type TypedStreamSession[T net.Conn] interface {
+	OpenStream() (T, error)
+	AcceptStream() (T, error)
+	Close() error
+	addrPair
+}
+
+// streamSession adapt StreamSession to MultiplexedConn
+type streamSession struct {
+	StreamSession
+	// original session, deadlines are applied to it
+	session interface{}
+}
+
+var _ MultiplexedConn = streamSession{}
+
+// WrapStreamSession use a stream multiplexer session as MultiplexedConn, so third party multiplexer can replace NewStreamMux.
+// Deadlines are applied to session only when it supports them
+func WrapStreamSession(s StreamSession) MultiplexedConn {
+	return streamSession{StreamSession: s, session: s}
+}
+
+// WrapTypedStreamSession works like WrapStreamSession, for session which doesn't return net.Conn from Open and Accept,
+// e.g. nt.WrapTypedStreamSession[*smux.Stream](session)
+func WrapTypedStreamSession[T net.Conn](s TypedStreamSession[T]) MultiplexedConn {
+	return streamSession{StreamSession: typedStreamSession[T]{s}, session: s}
+}
+
+func (s streamSession) Dial() (net.Conn, error) {
+	return s.Open()
+}
+
+func (s streamSession) SetDeadline(t time.Time) error {
+	if d, ok := s.session.(interface{ SetDeadline(time.Time) error }); ok {
+		return d.SetDeadline(t)
+	}
+	return nil
+}
+
+func (s streamSession) SetReadDeadline(t time.Time) error {
+	if d, ok := s.session.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (s streamSession) SetWriteDeadline(t time.Time) error {
+	if d, ok := s.session.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// typedStreamSession adapt TypedStreamSession to StreamSession
+type typedStreamSession[T net.Conn] struct {
+	TypedStreamSession[T]
+}
+
+func (s typedStreamSession[T]) Open() (net.Conn, error) {
+	c, err := s.OpenStream()
+	if err != nil {
+		// don't return typed nil
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s typedStreamSession[T]) Accept() (net.Conn, error) {
+	c, err := s.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
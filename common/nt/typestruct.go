@@ -3,7 +3,6 @@ package nt
 import (
 	"context"
 	"net"
-	"time"
 
 	"github.com/lucas-clemente/quic-go"
 	"github.com/studentmain/socks6/common/arrayx"
@@ -35,7 +34,11 @@ func (u udpDatagram) RemoteAddr() net.Addr {
 }
 
 func ReadUDPDatagram(pc net.PacketConn) (Datagram, error) {
-	b := make([]byte, 4096)
+	return ReadUDPDatagramTo(pc, make([]byte, 4096))
+}
+
+// ReadUDPDatagramTo read a datagram into b, returned datagram's data refer to b
+func ReadUDPDatagramTo(pc net.PacketConn, b []byte) (Datagram, error) {
 	n, addr, err := pc.ReadFrom(b)
 	if err != nil {
 		return nil, err
@@ -98,8 +101,9 @@ func (u dtlsDatagram) RemoteAddr() net.Addr {
 	return u.conn.RemoteAddr()
 }
 
+// quicMuxConn use QUIC streams as connections, QUIC datagrams as datagrams
 type quicMuxConn struct {
-	conn quic.Connection
+	quicSeqPacket
 }
 
 var _ MultiplexedConn = quicMuxConn{}
@@ -115,47 +119,13 @@ func (u quicMuxConn) Dial() (net.Conn, error) {
 	return quicConn{Connection: u.conn, Stream: qs}, err
 }
 
+// Close close whole QUIC connection
 func (u quicMuxConn) Close() error {
-	// noop
-	return nil
-}
-
-func (u quicMuxConn) NextDatagram() (Datagram, error) {
-	data, err := u.conn.ReceiveMessage()
-	if err != nil {
-		return nil, err
-	}
-
-	dgram := quicDatagram{
-		data: data,
-		conn: u.conn,
-	}
-	return dgram, nil
-}
-func (u quicMuxConn) Reply(b []byte) error {
-	return u.conn.SendMessage(b)
-}
-func (u quicMuxConn) LocalAddr() net.Addr {
-	return u.conn.LocalAddr()
-}
-func (u quicMuxConn) RemoteAddr() net.Addr {
-	return u.conn.RemoteAddr()
-}
-
-func (u quicMuxConn) SetDeadline(t time.Time) error {
-	return nil
-}
-
-func (u quicMuxConn) SetReadDeadline(t time.Time) error {
-	return nil
-}
-
-func (u quicMuxConn) SetWriteDeadline(t time.Time) error {
-	return nil
+	return u.conn.CloseWithError(0, "")
 }
 
 func WrapQUICConn(conn quic.Connection) DualModeMultiplexedConn {
-	return quicMuxConn{conn: conn}
+	return quicMuxConn{quicSeqPacket{conn: conn}}
 }
 
 type quicConn struct {
@@ -165,22 +135,17 @@ type quicConn struct {
 
 var _ net.Conn = quicConn{}
 
-type quicDatagram struct {
-	data []byte
-	conn quic.Connection
-}
-
-var _ Datagram = quicDatagram{}
-
-func (u quicDatagram) Data() []byte {
-	return u.data
-}
-func (u quicDatagram) Reply(b []byte) error {
-	return u.conn.SendMessage(b)
-}
-func (u quicDatagram) LocalAddr() net.Addr {
-	return u.conn.LocalAddr()
-}
-func (u quicDatagram) RemoteAddr() net.Addr {
-	return u.conn.RemoteAddr()
+// HandshakeDone return a channel closed when handshake of conn's QUIC connection complete,
+// it's not closed when handshake fail, so closed is returned too, which is closed when the QUIC connection is closed.
+// ok is false when conn is not a stream of QUIC connection accepting 0-RTT data
+func HandshakeDone(conn net.Conn) (done <-chan struct{}, closed <-chan struct{}, ok bool) {
+	qc, ok := conn.(quicConn)
+	if !ok {
+		return nil, nil, false
+	}
+	ec, ok := qc.Connection.(quic.EarlyConnection)
+	if !ok {
+		return nil, nil, false
+	}
+	return ec.HandshakeComplete().Done(), qc.Connection.Context().Done(), true
 }
@@ -0,0 +1,12 @@
+//go:build !linux && !windows
+
+package common
+
+import (
+	"syscall"
+)
+
+// ConvertSocketErrno return e unchanged, socket errno is already POSIX errno on this platform
+func ConvertSocketErrno(e syscall.Errno) syscall.Errno {
+	return e
+}
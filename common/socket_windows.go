@@ -1,7 +1,6 @@
 package common
 
 import (
-	"log"
 	"syscall"
 
 	"golang.org/x/sys/windows"
@@ -13,13 +12,27 @@ func ConvertSocketErrno(e syscall.Errno) syscall.Errno {
 		return syscall.ENOPROTOOPT
 	case windows.WSAENETUNREACH:
 		return syscall.ENETUNREACH
+	case windows.WSAENETDOWN:
+		return syscall.ENETDOWN
 	case windows.WSAEHOSTUNREACH:
 		return syscall.EHOSTUNREACH
-	case windows.WSAEREFUSED:
+	case windows.WSAEHOSTDOWN:
+		return syscall.EHOSTDOWN
+	case windows.WSAECONNREFUSED:
 		return syscall.ECONNREFUSED
+	case windows.WSAECONNRESET:
+		return syscall.ECONNRESET
 	case windows.WSAETIMEDOUT:
+		return syscall.ETIMEDOUT
+	case windows.WSAEACCES:
+		return syscall.EACCES
+	case windows.WSAEAFNOSUPPORT:
+		return syscall.EAFNOSUPPORT
+	case windows.WSAEADDRNOTAVAIL:
+		return syscall.EADDRNOTAVAIL
+	case windows.WSAEMSGSIZE:
+		return syscall.EMSGSIZE
 	default:
 		return e
 	}
-	return e
 }
@@ -30,6 +30,12 @@ func (s *SyncMap[K, V]) Range(f func(key K, value V) bool) {
 	})
 }
 
+// LoadOrStore return existing value of key if present, otherwise store and return value
+func (s *SyncMap[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
+	v, l := s.m.LoadOrStore(key, value)
+	return v.(V), l
+}
+
 func (s *SyncMap[K, V]) Delete(key K) {
 	s.m.Delete(key)
 }
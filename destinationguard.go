@@ -0,0 +1,149 @@
+package socks6
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/studentmain/socks6/message"
+)
+
+// local address cache lifetime
+const localAddrRefreshInterval = time.Minute
+
+// DestinationGuard refuse CONNECT and UDP traffic to internal destinations.
+// Zero value refuse loopback, unspecified, link-local, private (RFC1918, ULA)
+// and proxy's own addresses.
+type DestinationGuard struct {
+	// AllowLoopback permit loopback, unspecified and proxy's own addresses
+	AllowLoopback bool
+	// AllowLinkLocal permit link-local addresses
+	AllowLinkLocal bool
+	// AllowPrivate permit private network addresses
+	AllowPrivate bool
+
+	// Allowed networks are always permitted
+	Allowed []*net.IPNet
+	// Blocked networks are refused in addition to builtin rules
+	Blocked []*net.IPNet
+
+	mtx         sync.Mutex
+	localAddr   []net.IP
+	localUpdate time.Time
+}
+
+// AllowedIP check whether ip is a permitted destination
+func (g *DestinationGuard) AllowedIP(ip net.IP) bool {
+	for _, n := range g.Allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	for _, n := range g.Blocked {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if !g.AllowLoopback && (ip.IsLoopback() || ip.IsUnspecified() || g.isLocalIP(ip)) {
+		return false
+	}
+	if !g.AllowLinkLocal && (ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()) {
+		return false
+	}
+	if !g.AllowPrivate && ip.IsPrivate() {
+		return false
+	}
+	return true
+}
+
+// AllowedAddr check whether addr is a permitted destination, domain name is resolved first
+func (g *DestinationGuard) AllowedAddr(ctx context.Context, addr *message.SocksAddr) bool {
+	// not an Internet address, it's up to outbound
+	if addr.AddressType.IsCustom() {
+		return true
+	}
+	if addr.AddressType != message.AddressTypeDomainName {
+		return g.AllowedIP(addr.Address)
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, string(addr.Address))
+	if err != nil {
+		// resolve will fail again during dial
+		return true
+	}
+	for _, ip := range ips {
+		if !g.AllowedIP(ip.IP) {
+			return false
+		}
+	}
+	return true
+}
+
+// allowedNetAddr check remote address of established connection
+func (g *DestinationGuard) allowedNetAddr(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return g.AllowedIP(a.IP)
+	case *net.UDPAddr:
+		return g.AllowedIP(a.IP)
+	}
+	return true
+}
+
+// isLocalIP check whether ip belongs to this host
+func (g *DestinationGuard) isLocalIP(ip net.IP) bool {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	if time.Since(g.localUpdate) > localAddrRefreshInterval {
+		g.localUpdate = time.Now()
+		g.localAddr = g.localAddr[:0]
+		if addrs, err := net.InterfaceAddrs(); err == nil {
+			for _, a := range addrs {
+				if n, ok := a.(*net.IPNet); ok {
+					g.localAddr = append(g.localAddr, n.IP)
+				}
+			}
+		}
+	}
+	for _, l := range g.localAddr {
+		if l.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIP return ErrNotAllowedByRule when ip is refused by guard
+func (g *DestinationGuard) checkIP(ip net.IP) error {
+	if g.AllowedIP(ip) {
+		return nil
+	}
+	return ErrNotAllowedByRule
+}
+
+type destinationCheckKey struct{}
+
+// withDestinationCheck attach guard's IP check to context, used by ServerOutbound, nil guard attach nothing
+func withDestinationCheck(ctx context.Context, g *DestinationGuard) context.Context {
+	if g == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, destinationCheckKey{}, g.checkIP)
+}
+
+// DestinationCheckFromContext return IP check of DestinationGuard which serving the request,
+// ServerOutbound should refuse to connect IP rejected by it before any data is sent,
+// e.g. domain name resolved to another address after DestinationGuard checked it. nil when no guard
+func DestinationCheckFromContext(ctx context.Context) func(net.IP) error {
+	f, _ := ctx.Value(destinationCheckKey{}).(func(net.IP) error)
+	return f
+}
+
+// checkDestination return ErrNotAllowedByRule when addr is refused by guard, nil guard allow everything
+func (g *DestinationGuard) checkDestination(ctx context.Context, addr *message.SocksAddr) error {
+	if g == nil || g.AllowedAddr(ctx, addr) {
+		return nil
+	}
+	return ErrNotAllowedByRule
+}
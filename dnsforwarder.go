@@ -0,0 +1,257 @@
+package socks6
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/studentmain/socks6/common/lg"
+	"github.com/studentmain/socks6/common/rnd"
+	"github.com/studentmain/socks6/internal"
+	"github.com/studentmain/socks6/message"
+)
+
+// DNSForwarder forward DNS queries received by local UDP and TCP listener to Upstream,
+// through a UDP association created by Client
+type DNSForwarder struct {
+	Client   *Client
+	Upstream string        // resolver address, e.g. 8.8.8.8:53
+	Timeout  time.Duration // how long to wait for upstream response, 5 seconds when 0
+
+	mtx     sync.Mutex
+	pc      net.PacketConn // association to upstream, created when needed
+	pending map[uint16]*dnsPendingQuery
+}
+
+type dnsPendingQuery struct {
+	id       uint16 // query's original id
+	reply    func(b []byte)
+	deadline time.Time
+}
+
+var errDNSMessageTooShort = errors.New("dns message too short")
+
+// ListenAndServe listen on addr with both UDP and TCP, then serve DNS queries until ctx is done
+func (f *DNSForwarder) ListenAndServe(ctx context.Context, addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	go f.ServeTCP(ctx, l)
+	return f.ServeUDP(ctx, pc)
+}
+
+// ServeUDP serve DNS queries received by pc, pc is closed when returned
+func (f *DNSForwarder) ServeUDP(ctx context.Context, pc net.PacketConn) error {
+	defer pc.Close()
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+	buf := internal.BytesPool4k.Rent()
+	defer internal.BytesPool4k.Return(buf)
+	for {
+		n, a, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		err = f.forward(ctx, buf[:n], func(b []byte) {
+			if _, err := pc.WriteTo(b, a); err != nil {
+				lg.Debug("dns reply", a, err)
+			}
+		})
+		if err != nil {
+			lg.Info("dns forward", err)
+		}
+	}
+}
+
+// ServeTCP serve DNS queries received by connections accepted from l, l is closed when returned
+func (f *DNSForwarder) ServeTCP(ctx context.Context, l net.Listener) error {
+	defer l.Close()
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go f.serveTCPConn(ctx, conn)
+	}
+}
+
+// serveTCPConn read length prefixed queries from conn, queries are still forwarded over UDP
+func (f *DNSForwarder) serveTCPConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	wmtx := sync.Mutex{}
+	lb := []byte{0, 0}
+	for {
+		if _, err := io.ReadFull(conn, lb); err != nil {
+			return
+		}
+		q := make([]byte, binary.BigEndian.Uint16(lb))
+		if _, err := io.ReadFull(conn, q); err != nil {
+			return
+		}
+		err := f.forward(ctx, q, func(b []byte) {
+			wmtx.Lock()
+			defer wmtx.Unlock()
+			r := make([]byte, 2+len(b))
+			binary.BigEndian.PutUint16(r, uint16(len(b)))
+			copy(r[2:], b)
+			if _, err := conn.Write(r); err != nil {
+				lg.Debug("dns reply", conn.RemoteAddr(), err)
+			}
+		})
+		if err != nil {
+			lg.Info("dns forward", err)
+		}
+	}
+}
+
+// forward send query to upstream with a new id, reply is called with response which has original id
+func (f *DNSForwarder) forward(ctx context.Context, q []byte, reply func(b []byte)) error {
+	if len(q) < 12 {
+		return errDNSMessageTooShort
+	}
+	upstream, err := message.NewAddr(f.Upstream)
+	if err != nil {
+		return err
+	}
+	pc, err := f.association(ctx)
+	if err != nil {
+		return err
+	}
+
+	f.mtx.Lock()
+	f.expire()
+	id, ok := f.allocateID()
+	if !ok {
+		f.mtx.Unlock()
+		return errors.New("too many pending dns queries")
+	}
+	f.pending[id] = &dnsPendingQuery{
+		id:       binary.BigEndian.Uint16(q),
+		reply:    reply,
+		deadline: time.Now().Add(f.timeout()),
+	}
+	f.mtx.Unlock()
+
+	b := make([]byte, len(q))
+	copy(b, q)
+	binary.BigEndian.PutUint16(b, id)
+	if _, err := pc.WriteTo(b, upstream); err != nil {
+		f.mtx.Lock()
+		delete(f.pending, id)
+		f.mtx.Unlock()
+		return err
+	}
+	return nil
+}
+
+// association return UDP association to upstream, create one when necessary
+func (f *DNSForwarder) association(ctx context.Context) (net.PacketConn, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.pc != nil {
+		return f.pc, nil
+	}
+	pc, err := f.Client.ListenPacketContext(ctx, "udp", "")
+	if err != nil {
+		return nil, err
+	}
+	f.pc = pc
+	if f.pending == nil {
+		f.pending = map[uint16]*dnsPendingQuery{}
+	}
+	go f.readResponse(pc)
+	return pc, nil
+}
+
+// readResponse dispatch upstream responses, until association fail
+func (f *DNSForwarder) readResponse(pc net.PacketConn) {
+	defer func() {
+		f.mtx.Lock()
+		defer f.mtx.Unlock()
+		// next query create new association
+		if f.pc == pc {
+			f.pc = nil
+		}
+		pc.Close()
+	}()
+	upstream, _ := message.NewAddr(f.Upstream)
+	buf := internal.BytesPool4k.Rent()
+	defer internal.BytesPool4k.Return(buf)
+	for {
+		n, a, err := pc.ReadFrom(buf)
+		if err != nil {
+			var ue *UDPError
+			if errors.As(err, &ue) {
+				continue
+			}
+			lg.Info("dns association", err)
+			return
+		}
+		if n < 12 {
+			continue
+		}
+		// response from other host, can't check if upstream is a domain name
+		if upstream.AddressType != message.AddressTypeDomainName && message.ConvertAddr(a).String() != upstream.String() {
+			continue
+		}
+		id := binary.BigEndian.Uint16(buf)
+
+		f.mtx.Lock()
+		pq, ok := f.pending[id]
+		delete(f.pending, id)
+		f.mtx.Unlock()
+		if !ok {
+			continue
+		}
+		r := make([]byte, n)
+		copy(r, buf[:n])
+		binary.BigEndian.PutUint16(r, pq.id)
+		pq.reply(r)
+	}
+}
+
+// allocateID pick a random id not used by pending queries, caller must hold mtx
+func (f *DNSForwarder) allocateID() (uint16, bool) {
+	if len(f.pending) >= 0x10000 {
+		return 0, false
+	}
+	for {
+		id := rnd.RandUint16()
+		if _, used := f.pending[id]; !used {
+			return id, true
+		}
+	}
+}
+
+// expire forget queries which upstream didn't respond in time, caller must hold mtx
+func (f *DNSForwarder) expire() {
+	now := time.Now()
+	for id, pq := range f.pending {
+		if now.After(pq.deadline) {
+			delete(f.pending, id)
+		}
+	}
+}
+
+func (f *DNSForwarder) timeout() time.Duration {
+	if f.Timeout <= 0 {
+		return 5 * time.Second
+	}
+	return f.Timeout
+}
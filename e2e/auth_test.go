@@ -1,13 +1,22 @@
 package e2e_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/studentmain/socks6"
 	"github.com/studentmain/socks6/auth"
 	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/internal/socket"
+	"github.com/studentmain/socks6/message"
 )
 
 func TestUserPassAuth(t *testing.T) {
@@ -21,7 +30,7 @@ func TestUserPassAuth(t *testing.T) {
 	proxy := socks6.Server{
 		Address:       "127.0.0.1",
 		CleartextPort: sPort,
-		Worker:        socks6.NewServerWorker(),
+		Worker:        newServerWorker(),
 	}
 	sa := auth.NewServerAuthenticator()
 	sa.AddMethod(auth.PasswordServerAuthenticationMethod{
@@ -71,7 +80,7 @@ func TestAsyncAuth(t *testing.T) {
 	proxy := socks6.Server{
 		Address:       "127.0.0.1",
 		CleartextPort: sPort,
-		Worker:        socks6.NewServerWorker(),
+		Worker:        newServerWorker(),
 	}
 	sa := auth.NewServerAuthenticator()
 	sa.AddMethod(e2etool.FakeEchoServerAuthenticationMethod{})
@@ -88,3 +97,408 @@ func TestAsyncAuth(t *testing.T) {
 	assert.NoError(t, err)
 	e2etool.AssertClosed(t, fd)
 }
+
+type tokenServerAuthenticationMethod struct {
+	token []byte
+}
+
+func (m tokenServerAuthenticationMethod) Authenticate(
+	ctx context.Context,
+	conn net.Conn,
+	data []byte,
+	sac *auth.ServerAuthenticationChannels,
+) {
+	sac.Result <- auth.ServerAuthenticationResult{
+		Success: bytes.Equal(data, m.token),
+	}
+	<-sac.Continue
+	sac.Err <- nil
+}
+func (m tokenServerAuthenticationMethod) ID() byte {
+	return 0x80
+}
+
+func TestMultiMethodAuth(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	discardAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, discardAddr, e2etool.Discard)
+
+	newProxy := func(methods ...auth.ServerAuthenticationMethod) string {
+		sAddr, sPort := e2etool.GetAddr()
+		proxy := socks6.Server{
+			Address:       "127.0.0.1",
+			CleartextPort: sPort,
+			Worker:        newServerWorker(),
+		}
+		sa := auth.NewServerAuthenticator()
+		for _, m := range methods {
+			sa.AddMethod(m)
+		}
+		proxy.Worker.Authenticator = sa
+		proxy.Start(ctx)
+		return sAddr
+	}
+	passwordProxy := newProxy(auth.PasswordServerAuthenticationMethod{
+		Passwords: map[string]string{"alice": "123456"},
+	})
+	echoProxy := newProxy(e2etool.FakeEchoServerAuthenticationMethod{})
+	tokenProxy := newProxy(tokenServerAuthenticationMethod{token: []byte("token")})
+
+	dial := func(sAddr string, client *socks6.Client) error {
+		client.Server = sAddr
+		fd, err := client.Dial("tcp", discardAddr)
+		if err == nil {
+			fd.Close()
+		}
+		return err
+	}
+	newClient := func(password string) *socks6.Client {
+		return &socks6.Client{
+			AuthenticationMethods: []auth.ClientAuthenticationMethod{
+				e2etool.FakeEchoClientAuthenticationMethod{},
+				auth.StaticClientAuthenticationMethod{Method: 0x80, Data: []byte("token")},
+			},
+			Username: "alice",
+			Password: password,
+		}
+	}
+	assert.NoError(t, dial(passwordProxy, newClient("123456")))
+	// 2 stage
+	assert.NoError(t, dial(echoProxy, newClient("123456")))
+	assert.NoError(t, dial(tokenProxy, newClient("123456")))
+
+	assert.Error(t, dial(passwordProxy, newClient("654321")))
+	assert.NoError(t, dial(echoProxy, newClient("654321")))
+	assert.Error(t, dial(tokenProxy, &socks6.Client{Username: "alice", Password: "123456"}))
+}
+
+func TestSessionToken(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	spent := map[uint32]bool{}
+	worker.Rule = func(cc socks6.SocksConn) bool {
+		if d, ok := cc.Request.Options.GetData(message.OptionKindIdempotenceExpenditure); ok {
+			token := d.(message.IdempotenceExpenditureOptionData).Token
+			assert.False(t, spent[token], "token spent twice")
+			spent[token] = true
+		}
+		return true
+	}
+	proxy := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	proxy.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		UseSession: true,
+		UseToken:   16,
+	}
+	// more requests than window size
+	for i := 0; i < 40; i++ {
+		fd, err := client.DialContext(ctx, "tcp", echoAddr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		fd.Close()
+	}
+	// all requests except the one created session spend token
+	assert.Len(t, spent, 39)
+}
+
+func TestKeepAlive(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	newProxy := func() string {
+		sAddr, sPort := e2etool.GetAddr()
+		worker := newServerWorker()
+		worker.EnableMultiplex = true
+		proxy := socks6.Server{
+			Address:       "127.0.0.1",
+			CleartextPort: sPort,
+			Worker:        worker,
+		}
+		proxy.Start(ctx)
+		return sAddr
+	}
+
+	mtx := sync.Mutex{}
+	target := newProxy()
+	conns := []net.Conn{}
+	client := &socks6.Client{
+		UseSession:        true,
+		Multiplex:         true,
+		AutoReconnect:     true,
+		KeepAliveInterval: 50 * time.Millisecond,
+		// dial current proxy
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			c, err := (&net.Dialer{}).DialContext(ctx, network, target)
+			if err == nil {
+				conns = append(conns, c)
+			}
+			return c, err
+		},
+	}
+	dialed := func() int {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return len(conns)
+	}
+	fd, err := client.DialContext(ctx, "tcp", echoAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fd.Close()
+	client.StartKeepAlive(ctx)
+	time.Sleep(130 * time.Millisecond)
+	// NOOP is sent over multiplexed connection
+	assert.Equal(t, 1, dialed())
+
+	// session is lost with connection
+	mtx.Lock()
+	target = newProxy()
+	conns[0].Close()
+	mtx.Unlock()
+	time.Sleep(130 * time.Millisecond)
+	// rejected by new proxy, then authenticate again
+	assert.GreaterOrEqual(t, dialed(), 3)
+	n := dialed()
+	time.Sleep(130 * time.Millisecond)
+	assert.Equal(t, n, dialed())
+	fd, err = client.DialContext(ctx, "tcp", echoAddr)
+	if assert.NoError(t, err) {
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+	assert.Equal(t, n, dialed())
+}
+
+func TestWithoutSession(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.EnableMultiplex = true
+	sessions := [][]byte{}
+	worker.Rule = func(cc socks6.SocksConn) bool {
+		if cc.Request.CommandCode == message.CommandConnect {
+			sessions = append(sessions, cc.Session)
+		}
+		return true
+	}
+	proxy := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	proxy.Start(ctx)
+	dialed := 0
+	client := &socks6.Client{
+		Server:     sAddr,
+		UseSession: true,
+		Multiplex:  true,
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed++
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+	dial := func(ctx context.Context) {
+		fd, err := client.DialContext(ctx, "tcp", echoAddr)
+		if assert.NoError(t, err) {
+			e2etool.AssertForward(t, fd, fd)
+			fd.Close()
+		}
+	}
+	dial(ctx)
+	dial(socks6.WithoutSession(ctx))
+	dial(ctx)
+	// bypassed request use a new connection, others are multiplexed
+	assert.Equal(t, 2, dialed)
+	if assert.Len(t, sessions, 3) {
+		assert.NotEmpty(t, sessions[0])
+		assert.Empty(t, sessions[1])
+		assert.Equal(t, sessions[0], sessions[2])
+	}
+}
+
+// stuckClientAuthenticationMethod send token, then wait for something never happen after 1st reply,
+// or before sending data when stuckEarly is set
+type stuckClientAuthenticationMethod struct {
+	stuckEarly bool
+}
+
+func (m stuckClientAuthenticationMethod) Authenticate(
+	ctx context.Context,
+	conn net.Conn,
+	cac auth.ClientAuthenticationChannels,
+) {
+	if !m.stuckEarly {
+		cac.Data <- []byte("token")
+		select {
+		case <-cac.FirstAuthReply:
+		case <-ctx.Done():
+			return
+		}
+	}
+	<-ctx.Done()
+}
+
+func (m stuckClientAuthenticationMethod) ID() byte {
+	return 0x80
+}
+
+func TestAuthContext(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	proxy := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        newServerWorker(),
+	}
+	sa := auth.NewServerAuthenticator()
+	sa.AddMethod(tokenServerAuthenticationMethod{token: []byte("token")})
+	proxy.Worker.Authenticator = sa
+	proxy.Start(ctx)
+
+	for _, early := range []bool{true, false} {
+		client := &socks6.Client{
+			Server:               sAddr,
+			AuthenticationMethod: stuckClientAuthenticationMethod{stuckEarly: early},
+		}
+		tctx, tcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		start := time.Now()
+		_, err := client.DialContext(tctx, "tcp", echoAddr)
+		tcancel()
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), 200*time.Millisecond)
+	}
+}
+
+func TestListenerWorker(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+
+	sAddr, sPort := e2etool.GetAddr()
+	tAddr, tPort := e2etool.GetAddr()
+	ca := e2etool.NewCA()
+	// cleartext listener require password, encrypted listener trust everyone
+	cleartext := newServerWorker()
+	sa := auth.NewServerAuthenticator()
+	sa.AddMethod(auth.PasswordServerAuthenticationMethod{
+		Passwords: map[string]string{"alice": "123456"},
+	})
+	cleartext.Authenticator = sa
+	proxy := socks6.Server{
+		Address:         "127.0.0.1",
+		CleartextPort:   sPort,
+		EncryptedPort:   tPort,
+		Worker:          newServerWorker(),
+		CleartextWorker: cleartext,
+		TlsConfig: &tls.Config{
+			Certificates: []tls.Certificate{ca.Issue("proxy")},
+		},
+	}
+	proxy.Start(ctx)
+
+	_, err := (&socks6.Client{Server: sAddr}).DialContext(ctx, "tcp", echoAddr)
+	assert.Error(t, err)
+
+	for _, client := range []*socks6.Client{
+		{Server: sAddr, Username: "alice", Password: "123456"},
+		{Server: tAddr, Encrypted: true, TlsConfig: &tls.Config{RootCAs: ca.Pool}},
+	} {
+		fd, err := client.DialContext(ctx, "tcp", echoAddr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+
+	// UDP association is served by worker of cleartext listener
+	client := socks6.Client{Server: sAddr, Username: "alice", Password: "123456"}
+	pc, err := client.ListenPacketContext(ctx, "udp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pc.Close()
+	pc.WriteTo([]byte{1}, message.ParseAddr(echoAddr))
+	buf := make([]byte, 10)
+	n, _, err := pc.ReadFrom(buf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte{1}, buf[:n])
+	}
+}
+
+func TestPeerCredAuth(t *testing.T) {
+	if !socket.PeerCredSupported {
+		t.Skip("peer credential is not supported")
+	}
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+
+	path := filepath.Join(t.TempDir(), "socks6.sock")
+	uid := uint32(os.Getuid())
+	names := make(chan string, 1)
+	unixWorker := newServerWorker()
+	sa := auth.NewServerAuthenticator()
+	sa.AddMethod(auth.PeerCredServerAuthenticationMethod{
+		ClientName: func(cred auth.PeerCred) (string, bool) {
+			return "local", cred.UID == uid && cred.PID == int32(os.Getpid())
+		},
+	})
+	unixWorker.Authenticator = sa
+	unixWorker.Rule = func(cc socks6.SocksConn) bool {
+		names <- cc.ClientId
+		return true
+	}
+	proxy := socks6.Server{
+		UnixSocket: path,
+		Worker:     newServerWorker(),
+		UnixWorker: unixWorker,
+	}
+	proxy.Start(ctx)
+	defer proxy.Stop()
+
+	client := socks6.Client{
+		Server: path,
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		},
+	}
+	fd, err := client.DialContext(ctx, "tcp", echoAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	e2etool.AssertForward(t, fd, fd)
+	assert.Equal(t, "local", <-names)
+}
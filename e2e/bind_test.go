@@ -4,6 +4,8 @@ import (
 	"context"
 	"net"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -22,7 +24,7 @@ func TestBind(t *testing.T) {
 	proxy := socks6.Server{
 		Address:       "127.0.0.1",
 		CleartextPort: sPort,
-		Worker:        socks6.NewServerWorker(),
+		Worker:        newServerWorker(),
 	}
 	proxy.Start(ctx)
 	client := socks6.Client{
@@ -65,7 +67,7 @@ func TestBacklogBind(t *testing.T) {
 	proxy := socks6.Server{
 		Address:       "127.0.0.1",
 		CleartextPort: sPort,
-		Worker:        socks6.NewServerWorker(),
+		Worker:        newServerWorker(),
 	}
 	proxy.Start(ctx)
 	client := socks6.Client{
@@ -114,3 +116,262 @@ func TestBacklogBind(t *testing.T) {
 	testFd1.Close()
 	e2etool.AssertClosed(t, clientFd1)
 }
+
+func TestBacklogBindClose(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sAddr, sPort := e2etool.GetAddr()
+	proxy := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        newServerWorker(),
+	}
+	proxy.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+		Backlog:    10,
+	}
+
+	l, err := client.Listen("tcp", "0.0.0.0:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	cListener := l.(*socks6.ProxyTCPListener)
+	actualAddr := cListener.Addr().String()
+
+	// accept deadline
+	cListener.SetDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err = cListener.Accept()
+	var ne net.Error
+	if assert.ErrorAs(t, err, &ne) {
+		assert.True(t, ne.Timeout())
+	}
+	cListener.SetDeadline(time.Time{})
+
+	// concurrent accept
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			defer wg.Done()
+			c, err := cListener.Accept()
+			if assert.NoError(t, err) {
+				e2etool.AssertForward(t, c, c)
+				c.Close()
+			}
+		}()
+	}
+	dialer := net.Dialer{
+		Timeout: 1 * time.Second,
+	}
+	testFds := []net.Conn{}
+	for i := 0; i < 2; i++ {
+		fd, err := dialer.Dial("tcp", actualAddr)
+		if assert.NoError(t, err) {
+			testFds = append(testFds, fd)
+			go e2etool.Echo(fd)
+		}
+	}
+	wg.Wait()
+
+	// close unblock pending accept
+	errCh := make(chan error)
+	go func() {
+		_, err := cListener.Accept()
+		errCh <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cListener.Close()
+	assert.ErrorIs(t, <-errCh, net.ErrClosed)
+	_, err = cListener.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+
+	// remote listener is closed
+	time.Sleep(20 * time.Millisecond)
+	_, err = dialer.Dial("tcp", actualAddr)
+	assert.Error(t, err)
+}
+
+func TestBacklogBindRefill(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sAddr, sPort := e2etool.GetAddr()
+	proxy := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        newServerWorker(),
+	}
+	proxy.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+		Backlog:    2,
+	}
+
+	cListener, err := client.Listen("tcp", "0.0.0.0:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cListener.Close()
+	actualAddr := cListener.Addr().String()
+
+	// more connections than backlog arrive before accept
+	dialer := net.Dialer{
+		Timeout: 1 * time.Second,
+	}
+	for i := 0; i < 5; i++ {
+		fd, err := dialer.Dial("tcp", actualAddr)
+		if assert.NoError(t, err) {
+			defer fd.Close()
+			go e2etool.Echo(fd)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	wg := sync.WaitGroup{}
+	wg.Add(5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			defer wg.Done()
+			c, err := cListener.Accept()
+			if assert.NoError(t, err) {
+				e2etool.AssertForward(t, c, c)
+				c.Close()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestBacklogBindMultiplex(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.EnableMultiplex = true
+	proxy := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	proxy.Start(ctx)
+	dialed := int32(0)
+	client := &socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: true,
+		Multiplex:  true,
+		Backlog:    4,
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dialed, 1)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+
+	// both listeners use session's multiplexed connection, connections are routed by stream id
+	listeners := []net.Listener{}
+	for i := 0; i < 2; i++ {
+		l, err := client.Listen("tcp", "0.0.0.0:0")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer l.Close()
+		listeners = append(listeners, l)
+	}
+	dialer := net.Dialer{
+		Timeout: 1 * time.Second,
+	}
+	for i := 0; i < 2; i++ {
+		for _, l := range listeners {
+			fd, err := dialer.Dial("tcp", l.Addr().String())
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer fd.Close()
+			cfd, err := l.Accept()
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer cfd.Close()
+			e2etool.AssertForward2(t, cfd, fd)
+		}
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&dialed))
+}
+
+func TestBindPolicy(t *testing.T) {
+	e2etool.WatchDog()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.BindPolicy = &socks6.BindPolicy{
+		Addresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		MinPort:   41100,
+		MaxPort:   41102,
+	}
+	proxy := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	proxy.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+	}
+
+	// only last port in range is free, candidates are tried until it's found
+	for _, a := range []string{"127.0.0.1:41100", "127.0.0.1:41101"} {
+		l, err := net.Listen("tcp", a)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer l.Close()
+	}
+	// unspecified address is replaced by allowed address
+	cListener, err := client.Listen("tcp", "0.0.0.0:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "127.0.0.1:41102", cListener.Addr().String())
+	defer cListener.Close()
+
+	// no candidate left
+	_, err = client.Listen("tcp", "127.0.0.1:0")
+	assert.Error(t, err)
+
+	testFd, err := net.Dial("tcp", cListener.Addr().String())
+	if assert.NoError(t, err) {
+		defer testFd.Close()
+		clientFd, err := cListener.Accept()
+		if assert.NoError(t, err) {
+			e2etool.AssertForward2(t, clientFd, testFd)
+			clientFd.Close()
+		}
+	}
+
+	for _, a := range []string{
+		// port outside range
+		"127.0.0.1:41200",
+		// address not allowed
+		"127.0.0.2:41101",
+		// no allowed address of this family
+		"[::]:0",
+	} {
+		_, err = client.Listen("tcp", a)
+		assert.ErrorIs(t, err, syscall.EACCES, a)
+	}
+}
@@ -0,0 +1,199 @@
+package e2e_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/message"
+)
+
+type lockedBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return append([]byte{}, b.buf.Bytes()...)
+}
+
+// pcapngPackets return packet data of enhanced packet blocks
+func pcapngPackets(t *testing.T, b []byte) [][]byte {
+	ret := [][]byte{}
+	if !assert.GreaterOrEqual(t, len(b), 12) {
+		return ret
+	}
+	assert.EqualValues(t, 0x0A0D0D0A, binary.LittleEndian.Uint32(b))
+	for len(b) >= 12 {
+		typ := binary.LittleEndian.Uint32(b)
+		l := binary.LittleEndian.Uint32(b[4:])
+		if !assert.LessOrEqual(t, int(l), len(b)) {
+			return ret
+		}
+		assert.Equal(t, l, binary.LittleEndian.Uint32(b[l-4:]))
+		if typ == 6 {
+			capLen := binary.LittleEndian.Uint32(b[20:])
+			ret = append(ret, b[28:28+capLen])
+		}
+		b = b[l:]
+	}
+	return ret
+}
+
+func TestCapture(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+
+	w := &lockedBuffer{}
+	stop, err := worker.StartCapture("address 127.0.0.1", w)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// nothing is written when capture is refused
+	w2 := &lockedBuffer{}
+	_, err = worker.StartCapture("address 127.0.0.1", w2)
+	assert.ErrorIs(t, err, socks6.ErrCaptureInProgress)
+	assert.Empty(t, w2.Bytes())
+
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+		UDPOverTCP: true,
+	}
+	buf := make([]byte, 10)
+
+	fd, err := client.DialContext(ctx, "tcp", echoAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fd.Write([]byte("tcp!"))
+	_, err = fd.Read(buf)
+	assert.NoError(t, err)
+	fd.Close()
+
+	ufd, err := client.DialContext(ctx, "udp", echoAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ufd.Write([]byte("udp!"))
+	_, err = ufd.Read(buf)
+	assert.NoError(t, err)
+	ufd.Close()
+	// downlink is captured after datagram is sent
+	time.Sleep(50 * time.Millisecond)
+	stop()
+
+	tcpData, udpData := 0, 0
+	for _, pkt := range pcapngPackets(t, w.Bytes()) {
+		if !assert.EqualValues(t, 0x45, pkt[0]) {
+			continue
+		}
+		switch pkt[9] {
+		case 6:
+			if bytes.Equal(pkt[40:], []byte("tcp!")) {
+				tcpData++
+			}
+		case 17:
+			if bytes.Equal(pkt[28:], []byte("udp!")) {
+				udpData++
+			}
+		}
+	}
+	// both direction
+	assert.Equal(t, 2, tcpData)
+	assert.Equal(t, 2, udpData)
+}
+
+func TestUDPAssociationCapture(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+		UDPOverTCP: true,
+	}
+	fd, err := client.UDPAssociateRequest(ctx, nil, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	id := fd.AssociationID()
+
+	// only one of concurrent captures is started
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	stops := []func(){}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stop, err := worker.StartUDPAssociationCapture(id, &lockedBuffer{})
+			if err != nil {
+				assert.ErrorIs(t, err, socks6.ErrCaptureInProgress)
+				return
+			}
+			mtx.Lock()
+			stops = append(stops, stop)
+			mtx.Unlock()
+		}()
+	}
+	wg.Wait()
+	if !assert.Len(t, stops, 1) {
+		return
+	}
+	stops[0]()
+
+	// capture again after stopped
+	w := &lockedBuffer{}
+	stop, err := worker.StartUDPAssociationCapture(id, w)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fd.WriteTo([]byte("udp!"), message.ParseAddr(echoAddr))
+	buf := make([]byte, 10)
+	_, _, err = fd.ReadFrom(buf)
+	assert.NoError(t, err)
+	// downlink is captured after datagram is sent
+	time.Sleep(50 * time.Millisecond)
+	stop()
+	assert.Len(t, pcapngPackets(t, w.Bytes()), 2)
+}
@@ -0,0 +1,69 @@
+package e2e_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+)
+
+func TestClientGroup(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+
+	newProxy := func(allow bool) string {
+		sAddr, sPort := e2etool.GetAddr()
+		worker := newServerWorker()
+		worker.Rule = func(cc socks6.SocksConn) bool {
+			return allow
+		}
+		server := socks6.Server{
+			Address:       "127.0.0.1",
+			CleartextPort: sPort,
+			Worker:        worker,
+		}
+		server.Start(ctx)
+		return sAddr
+	}
+	// nothing listen on it
+	deadAddr, _ := e2etool.GetAddr()
+	dead := &socks6.Client{Server: deadAddr}
+	alive := &socks6.Client{Server: newProxy(true)}
+	deny := &socks6.Client{Server: newProxy(false)}
+
+	group := socks6.ClientGroup{
+		Clients:       []*socks6.Client{dead, alive},
+		CheckInterval: time.Hour,
+	}
+	fd, err := group.DialContext(ctx, "tcp", echoAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	e2etool.AssertForward(t, fd, fd)
+	fd.Close()
+	status := group.Status()
+	assert.False(t, status[0].Healthy)
+	assert.True(t, status[1].Healthy)
+
+	group.Check(ctx)
+	status = group.Status()
+	assert.False(t, status[0].Healthy)
+	assert.True(t, status[1].Healthy)
+	assert.NotZero(t, status[1].Latency)
+
+	// proxy replied failure, not retried
+	group2 := socks6.ClientGroup{
+		Clients: []*socks6.Client{deny, alive},
+	}
+	_, err = group2.DialContext(ctx, "tcp", echoAddr)
+	assert.ErrorIs(t, err, syscall.EACCES)
+	var re *socks6.ReplyError
+	assert.ErrorAs(t, err, &re)
+}
@@ -3,16 +3,27 @@ package e2e_test
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"net"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/yamux"
 	"github.com/samber/lo"
 	"github.com/stretchr/testify/assert"
 	"github.com/studentmain/socks6"
 	"github.com/studentmain/socks6/common"
+	"github.com/studentmain/socks6/common/nt"
 	"github.com/studentmain/socks6/common/rnd"
 	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/internal/socket"
+	"github.com/studentmain/socks6/message"
+	"github.com/xtaci/smux"
 )
 
 func TestConnect(t *testing.T) {
@@ -25,7 +36,7 @@ func TestConnect(t *testing.T) {
 	server := socks6.Server{
 		Address:       "127.0.0.1",
 		CleartextPort: sPort,
-		Worker:        socks6.NewServerWorker(),
+		Worker:        newServerWorker(),
 	}
 	server.Start(ctx)
 	client := socks6.Client{
@@ -46,6 +57,101 @@ func TestConnect(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestConnectLoopbackRefused(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        socks6.NewServerWorker(),
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+	}
+	_, err := client.Dial("tcp", echoAddr)
+	assert.Error(t, err)
+}
+
+func TestConnectRebindRefused(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := lo.Must1(net.Listen("tcp", "127.0.0.1:0"))
+	defer l.Close()
+	accepted := int32(0)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			c.Close()
+		}
+	}()
+	sAddr, sPort := e2etool.GetAddr()
+	worker := socks6.NewServerWorker()
+	// name doesn't resolve when guard check it, but resolve to loopback during dial
+	outbound := worker.Outbound.(socks6.InternetServerOutbound)
+	outbound.Hosts = map[string]net.IP{"rebind.invalid": net.IPv4(127, 0, 0, 1)}
+	worker.Outbound = outbound
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	client := socks6.Client{Server: sAddr}
+	addr := net.JoinHostPort("rebind.invalid", strconv.Itoa(l.Addr().(*net.TCPAddr).Port))
+
+	_, err := client.DialWithInitialData(ctx, addr, []byte("secret"))
+	assert.ErrorIs(t, err, syscall.EACCES)
+	_, err = client.DialContext(ctx, "tcp", addr)
+	assert.ErrorIs(t, err, syscall.EACCES)
+	// connection is refused before connect
+	assert.EqualValues(t, 0, atomic.LoadInt32(&accepted))
+}
+
+func TestConnectHosts(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, echoPort := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	outbound := worker.Outbound.(socks6.InternetServerOutbound)
+	outbound.Hosts = map[string]net.IP{"echo.invalid": net.IPv4(127, 0, 0, 1)}
+	worker.Outbound = outbound
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	client := socks6.Client{Server: sAddr}
+	port := strconv.Itoa(int(echoPort))
+
+	// name is case insensitive and may be fully qualified
+	for _, name := range []string{"echo.invalid", "Echo.INVALID", "echo.invalid."} {
+		fd, err := client.DialContext(ctx, "tcp", net.JoinHostPort(name, port))
+		if assert.NoError(t, err, name) {
+			e2etool.AssertForward(t, fd, fd)
+			fd.Close()
+		}
+	}
+	// not pinned name is resolved by DNS
+	_, err := client.DialContext(ctx, "tcp", net.JoinHostPort("other.invalid", port))
+	assert.ErrorIs(t, err, syscall.EHOSTUNREACH)
+}
+
 func TestFragmentedConnect(t *testing.T) {
 	e2etool.WatchDog()
 	ctx, cancel := context.WithCancel(context.Background())
@@ -56,7 +162,7 @@ func TestFragmentedConnect(t *testing.T) {
 	server := socks6.Server{
 		Address:       "127.0.0.1",
 		CleartextPort: sPort,
-		Worker:        socks6.NewServerWorker(),
+		Worker:        newServerWorker(),
 	}
 	server.Start(ctx)
 
@@ -83,6 +189,71 @@ func TestFragmentedConnect(t *testing.T) {
 
 }
 
+func TestRequestTimeout(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.RequestTimeout = 100 * time.Millisecond
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+
+	clientFd := lo.Must1(net.Dial("tcp", sAddr))
+	defer clientFd.Close()
+	// incomplete request
+	e2etool.AssertWrite(t, clientFd, []byte{common.ProtocolVersion, 1})
+	clientFd.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := clientFd.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.HandshakeTimeout = 100 * time.Millisecond
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+
+	clientFd := lo.Must1(net.Dial("tcp", sAddr))
+	defer clientFd.Close()
+	// complete request, but initial data never arrive
+	req := message.NewRequest()
+	req.CommandCode = message.CommandConnect
+	req.Endpoint = message.ParseAddr(echoAddr)
+	req.Options.Add(message.Option{
+		Kind: message.OptionKindAuthenticationMethodAdvertisement,
+		Data: message.AuthenticationMethodAdvertisementOptionData{InitialDataLength: 4},
+	})
+	e2etool.AssertWrite(t, clientFd, req.Marshal())
+	clientFd.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := clientFd.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	// established connection is not affected
+	client := socks6.Client{Server: sAddr}
+	fd, err := client.DialContext(ctx, "tcp", echoAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	time.Sleep(200 * time.Millisecond)
+	e2etool.AssertForward(t, fd, fd)
+}
+
 func BenchmarkRelay(b *testing.B) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -92,7 +263,7 @@ func BenchmarkRelay(b *testing.B) {
 	server := socks6.Server{
 		Address:       "127.0.0.1",
 		CleartextPort: sPort,
-		Worker:        socks6.NewServerWorker(),
+		Worker:        newServerWorker(),
 	}
 	server.Start(ctx)
 	client := socks6.Client{
@@ -133,7 +304,7 @@ func BenchmarkAccept(b *testing.B) {
 	server := socks6.Server{
 		Address:       "127.0.0.1",
 		CleartextPort: sPort,
-		Worker:        socks6.NewServerWorker(),
+		Worker:        newServerWorker(),
 	}
 	server.Start(ctx)
 	client := socks6.Client{
@@ -149,3 +320,907 @@ func BenchmarkAccept(b *testing.B) {
 	}
 }
 */
+
+func TestConnectContext(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// proxy which never reply
+	sAddr, _ := e2etool.GetAddr()
+	l, err := net.Listen("tcp", sAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				<-ctx.Done()
+				c.Close()
+			}()
+		}
+	}()
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+	}
+
+	_, err = client.DialContext(ctx, "sctp", "127.0.0.1:1")
+	assert.Error(t, err)
+
+	tctx, tcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer tcancel()
+	_, err = client.DialContext(tctx, "tcp", "127.0.0.1:1")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	cctx, ccancel := context.WithCancel(ctx)
+	go func() {
+		<-time.After(50 * time.Millisecond)
+		ccancel()
+	}()
+	_, err = client.DialContext(cctx, "udp", "127.0.0.1:1")
+	assert.ErrorIs(t, err, context.Canceled)
+	var ne net.Error
+	assert.ErrorAs(t, err, &ne)
+}
+
+func TestConnectMultiplex(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.EnableMultiplex = true
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+
+	dialed := 0
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: true,
+		Multiplex:  true,
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed++
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+	fds := []net.Conn{}
+	for i := 0; i < 3; i++ {
+		fd, err := client.DialContext(ctx, "tcp", echoAddr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		fds = append(fds, fd)
+	}
+	buf := make([]byte, 10)
+	for i, fd := range fds {
+		fd.Write([]byte{byte(i)})
+		n, err := fd.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{byte(i)}, buf[:n])
+	}
+	e2etool.AssertForward(t, fds[1], fds[1])
+	for _, fd := range fds {
+		assert.NoError(t, fd.Close())
+	}
+	// all requests share one connection
+	assert.Equal(t, 1, dialed)
+}
+
+func TestConnectMultiplexSession(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+
+	type muxFunc = func(conn net.Conn) (nt.MultiplexedConn, error)
+	for name, fn := range map[string]func(server bool) muxFunc{
+		"yamux": func(server bool) muxFunc {
+			return func(conn net.Conn) (nt.MultiplexedConn, error) {
+				open := yamux.Client
+				if server {
+					open = yamux.Server
+				}
+				s, err := open(conn, nil)
+				if err != nil {
+					return nil, err
+				}
+				return nt.WrapStreamSession(s), nil
+			}
+		},
+		"smux": func(server bool) muxFunc {
+			return func(conn net.Conn) (nt.MultiplexedConn, error) {
+				open := smux.Client
+				if server {
+					open = smux.Server
+				}
+				s, err := open(conn, nil)
+				if err != nil {
+					return nil, err
+				}
+				return nt.WrapTypedStreamSession[*smux.Stream](s), nil
+			}
+		},
+	} {
+		sAddr, sPort := e2etool.GetAddr()
+		worker := newServerWorker()
+		worker.EnableMultiplex = true
+		worker.MultiplexFunc = fn(true)
+		server := socks6.Server{
+			Address:       "127.0.0.1",
+			CleartextPort: sPort,
+			Worker:        worker,
+		}
+		server.Start(ctx)
+
+		sessions := 0
+		client := socks6.Client{
+			Server:     sAddr,
+			UseSession: true,
+			Multiplex:  true,
+			MultiplexFunc: func(conn net.Conn) (nt.MultiplexedConn, error) {
+				sessions++
+				return fn(false)(conn)
+			},
+		}
+		for i := 0; i < 2; i++ {
+			fd, err := client.DialContext(ctx, "tcp", echoAddr)
+			if !assert.NoError(t, err, name) {
+				return
+			}
+			e2etool.AssertForward(t, fd, fd)
+			fd.Close()
+		}
+		// requests share one multiplexer session
+		assert.Equal(t, 1, sessions, name)
+	}
+}
+
+func TestConnectRequestOptions(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	const vendorKind message.OptionKind = 0xfd80
+	worker := newServerWorker()
+	worker.Rule = func(cc socks6.SocksConn) bool {
+		d, ok := cc.Request.Options.GetData(vendorKind)
+		return ok && bytes.Equal(d.(*message.RawOptionData).Data, []byte("hint"))
+	}
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+	}
+	_, err := client.DialContext(ctx, "tcp", echoAddr)
+	assert.ErrorIs(t, err, syscall.EACCES)
+
+	octx := socks6.WithRequestOptions(ctx, message.Option{
+		Kind: vendorKind,
+		Data: &message.RawOptionData{Data: []byte("hint")},
+	})
+	fd, err := client.DialContext(octx, "tcp", echoAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	e2etool.AssertForward(t, fd, fd)
+	fd.Close()
+	// options can be reused
+	fd, err = client.DialContext(octx, "tcp", echoAddr)
+	if assert.NoError(t, err) {
+		fd.Close()
+	}
+}
+
+// clientOutbound relay CONNECT to another proxy
+type clientOutbound struct {
+	socks6.ServerOutbound
+	client *socks6.Client
+}
+
+func (c clientOutbound) Dial(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.Conn, message.StackOptionInfo, error) {
+	conn, err := c.client.DialContext(ctx, "tcp", addr.String())
+	return conn, nil, err
+}
+
+func TestConnectRelayPrivateOptions(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	vendorKind := message.VendorOptionKind(0x18, 1)
+
+	upAddr, upPort := e2etool.GetAddr()
+	upWorker := newServerWorker()
+	upWorker.Rule = func(cc socks6.SocksConn) bool {
+		d, ok := cc.Request.Options.GetData(vendorKind)
+		return ok && bytes.Equal(d.(*message.RawOptionData).Data, []byte("hint"))
+	}
+	up := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: upPort,
+		Worker:        upWorker,
+	}
+	up.Start(ctx)
+
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.Outbound = clientOutbound{
+		ServerOutbound: worker.Outbound,
+		client:         &socks6.Client{Server: upAddr},
+	}
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	client := socks6.Client{Server: sAddr}
+
+	octx := socks6.WithRequestOptions(ctx, message.Option{
+		Kind: vendorKind,
+		Data: &message.RawOptionData{Data: []byte("hint")},
+	})
+	_, err := client.DialContext(octx, "tcp", echoAddr)
+	assert.Error(t, err)
+
+	worker.RelayPrivateOptions = true
+	fd, err := client.DialContext(octx, "tcp", echoAddr)
+	if assert.NoError(t, err) {
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+}
+
+func TestConnectStackOptions(t *testing.T) {
+	e2etool.WatchDog()
+	if runtime.GOOS != "linux" {
+		t.Skip("stack options are applied on linux only")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        newServerWorker(),
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+	}
+	sctx := socks6.WithStackOptions(ctx, message.StackOptionInfo{
+		message.StackOptionIPTTL: byte(42),
+	})
+	fd, err := client.DialContext(sctx, "tcp", echoAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	applied := fd.(*socks6.ProxyTCPConn).StackOptions()
+	assert.EqualValues(t, 42, applied[message.StackOptionIPTTL])
+	e2etool.AssertForward(t, fd, fd)
+}
+
+func TestConnectTransparentStackOptions(t *testing.T) {
+	e2etool.WatchDog()
+	if runtime.GOOS != "linux" {
+		t.Skip("transparent outbound is supported on linux only")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	// client address is loopback, so connection from it can be routed back without TPROXY rule
+	probe, err := net.Listen("tcp4", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer probe.Close()
+	conn, _, err := socket.DialTransparentWithOption(ctx,
+		&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		*message.ParseAddr(probe.Addr().String()),
+		message.StackOptionInfo{},
+		nil,
+	)
+	if err != nil {
+		t.Skip("IP_TRANSPARENT is not available", err)
+	}
+	conn.Close()
+
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.Outbound = socks6.InternetServerOutbound{Transparent: true}
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+	}
+	sctx := socks6.WithStackOptions(ctx, message.StackOptionInfo{
+		message.StackOptionIPTTL: byte(42),
+	})
+	fd, err := client.DialContext(sctx, "tcp", echoAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	applied := fd.(*socks6.ProxyTCPConn).StackOptions()
+	assert.EqualValues(t, 42, applied[message.StackOptionIPTTL])
+	e2etool.AssertForward(t, fd, fd)
+}
+
+func TestReplyMetadata(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	remotes := make(chan string, 1)
+	go e2etool.ServeTCP(ctx, echoAddr, func(c io.ReadWriteCloser) {
+		remotes <- c.(net.Conn).RemoteAddr().String()
+		e2etool.Echo(c)
+	})
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        newServerWorker(),
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+	}
+
+	fd, err := client.DialContext(ctx, "tcp", echoAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	e2etool.AssertForward(t, fd, fd)
+	md := fd.(socks6.ReplyMetadata)
+	// proxy's outbound address
+	assert.Equal(t, <-remotes, md.ProxyBindAddr().String())
+	assert.NotNil(t, md.ReplyOptions())
+
+	l, err := client.ListenContext(ctx, "tcp", "0.0.0.0:0")
+	if assert.NoError(t, err) {
+		md := l.(socks6.ReplyMetadata)
+		assert.Equal(t, l.Addr(), md.ProxyBindAddr())
+		assert.NotNil(t, md.ReplyOptions())
+		l.Close()
+	}
+
+	pc, err := client.ListenPacketContext(ctx, "udp4", "")
+	if assert.NoError(t, err) {
+		md := pc.(socks6.ReplyMetadata)
+		_, port, _ := net.SplitHostPort(md.ProxyBindAddr().String())
+		assert.NotEqual(t, "0", port)
+		assert.NotNil(t, md.ReplyOptions())
+		pc.Close()
+	}
+}
+
+// flakyOutbound fail first fails Dial with err
+type flakyOutbound struct {
+	socks6.ServerOutbound
+	fails int32
+	err   error
+}
+
+func (f *flakyOutbound) Dial(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.Conn, message.StackOptionInfo, error) {
+	if atomic.AddInt32(&f.fails, -1) >= 0 {
+		return nil, nil, f.err
+	}
+	return f.ServerOutbound.Dial(ctx, option, addr)
+}
+
+func TestConnectRetry(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	outbound := &flakyOutbound{ServerOutbound: worker.Outbound}
+	worker.Outbound = outbound
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	client := &socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+		Retry: &socks6.RetryPolicy{
+			MaxRetries: 2,
+			Backoff:    10 * time.Millisecond,
+		},
+	}
+
+	// transient failure
+	outbound.err = syscall.ETIMEDOUT
+	atomic.StoreInt32(&outbound.fails, 2)
+	fd, err := client.DialContext(ctx, "tcp", echoAddr)
+	if assert.NoError(t, err) {
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+	atomic.StoreInt32(&outbound.fails, 3)
+	_, err = client.DialContext(ctx, "tcp", echoAddr)
+	assert.ErrorIs(t, err, syscall.ETIMEDOUT)
+	// bounded by context
+	atomic.StoreInt32(&outbound.fails, 3)
+	client.Retry.Backoff = time.Second
+	tctx, tcancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer tcancel()
+	start := time.Now()
+	_, err = client.DialContext(tctx, "tcp", echoAddr)
+	assert.ErrorIs(t, err, syscall.ETIMEDOUT)
+	assert.Less(t, time.Since(start), time.Second)
+	client.Retry.Backoff = 10 * time.Millisecond
+
+	// not transient
+	outbound.err = syscall.ECONNREFUSED
+	atomic.StoreInt32(&outbound.fails, 1)
+	_, err = client.DialContext(ctx, "tcp", echoAddr)
+	assert.ErrorIs(t, err, syscall.ECONNREFUSED)
+	assert.EqualValues(t, 0, atomic.LoadInt32(&outbound.fails))
+}
+
+func TestConnectInitialData(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        newServerWorker(),
+	}
+	server.Start(ctx)
+	for _, useSession := range []bool{false, true} {
+		client := &socks6.Client{
+			Server:     sAddr,
+			Encrypted:  false,
+			UseSession: useSession,
+		}
+		// 2nd dial use session
+		for i := 0; i < 2; i++ {
+			fd, err := client.DialWithInitialData(ctx, echoAddr, []byte("early"))
+			if !assert.NoError(t, err) {
+				return
+			}
+			buf := make([]byte, 10)
+			n, err := io.ReadFull(fd, buf[:5])
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("early"), buf[:n])
+			e2etool.AssertForward(t, fd, fd)
+			fd.Close()
+		}
+
+		_, err := client.DialWithInitialData(ctx, echoAddr, make([]byte, common.MaxInitialDataLength+1))
+		assert.ErrorIs(t, err, socks6.ErrInitialDataTooLong)
+	}
+}
+
+func TestConnectResolveLocally(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, echoPort := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	requested := []message.AddressType{}
+	worker.Rule = func(cc socks6.SocksConn) bool {
+		requested = append(requested, cc.Request.Endpoint.AddressType)
+		return true
+	}
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	for _, local := range []bool{false, true} {
+		client := &socks6.Client{
+			Server:         sAddr,
+			Encrypted:      false,
+			UseSession:     false,
+			ResolveLocally: local,
+		}
+		fd, err := client.DialContext(ctx, "tcp4", net.JoinHostPort("localhost", strconv.Itoa(int(echoPort))))
+		if !assert.NoError(t, err) {
+			return
+		}
+		e2etool.AssertForward(t, fd, fd)
+		pc := fd.(*socks6.ProxyTCPConn)
+		// bound address is reported either way
+		bound := message.ConvertAddr(pc.ProxyLocalAddr())
+		assert.Equal(t, message.AddressTypeIPv4, bound.AddressType)
+		assert.Equal(t, sAddr, pc.ProxyRemoteAddr().String())
+		fd.Close()
+	}
+	assert.Equal(t, []message.AddressType{message.AddressTypeDomainName, message.AddressTypeIPv4}, requested)
+}
+
+func TestConnectProfile(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	uechoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, uechoAddr, e2etool.UEcho)
+	// proxy only accept default profile
+	strictAddr, strictPort := e2etool.GetAddr()
+	strict := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: strictPort,
+		Worker:        newServerWorker(),
+	}
+	strict.Start(ctx)
+
+	client := socks6.Client{Server: strictAddr, Profile: message.ProfileDraft11}
+	_, err := client.DialContext(ctx, "tcp", echoAddr)
+	assert.Error(t, err)
+
+	// proxy accept draft 11 too
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.ParseConfig = &message.ParseConfig{Profiles: []*message.Profile{message.ProfileDraft11}}
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	for _, p := range []*message.Profile{nil, message.ProfileDraft11} {
+		client := socks6.Client{Server: sAddr, Profile: p}
+		fd, err := client.DialContext(ctx, "tcp", echoAddr)
+		if assert.NoError(t, err, p) {
+			e2etool.AssertForward(t, fd, fd)
+			fd.Close()
+		}
+
+		pc, err := client.ListenPacketContext(ctx, "udp", ":0")
+		if !assert.NoError(t, err, p) {
+			continue
+		}
+		eAddr := message.ParseAddr(uechoAddr)
+		pc.WriteTo([]byte{1}, eAddr)
+		buf := make([]byte, 10)
+		n, _, err := pc.ReadFrom(buf)
+		if assert.NoError(t, err, p) {
+			assert.Equal(t, []byte{1}, buf[:n])
+		}
+		pc.Close()
+	}
+}
+
+func TestConnectPadding(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.Padding = 64
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+
+	client := socks6.Client{Server: sAddr, Padding: 128}
+	fd, err := client.DialContext(ctx, "tcp", echoAddr)
+	if assert.NoError(t, err) {
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+
+	// check reply size on wire
+	conn := lo.Must1(net.Dial("tcp", sAddr))
+	defer conn.Close()
+	req := message.NewRequest()
+	req.CommandCode = message.CommandConnect
+	req.Endpoint = message.ParseAddr(echoAddr)
+	req.Pad(128)
+	assert.Len(t, req.Marshal(), 128)
+	e2etool.AssertWrite(t, conn, req.Marshal())
+
+	aurep, err := message.ParseAuthenticationReplyFrom(conn)
+	if assert.NoError(t, err) {
+		assert.Len(t, aurep.Marshal(), 64)
+		assert.Len(t, aurep.Options.GetKind(message.OptionKindPadding), 1)
+	}
+	oprep, err := message.ParseOperationReplyFrom(conn)
+	if assert.NoError(t, err) {
+		assert.Equal(t, message.OperationReplySuccess, oprep.ReplyCode)
+		assert.Len(t, oprep.Marshal(), 64)
+	}
+}
+
+func TestListenOption(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT is only supported on linux")
+	}
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	opt := socks6.ListenOption{
+		ReusePort:   true,
+		KeepAlive:   10 * time.Second,
+		DeferAccept: time.Second,
+	}
+	// both server listen on same port
+	for i := 0; i < 2; i++ {
+		server := socks6.Server{
+			Address:       "127.0.0.1",
+			CleartextPort: sPort,
+			ListenOption:  opt,
+			Worker:        newServerWorker(),
+		}
+		server.Start(ctx)
+	}
+	client := socks6.Client{Server: sAddr}
+	for i := 0; i < 4; i++ {
+		fd, err := client.DialContext(ctx, "tcp", echoAddr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+}
+
+func TestAcceptLimit(t *testing.T) {
+	e2etool.WatchDog10s()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+
+	// rate limit and ban
+	sAddr, sPort := e2etool.GetAddr()
+	sw := newServerWorker()
+	sw.AcceptLimit = socks6.AcceptLimit{ConnectionsPerSecond: 2, BanDuration: time.Minute}
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        sw,
+	}
+	server.Start(ctx)
+	client := socks6.Client{Server: sAddr}
+	for i := 0; i < 2; i++ {
+		fd, err := client.DialContext(ctx, "tcp", echoAddr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+	_, err := client.DialContext(ctx, "tcp", echoAddr)
+	assert.Error(t, err)
+	time.Sleep(time.Second)
+	// still banned after bucket refilled
+	_, err = client.DialContext(ctx, "tcp", echoAddr)
+	assert.Error(t, err)
+
+	// pending handshake cap
+	sAddr2, sPort2 := e2etool.GetAddr()
+	sw2 := newServerWorker()
+	sw2.AcceptLimit = socks6.AcceptLimit{MaxPendingHandshake: 1}
+	server2 := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort2,
+		Worker:        sw2,
+	}
+	server2.Start(ctx)
+	idle, err := net.Dial("tcp", sAddr2)
+	if !assert.NoError(t, err) {
+		return
+	}
+	time.Sleep(100 * time.Millisecond)
+	client2 := socks6.Client{Server: sAddr2}
+	_, err = client2.DialContext(ctx, "tcp", echoAddr)
+	assert.Error(t, err)
+	idle.Close()
+	time.Sleep(100 * time.Millisecond)
+	fd, err := client2.DialContext(ctx, "tcp", echoAddr)
+	if assert.NoError(t, err) {
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+}
+
+func TestConnectProxyProtocol(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, echoPort := e2etool.GetAddr()
+	headers := make(chan []byte, 1)
+	// read PROXY protocol v2 header of IPv4 connection, then echo
+	go e2etool.ServeTCP(ctx, echoAddr, func(c io.ReadWriteCloser) {
+		h := make([]byte, 28)
+		if _, err := io.ReadFull(c, h); err != nil {
+			c.Close()
+			return
+		}
+		headers <- h
+		e2etool.Echo(c)
+	})
+	sAddr, sPort := e2etool.GetAddr()
+	sw := newServerWorker()
+	ob := sw.Outbound.(socks6.InternetServerOutbound)
+	ob.ProxyProtocol = func(addr *message.SocksAddr) bool {
+		return addr.Port == echoPort
+	}
+	sw.Outbound = ob
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        sw,
+	}
+	server.Start(ctx)
+	client := socks6.Client{Server: sAddr}
+	fd, err := client.DialContext(ctx, "tcp", echoAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	e2etool.AssertForward(t, fd, fd)
+
+	h := <-headers
+	assert.Equal(t, []byte("\r\n\r\n\x00\r\nQUIT\n"), h[:12])
+	// PROXY, TCP over IPv4, 12 bytes of address
+	assert.Equal(t, []byte{0x21, 0x11, 0, 12}, h[12:16])
+	assert.Equal(t, []byte{127, 0, 0, 1}, h[16:20])
+	assert.Equal(t, []byte{127, 0, 0, 1}, h[20:24])
+	assert.Equal(t, echoPort, uint16(h[26])<<8|uint16(h[27]))
+}
+
+func TestServerStop(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        newServerWorker(),
+	}
+	server.Start(ctx)
+	client := socks6.Client{Server: sAddr}
+	fd, err := client.DialContext(ctx, "tcp", echoAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	e2etool.AssertForward(t, fd, fd)
+	fd.Close()
+	pc, err := client.ListenPacketContext(ctx, "udp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pc.Close()
+
+	assert.NoError(t, server.Stop())
+	select {
+	case <-server.Done():
+	default:
+		assert.Fail(t, "server not stopped")
+	}
+	// association is closed by worker shutdown
+	pc.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	_, _, err = pc.ReadFrom(make([]byte, 10))
+	assert.Error(t, err)
+	_, err = client.DialContext(ctx, "tcp", echoAddr)
+	assert.Error(t, err)
+}
+
+// brokenListener fail on Accept
+type brokenListener struct {
+	net.Listener
+}
+
+func (l brokenListener) Accept() (net.Conn, error) {
+	return nil, errors.New("listener broken")
+}
+
+type brokenTransport struct{}
+
+func (brokenTransport) WrapListener(l net.Listener) net.Listener {
+	return brokenListener{Listener: l}
+}
+
+func (brokenTransport) WrapConn(conn net.Conn) (net.Conn, error) {
+	return conn, nil
+}
+
+func TestServerFatalError(t *testing.T) {
+	e2etool.WatchDog()
+	_, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        newServerWorker(),
+		Transport:     brokenTransport{},
+	}
+	server.Start(context.Background())
+	<-server.Done()
+	assert.ErrorContains(t, server.Err(), "listener broken")
+	assert.ErrorContains(t, server.Stop(), "listener broken")
+}
+
+func TestServerStartError(t *testing.T) {
+	e2etool.WatchDog()
+	sAddr, sPort := e2etool.GetAddr()
+	// UDP listener is started after TCP listener
+	occupied, err := net.ListenPacket("udp", sAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer occupied.Close()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        newServerWorker(),
+	}
+	done := server.Done()
+	err = server.Start(context.Background())
+	assert.ErrorContains(t, err, "UDP server")
+	<-done
+	assert.Equal(t, err, server.Err())
+	assert.Equal(t, err, server.Stop())
+	// TCP listener is closed
+	l, err := net.Listen("tcp", sAddr)
+	if assert.NoError(t, err) {
+		l.Close()
+	}
+}
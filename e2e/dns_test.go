@@ -0,0 +1,75 @@
+package e2e_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+)
+
+func TestDNSForwarder(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// echo server act as resolver, response is same as query
+	resolverAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, resolverAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        newServerWorker(),
+	}
+	server.Start(ctx)
+	fwd := socks6.DNSForwarder{
+		Client: &socks6.Client{
+			Server:     sAddr,
+			Encrypted:  false,
+			UseSession: false,
+		},
+		Upstream: resolverAddr,
+	}
+	fwdAddr, _ := e2etool.GetAddr()
+	go fwd.ListenAndServe(ctx, fwdAddr)
+	time.Sleep(100 * time.Millisecond)
+
+	query := []byte{0x12, 0x34, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0, 1, 2, 3}
+
+	uc, err := net.Dial("udp", fwdAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer uc.Close()
+	uc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = uc.Write(query)
+	assert.NoError(t, err)
+	buf := make([]byte, 512)
+	n, err := uc.Read(buf)
+	if assert.NoError(t, err) {
+		// original id is restored
+		assert.Equal(t, query, buf[:n])
+	}
+
+	tc, err := net.Dial("tcp", fwdAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer tc.Close()
+	tc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	tq := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(tq, uint16(len(query)))
+	copy(tq[2:], query)
+	_, err = tc.Write(tq)
+	assert.NoError(t, err)
+	tr := make([]byte, len(tq))
+	_, err = io.ReadFull(tc, tr)
+	if assert.NoError(t, err) {
+		assert.Equal(t, tq, tr)
+	}
+}
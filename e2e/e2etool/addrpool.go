@@ -2,16 +2,21 @@ package e2etool
 
 import (
 	"fmt"
+	"sync/atomic"
 
 	"github.com/studentmain/socks6/common/rnd"
 )
 
+// below ephemeral port range of common OS, so it won't conflict with outgoing connections
 const (
-	startPort = 34535
-	portCount = 128
+	startPort = 24535
+	portCount = 1024
 )
 
+// next port offset, ports are allocated in order to avoid collision in one test run
+var nextPort = uint32(rnd.RandUint16() % portCount)
+
 func GetAddr() (string, uint16) {
-	port := rnd.RandUint16()%portCount + startPort
+	port := uint16(atomic.AddUint32(&nextPort, 1)%portCount) + startPort
 	return fmt.Sprintf("127.0.0.1:%d", port), port
 }
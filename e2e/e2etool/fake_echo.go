@@ -62,11 +62,14 @@ func (f FakeEchoClientAuthenticationMethod) Authenticate(
 	cac auth.ClientAuthenticationChannels,
 ) {
 	cac.Data <- []byte{}
-	rep1 := <-cac.FirstAuthReply
-	df, _ := rep1.Options.GetDataF(message.OptionKindAuthenticationData, func(o message.Option) bool {
-		return o.Data.(message.AuthenticationDataOptionData).Method == authIdFakeEcho
-	})
-	if _, err := conn.Write(df.(message.AuthenticationDataOptionData).Data); err != nil {
+	var rep1 *message.AuthenticationReply
+	select {
+	case rep1 = <-cac.FirstAuthReply:
+	case <-ctx.Done():
+		return
+	}
+	df, _ := message.GetAuthenticationData(rep1.Options, authIdFakeEcho)
+	if _, err := conn.Write(df); err != nil {
 		cac.FinalAuthReply <- nil
 		cac.Error <- err
 		return
@@ -1,11 +1,15 @@
 package e2etool
 
 import (
+	"sync/atomic"
 	"time"
 
 	"github.com/studentmain/socks6/common/lg"
 )
 
+// generation of latest watchdog, tests run one by one, so watchdog of previous test is stopped by next one
+var wdGen uint32
+
 func WatchDog() {
 	wd(1 * time.Second)
 }
@@ -15,10 +19,14 @@ func WatchDog10s() {
 }
 
 func wd(t time.Duration) {
+	gen := atomic.AddUint32(&wdGen, 1)
 	go func() {
 		before := time.Now()
 		<-time.After(t)
 		after := time.Now()
+		if atomic.LoadUint32(&wdGen) != gen {
+			return
+		}
 		if after.Sub(before) < t*11/10 {
 			panic("test timeout")
 		}
@@ -0,0 +1,84 @@
+package e2e_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS answer 127.0.0.1 for every A query
+func fakeDNS(p net.PacketConn, d []byte, a net.Addr) {
+	msg := dnsmessage.Message{}
+	if err := msg.Unpack(d); err != nil || len(msg.Questions) != 1 {
+		return
+	}
+	msg.Header.Response = true
+	q := msg.Questions[0]
+	if q.Type == dnsmessage.TypeA {
+		msg.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+			Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+		}}
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		return
+	}
+	p.WriteTo(b, a)
+}
+
+func TestHTTPTransport(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	httpAddr, _ := e2etool.GetAddr()
+	l, err := net.Listen("tcp", httpAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	hs := http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello "+r.Host)
+	})}
+	go hs.Serve(l)
+	defer hs.Close()
+	dnsAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, dnsAddr, fakeDNS)
+
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        newServerWorker(),
+	}
+	server.Start(ctx)
+	client := &socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+	}
+
+	get := func(hc *http.Client, url string) string {
+		resp, err := hc.Get(url)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return string(b)
+	}
+	hc := &http.Client{Transport: client.HTTPTransport("")}
+	assert.Equal(t, "hello "+httpAddr, get(hc, "http://"+httpAddr+"/"))
+
+	// name is resolved by DNS server through proxy
+	_, port, _ := net.SplitHostPort(httpAddr)
+	hc = &http.Client{Transport: client.HTTPTransport(dnsAddr)}
+	assert.Equal(t, "hello example.test:"+port, get(hc, "http://example.test:"+port+"/"))
+}
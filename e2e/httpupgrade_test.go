@@ -0,0 +1,59 @@
+package e2e_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/message"
+)
+
+func TestHTTPUpgrade(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:  "127.0.0.1",
+		HTTPPort: sPort,
+		Worker:   newServerWorker(),
+	}
+	server.Start(ctx)
+
+	for _, u := range []string{"ws://" + sAddr + "/socks6", "http://" + sAddr + "/"} {
+		client := socks6.Client{
+			HTTPUpgradeURL: u,
+		}
+		fd, err := client.DialContext(ctx, "tcp", echoAddr)
+		if !assert.NoError(t, err, u) {
+			continue
+		}
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+
+		eAddr := message.ParseAddr(echoAddr)
+		ufd, err := client.ListenPacketContext(ctx, "udp", ":0")
+		if !assert.NoError(t, err, u) {
+			continue
+		}
+		ufd.WriteTo([]byte{1}, eAddr)
+		buf := make([]byte, 10)
+		n, _, err := ufd.ReadFrom(buf)
+		if assert.NoError(t, err, u) {
+			assert.Equal(t, []byte{1}, buf[:n])
+		}
+		ufd.Close()
+	}
+
+	// not a SOCKS 6 over HTTP server
+	client := socks6.Client{
+		HTTPUpgradeURL: "http://" + echoAddr + "/",
+	}
+	_, err := client.DialContext(ctx, "tcp", echoAddr)
+	assert.Error(t, err)
+}
@@ -0,0 +1,66 @@
+package e2e_test
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/auth"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"golang.org/x/net/proxy"
+)
+
+func TestProxyURL(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        newServerWorker(),
+	}
+	sa := auth.NewServerAuthenticator()
+	sa.AddMethod(auth.PasswordServerAuthenticationMethod{
+		Passwords: map[string]string{"alice": "123456"},
+	})
+	server.Worker.Authenticator = sa
+	server.Start(ctx)
+
+	socks6.RegisterDialerType()
+	d, err := proxy.FromURL(&url.URL{Scheme: "socks6", User: url.UserPassword("alice", "123456"), Host: sAddr}, proxy.Direct)
+	if !assert.NoError(t, err) {
+		return
+	}
+	client, ok := d.(*socks6.Client)
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Equal(t, sAddr, client.Server)
+	assert.False(t, client.Encrypted)
+	fd, err := d.(proxy.ContextDialer).DialContext(ctx, "tcp", echoAddr)
+	if assert.NoError(t, err) {
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+
+	d, err = proxy.FromURL(&url.URL{Scheme: "socks6", User: url.UserPassword("alice", "wrong"), Host: sAddr}, proxy.Direct)
+	if assert.NoError(t, err) {
+		_, err = d.Dial("tcp", echoAddr)
+		assert.Error(t, err)
+	}
+
+	u, _ := url.Parse("socks6s://proxy.example")
+	client, err = socks6.ClientFromURL(u)
+	if assert.NoError(t, err) {
+		assert.True(t, client.Encrypted)
+		assert.Equal(t, "proxy.example:8389", client.Server)
+	}
+	u, _ = url.Parse("socks5://proxy.example")
+	_, err = socks6.ClientFromURL(u)
+	assert.Error(t, err)
+}
@@ -0,0 +1,140 @@
+package e2e_test
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/message"
+)
+
+func TestQUIC(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	ca := e2etool.NewCA()
+	server := socks6.Server{
+		Address:  "127.0.0.1",
+		QUICPort: sPort,
+		Worker:   newServerWorker(),
+		TlsConfig: &tls.Config{
+			Certificates: []tls.Certificate{ca.Issue("proxy")},
+		},
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:    sAddr,
+		QUIC:      true,
+		TlsConfig: &tls.Config{RootCAs: ca.Pool},
+	}
+
+	fds := []interface{ Close() error }{}
+	defer func() {
+		for _, fd := range fds {
+			fd.Close()
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		fd, err := client.DialContext(ctx, "tcp", echoAddr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		fds = append(fds, fd)
+		e2etool.AssertForward(t, fd, fd)
+	}
+
+	eAddr := message.ParseAddr(echoAddr)
+	ufd, err := client.ListenPacketContext(ctx, "udp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	fds = append(fds, ufd)
+	ufd.WriteTo([]byte{1}, eAddr)
+	buf := make([]byte, 10)
+	n, a2, err := ufd.ReadFrom(buf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte{1}, buf[:n])
+		assert.Equal(t, eAddr.String(), a2.String())
+	}
+}
+
+func TestQUICCertificateSource(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	ca := e2etool.NewCA()
+	cert := ca.Issue("proxy")
+	server := socks6.Server{
+		Address:  "127.0.0.1",
+		QUICPort: sPort,
+		Worker:   newServerWorker(),
+		// no TlsConfig, ALPN is filled by server
+		CertificateSource: certificateFunc(func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &cert, nil
+		}),
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:    sAddr,
+		QUIC:      true,
+		TlsConfig: &tls.Config{RootCAs: ca.Pool},
+	}
+	fd, err := client.DialContext(ctx, "tcp", echoAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	e2etool.AssertForward(t, fd, fd)
+}
+
+type certificateFunc func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+func (f certificateFunc) GetCertificate(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return f(chi)
+}
+
+func TestQUICZeroRTT(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	ca := e2etool.NewCA()
+	server := socks6.Server{
+		Address:  "127.0.0.1",
+		QUICPort: sPort,
+		Worker:   newServerWorker(),
+		TlsConfig: &tls.Config{
+			Certificates: []tls.Certificate{ca.Issue("proxy")},
+		},
+	}
+	server.Start(ctx)
+	// clients share session cache, 2nd client send request in 0-RTT data
+	// without token, proxy process it after handshake
+	cache := tls.NewLRUClientSessionCache(0)
+	for i := 0; i < 2; i++ {
+		client := socks6.Client{
+			Server:    sAddr,
+			QUIC:      true,
+			ZeroRTT:   true,
+			TlsConfig: &tls.Config{RootCAs: ca.Pool, ClientSessionCache: cache},
+		}
+		fd, err := client.DialContext(ctx, "tcp", echoAddr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+}
@@ -0,0 +1,110 @@
+package e2e_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/message"
+)
+
+// errorOutbound fail Dial with err
+type errorOutbound struct {
+	socks6.ServerOutbound
+	err error
+}
+
+func (o *errorOutbound) Dial(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.Conn, message.StackOptionInfo, error) {
+	return nil, nil, o.err
+}
+
+type replyCodeCase struct {
+	name string
+	err  error
+	code message.ReplyCode
+}
+
+// assertReplyCode check reply code of CONNECT when outbound fail with each case's error
+func assertReplyCode(t *testing.T, mapper func(err error) (message.ReplyCode, bool), cases []replyCodeCase) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	outbound := &errorOutbound{ServerOutbound: worker.Outbound}
+	worker.Outbound = outbound
+	worker.ReplyCodeMapper = mapper
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+	}
+	for _, c := range cases {
+		// requests are sequential
+		outbound.err = c.err
+		_, err := client.DialContext(ctx, "tcp", "127.0.0.1:1")
+		re := &socks6.ReplyError{}
+		if assert.ErrorAs(t, err, &re, c.name) {
+			assert.Equal(t, c.code, re.Code, c.name)
+		}
+	}
+}
+
+func TestReplyCode(t *testing.T) {
+	e2etool.WatchDog()
+	connErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	assertReplyCode(t, nil, []replyCodeCase{
+		{"rule", socks6.ErrNotAllowedByRule, message.OperationReplyNotAllowedByRule},
+		{"address type", message.ErrAddressTypeNotSupport, message.OperationReplyAddressNotSupported},
+		{"dns not found", &net.DNSError{Err: "no such host", Name: "a.invalid", IsNotFound: true}, message.OperationReplyHostUnreachable},
+		{"dns timeout", &net.DNSError{Err: "i/o timeout", Name: "a.invalid", IsTimeout: true}, message.OperationReplyTimeout},
+		{"ENETUNREACH", connErr(syscall.ENETUNREACH), message.OperationReplyNetworkUnreachable},
+		{"ENETDOWN", connErr(syscall.ENETDOWN), message.OperationReplyNetworkUnreachable},
+		{"EHOSTUNREACH", connErr(syscall.EHOSTUNREACH), message.OperationReplyHostUnreachable},
+		{"EHOSTDOWN", connErr(syscall.EHOSTDOWN), message.OperationReplyHostUnreachable},
+		{"ECONNREFUSED", connErr(syscall.ECONNREFUSED), message.OperationReplyConnectionRefused},
+		{"ETIMEDOUT", connErr(syscall.ETIMEDOUT), message.OperationReplyTimeout},
+		{"EACCES", connErr(syscall.EACCES), message.OperationReplyNotAllowedByRule},
+		{"EPERM", connErr(syscall.EPERM), message.OperationReplyNotAllowedByRule},
+		{"EAFNOSUPPORT", connErr(syscall.EAFNOSUPPORT), message.OperationReplyAddressNotSupported},
+		{"EADDRNOTAVAIL", connErr(syscall.EADDRNOTAVAIL), message.OperationReplyAddressNotSupported},
+		{"other errno", connErr(syscall.EINVAL), message.OperationReplyServerFailure},
+		{"net timeout", &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, message.OperationReplyTimeout},
+		{"other error", errors.New("other"), message.OperationReplyServerFailure},
+	})
+}
+
+func TestReplyCodeMapper(t *testing.T) {
+	e2etool.WatchDog()
+	errLoop := errors.New("routing loop")
+	mapper := func(err error) (message.ReplyCode, bool) {
+		if errors.Is(err, errLoop) {
+			return message.OperationReplyTTLExpired, true
+		}
+		// ECONNREFUSED is overridden
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return message.OperationReplyHostUnreachable, true
+		}
+		return 0, false
+	}
+	assertReplyCode(t, mapper, []replyCodeCase{
+		{"mapped", errLoop, message.OperationReplyTTLExpired},
+		{"overridden", syscall.ECONNREFUSED, message.OperationReplyHostUnreachable},
+		// fallback to default mapping
+		{"not mapped", syscall.ETIMEDOUT, message.OperationReplyTimeout},
+		{"not mapped rule", socks6.ErrNotAllowedByRule, message.OperationReplyNotAllowedByRule},
+	})
+}
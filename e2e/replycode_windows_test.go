@@ -0,0 +1,25 @@
+package e2e_test
+
+import (
+	"testing"
+
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/message"
+	"golang.org/x/sys/windows"
+)
+
+func TestReplyCodeWSA(t *testing.T) {
+	e2etool.WatchDog()
+	// winsock return WSAExxx instead of POSIX errno
+	assertReplyCode(t, nil, []replyCodeCase{
+		{"WSAENETUNREACH", windows.WSAENETUNREACH, message.OperationReplyNetworkUnreachable},
+		{"WSAENETDOWN", windows.WSAENETDOWN, message.OperationReplyNetworkUnreachable},
+		{"WSAEHOSTUNREACH", windows.WSAEHOSTUNREACH, message.OperationReplyHostUnreachable},
+		{"WSAEHOSTDOWN", windows.WSAEHOSTDOWN, message.OperationReplyHostUnreachable},
+		{"WSAECONNREFUSED", windows.WSAECONNREFUSED, message.OperationReplyConnectionRefused},
+		{"WSAETIMEDOUT", windows.WSAETIMEDOUT, message.OperationReplyTimeout},
+		{"WSAEACCES", windows.WSAEACCES, message.OperationReplyNotAllowedByRule},
+		{"WSAEAFNOSUPPORT", windows.WSAEAFNOSUPPORT, message.OperationReplyAddressNotSupported},
+		{"WSAEADDRNOTAVAIL", windows.WSAEADDRNOTAVAIL, message.OperationReplyAddressNotSupported},
+	})
+}
@@ -3,6 +3,7 @@ package e2e_test
 import (
 	"log"
 
+	"github.com/studentmain/socks6"
 	"github.com/studentmain/socks6/common/lg"
 )
 
@@ -11,3 +12,10 @@ func init() {
 	lg.MinimalLevel = lg.LvDebug
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds | log.Lshortfile)
 }
+
+// newServerWorker create a server worker which can reach test services on loopback
+func newServerWorker() *socks6.ServerWorker {
+	w := socks6.NewServerWorker()
+	w.DestinationGuard.AllowLoopback = true
+	return w
+}
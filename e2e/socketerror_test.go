@@ -0,0 +1,92 @@
+package e2e_test
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6/internal/socket"
+	"github.com/studentmain/socks6/message"
+)
+
+func TestSocketErrorUDPError(t *testing.T) {
+	dst4 := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53}
+	dst6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}
+	router4 := net.IPv4(198, 51, 100, 1)
+	router6 := net.ParseIP("2001:db8::ff")
+	cases := []struct {
+		name string
+		se   socket.SocketError
+		code message.UDPErrorType
+		ok   bool
+	}{
+		{"v4 net unreachable", socket.SocketError{Version: 4, Type: 3, Code: 0}, message.UDPErrorNetworkUnreachable, true},
+		{"v4 host unreachable", socket.SocketError{Version: 4, Type: 3, Code: 1}, message.UDPErrorHostUnreachable, true},
+		{"v4 fragmentation needed", socket.SocketError{Version: 4, Type: 3, Code: 4, MTU: 1400}, message.UDPErrorDatagramTooBig, true},
+		{"v4 ttl exceeded", socket.SocketError{Version: 4, Type: 11, Code: 0}, message.UDPErrorTTLExpired, true},
+		{"v4 port unreachable", socket.SocketError{Version: 4, Type: 3, Code: 3}, 0, false},
+		{"v4 reassembly time exceeded", socket.SocketError{Version: 4, Type: 11, Code: 1}, 0, false},
+		{"v6 no route", socket.SocketError{Version: 6, Type: 1, Code: 0}, message.UDPErrorNetworkUnreachable, true},
+		{"v6 address unreachable", socket.SocketError{Version: 6, Type: 1, Code: 3}, message.UDPErrorHostUnreachable, true},
+		{"v6 packet too big", socket.SocketError{Version: 6, Type: 2, Code: 0, MTU: 1280}, message.UDPErrorDatagramTooBig, true},
+		{"v6 hop limit exceeded", socket.SocketError{Version: 6, Type: 3, Code: 0}, message.UDPErrorTTLExpired, true},
+		{"v6 port unreachable", socket.SocketError{Version: 6, Type: 1, Code: 4}, 0, false},
+		{"unknown version", socket.SocketError{Type: 3, Code: 0}, 0, false},
+	}
+	for _, c := range cases {
+		dst := dst4
+		if c.se.Version == 6 {
+			dst = dst6
+		}
+		// reported by destination
+		se := c.se
+		se.Destination = dst
+		code, reporter, ok := se.UDPError()
+		assert.Equal(t, c.ok, ok, c.name)
+		if !c.ok {
+			continue
+		}
+		assert.Equal(t, c.code, code, c.name)
+		assert.Equal(t, dst.IP.String(), net.IP(reporter.Address).String(), c.name)
+
+		// reported by router
+		router := router4
+		if c.se.Version == 6 {
+			router = router6
+		}
+		se.Offender = router
+		_, reporter, _ = se.UDPError()
+		assert.Equal(t, router.String(), net.IP(reporter.Address).String(), c.name)
+	}
+}
+
+func TestSocketErrno(t *testing.T) {
+	wrap := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", errno)}
+	}
+	cases := []struct {
+		err        error
+		permission bool
+		icmp       bool
+		tooLong    bool
+	}{
+		{wrap(syscall.EACCES), true, false, false},
+		{wrap(syscall.EPERM), true, false, false},
+		{wrap(syscall.ECONNREFUSED), false, true, false},
+		{wrap(syscall.EHOSTUNREACH), false, true, false},
+		{wrap(syscall.ENETUNREACH), false, true, false},
+		{wrap(syscall.EMSGSIZE), false, true, true},
+		{syscall.EMSGSIZE, false, true, true},
+		{wrap(syscall.EINVAL), false, false, false},
+		{errors.New("other"), false, false, false},
+		{nil, false, false, false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.permission, socket.IsPermissionError(c.err), c.err)
+		assert.Equal(t, c.icmp, socket.IsICMPErrno(c.err), c.err)
+		assert.Equal(t, c.tooLong, socket.IsMessageTooLong(c.err), c.err)
+	}
+}
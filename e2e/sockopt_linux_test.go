@@ -0,0 +1,169 @@
+package e2e_test
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/internal/socket"
+	"github.com/studentmain/socks6/message"
+	"golang.org/x/sys/unix"
+)
+
+// getsockopt read an integer socket option of c from kernel
+func getsockopt(t *testing.T, c syscall.Conn, level, opt int) int {
+	rc, err := c.SyscallConn()
+	if !assert.NoError(t, err) {
+		return -1
+	}
+	v := -1
+	rc.Control(func(fd uintptr) {
+		v, err = unix.GetsockoptInt(int(fd), level, opt)
+	})
+	assert.NoError(t, err)
+	return v
+}
+
+func TestDialStackOptions(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	conn, applied, err := socket.DialWithOption(ctx, *message.ParseAddr(l.Addr().String()), message.StackOptionInfo{
+		message.StackOptionIPTTL: byte(42),
+		message.StackOptionIPTOS: byte(0x20),
+		// DF is UDP only
+		message.StackOptionIPNoFragment: true,
+	}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.Equal(t, message.StackOptionInfo{
+		message.StackOptionIPTTL: byte(42),
+		message.StackOptionIPTOS: byte(0x20),
+	}, applied)
+	sc := conn.(syscall.Conn)
+	assert.Equal(t, 42, getsockopt(t, sc, unix.IPPROTO_IP, unix.IP_TTL))
+	assert.Equal(t, 0x20, getsockopt(t, sc, unix.IPPROTO_IP, unix.IP_TOS))
+}
+
+func TestPacketConnStackOptions(t *testing.T) {
+	e2etool.WatchDog()
+	for _, df := range []bool{true, false} {
+		pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if !assert.NoError(t, err) {
+			return
+		}
+		applied := socket.SetPacketConnOpt(pc, message.StackOptionInfo{
+			message.StackOptionIPTTL:        byte(7),
+			message.StackOptionIPNoFragment: df,
+		})
+		assert.Equal(t, message.StackOptionInfo{
+			message.StackOptionIPTTL:        byte(7),
+			message.StackOptionIPNoFragment: df,
+		}, applied)
+		sc := pc.(syscall.Conn)
+		assert.Equal(t, 7, getsockopt(t, sc, unix.IPPROTO_IP, unix.IP_TTL))
+		assert.Equal(t, 7, getsockopt(t, sc, unix.IPPROTO_IP, unix.IP_MULTICAST_TTL))
+		mode := unix.IP_PMTUDISC_DONT
+		if df {
+			mode = unix.IP_PMTUDISC_DO
+		}
+		assert.Equal(t, mode, getsockopt(t, sc, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER))
+		pc.Close()
+	}
+}
+
+func TestListenerStackOptions(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, applied, err := socket.ListenerWithOption(ctx, *message.ParseAddr("127.0.0.1:0"), message.StackOptionInfo{
+		message.StackOptionTCPTFO: uint16(100),
+	}, socket.ListenOption{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	sc := l.(syscall.Conn)
+	if getsockopt(t, sc, unix.IPPROTO_TCP, unix.TCP_FASTOPEN) <= 0 {
+		// server side TFO is disabled by net.ipv4.tcp_fastopen
+		assert.NotContains(t, applied, message.StackOptionTCPTFO)
+		return
+	}
+	assert.EqualValues(t, 100, applied[message.StackOptionTCPTFO])
+
+	// TFO is only applied on listener
+	conn, applied, err := socket.DialWithOption(ctx, *message.ParseAddr(l.Addr().String()), message.StackOptionInfo{
+		message.StackOptionTCPTFO: uint16(100),
+	}, nil)
+	if assert.NoError(t, err) {
+		assert.NotContains(t, applied, message.StackOptionTCPTFO)
+		conn.Close()
+	}
+}
+
+func TestDialWithInitialData(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	addr := *message.ParseAddr(l.Addr().String())
+	tfo := message.StackOptionInfo{message.StackOptionTCPTFO: uint16(100)}
+
+	cases := []struct {
+		name       string
+		opt        message.StackOptionInfo
+		data       []byte
+		tfoConnect int
+	}{
+		// connect is deferred to first write, data is sent with SYN when cookie is available
+		{"tfo", tfo, []byte("hello"), 1},
+		// fallback to normal connect then write
+		{"no tfo", message.StackOptionInfo{}, []byte("hello"), 0},
+		{"no data", tfo, nil, 0},
+	}
+	for _, c := range cases {
+		conn, applied, err := socket.DialWithInitialData(ctx, addr, c.opt, c.data, nil)
+		if !assert.NoError(t, err, c.name) {
+			continue
+		}
+		assert.Equal(t, c.tfoConnect, getsockopt(t, conn.(syscall.Conn), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT), c.name)
+		if c.tfoConnect != 0 {
+			assert.EqualValues(t, len(c.data), applied[message.StackOptionTCPTFO], c.name)
+		} else {
+			assert.NotContains(t, applied, message.StackOptionTCPTFO, c.name)
+		}
+		sconn, err := l.Accept()
+		if assert.NoError(t, err, c.name) {
+			if len(c.data) > 0 {
+				e2etool.AssertRead(t, sconn, c.data)
+			}
+			sconn.Close()
+		}
+		conn.Close()
+	}
+
+	// deferred connect fail at write
+	l2, err := net.Listen("tcp4", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	closed := *message.ParseAddr(l2.Addr().String())
+	l2.Close()
+	_, _, err = socket.DialWithInitialData(ctx, closed, tfo, []byte("hello"), nil)
+	assert.ErrorIs(t, err, syscall.ECONNREFUSED)
+}
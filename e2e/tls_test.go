@@ -0,0 +1,340 @@
+package e2e_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/common"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/message"
+)
+
+func TestConnectMutualTLS(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	ca := e2etool.NewCA()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		EncryptedPort: sPort,
+		Worker:        newServerWorker(),
+		TlsConfig: &tls.Config{
+			Certificates: []tls.Certificate{ca.Issue("proxy")},
+			ClientCAs:    ca.Pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		},
+	}
+	server.Start(ctx)
+
+	client := socks6.Client{
+		Server:    sAddr,
+		Encrypted: true,
+		TlsConfig: &tls.Config{
+			RootCAs:      ca.Pool,
+			Certificates: []tls.Certificate{ca.Issue("client")},
+		},
+	}
+	fd, err := client.DialContext(ctx, "tcp", echoAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	e2etool.AssertForward(t, fd, fd)
+	fd.Close()
+
+	// without client certificate
+	noCert := socks6.Client{
+		Server:    sAddr,
+		Encrypted: true,
+		TlsConfig: &tls.Config{RootCAs: ca.Pool},
+	}
+	_, err = noCert.DialContext(ctx, "tcp", echoAddr)
+	assert.Error(t, err)
+
+	// unknown CA
+	noCA := socks6.Client{
+		Server:    sAddr,
+		Encrypted: true,
+	}
+	_, err = noCA.DialContext(ctx, "tcp", echoAddr)
+	assert.Error(t, err)
+}
+
+func TestUDPDatagramTLS(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	ca := e2etool.NewCA()
+	psk := func(hint []byte) ([]byte, error) {
+		return []byte("pre-shared key"), nil
+	}
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		EncryptedPort: sPort,
+		Worker:        newServerWorker(),
+		TlsConfig: &tls.Config{
+			Certificates: []tls.Certificate{ca.Issue("proxy")},
+		},
+		DatagramTLSConfig: &dtls.Config{
+			PSK:             psk,
+			PSKIdentityHint: []byte("proxy"),
+			CipherSuites:    []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_GCM_SHA256},
+		},
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:    sAddr,
+		Encrypted: true,
+		TlsConfig: &tls.Config{RootCAs: ca.Pool},
+		DatagramTLSConfig: &dtls.Config{
+			PSK:             psk,
+			PSKIdentityHint: []byte("client"),
+			CipherSuites:    []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_GCM_SHA256},
+		},
+	}
+	eAddr := message.ParseAddr(echoAddr)
+	fd, err := client.ListenPacketContext(ctx, "udp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	fd.WriteTo([]byte{1}, eAddr)
+	buf := make([]byte, 10)
+	n, _, err := fd.ReadFrom(buf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte{1}, buf[:n])
+	}
+}
+
+func TestTLSCertificateReload(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ca1 := e2etool.NewCA()
+	e2etool.WritePEM(ca1.Issue("proxy"), certFile, keyFile)
+	cs, err := socks6.NewFileCertificateSource(certFile, keyFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cs.CheckInterval = 0
+
+	server := socks6.Server{
+		Address:           "127.0.0.1",
+		EncryptedPort:     sPort,
+		Worker:            newServerWorker(),
+		CertificateSource: cs,
+	}
+	server.Start(ctx)
+
+	dial := func(ca *e2etool.CA) error {
+		client := socks6.Client{
+			Server:    sAddr,
+			Encrypted: true,
+			TlsConfig: &tls.Config{RootCAs: ca.Pool},
+		}
+		fd, err := client.DialContext(ctx, "tcp", echoAddr)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		e2etool.AssertForward(t, fd, fd)
+		return nil
+	}
+	assert.NoError(t, dial(ca1))
+
+	// renew certificate with another CA
+	ca2 := e2etool.NewCA()
+	e2etool.WritePEM(ca2.Issue("proxy"), certFile, keyFile)
+	future := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(certFile, future, future))
+	assert.NoError(t, os.Chtimes(keyFile, future, future))
+
+	assert.NoError(t, dial(ca2))
+	assert.Error(t, dial(ca1))
+
+	// broken files don't stop server
+	assert.NoError(t, os.WriteFile(certFile, []byte("broken"), 0600))
+	future = future.Add(time.Minute)
+	assert.NoError(t, os.Chtimes(certFile, future, future))
+	assert.NoError(t, dial(ca2))
+}
+
+func TestUDPDatagramTLSCertificate(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	ca := e2etool.NewCA()
+	// DTLS config is converted from TLS config
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		EncryptedPort: sPort,
+		Worker:        newServerWorker(),
+		TlsConfig: &tls.Config{
+			Certificates: []tls.Certificate{ca.Issue("proxy")},
+		},
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:    sAddr,
+		Encrypted: true,
+		TlsConfig: &tls.Config{RootCAs: ca.Pool},
+	}
+	eAddr := message.ParseAddr(echoAddr)
+	fd, err := client.ListenPacketContext(ctx, "udp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	fd.WriteTo([]byte{1}, eAddr)
+	buf := make([]byte, 10)
+	n, _, err := fd.ReadFrom(buf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte{1}, buf[:n])
+	}
+
+	// unknown CA
+	noCA := socks6.Client{
+		Server:    sAddr,
+		Encrypted: true,
+	}
+	_, err = noCA.ListenPacketContext(ctx, "udp", ":0")
+	assert.Error(t, err)
+}
+
+func TestTLSFallbackHandler(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	ca := e2etool.NewCA()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		EncryptedPort: sPort,
+		Worker:        newServerWorker(),
+		TlsConfig: &tls.Config{
+			Certificates: []tls.Certificate{ca.Issue("proxy")},
+		},
+		// a tiny web server
+		FallbackHandler: func(ctx context.Context, conn net.Conn) {
+			defer conn.Close()
+			req, err := http.ReadRequest(bufio.NewReader(conn))
+			if err != nil {
+				return
+			}
+			rep := &http.Response{
+				StatusCode:    http.StatusOK,
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				Body:          io.NopCloser(strings.NewReader("hello")),
+				ContentLength: 5,
+				Request:       req,
+			}
+			rep.Write(conn)
+		},
+	}
+	server.Start(ctx)
+
+	// without ALPN and with SOCKS 6 ALPN
+	for _, protos := range [][]string{nil, {common.TLSProtocol}} {
+		client := socks6.Client{
+			Server:    sAddr,
+			Encrypted: true,
+			TlsConfig: &tls.Config{RootCAs: ca.Pool, NextProtos: protos},
+		}
+		fd, err := client.DialContext(ctx, "tcp", echoAddr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+
+	hc := http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: ca.Pool, NextProtos: []string{"http/1.1"}},
+	}}
+	rep, err := hc.Get("https://" + sAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer rep.Body.Close()
+	assert.Equal(t, http.StatusOK, rep.StatusCode)
+	body, err := io.ReadAll(rep.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestTLSZeroRTT(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	ca := e2etool.NewCA()
+	resumed := int32(0)
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		EncryptedPort: sPort,
+		Worker:        newServerWorker(),
+		TlsConfig: &tls.Config{
+			Certificates: []tls.Certificate{ca.Issue("proxy")},
+			VerifyConnection: func(cs tls.ConnectionState) error {
+				if cs.DidResume {
+					atomic.AddInt32(&resumed, 1)
+				}
+				return nil
+			},
+		},
+	}
+	server.Start(ctx)
+
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  true,
+		TlsConfig:  &tls.Config{RootCAs: ca.Pool},
+		ZeroRTT:    true,
+		UseSession: true,
+		UseToken:   16,
+	}
+	for i := 0; i < 3; i++ {
+		fd, err := client.DialContext(ctx, "tcp", echoAddr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		// session ticket is received with relayed data
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+	// every connection except the first one resumed TLS session
+	assert.Equal(t, int32(2), atomic.LoadInt32(&resumed))
+}
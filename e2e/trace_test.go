@@ -0,0 +1,135 @@
+package e2e_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/message"
+)
+
+func TestClientTrace(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        newServerWorker(),
+	}
+	server.Start(ctx)
+
+	mtx := sync.Mutex{}
+	requests := []socks6.RequestInfo{}
+	conns := []socks6.ConnInfo{}
+	client := &socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+		Trace: &socks6.ClientTrace{
+			RequestDone: func(info socks6.RequestInfo) {
+				mtx.Lock()
+				defer mtx.Unlock()
+				requests = append(requests, info)
+			},
+			ConnClosed: func(info socks6.ConnInfo) {
+				mtx.Lock()
+				defer mtx.Unlock()
+				conns = append(conns, info)
+			},
+		},
+	}
+	fd, err := client.DialContext(ctx, "tcp", echoAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fd.Write([]byte("trace"))
+	buf := make([]byte, 10)
+	n, err := fd.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+	fd.Close()
+	fd.Close()
+
+	// connection refused by destination
+	_, err = client.DialContext(ctx, "tcp", "127.0.0.1:1")
+	assert.Error(t, err)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if assert.Len(t, requests, 2) {
+		assert.Equal(t, message.CommandConnect, requests[0].Command)
+		assert.Equal(t, echoAddr, requests[0].Addr.String())
+		assert.True(t, requests[0].Replied)
+		assert.Equal(t, message.OperationReplySuccess, requests[0].ReplyCode)
+		assert.NoError(t, requests[0].Err)
+		assert.Greater(t, requests[0].Duration, time.Duration(0))
+
+		assert.True(t, requests[1].Replied)
+		assert.NotEqual(t, message.OperationReplySuccess, requests[1].ReplyCode)
+		assert.Error(t, requests[1].Err)
+	}
+	// called once
+	if assert.Len(t, conns, 1) {
+		assert.Equal(t, message.CommandConnect, conns[0].Command)
+		assert.EqualValues(t, 5, conns[0].BytesSent)
+		assert.EqualValues(t, 5, conns[0].BytesReceived)
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        newServerWorker(),
+	}
+	server.Start(ctx)
+	client := &socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+	}
+	buf := make([]byte, 10)
+
+	fd, err := client.DialContext(ctx, "tcp", echoAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	fd.Write([]byte("stats"))
+	_, err = fd.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, socks6.ConnStats{BytesSent: 5, BytesReceived: 5}, fd.(*socks6.ProxyTCPConn).Stats())
+
+	ufd, err := client.DialContext(ctx, "udp", echoAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ufd.Close()
+	for i := 0; i < 2; i++ {
+		ufd.Write([]byte("udp"))
+		ufd.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = ufd.Read(buf)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, socks6.ConnStats{
+		BytesSent:         6,
+		BytesReceived:     6,
+		DatagramsSent:     2,
+		DatagramsReceived: 2,
+	}, ufd.(*socks6.ProxyUDPConn).Stats())
+}
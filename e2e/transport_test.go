@@ -0,0 +1,82 @@
+package e2e_test
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+)
+
+// xorConn is a toy obfuscation layer
+type xorConn struct {
+	net.Conn
+}
+
+func (c xorConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	for i := range b[:n] {
+		b[i] ^= 0x5a
+	}
+	return n, err
+}
+
+func (c xorConn) Write(b []byte) (int, error) {
+	x := make([]byte, len(b))
+	for i := range b {
+		x[i] = b[i] ^ 0x5a
+	}
+	return c.Conn.Write(x)
+}
+
+func xorTransport() socks6.Transport {
+	wrap := func(conn net.Conn) (net.Conn, error) {
+		return xorConn{Conn: conn}, nil
+	}
+	return socks6.ConnTransport{Server: wrap, Client: wrap}
+}
+
+func TestTransport(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	tAddr, tPort := e2etool.GetAddr()
+	ca := e2etool.NewCA()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		EncryptedPort: tPort,
+		Worker:        newServerWorker(),
+		TlsConfig: &tls.Config{
+			Certificates: []tls.Certificate{ca.Issue("proxy")},
+		},
+		Transport: xorTransport(),
+	}
+	server.Start(ctx)
+
+	for _, client := range []*socks6.Client{
+		{Server: sAddr, Transport: xorTransport()},
+		{Server: tAddr, Transport: xorTransport(), Encrypted: true, TlsConfig: &tls.Config{RootCAs: ca.Pool}},
+	} {
+		fd, err := client.DialContext(ctx, "tcp", echoAddr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+
+	// proxy doesn't understand client without transport
+	client := socks6.Client{Server: sAddr}
+	ctx2, cancel2 := context.WithTimeout(ctx, time.Second)
+	defer cancel2()
+	_, err := client.DialContext(ctx2, "tcp", echoAddr)
+	assert.Error(t, err)
+}
@@ -2,11 +2,18 @@ package e2e_test
 
 import (
 	"context"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/common/rnd"
 	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/internal/socket"
 	"github.com/studentmain/socks6/message"
 )
 
@@ -20,7 +27,7 @@ func TestUDP(t *testing.T) {
 	server := socks6.Server{
 		Address:       "127.0.0.1",
 		CleartextPort: sPort,
-		Worker:        socks6.NewServerWorker(),
+		Worker:        newServerWorker(),
 	}
 	server.Start(ctx)
 	client := socks6.Client{
@@ -41,6 +48,45 @@ func TestUDP(t *testing.T) {
 	}
 }
 
+func TestUDPSCTP(t *testing.T) {
+	e2etool.WatchDog()
+	if l, err := socket.ListenSCTP("127.0.0.1:0"); err != nil {
+		t.Skip("SCTP not available", err)
+	} else {
+		l.Close()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		SCTP:          true,
+		Worker:        newServerWorker(),
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server: sAddr,
+		SCTP:   true,
+	}
+	eAddr := message.ParseAddr(echoAddr)
+	fd, err := client.ListenPacketContext(ctx, "udp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	fd.WriteTo([]byte{1}, eAddr)
+	buf := make([]byte, 10)
+	n, a2, err := fd.ReadFrom(buf)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1, n)
+		assert.Equal(t, eAddr.String(), a2.String())
+		assert.EqualValues(t, 1, buf[0])
+	}
+}
+
 func TestUDPOverTCP(t *testing.T) {
 	e2etool.WatchDog()
 	ctx, cancel := context.WithCancel(context.Background())
@@ -51,7 +97,7 @@ func TestUDPOverTCP(t *testing.T) {
 	server := socks6.Server{
 		Address:       "127.0.0.1",
 		CleartextPort: sPort,
-		Worker:        socks6.NewServerWorker(),
+		Worker:        newServerWorker(),
 	}
 	server.Start(ctx)
 	client := socks6.Client{
@@ -70,3 +116,1056 @@ func TestUDPOverTCP(t *testing.T) {
 		assert.EqualValues(t, 1, buf[0])
 	}
 }
+
+func TestUDPFallback(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	// UDP to proxy is blocked
+	blackholeAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, blackholeAddr, func(p net.PacketConn, d []byte, a net.Addr) {})
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        newServerWorker(),
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:             sAddr,
+		Encrypted:          false,
+		UseSession:         false,
+		UDPFallbackTimeout: 100 * time.Millisecond,
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if network == "udp" {
+				addr = blackholeAddr
+			}
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+	fd, err := client.DialContext(ctx, "udp", echoAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	// read pending when fallback happens
+	read := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 10)
+		n, err := fd.Read(buf)
+		assert.NoError(t, err)
+		read <- buf[:n]
+	}()
+	fd.Write([]byte{1})
+	time.Sleep(200 * time.Millisecond)
+	_, err = fd.Write([]byte{2})
+	assert.NoError(t, err)
+	select {
+	case b := <-read:
+		assert.Equal(t, []byte{2}, b)
+	case <-time.After(500 * time.Millisecond):
+		t.Error("no reply over stream")
+	}
+}
+
+func TestUDPFragment(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.UDPFragmentSize = 200
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:          sAddr,
+		Encrypted:       false,
+		UseSession:      false,
+		UDPFragmentSize: 200,
+	}
+	eAddr := message.ParseAddr(echoAddr)
+	fd, err := client.ListenPacketContext(ctx, "udp", ":0")
+	assert.NoError(t, err)
+	data := rnd.RandBytes(1000)
+	fd.WriteTo(data, eAddr)
+	buf := make([]byte, 2000)
+	n, a2, err := fd.ReadFrom(buf)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1000, n)
+		assert.Equal(t, eAddr.String(), a2.String())
+		assert.Equal(t, data, buf[:n])
+	}
+}
+
+func TestUDPOffload(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.EnableUDPOffload = true
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+		UDPOverTCP: true,
+	}
+	fd, err := client.DialContext(ctx, "udp", echoAddr)
+	assert.NoError(t, err)
+	// same size burst, should be coalesced
+	sent := map[byte]bool{}
+	for i := 0; i < 8; i++ {
+		data := make([]byte, 1000)
+		data[0] = byte(i)
+		sent[byte(i)] = true
+		fd.Write(data)
+	}
+	buf := make([]byte, 2000)
+	for i := 0; i < 8; i++ {
+		n, err := fd.Read(buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.EqualValues(t, 1000, n)
+		assert.True(t, sent[buf[0]])
+		delete(sent, buf[0])
+	}
+}
+
+func TestUDPAssociationStats(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+		UDPOverTCP: true,
+	}
+	fd, err := client.DialContext(ctx, "udp", echoAddr)
+	assert.NoError(t, err)
+	fd.Write([]byte{1, 2, 3})
+	buf := make([]byte, 10)
+	_, err = fd.Read(buf)
+	assert.NoError(t, err)
+
+	// downlink is counted after datagram is sent
+	assert.Eventually(t, func() bool {
+		stats := worker.UDPAssociationStats()
+		return len(stats) == 1 && stats[0].DownDatagrams == 1
+	}, time.Second, 10*time.Millisecond)
+	stats := worker.UDPAssociationStats()
+	if assert.Len(t, stats, 1) {
+		st := stats[0]
+		assert.True(t, st.Established)
+		assert.True(t, st.OverTCP)
+		assert.EqualValues(t, 1, st.UpDatagrams)
+		assert.EqualValues(t, 3, st.UpBytes)
+		assert.EqualValues(t, 1, st.DownDatagrams)
+		assert.EqualValues(t, 3, st.DownBytes)
+		assert.Contains(t, st.Remotes, echoAddr)
+
+		st2, ok := worker.LookupUDPAssociation(st.ID)
+		assert.True(t, ok)
+		assert.Equal(t, st.ID, st2.ID)
+	}
+}
+
+func TestUDPPortRange(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.Outbound = socks6.InternetServerOutbound{
+		DefaultIPv4: net.IPv4(127, 0, 0, 1),
+		UDPPortMin:  41000,
+		UDPPortMax:  41009,
+	}
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+	}
+	fd, err := client.UDPAssociateRequest(ctx, message.ParseAddr("0.0.0.0:0"), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	port := fd.ProxyBindAddr().(*message.SocksAddr).Port
+	assert.GreaterOrEqual(t, port, uint16(41000))
+	assert.LessOrEqual(t, port, uint16(41009))
+
+	// outside range
+	_, err = client.UDPAssociateRequest(ctx, message.ParseAddr("0.0.0.0:42000"), nil)
+	assert.Error(t, err)
+}
+
+func TestUDPPortPair(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        newServerWorker(),
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+	}
+	fd, err := client.ReservePortPair(ctx, message.ParseAddr("127.0.0.1:0"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	rtp := fd.ProxyBindAddr().(*message.SocksAddr)
+	assert.EqualValues(t, 0, rtp.Port&1)
+	rtcpAddr := fd.ReservedAddr()
+	if !assert.NotNil(t, rtcpAddr) {
+		return
+	}
+	assert.EqualValues(t, rtp.Port+1, rtcpAddr.(*message.SocksAddr).Port)
+
+	// follow-up association use reserved port
+	fd2, err := client.UDPAssociateRequest(ctx, rtcpAddr, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, rtcpAddr.String(), fd2.ProxyBindAddr().String())
+	eAddr := message.ParseAddr(echoAddr)
+	fd2.WriteTo([]byte{1}, eAddr)
+	buf := make([]byte, 10)
+	n, _, err := fd2.ReadFrom(buf)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1, n)
+	}
+}
+
+func TestUDPPortDependentFiltering(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.UDPFiltering = socks6.UDPFilteringAddressAndPortDependent
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+	}
+	fd, err := client.UDPAssociateRequest(ctx, message.ParseAddr("127.0.0.1:0"), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	eAddr := message.ParseAddr(echoAddr)
+	buf := make([]byte, 10)
+	fd.WriteTo([]byte{1}, eAddr)
+	_, _, err = fd.ReadFrom(buf)
+	assert.NoError(t, err)
+
+	// same address, different port
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer other.Close()
+	bind, err := net.ResolveUDPAddr("udp", fd.ProxyBindAddr().String())
+	assert.NoError(t, err)
+	other.WriteTo([]byte{2}, bind)
+
+	fd.WriteTo([]byte{3}, eAddr)
+	n, a, err := fd.ReadFrom(buf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, eAddr.String(), a.String())
+		assert.Equal(t, []byte{3}, buf[:n])
+	}
+}
+
+func TestUDPResume(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.UDPResumeTimeout = 10 * time.Second
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: true,
+	}
+	eAddr := message.ParseAddr(echoAddr)
+	buf := make([]byte, 10)
+	fd, err := client.UDPAssociateRequest(ctx, nil, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fd.WriteTo([]byte{1}, eAddr)
+	_, _, err = fd.ReadFrom(buf)
+	assert.NoError(t, err)
+	id := fd.AssociationID()
+	bind := fd.ProxyBindAddr().String()
+	// lost control connection
+	fd.Close()
+
+	fd2, err := client.ResumeUDPAssociation(ctx, id)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, id, fd2.AssociationID())
+	assert.Equal(t, bind, fd2.ProxyBindAddr().String())
+	fd2.WriteTo([]byte{2}, eAddr)
+	n, _, err := fd2.ReadFrom(buf)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1, n)
+		assert.EqualValues(t, 2, buf[0])
+	}
+
+	// association of other session can't be resumed
+	client2 := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: true,
+	}
+	_, err = client2.ResumeUDPAssociation(ctx, id)
+	assert.Error(t, err)
+}
+
+// run with -race, downlink keep reading control connection state while it's replaced
+func TestUDPResumeUnderTraffic(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// remote keep sending to the association once it heard from it
+	remote, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer remote.Close()
+	go func() {
+		buf := make([]byte, 10)
+		_, a, err := remote.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		for ctx.Err() == nil {
+			if _, err := remote.WriteTo([]byte{3}, a); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.UDPResumeTimeout = 10 * time.Second
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: true,
+	}
+	rAddr := message.ConvertAddr(remote.LocalAddr())
+	buf := make([]byte, 10)
+	fd, err := client.UDPAssociateRequest(ctx, nil, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fd.WriteTo([]byte{1}, rAddr)
+	_, _, err = fd.ReadFrom(buf)
+	assert.NoError(t, err)
+	id := fd.AssociationID()
+	// lost control connection while downlink is busy
+	fd.Close()
+
+	fd2, err := client.ResumeUDPAssociation(ctx, id)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd2.Close()
+	fd2.WriteTo([]byte{2}, rAddr)
+	for i := 0; i < 10; i++ {
+		n, _, err := fd2.ReadFrom(buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.EqualValues(t, 1, n)
+		assert.EqualValues(t, 3, buf[0])
+	}
+}
+
+func TestUDPListenPacket(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr1, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr1, e2etool.UEcho)
+	echoAddr2, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr2, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        newServerWorker(),
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+	}
+	_, err := client.ListenPacketContext(ctx, "tcp", ":0")
+	assert.Error(t, err)
+
+	var pc net.PacketConn
+	pc, err = client.ListenPacketContext(ctx, "udp4", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pc.Close()
+	// unconnected socket, any destination
+	for i, ea := range []string{echoAddr1, echoAddr2} {
+		ua, err := net.ResolveUDPAddr("udp", ea)
+		assert.NoError(t, err)
+		_, err = pc.WriteTo([]byte{byte(i)}, ua)
+		assert.NoError(t, err)
+		buf := make([]byte, 10)
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, a, err := pc.ReadFrom(buf)
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, 1, n)
+			assert.EqualValues(t, i, buf[0])
+			assert.IsType(t, &net.UDPAddr{}, a)
+			assert.Equal(t, ua.String(), a.String())
+		}
+	}
+}
+
+func TestUDPErrorReport(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.EnableICMP = true
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	reported := make(chan *socks6.UDPError, 1)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+		UDPOverTCP: true,
+		EnableICMP: true,
+		UDPErrorHandler: func(err *socks6.UDPError) {
+			reported <- err
+		},
+	}
+	fd, err := client.ListenPacketContext(ctx, "udp", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	go func() {
+		buf := make([]byte, 10)
+		for {
+			if _, _, err := fd.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+	eAddr := message.ParseAddr(echoAddr)
+	// longer than max IPv4 UDP payload
+	_, err = fd.WriteTo(make([]byte, 65510), eAddr)
+	assert.NoError(t, err)
+	select {
+	case ue := <-reported:
+		assert.Equal(t, message.UDPErrorDatagramTooBig, ue.Code)
+		assert.Equal(t, eAddr.String(), ue.Endpoint.String())
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "no error reported")
+		return
+	}
+	// next datagram to same destination return error like UDP socket
+	_, err = fd.WriteTo([]byte{1}, eAddr)
+	assert.ErrorIs(t, err, syscall.EMSGSIZE)
+	var ne net.Error
+	assert.ErrorAs(t, err, &ne)
+	_, err = fd.WriteTo([]byte{1}, eAddr)
+	assert.NoError(t, err)
+}
+
+func TestUDPDualStack(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr4, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr4, e2etool.UEcho)
+	_, port6 := e2etool.GetAddr()
+	echoAddr6 := net.JoinHostPort("::1", strconv.Itoa(int(port6)))
+	go e2etool.ServeUDP(ctx, echoAddr6, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.Outbound = socks6.InternetServerOutbound{
+		DualStackUDP: true,
+	}
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+	}
+	pc, err := client.ListenPacketContext(ctx, "udp", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pc.Close()
+	// same association reach both address family
+	for i, ea := range []string{echoAddr4, echoAddr6} {
+		eAddr := message.ParseAddr(ea)
+		_, err = pc.WriteTo([]byte{byte(i)}, eAddr)
+		assert.NoError(t, err)
+		buf := make([]byte, 10)
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, a, err := pc.ReadFrom(buf)
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, 1, n)
+			assert.EqualValues(t, i, buf[0])
+			assert.Equal(t, eAddr.String(), message.ConvertAddr(a).String())
+		}
+	}
+}
+
+func TestUDPMaxPayload(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.UDPMaxPayload = 1000
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:        sAddr,
+		Encrypted:     false,
+		UseSession:    false,
+		UDPMaxPayload: 512,
+	}
+	fd, err := client.ListenPacketContext(ctx, "udp", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	// smaller limit is applied
+	assert.Equal(t, 512, fd.(*socks6.ProxyUDPConn).MaxPayload())
+
+	eAddr := message.ParseAddr(echoAddr)
+	_, err = fd.WriteTo(make([]byte, 513), eAddr)
+	assert.ErrorIs(t, err, syscall.EMSGSIZE)
+
+	_, err = fd.WriteTo(make([]byte, 512), eAddr)
+	assert.NoError(t, err)
+	buf := make([]byte, 1024)
+	n, _, err := fd.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 512, n)
+}
+
+func TestUDPRateLimit(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.UDPRateLimit = socks6.UDPRateLimit{PacketsPerSecond: 4}
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+		UDPOverTCP: true,
+	}
+	fd, err := client.DialContext(ctx, "udp", echoAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	for i := 0; i < 20; i++ {
+		fd.Write([]byte{byte(i)})
+	}
+	received := 0
+	buf := make([]byte, 10)
+	// association is kept for stats
+	fd.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	for {
+		if _, err := fd.Read(buf); err != nil {
+			break
+		}
+		received++
+	}
+	// burst of 4 packets and refill in 200ms are shared by both direction
+	assert.LessOrEqual(t, received, 5)
+	stats := worker.UDPAssociationStats()
+	if assert.Len(t, stats, 1) {
+		st := stats[0]
+		assert.LessOrEqual(t, st.UpDatagrams+st.DownDatagrams, uint64(5))
+		assert.GreaterOrEqual(t, st.Dropped, uint64(15))
+	}
+}
+
+func TestUDPRateLimitPerClient(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// remote never reply, only uplink is counted
+	sink, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sink.Close()
+	sinkAddr := message.ConvertAddr(sink.LocalAddr())
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.UDPRateLimit = socks6.UDPRateLimit{PacketsPerSecond: 2}
+	worker.UDPRateLimitPerClient = socks6.UDPRateLimit{PacketsPerSecond: 6}
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+		UDPOverTCP: true,
+	}
+	fds := []*socks6.ProxyUDPConn{}
+	for i := 0; i < 4; i++ {
+		fd, err := client.UDPAssociateRequest(ctx, nil, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer fd.Close()
+		fds = append(fds, fd)
+	}
+	// other associations use up client's limit
+	for _, fd := range fds[1:] {
+		fd.WriteTo([]byte{1}, sinkAddr)
+		fd.WriteTo([]byte{2}, sinkAddr)
+	}
+	time.Sleep(20 * time.Millisecond)
+	// dropped by client's limit, association's tokens are kept
+	fd := fds[0]
+	fd.WriteTo([]byte{3}, sinkAddr)
+	fd.WriteTo([]byte{4}, sinkAddr)
+	time.Sleep(300 * time.Millisecond)
+	// client's limit is refilled faster than association's
+	fd.WriteTo([]byte{5}, sinkAddr)
+	time.Sleep(20 * time.Millisecond)
+
+	for _, st := range worker.UDPAssociationStats() {
+		if st.ID == fd.AssociationID() {
+			assert.GreaterOrEqual(t, st.UpDatagrams, uint64(1))
+			return
+		}
+	}
+	t.Error("association not found")
+}
+
+func TestUDPReconnect(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.UDPResumeTimeout = 10 * time.Second
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	conns := []net.Conn{}
+	client := socks6.Client{
+		Server:        sAddr,
+		Encrypted:     false,
+		UseSession:    true,
+		UDPOverTCP:    true,
+		AutoReconnect: true,
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err == nil {
+				conns = append(conns, c)
+			}
+			return c, err
+		},
+	}
+	eAddr := message.ParseAddr(echoAddr)
+	buf := make([]byte, 10)
+	fd, err := client.UDPAssociateRequest(ctx, nil, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	fd.WriteTo([]byte{1}, eAddr)
+	_, _, err = fd.ReadFrom(buf)
+	assert.NoError(t, err)
+	id := fd.AssociationID()
+
+	// lost control connection
+	conns[0].Close()
+	_, err = fd.WriteTo([]byte{2}, eAddr)
+	var ne net.Error
+	if assert.ErrorAs(t, err, &ne) {
+		assert.ErrorIs(t, err, socks6.ErrAssociationReconnected)
+		assert.True(t, ne.Temporary())
+	}
+	assert.Len(t, conns, 2)
+	assert.Equal(t, id, fd.AssociationID())
+
+	fd.WriteTo([]byte{3}, eAddr)
+	n, _, err := fd.ReadFrom(buf)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1, n)
+		assert.EqualValues(t, 3, buf[0])
+	}
+}
+
+func TestUDPSharedAssociation(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr1, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr1, e2etool.UEcho)
+	echoAddr2, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr2, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	assocs := 0
+	worker.Rule = func(cc socks6.SocksConn) bool {
+		if cc.Request.CommandCode == message.CommandUdpAssociate {
+			assocs++
+		}
+		return true
+	}
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	client := &socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+	}
+	s, err := client.ShareUDPAssociation(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Close()
+	ua1, _ := net.ResolveUDPAddr("udp", echoAddr1)
+	ua2, _ := net.ResolveUDPAddr("udp", echoAddr2)
+
+	pc1, err := s.NewPacketConn()
+	assert.NoError(t, err)
+	pc2, err := s.NewPacketConn()
+	assert.NoError(t, err)
+	// each PacketConn only receive from destinations it sent to
+	for i, pc := range []net.PacketConn{pc1, pc2} {
+		ua := []*net.UDPAddr{ua1, ua2}[i]
+		_, err = pc.WriteTo([]byte{byte(i)}, ua)
+		assert.NoError(t, err)
+	}
+	for i, pc := range []net.PacketConn{pc1, pc2} {
+		buf := make([]byte, 10)
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, a, err := pc.ReadFrom(buf)
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, 1, n)
+			assert.EqualValues(t, i, buf[0])
+			assert.Equal(t, []*net.UDPAddr{ua1, ua2}[i].String(), a.String())
+		}
+	}
+
+	_, err = pc2.WriteTo([]byte{1}, ua1)
+	assert.ErrorIs(t, err, socks6.ErrDestinationInUse)
+	// destination is released when closed
+	pc1.Close()
+	_, err = pc1.WriteTo([]byte{1}, ua1)
+	assert.ErrorIs(t, err, net.ErrClosed)
+	_, err = pc2.WriteTo([]byte{2}, ua1)
+	assert.NoError(t, err)
+	buf := make([]byte, 10)
+	pc2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, a, err := pc2.ReadFrom(buf)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 2, buf[0])
+		assert.Equal(t, ua1.String(), a.String())
+	}
+	pc2.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err = pc2.ReadFrom(buf)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	assert.Equal(t, 1, assocs)
+	s.Close()
+	pc2.SetReadDeadline(time.Time{})
+	_, _, err = pc2.ReadFrom(buf)
+	assert.ErrorIs(t, err, net.ErrClosed)
+	_, err = s.NewPacketConn()
+	assert.Error(t, err)
+}
+
+func TestUDPAssociationQuota(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.MaxUDPAssociationPerClient = 2
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+	}
+	// concurrent requests from same client can't exceed quota
+	type result struct {
+		pc  net.PacketConn
+		err error
+	}
+	results := make(chan result)
+	for i := 0; i < 5; i++ {
+		go func() {
+			pc, err := client.ListenPacketContext(ctx, "udp", ":0")
+			results <- result{pc, err}
+		}()
+	}
+	pcs := []net.PacketConn{}
+	for i := 0; i < 5; i++ {
+		r := <-results
+		if r.err != nil {
+			assert.ErrorIs(t, r.err, syscall.EACCES)
+			continue
+		}
+		pcs = append(pcs, r.pc)
+	}
+	defer func() {
+		for _, pc := range pcs {
+			pc.Close()
+		}
+	}()
+	if !assert.Len(t, pcs, 2) {
+		return
+	}
+	_, err := client.ListenPacketContext(ctx, "udp", ":0")
+	assert.ErrorIs(t, err, syscall.EACCES)
+
+	// quota is returned when association exit
+	pcs[0].Close()
+	pcs = pcs[1:]
+	for {
+		pc, err := client.ListenPacketContext(ctx, "udp", ":0")
+		if err == nil {
+			pcs = append(pcs, pc)
+			break
+		}
+		assert.ErrorIs(t, err, syscall.EACCES)
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err = client.ListenPacketContext(ctx, "udp", ":0")
+	assert.ErrorIs(t, err, syscall.EACCES)
+}
+
+func TestUDPHosts(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, echoPort := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	outbound := worker.Outbound.(socks6.InternetServerOutbound)
+	outbound.Hosts = map[string]net.IP{"echo.invalid": net.IPv4(127, 0, 0, 1)}
+	worker.Outbound = outbound
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+	}
+	fd, err := client.ListenPacketContext(ctx, "udp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	// datagram to pinned name is sent to pinned address
+	dst := message.ParseAddr(net.JoinHostPort("Echo.Invalid", strconv.Itoa(int(echoPort))))
+	assert.Equal(t, message.AddressTypeDomainName, dst.AddressType)
+	_, err = fd.WriteTo([]byte{1}, dst)
+	assert.NoError(t, err)
+	buf := make([]byte, 10)
+	fd.SetReadDeadline(time.Now().Add(time.Second))
+	n, a, err := fd.ReadFrom(buf)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1, n)
+		assert.EqualValues(t, 1, buf[0])
+		assert.Equal(t, echoAddr, a.String())
+	}
+}
+
+func TestUDPErrorQueueFallback(t *testing.T) {
+	e2etool.WatchDog()
+	if !socket.RecvErrSupported {
+		t.Skip("socket error queue is not supported")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	closedAddr, _ := e2etool.GetAddr()
+	sAddr, sPort := e2etool.GetAddr()
+	worker := newServerWorker()
+	worker.EnableICMP = true
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        worker,
+		// not a local address, raw socket can't be opened
+		ICMPListenIPv4: net.IPv4(192, 0, 2, 1),
+	}
+	server.Start(ctx)
+	reported := make(chan *socks6.UDPError, 1)
+	client := socks6.Client{
+		Server:     sAddr,
+		Encrypted:  false,
+		UseSession: false,
+		UDPOverTCP: true,
+		EnableICMP: true,
+		UDPErrorHandler: func(err *socks6.UDPError) {
+			reported <- err
+		},
+	}
+	fd, err := client.ListenPacketContext(ctx, "udp", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	// ICMP error is read from UDP socket
+	assert.Contains(t, fd.(*socks6.ProxyUDPConn).StackOptions(), message.StackOptionUDPUDPError)
+
+	// port unreachable is read from error queue, it has no socks 6 equivalent and association keep working
+	_, err = fd.WriteTo([]byte{1}, message.ParseAddr(closedAddr))
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	eAddr := message.ParseAddr(echoAddr)
+	_, err = fd.WriteTo([]byte{2}, eAddr)
+	assert.NoError(t, err)
+	buf := make([]byte, 10)
+	fd.SetReadDeadline(time.Now().Add(time.Second))
+	n, a, err := fd.ReadFrom(buf)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1, n)
+		assert.EqualValues(t, 2, buf[0])
+		assert.Equal(t, eAddr.String(), a.String())
+	}
+	select {
+	case ue := <-reported:
+		assert.Fail(t, "unexpected error reported", ue)
+	default:
+	}
+}
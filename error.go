@@ -1,8 +1,54 @@
 package socks6
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/studentmain/socks6/message"
+)
 
 var ErrTTLExpired = errors.New("ttl expired")
 var ErrServerFailure = errors.New("socks 6 server failure")
 var ErrUnexpectedMessage = errors.New("unexpected protocol message")
 var ErrAssociationMismatch = errors.New("association mismatch")
+var ErrNotAllowedByRule = errors.New("not allowed by rule")
+var ErrAssociationExpired = errors.New("association expired")
+var ErrCaptureInProgress = errors.New("capture already in progress")
+var ErrSessionInvalid = errors.New("session invalid")
+var ErrTokenRejected = errors.New("idempotence token rejected")
+var ErrInitialDataTooLong = errors.New("initial data too long")
+var ErrDestinationInUse = errors.New("destination used by another shared packet conn")
+var ErrNoCertificate = errors.New("no certificate loaded")
+var ErrServerClosed = errors.New("socks 6 server closed")
+
+// ErrAssociationReconnected is returned by UDP association operation interrupted by reconnection,
+// it's temporary and the operation can be retried
+var ErrAssociationReconnected error = temporaryError("udp association reconnected")
+
+// ReplyError is returned when proxy replied a failure code, unlike other errors, proxy itself is working.
+// It wraps a syscall.Errno or package error, e.g. syscall.ECONNREFUSED and ErrTTLExpired, which can be checked by errors.Is
+type ReplyError struct {
+	Code message.ReplyCode
+	Err  error
+}
+
+func (e *ReplyError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ReplyError) Unwrap() error {
+	return e.Err
+}
+
+type temporaryError string
+
+func (e temporaryError) Error() string {
+	return string(e)
+}
+
+func (e temporaryError) Timeout() bool {
+	return false
+}
+
+func (e temporaryError) Temporary() bool {
+	return true
+}
@@ -0,0 +1,58 @@
+package socks6
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// HTTPTransport return http.Transport connect to HTTP servers through proxy, host names are resolved by proxy.
+// When dnsServer is not empty, host names are resolved by dnsServer, which is queried through proxy
+func (c *Client) HTTPTransport(dnsServer string) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = c.DialContext
+	if dnsServer != "" {
+		t.DialContext = c.resolvingDialContext(c.Resolver(dnsServer))
+	}
+	return t
+}
+
+// Resolver return net.Resolver which query dnsServer through proxy, using UDP association and CONNECT for TCP fallback
+func (c *Client) Resolver(dnsServer string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return c.DialContext(ctx, network, dnsServer)
+		},
+	}
+}
+
+// resolvingDialContext return dial function which resolve host name by r, then dial addresses in order until success
+func (c *Client) resolvingDialContext(r *net.Resolver) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+		if net.ParseIP(host) != nil {
+			return c.DialContext(ctx, network, addr)
+		}
+		ips, err := r.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+		var lastErr error
+		for _, ip := range ips {
+			conn, err := c.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, lastErr
+	}
+}
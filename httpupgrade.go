@@ -0,0 +1,75 @@
+package socks6
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/studentmain/socks6/common"
+	"github.com/studentmain/socks6/common/nt"
+)
+
+// HTTPHandler return a http.Handler which serve SOCKS 6 over WebSocket and HTTP/1.1 Upgrade,
+// so proxy can be deployed behind CDN and reverse proxy. Request's context is used by ServeStream.
+func (s *ServerWorker) HTTPHandler() http.Handler {
+	return nt.NewHTTPUpgradeHandler(common.HTTPUpgradeProtocol, func(r *http.Request, conn net.Conn) {
+		s.ServeStream(r.Context(), conn)
+	})
+}
+
+// connectHTTPUpgrade connect to HTTPUpgradeURL and upgrade to WebSocket or SOCKS 6
+func (c *Client) connectHTTPUpgrade(ctx context.Context) (net.Conn, error) {
+	u, err := url.Parse(c.HTTPUpgradeURL)
+	if err != nil {
+		return nil, err
+	}
+	secure := false
+	port := "80"
+	switch u.Scheme {
+	case "ws", "http":
+	case "wss", "https":
+		secure = true
+		port = "443"
+	default:
+		return nil, errors.New("unsupported HTTP upgrade URL scheme " + u.Scheme)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	dial := (&net.Dialer{}).DialContext
+	if c.DialFunc != nil {
+		dial = c.DialFunc
+	}
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if secure {
+		conf := c.tlsConfig()
+		if c.TlsConfig == nil || c.TlsConfig.ServerName == "" {
+			conf.ServerName = u.Hostname()
+		}
+		conn = tls.Client(conn, conf)
+	}
+
+	stopWatch := watchContext(ctx, conn)
+	var uconn net.Conn
+	if u.Scheme == "ws" || u.Scheme == "wss" {
+		uconn, err = nt.UpgradeWebSocket(conn, u)
+	} else {
+		uconn, err = nt.UpgradeHTTP(conn, u, common.HTTPUpgradeProtocol)
+	}
+	if cerr := stopWatch(); cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return uconn, nil
+}
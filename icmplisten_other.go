@@ -0,0 +1,16 @@
+//go:build !windows
+
+package socks6
+
+import "net"
+
+// icmpListenAddress return address for raw ICMP socket, wildcard address when ip is nil
+func icmpListenAddress(ver int, ip net.IP) (string, error) {
+	if ip != nil {
+		return ip.String(), nil
+	}
+	if ver == 4 {
+		return "0.0.0.0", nil
+	}
+	return "::", nil
+}
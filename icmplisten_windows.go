@@ -0,0 +1,24 @@
+package socks6
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/studentmain/socks6/common/nt"
+)
+
+// icmpListenAddress return address for raw ICMP socket,
+// windows won't deliver ICMP to raw socket bound to wildcard address, so default address is guessed when ip is nil
+func icmpListenAddress(ver int, ip net.IP) (string, error) {
+	if ip == nil {
+		if ver == 4 {
+			ip = nt.GuessDefaultIPv4()
+		} else {
+			ip = nt.GuessDefaultIPv6()
+		}
+	}
+	if ip.IsUnspecified() {
+		return "", fmt.Errorf("no default IPv%d address for ICMP socket, set Server.ICMPListenIPv%d", ver, ver)
+	}
+	return ip.String(), nil
+}
@@ -0,0 +1,43 @@
+package socket
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/studentmain/socks6/common"
+)
+
+// IsPermissionError check whether err is caused by insufficient privilege
+func IsPermissionError(err error) bool {
+	errno := syscall.Errno(0)
+	if !errors.As(err, &errno) {
+		return false
+	}
+	switch common.ConvertSocketErrno(errno) {
+	case syscall.EACCES, syscall.EPERM:
+		return true
+	}
+	return false
+}
+
+// IsICMPErrno check whether err is an ICMP error reported by socket
+func IsICMPErrno(err error) bool {
+	errno := syscall.Errno(0)
+	if !errors.As(err, &errno) {
+		return false
+	}
+	switch common.ConvertSocketErrno(errno) {
+	case syscall.ECONNREFUSED, syscall.EHOSTUNREACH, syscall.ENETUNREACH, syscall.EMSGSIZE:
+		return true
+	}
+	return false
+}
+
+// IsMessageTooLong check whether err is caused by datagram exceed MTU with DF set
+func IsMessageTooLong(err error) bool {
+	errno := syscall.Errno(0)
+	if !errors.As(err, &errno) {
+		return false
+	}
+	return common.ConvertSocketErrno(errno) == syscall.EMSGSIZE
+}
@@ -0,0 +1,38 @@
+package socket
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// ListenOption is socket options of listener, which are configured by proxy operator instead of negotiated by stack options
+type ListenOption struct {
+	// ReusePort set SO_REUSEPORT, so multiple processes can listen on same port and share incoming connections
+	ReusePort bool
+	// KeepAlive is TCP keepalive period of accepted connections, 0 use default, negative disable keepalive
+	KeepAlive time.Duration
+	// DeferAccept wake up accept only after client sent data or timeout, round up to seconds, 0 to disable.
+	// It's TCP_DEFER_ACCEPT on linux, ignored on other platforms
+	DeferAccept time.Duration
+}
+
+// listenConfig create net.ListenConfig apply options on socket before bind
+func (o ListenOption) listenConfig() net.ListenConfig {
+	return net.ListenConfig{
+		KeepAlive: o.KeepAlive,
+		Control:   listenControl(o),
+	}
+}
+
+// Listen listen stream socket with options
+func Listen(ctx context.Context, network, addr string, o ListenOption) (net.Listener, error) {
+	cfg := o.listenConfig()
+	return cfg.Listen(ctx, network, addr)
+}
+
+// ListenPacket listen packet socket with options, stream only options are ignored
+func ListenPacket(ctx context.Context, network, addr string, o ListenOption) (net.PacketConn, error) {
+	cfg := o.listenConfig()
+	return cfg.ListenPacket(ctx, network, addr)
+}
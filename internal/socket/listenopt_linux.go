@@ -0,0 +1,35 @@
+package socket
+
+import (
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenControl set SO_REUSEPORT and TCP_DEFER_ACCEPT, nil when nothing to set
+func listenControl(o ListenOption) func(network, address string, c syscall.RawConn) error {
+	if !o.ReusePort && o.DeferAccept <= 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var err2 error
+		err := c.Control(func(fd uintptr) {
+			s := int(fd)
+			if o.ReusePort {
+				if err2 = unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err2 != nil {
+					return
+				}
+			}
+			if o.DeferAccept > 0 && strings.HasPrefix(network, "tcp") {
+				sec := int((o.DeferAccept + time.Second - 1) / time.Second)
+				err2 = unix.SetsockoptInt(s, unix.IPPROTO_TCP, unix.TCP_DEFER_ACCEPT, sec)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return err2
+	}
+}
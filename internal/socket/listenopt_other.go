@@ -0,0 +1,18 @@
+//go:build !linux
+
+package socket
+
+import (
+	"errors"
+	"syscall"
+)
+
+// listenControl reject SO_REUSEPORT, which is not implemented yet, DeferAccept is ignored
+func listenControl(o ListenOption) func(network, address string, c syscall.RawConn) error {
+	if !o.ReusePort {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("SO_REUSEPORT is not supported on this platform")
+	}
+}
@@ -0,0 +1,8 @@
+package socket
+
+// PeerCred is credential of process on the other side of a unix socket
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
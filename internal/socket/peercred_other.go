@@ -0,0 +1,16 @@
+//go:build !linux
+
+package socket
+
+import (
+	"errors"
+	"net"
+)
+
+// PeerCredSupported indicate whether GetPeerCred works on this platform
+const PeerCredSupported = false
+
+// GetPeerCred is only supported on linux
+func GetPeerCred(conn net.Conn) (*PeerCred, error) {
+	return nil, errors.New("peer credential is not supported on this platform")
+}
@@ -0,0 +1,59 @@
+package socket
+
+import (
+	"net"
+
+	"github.com/studentmain/socks6/message"
+)
+
+// SocketError is an ICMP error reported by socket error queue
+type SocketError struct {
+	Version     int          // ICMP version, 4 or 6
+	Type        byte         // ICMP type
+	Code        byte         // ICMP code
+	Offender    net.IP       // who sent the ICMP message, can be nil
+	Destination *net.UDPAddr // original datagram's destination
+	MTU         int          // next hop MTU when datagram is too big, 0 if unknown
+}
+
+// UDPError map ICMP error to socks6 error code and reporter address,
+// ok is false when it has no socks6 equivalent, e.g. port unreachable
+func (se *SocketError) UDPError() (code message.UDPErrorType, reporter *message.SocksAddr, ok bool) {
+	switch se.Version {
+	case 4:
+		switch {
+		case se.Type == 3 && se.Code == 0:
+			code = message.UDPErrorNetworkUnreachable
+		case se.Type == 3 && se.Code == 1:
+			code = message.UDPErrorHostUnreachable
+		case se.Type == 3 && se.Code == 4:
+			// fragmentation needed
+			code = message.UDPErrorDatagramTooBig
+		case se.Type == 11 && se.Code == 0:
+			code = message.UDPErrorTTLExpired
+		default:
+			return 0, nil, false
+		}
+	case 6:
+		switch {
+		case se.Type == 1 && se.Code == 0:
+			code = message.UDPErrorNetworkUnreachable
+		case se.Type == 1 && se.Code == 3:
+			code = message.UDPErrorHostUnreachable
+		case se.Type == 3 && se.Code == 0:
+			code = message.UDPErrorTTLExpired
+		case se.Type == 2:
+			code = message.UDPErrorDatagramTooBig
+		default:
+			return 0, nil, false
+		}
+	default:
+		return 0, nil, false
+	}
+	if se.Offender != nil {
+		reporter = message.ConvertAddr(&net.UDPAddr{IP: se.Offender})
+	} else {
+		reporter = message.ConvertAddr(se.Destination)
+	}
+	return code, reporter, true
+}
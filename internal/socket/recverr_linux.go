@@ -0,0 +1,130 @@
+package socket
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// RecvErrSupported indicate whether EnableRecvErr works on this platform
+const RecvErrSupported = true
+
+// EnableRecvErr set IP_RECVERR on packet socket, so ICMP errors can be read by ReadSocketError
+// without raw socket
+func EnableRecvErr(pc net.PacketConn) bool {
+	sc, ok := pc.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	ipv6 := isIPv6Socket(pc.LocalAddr())
+	var err2 error
+	err = rc.Control(func(fd uintptr) {
+		if ipv6 {
+			// mapped IPv4 error is reported via IP_RECVERR on dual stack socket
+			unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVERR, 1)
+			err2 = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVERR, 1)
+		} else {
+			err2 = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVERR, 1)
+		}
+	})
+	return err == nil && err2 == nil
+}
+
+// ReadSocketError read an ICMP error from socket's error queue
+func ReadSocketError(pc net.PacketConn) (*SocketError, error) {
+	sc, ok := pc.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("not a socket")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 512)
+	oob := make([]byte, 512)
+	var oobn int
+	var from unix.Sockaddr
+	var err2 error
+	err = rc.Control(func(fd uintptr) {
+		_, oobn, _, from, err2 = unix.Recvmsg(int(fd), b, oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err2 != nil {
+		return nil, err2
+	}
+
+	cmsgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	for _, cmsg := range cmsgs {
+		isV4 := cmsg.Header.Level == unix.SOL_IP && cmsg.Header.Type == unix.IP_RECVERR
+		isV6 := cmsg.Header.Level == unix.SOL_IPV6 && cmsg.Header.Type == unix.IPV6_RECVERR
+		if !isV4 && !isV6 {
+			continue
+		}
+		eeLen := int(unsafe.Sizeof(unix.SockExtendedErr{}))
+		if len(cmsg.Data) < eeLen {
+			return nil, errors.New("extended error too short")
+		}
+		ee := (*unix.SockExtendedErr)(unsafe.Pointer(&cmsg.Data[0]))
+		se := &SocketError{
+			Type:        ee.Type,
+			Code:        ee.Code,
+			Offender:    parseOffender(cmsg.Data[eeLen:]),
+			Destination: sockaddrToUDPAddr(from),
+		}
+		if ee.Errno == uint32(unix.EMSGSIZE) {
+			se.MTU = int(ee.Info)
+		}
+		switch ee.Origin {
+		case unix.SO_EE_ORIGIN_ICMP:
+			se.Version = 4
+		case unix.SO_EE_ORIGIN_ICMP6:
+			se.Version = 6
+		default:
+			// local error, e.g. EMSGSIZE
+			continue
+		}
+		return se, nil
+	}
+	return nil, errors.New("no ICMP error in error queue")
+}
+
+// parseOffender parse SO_EE_OFFENDER sockaddr
+func parseOffender(b []byte) net.IP {
+	if len(b) < 2 {
+		return nil
+	}
+	// sa_family is in host byte order
+	switch *(*uint16)(unsafe.Pointer(&b[0])) {
+	case unix.AF_INET:
+		if len(b) >= 8 {
+			return net.IP(append([]byte{}, b[4:8]...))
+		}
+	case unix.AF_INET6:
+		if len(b) >= 24 {
+			return net.IP(append([]byte{}, b[8:24]...))
+		}
+	}
+	return nil
+}
+
+func sockaddrToUDPAddr(sa unix.Sockaddr) *net.UDPAddr {
+	switch a := sa.(type) {
+	case *unix.SockaddrInet4:
+		return &net.UDPAddr{IP: net.IPv4(a.Addr[0], a.Addr[1], a.Addr[2], a.Addr[3]), Port: a.Port}
+	case *unix.SockaddrInet6:
+		return &net.UDPAddr{IP: append(net.IP{}, a.Addr[:]...), Port: a.Port}
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package socket
+
+import (
+	"errors"
+	"net"
+)
+
+// RecvErrSupported indicate whether EnableRecvErr works on this platform
+const RecvErrSupported = false
+
+// EnableRecvErr is only supported on linux
+func EnableRecvErr(pc net.PacketConn) bool {
+	return false
+}
+
+// ReadSocketError is only supported on linux
+func ReadSocketError(pc net.PacketConn) (*SocketError, error) {
+	return nil, errors.New("socket error queue is not supported on this platform")
+}
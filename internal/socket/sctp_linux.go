@@ -0,0 +1,88 @@
+package socket
+
+import (
+	"context"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// SCTPSupported indicate whether ListenSCTP and DialSCTP works on this platform,
+// kernel may still lack SCTP support
+const SCTPSupported = true
+
+// ListenSCTP listen one-to-one style SCTP socket on addr,
+// accepted associations are *net.TCPConn with TCP addresses, each Write send a message
+func ListenSCTP(addr string) (net.Listener, error) {
+	sa, family, err := sctpSockaddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := sctpSocket(family)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "sctp")
+	defer f.Close()
+	unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+	if err = unix.Bind(fd, sa); err != nil {
+		return nil, &net.OpError{Op: "listen", Net: "sctp", Err: os.NewSyscallError("bind", err)}
+	}
+	if err = unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		return nil, &net.OpError{Op: "listen", Net: "sctp", Err: os.NewSyscallError("listen", err)}
+	}
+	return net.FileListener(f)
+}
+
+// DialSCTP connect a one-to-one style SCTP association to addr, each Write send a message
+func DialSCTP(ctx context.Context, addr string) (net.Conn, error) {
+	sa, family, err := sctpSockaddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := sctpSocket(family)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "sctp")
+	defer f.Close()
+	// blocking connect, timeout by SO_SNDTIMEO
+	if deadline, ok := ctx.Deadline(); ok {
+		tv := unix.NsecToTimeval(int64(time.Until(deadline)))
+		unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_SNDTIMEO, &tv)
+	}
+	if err = unix.Connect(fd, sa); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "sctp", Err: os.NewSyscallError("connect", err)}
+	}
+	tv := unix.Timeval{}
+	unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_SNDTIMEO, &tv)
+	return net.FileConn(f)
+}
+
+func sctpSocket(family int) (int, error) {
+	fd, err := unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, unix.IPPROTO_SCTP)
+	if err != nil {
+		return -1, &net.OpError{Op: "socket", Net: "sctp", Err: os.NewSyscallError("socket", err)}
+	}
+	return fd, nil
+}
+
+// sctpSockaddr resolve addr, unspecified address use dual stack IPv6 socket
+func sctpSockaddr(addr string) (unix.Sockaddr, int, error) {
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	if ip4 := a.IP.To4(); ip4 != nil && !a.IP.IsUnspecified() {
+		sa := &unix.SockaddrInet4{Port: a.Port}
+		copy(sa.Addr[:], ip4)
+		return sa, unix.AF_INET, nil
+	}
+	sa := &unix.SockaddrInet6{Port: a.Port}
+	if !a.IP.IsUnspecified() {
+		copy(sa.Addr[:], a.IP.To16())
+	}
+	return sa, unix.AF_INET6, nil
+}
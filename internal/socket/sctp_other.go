@@ -0,0 +1,24 @@
+//go:build !linux
+
+package socket
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// SCTPSupported indicate whether ListenSCTP and DialSCTP works on this platform
+const SCTPSupported = false
+
+var errSCTPNotSupported = errors.New("SCTP is not supported on this platform")
+
+// ListenSCTP is only supported on linux
+func ListenSCTP(addr string) (net.Listener, error) {
+	return nil, errSCTPNotSupported
+}
+
+// DialSCTP is only supported on linux
+func DialSCTP(ctx context.Context, addr string) (net.Conn, error) {
+	return nil, errSCTPNotSupported
+}
@@ -3,18 +3,76 @@ package socket
 import (
 	"context"
 	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/studentmain/socks6/message"
 )
 
+// SetConnOpt apply stack options on established connection, return applied options
 func SetConnOpt(conn net.Conn, opt message.StackOptionInfo) message.StackOptionInfo {
-	return message.StackOptionInfo{}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return message.StackOptionInfo{}
+	}
+	return setSocketOption(sc, conn.LocalAddr(), false, opt)
 }
 
-func DialWithOption(ctx context.Context, addr message.SocksAddr, opt message.StackOptionInfo) (net.Conn, message.StackOptionInfo, error) {
-	appliedOption := message.StackOptionInfo{}
+// SetListenerOpt apply stack options on listener, return applied options
+func SetListenerOpt(listener net.Listener, opt message.StackOptionInfo) message.StackOptionInfo {
+	sc, ok := listener.(syscall.Conn)
+	if !ok {
+		return message.StackOptionInfo{}
+	}
+	return setSocketOption(sc, listener.Addr(), true, opt)
+}
+
+// SetPacketConnOpt apply stack options on packet socket, return applied options
+func SetPacketConnOpt(pc net.PacketConn, opt message.StackOptionInfo) message.StackOptionInfo {
+	sc, ok := pc.(syscall.Conn)
+	if !ok {
+		return message.StackOptionInfo{}
+	}
+	return setSocketOption(sc, pc.LocalAddr(), false, opt)
+}
 
+// DialWithOption dial to addr then apply stack options on connection,
+// when check is not nil, resolved IP rejected by it is not connected
+func DialWithOption(ctx context.Context, addr message.SocksAddr, opt message.StackOptionInfo, check func(net.IP) error) (net.Conn, message.StackOptionInfo, error) {
+	return dialWithOption(ctx, net.Dialer{}, addr, opt, check)
+}
+
+// DialWithInitialData dial to addr then write data to it, when TFO is requested, data is sent with SYN
+func DialWithInitialData(ctx context.Context, addr message.SocksAddr, opt message.StackOptionInfo, data []byte, check func(net.IP) error) (net.Conn, message.StackOptionInfo, error) {
 	dialer := net.Dialer{}
+	_, tfo := opt[message.StackOptionTCPTFO]
+	tfo = tfo && len(data) > 0 && tfoConnectControl != nil
+	// happy eyeballs may try several sockets concurrently
+	var tfoFailed int32
+	if tfo {
+		dialer.Control = tfoConnectControl(&tfoFailed)
+	}
+	conn, appliedOption, err := dialWithOption(ctx, dialer, addr, opt, check)
+	if err != nil {
+		return nil, appliedOption, err
+	}
+	if len(data) == 0 {
+		return conn, appliedOption, nil
+	}
+	if _, err := conn.Write(data); err != nil {
+		conn.Close()
+		return nil, appliedOption, err
+	}
+	if tfo && atomic.LoadInt32(&tfoFailed) == 0 {
+		appliedOption[message.StackOptionTCPTFO] = uint16(len(data))
+	}
+	return conn, appliedOption, nil
+}
+
+func dialWithOption(ctx context.Context, dialer net.Dialer, addr message.SocksAddr, opt message.StackOptionInfo, check func(net.IP) error) (net.Conn, message.StackOptionInfo, error) {
+	appliedOption := message.StackOptionInfo{}
+	dialer.Control = checkIPControl(check, dialer.Control)
 
 	happyEyeballOp, ok := opt[message.StackOptionIPHappyEyeball]
 	if ok && addr.AddressType == message.AddressTypeDomainName {
@@ -27,14 +85,45 @@ func DialWithOption(ctx context.Context, addr message.SocksAddr, opt message.Sta
 	}
 
 	conn, err := dialer.DialContext(ctx, "tcp", addr.String())
-	return conn, appliedOption, err
+	if err != nil {
+		return nil, appliedOption, err
+	}
+	appliedOption.Combine(SetConnOpt(conn, opt))
+	return conn, appliedOption, nil
 }
 
-func ListenerWithOption(ctx context.Context, addr message.SocksAddr, opt message.StackOptionInfo) (net.Listener, message.StackOptionInfo, error) {
-	appliedOption := message.StackOptionInfo{}
+// checkIPControl return a dialer control function which refuse to connect IP rejected by check,
+// then run next. It's called for every resolved IP, before connect()
+func checkIPControl(check func(net.IP) error, next func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	if check == nil {
+		return next
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		// link-local address may have zone
+		if i := strings.IndexByte(host, '%'); i >= 0 {
+			host = host[:i]
+		}
+		if err := check(net.ParseIP(host)); err != nil {
+			return err
+		}
+		if next == nil {
+			return nil
+		}
+		return next(network, address, c)
+	}
+}
 
-	cfg := net.ListenConfig{}
+// ListenerWithOption listen on addr with listener options, then apply stack options on it
+func ListenerWithOption(ctx context.Context, addr message.SocksAddr, opt message.StackOptionInfo, lopt ListenOption) (net.Listener, message.StackOptionInfo, error) {
+	cfg := lopt.listenConfig()
 
 	listener, err := cfg.Listen(ctx, "tcp", addr.String())
-	return listener, appliedOption, err
+	if err != nil {
+		return nil, message.StackOptionInfo{}, err
+	}
+	return listener, SetListenerOpt(listener, opt), nil
 }
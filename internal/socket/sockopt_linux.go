@@ -0,0 +1,133 @@
+package socket
+
+import (
+	"net"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/studentmain/socks6/message"
+	"golang.org/x/sys/unix"
+)
+
+// tfoQueueLen is the pending TFO request queue length used on listener
+const tfoQueueLen = 256
+
+// setSocketOption apply requested options on socket, then read them back from kernel,
+// only options which actually took effect are returned
+func setSocketOption(sc syscall.Conn, addr net.Addr, listener bool, opt message.StackOptionInfo) message.StackOptionInfo {
+	appliedOption := message.StackOptionInfo{}
+	if len(opt) == 0 {
+		return appliedOption
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return appliedOption
+	}
+	ipv6 := isIPv6Socket(addr)
+	_, isUDP := addr.(*net.UDPAddr)
+
+	rc.Control(func(fd uintptr) {
+		s := int(fd)
+		if iTTL, ok := opt[message.StackOptionIPTTL]; ok {
+			ttl := int(iTTL.(byte))
+			// dual stack socket use IPv4 option for mapped address, error is ignored
+			unix.SetsockoptInt(s, unix.IPPROTO_IP, unix.IP_TTL, ttl)
+			if ipv6 {
+				unix.SetsockoptInt(s, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, ttl)
+			}
+			if isUDP {
+				unix.SetsockoptInt(s, unix.IPPROTO_IP, unix.IP_MULTICAST_TTL, ttl)
+				if ipv6 {
+					unix.SetsockoptInt(s, unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_HOPS, ttl)
+				}
+			}
+			if v, err := getTTL(s, ipv6); err == nil && v == ttl {
+				appliedOption[message.StackOptionIPTTL] = byte(v)
+			}
+		}
+		if iTOS, ok := opt[message.StackOptionIPTOS]; ok {
+			tos := int(iTOS.(byte))
+			if ipv6 {
+				unix.SetsockoptInt(s, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+			} else {
+				unix.SetsockoptInt(s, unix.IPPROTO_IP, unix.IP_TOS, tos)
+			}
+			if v, err := getTOS(s, ipv6); err == nil {
+				appliedOption[message.StackOptionIPTOS] = byte(v)
+			}
+		}
+		if iDF, ok := opt[message.StackOptionIPNoFragment]; ok && isUDP {
+			df := iDF.(bool)
+			mode := unix.IP_PMTUDISC_DONT
+			if df {
+				mode = unix.IP_PMTUDISC_DO
+			}
+			if ipv6 {
+				unix.SetsockoptInt(s, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, mode)
+			} else {
+				unix.SetsockoptInt(s, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, mode)
+			}
+			if v, err := getPMTUDisc(s, ipv6); err == nil {
+				appliedOption[message.StackOptionIPNoFragment] = v == unix.IP_PMTUDISC_DO
+			}
+		}
+		if iTFO, ok := opt[message.StackOptionTCPTFO]; ok && listener && !isUDP {
+			unix.SetsockoptInt(s, unix.IPPROTO_TCP, unix.TCP_FASTOPEN, tfoQueueLen)
+			if v, err := unix.GetsockoptInt(s, unix.IPPROTO_TCP, unix.TCP_FASTOPEN); err == nil && v > 0 {
+				// server side doesn't limit SYN payload, client's request can be satisfied
+				appliedOption[message.StackOptionTCPTFO] = iTFO.(uint16)
+			}
+		}
+	})
+	return appliedOption
+}
+
+func getTTL(s int, ipv6 bool) (int, error) {
+	if ipv6 {
+		return unix.GetsockoptInt(s, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS)
+	}
+	return unix.GetsockoptInt(s, unix.IPPROTO_IP, unix.IP_TTL)
+}
+
+func getTOS(s int, ipv6 bool) (int, error) {
+	if ipv6 {
+		return unix.GetsockoptInt(s, unix.IPPROTO_IPV6, unix.IPV6_TCLASS)
+	}
+	return unix.GetsockoptInt(s, unix.IPPROTO_IP, unix.IP_TOS)
+}
+
+func getPMTUDisc(s int, ipv6 bool) (int, error) {
+	if ipv6 {
+		return unix.GetsockoptInt(s, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER)
+	}
+	return unix.GetsockoptInt(s, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER)
+}
+
+// isIPv6Socket guess socket address family from its local address
+func isIPv6Socket(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+	// wildcard socket is a dual stack IPv6 socket
+	return ip.To4() == nil
+}
+
+// tfoConnectControl return a dialer control function which enable TCP_FASTOPEN_CONNECT, connect() will be deferred to first write.
+// failed is set to non-zero when any socket can't enable it
+var tfoConnectControl = func(failed *int32) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		// fallback to normal connect when failed
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+		})
+		if err != nil || serr != nil {
+			atomic.StoreInt32(failed, 1)
+		}
+		return err
+	}
+}
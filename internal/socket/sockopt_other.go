@@ -0,0 +1,18 @@
+//go:build !linux
+
+package socket
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/studentmain/socks6/message"
+)
+
+// setSocketOption is not implemented yet, nothing is applied
+func setSocketOption(sc syscall.Conn, addr net.Addr, listener bool, opt message.StackOptionInfo) message.StackOptionInfo {
+	return message.StackOptionInfo{}
+}
+
+// tfoConnectControl is nil, TFO client isn't implemented on this platform
+var tfoConnectControl func(failed *int32) func(network, address string, c syscall.RawConn) error
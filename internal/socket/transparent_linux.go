@@ -0,0 +1,62 @@
+package socket
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"github.com/studentmain/socks6/message"
+	"golang.org/x/sys/unix"
+)
+
+// DialTransparentWithOption works like DialWithOption, but originate the connection from src
+// by setting IP_TRANSPARENT on socket, require CAP_NET_ADMIN and proper routing rule
+func DialTransparentWithOption(ctx context.Context, src net.Addr, addr message.SocksAddr, opt message.StackOptionInfo, check func(net.IP) error) (net.Conn, message.StackOptionInfo, error) {
+	appliedOption := message.StackOptionInfo{}
+
+	ip := transparentSourceIP(src)
+	if ip == nil {
+		return DialWithOption(ctx, addr, opt, check)
+	}
+	dialer := net.Dialer{
+		// use a random port, original port may still in use by client side connection
+		LocalAddr: &net.TCPAddr{IP: ip},
+		Control: checkIPControl(check, func(network, address string, c syscall.RawConn) error {
+			var err2 error
+			err := c.Control(func(fd uintptr) {
+				if ip.To4() != nil {
+					err2 = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+				} else {
+					err2 = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return err2
+		}),
+	}
+
+	// source address family decide which address family can be used
+	network := "tcp6"
+	if ip.To4() != nil {
+		network = "tcp4"
+	}
+	conn, err := dialer.DialContext(ctx, network, addr.String())
+	if err != nil {
+		return nil, appliedOption, err
+	}
+	appliedOption.Combine(SetConnOpt(conn, opt))
+	return conn, appliedOption, nil
+}
+
+// transparentSourceIP extract IP address from client address
+func transparentSourceIP(src net.Addr) net.IP {
+	switch a := src.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package socket
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/studentmain/socks6/message"
+)
+
+// DialTransparentWithOption is only supported on linux
+func DialTransparentWithOption(ctx context.Context, src net.Addr, addr message.SocksAddr, opt message.StackOptionInfo, check func(net.IP) error) (net.Conn, message.StackOptionInfo, error) {
+	return nil, nil, errors.New("transparent outbound is not supported on this platform")
+}
@@ -0,0 +1,66 @@
+package socket
+
+import (
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// not defined in x/sys yet
+const (
+	udpSegment = 103 // UDP_SEGMENT
+	udpGRO     = 104 // UDP_GRO
+)
+
+// UDPOffloadSupported indicate whether UDP GSO/GRO works on this platform
+const UDPOffloadSupported = true
+
+// GROBufferSize is oob buffer size required by ReadMsgGRO
+const GROBufferSize = 64
+
+// EnableUDPGRO set UDP_GRO on socket, then ReadMsgGRO may return coalesced datagrams
+func EnableUDPGRO(pc *net.UDPConn) bool {
+	rc, err := pc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var err2 error
+	err = rc.Control(func(fd uintptr) {
+		err2 = unix.SetsockoptInt(int(fd), unix.IPPROTO_UDP, udpGRO, 1)
+	})
+	return err == nil && err2 == nil
+}
+
+// ReadMsgGRO read datagram from socket, segSize is size of each coalesced datagram, 0 means not coalesced.
+// oob should be large enough to hold UDP_GRO control message.
+func ReadMsgGRO(pc *net.UDPConn, b []byte, oob []byte) (n int, segSize int, addr *net.UDPAddr, err error) {
+	n, oobn, _, addr, err := pc.ReadMsgUDP(b, oob)
+	if err != nil {
+		return n, 0, addr, err
+	}
+	cmsgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return n, 0, addr, nil
+	}
+	for _, c := range cmsgs {
+		if c.Header.Level == unix.IPPROTO_UDP && c.Header.Type == udpGRO && len(c.Data) >= 4 {
+			segSize = int(*(*int32)(unsafe.Pointer(&c.Data[0])))
+		}
+	}
+	return n, segSize, addr, nil
+}
+
+// WriteMsgGSO send b as datagrams of segSize bytes to addr in one syscall,
+// only last datagram can be shorter than segSize
+func WriteMsgGSO(pc *net.UDPConn, b []byte, segSize int, addr *net.UDPAddr) error {
+	oob := make([]byte, unix.CmsgSpace(2))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = unix.IPPROTO_UDP
+	h.Type = udpSegment
+	h.SetLen(unix.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&oob[unix.CmsgLen(0)])) = uint16(segSize)
+
+	_, _, err := pc.WriteMsgUDP(b, oob, addr)
+	return err
+}
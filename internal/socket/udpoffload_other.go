@@ -0,0 +1,31 @@
+//go:build !linux
+
+package socket
+
+import (
+	"errors"
+	"net"
+)
+
+// UDPOffloadSupported indicate whether UDP GSO/GRO works on this platform
+const UDPOffloadSupported = false
+
+// GROBufferSize is oob buffer size required by ReadMsgGRO
+const GROBufferSize = 0
+
+var errUDPOffloadNotSupported = errors.New("UDP GSO/GRO is not supported on this platform")
+
+// EnableUDPGRO is only supported on linux
+func EnableUDPGRO(pc *net.UDPConn) bool {
+	return false
+}
+
+// ReadMsgGRO is only supported on linux
+func ReadMsgGRO(pc *net.UDPConn, b []byte, oob []byte) (n int, segSize int, addr *net.UDPAddr, err error) {
+	return 0, 0, nil, errUDPOffloadNotSupported
+}
+
+// WriteMsgGSO is only supported on linux
+func WriteMsgGSO(pc *net.UDPConn, b []byte, segSize int, addr *net.UDPAddr) error {
+	return errUDPOffloadNotSupported
+}
@@ -5,7 +5,9 @@ import (
 	"encoding/binary"
 	"io"
 	"net"
+	"net/netip"
 	"strconv"
+	"strings"
 
 	"github.com/studentmain/socks6/common/arrayx"
 	"github.com/studentmain/socks6/common/lg"
@@ -30,6 +32,9 @@ type SocksAddr struct {
 	Address []byte
 	// port used by transport layer protocol
 	Port uint16
+	// IPv6 zone identifier, e.g. "eth0" of fe80::1%eth0, empty for other address types.
+	// It's only meaningful locally and not included in wireformat.
+	Zone string
 }
 
 var _ net.Addr = &SocksAddr{}
@@ -69,6 +74,7 @@ func ParseAddr(addr string) *SocksAddr {
 func ConvertAddr(addr net.Addr) *SocksAddr {
 	var ip net.IP
 	var port int
+	var zone string
 	if addr == nil {
 		return DefaultAddr
 	}
@@ -76,9 +82,11 @@ func ConvertAddr(addr net.Addr) *SocksAddr {
 	case *net.TCPAddr:
 		ip = a.IP
 		port = a.Port
+		zone = a.Zone
 	case *net.UDPAddr:
 		ip = a.IP
 		port = a.Port
+		zone = a.Zone
 	case *SocksAddr:
 		return a
 	default:
@@ -90,11 +98,28 @@ func ConvertAddr(addr net.Addr) *SocksAddr {
 	if ip4 := ip.To4(); ip4 != nil {
 		af = AddressTypeIPv4
 		ip = ip4
+		zone = ""
 	}
 	return &SocksAddr{
 		AddressType: af,
 		Address:     ip,
 		Port:        uint16(port),
+		Zone:        zone,
+	}
+}
+
+// AddrFromAddrPort convert netip.AddrPort to SocksAddr, IPv4-mapped IPv6 address is converted to IPv4
+func AddrFromAddrPort(ap netip.AddrPort) *SocksAddr {
+	ip := ap.Addr().Unmap()
+	af := AddressTypeIPv6
+	if ip.Is4() {
+		af = AddressTypeIPv4
+	}
+	return &SocksAddr{
+		AddressType: af,
+		Address:     ip.AsSlice(),
+		Port:        ap.Port(),
+		Zone:        ip.Zone(),
 	}
 }
 
@@ -114,17 +139,11 @@ func NewAddr(address string) (*SocksAddr, error) {
 	if len(h) == 0 {
 		atyp = AddressTypeIPv4
 		addr = []byte{0, 0, 0, 0}
-	} else if ip := net.ParseIP(h); ip != nil {
-		// is ip address
-		if ip4 := ip.To4(); ip4 != nil {
-			// is ipv4, use 4 byte IP
-			atyp = AddressTypeIPv4
-			addr = ip4
-		} else {
-			// ipv6
-			atyp = AddressTypeIPv6
-			addr = ip
-		}
+	} else if ip, err := netip.ParseAddr(h); err == nil {
+		// is ip address, may have IPv6 zone
+		return AddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+	} else if strings.Contains(h, "%") {
+		return nil, ErrFormat.WithVerbose("zone is only allowed on IPv6 address")
 	} else {
 		// is domain name
 		// convert to punycode encoded format
@@ -154,45 +173,118 @@ func (a *SocksAddr) Network() string {
 func (a *SocksAddr) String() string {
 	var h string
 	switch a.AddressType {
-	case AddressTypeIPv4, AddressTypeIPv6:
+	case AddressTypeIPv4:
 		h = net.IP(a.Address).String()
+	case AddressTypeIPv6:
+		h = net.IP(a.Address).String()
+		if a.Zone != "" {
+			h += "%" + a.Zone
+		}
 	case AddressTypeDomainName:
 		h = string(a.Address)
+	default:
+		if ah, ok := customAddressType(a.AddressType); ok {
+			h = ah.string(a.Address)
+		}
 	}
 	return net.JoinHostPort(h, strconv.FormatInt(int64(a.Port), 10))
 }
 
+// Addr return IP address of a, false if a is domain name or malformed
+func (a *SocksAddr) Addr() (netip.Addr, bool) {
+	if a.AddressType != AddressTypeIPv4 && a.AddressType != AddressTypeIPv6 {
+		return netip.Addr{}, false
+	}
+	ip, ok := netip.AddrFromSlice(a.Address)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	// net.IP may store IPv4 address in 16 bytes
+	if a.AddressType == AddressTypeIPv4 {
+		ip = ip.Unmap()
+		if !ip.Is4() {
+			return netip.Addr{}, false
+		}
+		return ip, true
+	}
+	return ip.WithZone(a.Zone), true
+}
+
+// AddrPort return IP address and port of a, false if a is domain name or malformed
+func (a *SocksAddr) AddrPort() (netip.AddrPort, bool) {
+	ip, ok := a.Addr()
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(ip, a.Port), true
+}
+
+// TCPAddr convert a to *net.TCPAddr, false if a is domain name or malformed
+func (a *SocksAddr) TCPAddr() (*net.TCPAddr, bool) {
+	ap, ok := a.AddrPort()
+	if !ok {
+		return nil, false
+	}
+	return net.TCPAddrFromAddrPort(ap), true
+}
+
+// UDPAddr convert a to *net.UDPAddr, false if a is domain name or malformed
+func (a *SocksAddr) UDPAddr() (*net.UDPAddr, bool) {
+	ap, ok := a.AddrPort()
+	if !ok {
+		return nil, false
+	}
+	return net.UDPAddrFromAddrPort(ap), true
+}
+
 // Marshal6 serialize to socks 6 wireformat
 func (a *SocksAddr) Marshal6(pad byte) []byte {
+	return a.AppendTo6(nil, pad)
+}
+
+// AppendTo6 append socks 6 wireformat to b and return the extended buffer
+func (a *SocksAddr) AppendTo6(b []byte, pad byte) []byte {
 	lg.Debugf("serialize socks 6 address %+v, padding %d", a, pad)
-	b := &bytes.Buffer{}
-	binary.Write(b, binary.BigEndian, a.Port)
-	b.WriteByte(pad)
-	b.WriteByte(byte(a.AddressType))
+	start := len(b)
+	b = append(b, byte(a.Port>>8), byte(a.Port), pad, byte(a.AddressType))
 
+	data := a.Address
 	npad := 0
 	if a.AddressType == AddressTypeDomainName {
 		l := 1 + len(a.Address)
 		total := arrayx.PaddedLen(l, 4)
 		lg.Debugf("serialize socks 6 address domain name, padding %d to %d", total, l)
-		if total > 255 {
+		// length byte doesn't count itself
+		if total-1 > 255 {
 			lg.Panic("address too long")
 		}
-		b.WriteByte(byte(total))
+		b = append(b, byte(total-1))
 		npad = total - l
+	} else if ah, ok := customAddressType(a.AddressType); ok {
+		// length byte is actual length, padding is not counted
+		data = ah.marshal(a.Address)
+		if len(data) > 255 {
+			lg.Panic("address too long")
+		}
+		b = append(b, byte(len(data)))
+		npad = arrayx.PaddedLen(1+len(data), 4) - 1 - len(data)
 	}
-	b.Write(a.Address)
-	if npad > 0 {
-		b.Write(make([]byte, npad))
+	b = append(b, data...)
+	for i := 0; i < npad; i++ {
+		b = append(b, 0)
 	}
 
-	ret := b.Bytes()
-	lg.Debugf("serialize socks 6 address %+v to %+v", a, ret)
-	return ret
+	lg.Debugf("serialize socks 6 address %+v to %+v", a, b[start:])
+	return b
 }
 
 // ParseSocksAddr6FromWithLimit parse socks 6 address with border check
 func ParseSocksAddr6FromWithLimit(b io.Reader, limit int) (addr *SocksAddr, pad byte, nConsume int, err error) {
+	return parseSocksAddr6From(b, limit, false)
+}
+
+// parseSocksAddr6From parse socks 6 address with border check, domain name padding is checked when strict
+func parseSocksAddr6From(b io.Reader, limit int, strict bool) (addr *SocksAddr, pad byte, nConsume int, err error) {
 	lg.Debugf("read socks 6 address withing %d byte", limit)
 	if limit <= 4 {
 		return nil, 0, 0, ErrBufferSize
@@ -219,7 +311,7 @@ func ParseSocksAddr6FromWithLimit(b io.Reader, limit int) (addr *SocksAddr, pad
 		}
 		lg.Debug("read socks 6 address domain name length", buf[0])
 		l := buf[0]
-		if int(l)+5 >= limit {
+		if int(l)+5 > limit {
 			return nil, 0, 0, ErrBufferSize
 		}
 		// read addr
@@ -227,6 +319,12 @@ func ParseSocksAddr6FromWithLimit(b io.Reader, limit int) (addr *SocksAddr, pad
 			return nil, 0, 0, err
 		}
 		lg.Debug("read socks 6 address domain raw", buf[:l])
+		if strict {
+			name := bytes.TrimRight(buf[:l], "\x00")
+			if len(name) == 0 || bytes.IndexByte(name, 0) >= 0 || arrayx.PaddedLen(len(name)+1, 4)-1 != int(l) {
+				return nil, 0, 0, ErrPadding.WithVerbose("domain name %q not padded to multiple of 4 with zeros", buf[:l])
+			}
+		}
 		// remove padding
 		addr.Address = bytes.Trim(buf[:l], "\x00")
 		lg.Debug("read socks 6 address domain trimmed", addr.Address)
@@ -243,6 +341,9 @@ func ParseSocksAddr6FromWithLimit(b io.Reader, limit int) (addr *SocksAddr, pad
 		case AddressTypeIPv4:
 			l = 4
 		default:
+			if ah, ok := customAddressType(addr.AddressType); ok {
+				return parseCustomAddrData(b, buf, addr, ah, padding, limit)
+			}
 			// unknown address type
 			return nil, 0, 0, ErrAddressTypeNotSupport
 		}
@@ -260,6 +361,32 @@ func ParseSocksAddr6FromWithLimit(b io.Reader, limit int) (addr *SocksAddr, pad
 	}
 }
 
+// parseCustomAddrData parse length and data of address type registered by RegisterAddressType,
+// port and address type are already read into addr
+func parseCustomAddrData(b io.Reader, buf []byte, addr *SocksAddr, ah AddressTypeHandler, padding byte, limit int) (*SocksAddr, byte, int, error) {
+	if limit <= 5 {
+		return nil, 0, 0, ErrBufferSize
+	}
+	if _, err := io.ReadFull(b, buf[:1]); err != nil {
+		return nil, 0, 0, err
+	}
+	l := int(buf[0])
+	total := arrayx.PaddedLen(1+l, 4) + 4
+	if total > limit {
+		return nil, 0, 0, ErrBufferSize
+	}
+	if _, err := io.ReadFull(b, buf[:total-5]); err != nil {
+		return nil, 0, 0, err
+	}
+	a, err := ah.parse(arrayx.Dup(buf[:l]))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	addr.Address = a
+	lg.Debugf("read socks 6 address %+v, padding %d, used %d", addr, padding, total)
+	return addr, padding, total, nil
+}
+
 // ParseSocksAddr6FromWithLimit parse socks 6 address with border set to 260 byte
 func ParseSocksAddr6From(b io.Reader) (addr *SocksAddr, pad byte, nConsume int, err error) {
 	return ParseSocksAddr6FromWithLimit(b, 260)
@@ -1,6 +1,10 @@
 package message_test
 
 import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -112,6 +116,114 @@ func TestAddrString(t *testing.T) {
 	}
 }
 
+func TestAddrMarshal6Domain(t *testing.T) {
+	tests := []struct {
+		addr string
+		bin  []byte
+	}{
+		{addr: "aa:1", bin: []byte{0, 1, 0, 3, 3, 'a', 'a', 0}},
+		{addr: "aaa:1", bin: []byte{0, 1, 0, 3, 3, 'a', 'a', 'a'}},
+		{addr: "localhost:2", bin: []byte{0, 2, 0, 3, 11, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't', 0, 0}},
+	}
+	for _, tt := range tests {
+		a := message.ParseAddr(tt.addr)
+		b := a.Marshal6(0)
+		assert.Equal(t, tt.bin, b)
+		a2, _, n, err := message.ParseSocksAddr6From(bytes.NewReader(b))
+		assert.NoError(t, err)
+		assert.Equal(t, len(b), n)
+		assert.Equal(t, a, a2)
+	}
+}
+
+func TestAddrCustomType(t *testing.T) {
+	const atyp = message.AddressType(0x80)
+	assert.Error(t, message.RegisterAddressType(message.AddressTypeIPv4, message.AddressTypeHandler{}))
+
+	a := &message.SocksAddr{AddressType: atyp, Address: []byte("node1"), Port: 1}
+	b := a.Marshal6(0)
+	_, _, _, err := message.ParseSocksAddr6From(bytes.NewReader(b))
+	assert.ErrorIs(t, err, message.ErrAddressTypeNotSupport)
+	assert.False(t, atyp.IsCustom())
+
+	assert.NoError(t, message.RegisterAddressType(atyp, message.AddressTypeHandler{
+		String: func(addr []byte) string { return "node-" + string(addr) },
+	}))
+	defer message.UnregisterAddressType(atyp)
+	assert.True(t, atyp.IsCustom())
+
+	b = a.Marshal6(0)
+	assert.Equal(t, []byte{0, 1, 0, 0x80, 5, 'n', 'o', 'd', 'e', '1', 0, 0}, b)
+	a2, _, n, err := message.ParseSocksAddr6From(bytes.NewReader(b))
+	assert.NoError(t, err)
+	assert.Equal(t, len(b), n)
+	assert.Equal(t, a, a2)
+	assert.Equal(t, "node-node1:1", a2.String())
+
+	_, _, _, err = message.ParseSocksAddr6From(bytes.NewReader(b[:8]))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestAddrNetIP(t *testing.T) {
+	tests := []struct {
+		in   netip.AddrPort
+		atyp message.AddressType
+		out  netip.AddrPort
+	}{
+		{in: netip.MustParseAddrPort("127.0.0.1:1"), atyp: message.AddressTypeIPv4, out: netip.MustParseAddrPort("127.0.0.1:1")},
+		{in: netip.MustParseAddrPort("[::ffff:127.0.0.1]:2"), atyp: message.AddressTypeIPv4, out: netip.MustParseAddrPort("127.0.0.1:2")},
+		{in: netip.MustParseAddrPort("[fe80::1]:3"), atyp: message.AddressTypeIPv6, out: netip.MustParseAddrPort("[fe80::1]:3")},
+	}
+	for _, tt := range tests {
+		a := message.AddrFromAddrPort(tt.in)
+		assert.Equal(t, tt.atyp, a.AddressType)
+		assert.Equal(t, a, message.ConvertAddr(net.TCPAddrFromAddrPort(tt.in)))
+
+		ap, ok := a.AddrPort()
+		assert.True(t, ok)
+		assert.Equal(t, tt.out, ap)
+		ta, ok := a.TCPAddr()
+		assert.True(t, ok)
+		assert.Equal(t, tt.out, ta.AddrPort())
+		ua, ok := a.UDPAddr()
+		assert.True(t, ok)
+		assert.Equal(t, tt.out, ua.AddrPort())
+	}
+
+	d := message.ParseAddr("example.com:1")
+	_, ok := d.AddrPort()
+	assert.False(t, ok)
+	_, ok = d.TCPAddr()
+	assert.False(t, ok)
+	_, ok = (&message.SocksAddr{AddressType: message.AddressTypeIPv4, Address: []byte{1, 2}}).Addr()
+	assert.False(t, ok)
+}
+
+func TestAddrZone(t *testing.T) {
+	a, err := message.NewAddr("[fe80::1%eth0]:80")
+	assert.NoError(t, err)
+	assert.Equal(t, message.AddressTypeIPv6, a.AddressType)
+	assert.Equal(t, "eth0", a.Zone)
+	assert.Equal(t, "[fe80::1%eth0]:80", a.String())
+
+	ap, ok := a.AddrPort()
+	assert.True(t, ok)
+	assert.Equal(t, netip.MustParseAddrPort("[fe80::1%eth0]:80"), ap)
+	assert.Equal(t, a, message.AddrFromAddrPort(ap))
+	ua, _ := a.UDPAddr()
+	assert.Equal(t, "eth0", ua.Zone)
+	assert.Equal(t, a, message.ConvertAddr(ua))
+
+	// zone is not in wireformat
+	a2, _, _, err := message.ParseSocksAddr6From(bytes.NewReader(a.Marshal6(0)))
+	assert.NoError(t, err)
+	assert.Equal(t, "", a2.Zone)
+	assert.Equal(t, "[fe80::1]:80", a2.String())
+
+	_, err = message.NewAddr("1.2.3.4%eth0:80")
+	assert.Error(t, err)
+}
+
 /*
 func TestAddrMarshalAddress(t *testing.T) {
 	tests := []struct {
@@ -0,0 +1,80 @@
+package message
+
+import "sync"
+
+// AddressTypeHandler describe an address type registered by RegisterAddressType.
+// Its wireformat is a length byte followed by address data, padded with zeros to multiple of 4.
+type AddressTypeHandler struct {
+	// Parse check and convert address data in wireformat to SocksAddr.Address, nil means accept data as is
+	Parse func(b []byte) ([]byte, error)
+	// Marshal convert SocksAddr.Address to address data in wireformat, nil means use it as is
+	Marshal func(addr []byte) []byte
+	// String format SocksAddr.Address as host part of SocksAddr.String, nil means string(addr)
+	String func(addr []byte) string
+}
+
+var (
+	addressTypeMtx      sync.RWMutex
+	customAddressTypes  = map[AddressType]AddressTypeHandler{}
+	builtinAddressTypes = map[AddressType]bool{
+		AddressTypeIPv4:       true,
+		AddressTypeDomainName: true,
+		AddressTypeIPv6:       true,
+	}
+)
+
+// RegisterAddressType add an address type, so private deployments can carry non-IP endpoints in messages.
+// Types defined by the spec can't be overridden. Unregistered types are still rejected by ErrAddressTypeNotSupport
+func RegisterAddressType(t AddressType, h AddressTypeHandler) error {
+	if builtinAddressTypes[t] {
+		return ErrAddressTypeNotSupport.WithVerbose("address type %d is defined by the spec", t)
+	}
+	addressTypeMtx.Lock()
+	defer addressTypeMtx.Unlock()
+	customAddressTypes[t] = h
+	return nil
+}
+
+// UnregisterAddressType remove an address type added by RegisterAddressType
+func UnregisterAddressType(t AddressType) {
+	addressTypeMtx.Lock()
+	defer addressTypeMtx.Unlock()
+	delete(customAddressTypes, t)
+}
+
+func customAddressType(t AddressType) (AddressTypeHandler, bool) {
+	if builtinAddressTypes[t] {
+		return AddressTypeHandler{}, false
+	}
+	addressTypeMtx.RLock()
+	defer addressTypeMtx.RUnlock()
+	h, ok := customAddressTypes[t]
+	return h, ok
+}
+
+// IsCustom check whether t is added by RegisterAddressType
+func (t AddressType) IsCustom() bool {
+	_, ok := customAddressType(t)
+	return ok
+}
+
+func (h AddressTypeHandler) parse(b []byte) ([]byte, error) {
+	if h.Parse == nil {
+		return b, nil
+	}
+	return h.Parse(b)
+}
+
+func (h AddressTypeHandler) marshal(addr []byte) []byte {
+	if h.Marshal == nil {
+		return addr
+	}
+	return h.Marshal(addr)
+}
+
+func (h AddressTypeHandler) string(addr []byte) string {
+	if h.String == nil {
+		return string(addr)
+	}
+	return h.String(addr)
+}
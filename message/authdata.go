@@ -0,0 +1,46 @@
+package message
+
+// MaxAuthenticationDataChunk is max method data carried by one authentication data option,
+// option length is 16 bit and include 4 bytes header and method id
+const MaxAuthenticationDataChunk = 0xffff - 5
+
+// NewAuthenticationDataOptions split data of method into as many authentication data options as needed,
+// in the order they should be sent. Return nil when data is empty
+func NewAuthenticationDataOptions(method byte, data []byte) []Option {
+	ops := []Option{}
+	for len(data) > 0 {
+		l := len(data)
+		if l > MaxAuthenticationDataChunk {
+			l = MaxAuthenticationDataChunk
+		}
+		ops = append(ops, Option{Kind: OptionKindAuthenticationData, Data: AuthenticationDataOptionData{
+			Method: method,
+			Data:   data[:l],
+		}})
+		data = data[l:]
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	return ops
+}
+
+// GetAuthenticationData reassemble method's data from all its authentication data options in ops,
+// false when method has no data
+func GetAuthenticationData(ops *OptionSet, method byte) ([]byte, bool) {
+	d, ok := GetAllAuthenticationData(ops)[method]
+	return d, ok
+}
+
+// GetAllAuthenticationData reassemble data of each method from authentication data options in ops
+func GetAllAuthenticationData(ops *OptionSet) map[byte][]byte {
+	r := map[byte][]byte{}
+	for _, op := range ops.GetKind(OptionKindAuthenticationData) {
+		d, ok := op.Data.(AuthenticationDataOptionData)
+		if !ok {
+			continue
+		}
+		r[d.Method] = append(r[d.Method], d.Data...)
+	}
+	return r
+}
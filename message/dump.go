@@ -0,0 +1,323 @@
+package message
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+var commandCodeName = map[CommandCode]string{
+	CommandNoop:         "NOOP",
+	CommandConnect:      "CONNECT",
+	CommandBind:         "BIND",
+	CommandUdpAssociate: "UDP ASSOCIATE",
+}
+
+func (c CommandCode) String() string {
+	return enumName(commandCodeName, c)
+}
+
+var replyCodeName = map[ReplyCode]string{
+	OperationReplySuccess:             "Success",
+	OperationReplyServerFailure:       "ServerFailure",
+	OperationReplyNotAllowedByRule:    "NotAllowedByRule",
+	OperationReplyNetworkUnreachable:  "NetworkUnreachable",
+	OperationReplyHostUnreachable:     "HostUnreachable",
+	OperationReplyConnectionRefused:   "ConnectionRefused",
+	OperationReplyTTLExpired:          "TTLExpired",
+	OperationReplyCommandNotSupported: "CommandNotSupported",
+	OperationReplyAddressNotSupported: "AddressNotSupported",
+	OperationReplyTimeout:             "Timeout",
+}
+
+func (c ReplyCode) String() string {
+	return enumName(replyCodeName, c)
+}
+
+var authenticationReplyTypeName = map[AuthenticationReplyType]string{
+	AuthenticationReplySuccess: "Success",
+	AuthenticationReplyFail:    "Fail",
+}
+
+func (t AuthenticationReplyType) String() string {
+	return enumName(authenticationReplyTypeName, t)
+}
+
+var udpHeaderTypeName = map[UDPHeaderType]string{
+	UDPMessageAssociationInit: "AssociationInit",
+	UDPMessageAssociationAck:  "AssociationAck",
+	UDPMessageDatagram:        "Datagram",
+	UDPMessageError:           "Error",
+	UDPMessageFragment:        "Fragment",
+	UDPMessageStackOption:     "StackOption",
+}
+
+func (t UDPHeaderType) String() string {
+	return enumName(udpHeaderTypeName, t)
+}
+
+var udpErrorTypeName = map[UDPErrorType]string{
+	UDPErrorNetworkUnreachable: "NetworkUnreachable",
+	UDPErrorHostUnreachable:    "HostUnreachable",
+	UDPErrorTTLExpired:         "TTLExpired",
+	UDPErrorDatagramTooBig:     "DatagramTooBig",
+}
+
+func (t UDPErrorType) String() string {
+	return enumName(udpErrorTypeName, t)
+}
+
+var optionKindName = map[OptionKind]string{
+	OptionKindStack: "Stack",
+
+	OptionKindAuthenticationMethodAdvertisement: "AuthenticationMethodAdvertisement",
+	OptionKindAuthenticationMethodSelection:     "AuthenticationMethodSelection",
+	OptionKindAuthenticationData:                "AuthenticationData",
+
+	OptionKindSessionRequest:  "SessionRequest",
+	OptionKindSessionID:       "SessionID",
+	OptionKindSessionOK:       "SessionOK",
+	OptionKindSessionInvalid:  "SessionInvalid",
+	OptionKindSessionTeardown: "SessionTeardown",
+
+	OptionKindTokenRequest:           "TokenRequest",
+	OptionKindIdempotenceWindow:      "IdempotenceWindow",
+	OptionKindIdempotenceExpenditure: "IdempotenceExpenditure",
+	OptionKindIdempotenceAccepted:    "IdempotenceAccepted",
+	OptionKindIdempotenceRejected:    "IdempotenceRejected",
+
+	OptionKindStreamID:             "StreamID",
+	OptionKindUDPAssociationResume: "UDPAssociationResume",
+	OptionKindMultiplex:            "Multiplex",
+	OptionKindPadding:              "Padding",
+}
+
+func (k OptionKind) String() string {
+	if n, ok := optionKindName[k]; ok {
+		return n
+	}
+	return fmt.Sprintf("Kind(0x%04x)", uint16(k))
+}
+
+var stackOptionLevelName = map[StackOptionLevel]string{
+	StackOptionLevelIP:   "IP",
+	StackOptionLevelIPv4: "IPv4",
+	StackOptionLevelIPv6: "IPv6",
+	StackOptionLevelTCP:  "TCP",
+	StackOptionLevelUDP:  "UDP",
+}
+
+func (l StackOptionLevel) String() string {
+	return enumName(stackOptionLevelName, l)
+}
+
+var stackOptionName = map[int]string{
+	StackOptionIPTOS:                 "TOS",
+	StackOptionIPHappyEyeball:        "HappyEyeball",
+	StackOptionIPTTL:                 "TTL",
+	StackOptionIPNoFragment:          "NoFragment",
+	StackOptionTCPTFO:                "TFO",
+	StackOptionTCPMultipath:          "Multipath",
+	StackOptionTCPBacklog:            "Backlog",
+	StackOptionUDPUDPError:           "UDPError",
+	StackOptionUDPPortParity:         "PortParity",
+	StackOptionUDPMulticastJoin:      "MulticastJoin",
+	StackOptionUDPMulticastLeave:     "MulticastLeave",
+	StackOptionUDPMulticastInterface: "MulticastInterface",
+	StackOptionUDPMaxPayload:         "MaxPayload",
+}
+
+func enumName[T ~byte](names map[T]string, v T) string {
+	if n, ok := names[v]; ok {
+		return n
+	}
+	return fmt.Sprintf("Unknown(%d)", byte(v))
+}
+
+func (s BaseStackOptionData) String() string {
+	legs := []string{}
+	if s.ClientLeg {
+		legs = append(legs, "client")
+	}
+	if s.RemoteLeg {
+		legs = append(legs, "remote")
+	}
+	name, ok := stackOptionName[StackOptionID(s.Level, s.Code)]
+	if !ok {
+		name = fmt.Sprintf("Code(%d)", s.Code)
+	}
+	val := ""
+	if s.Data != nil {
+		val = optionValueString(s.Data.GetData())
+	}
+	return fmt.Sprintf("%s %s=%s [%s]", s.Level, name, val, strings.Join(legs, ","))
+}
+
+// optionValueString render value of option or stack option data
+func optionValueString(v interface{}) string {
+	switch d := v.(type) {
+	case []byte:
+		return hexString(d)
+	case *RawOptionData:
+		return hexString(d.Data)
+	case fmt.Stringer:
+		return d.String()
+	default:
+		return fmt.Sprintf("%+v", v)
+	}
+}
+
+func hexString(b []byte) string {
+	if len(b) == 0 {
+		return "<empty>"
+	}
+	return hex.EncodeToString(b)
+}
+
+// String render option in one line, e.g. "SessionID 00000001"
+func (o Option) String() string {
+	switch d := o.Data.(type) {
+	case nil:
+		return o.Kind.String()
+	case SessionRequestOptionData, SessionOKOptionData, SessionInvalidOptionData, SessionTeardownOptionData,
+		IdempotenceAcceptedOptionData, IdempotenceRejectedOptionData, MultiplexOptionData:
+		return o.Kind.String()
+	case AuthenticationMethodAdvertisementOptionData:
+		return fmt.Sprintf("%s methods=%v initial-data=%d", o.Kind, d.Methods, d.InitialDataLength)
+	case AuthenticationMethodSelectionOptionData:
+		return fmt.Sprintf("%s method=%d", o.Kind, d.Method)
+	case AuthenticationDataOptionData:
+		return fmt.Sprintf("%s method=%d data=%s", o.Kind, d.Method, hexString(d.Data))
+	case SessionIDOptionData:
+		return fmt.Sprintf("%s %s", o.Kind, hexString(d.ID))
+	case TokenRequestOptionData:
+		return fmt.Sprintf("%s window=%d", o.Kind, d.WindowSize)
+	case IdempotenceWindowOptionData:
+		return fmt.Sprintf("%s base=%d size=%d", o.Kind, d.WindowBase, d.WindowSize)
+	case IdempotenceExpenditureOptionData:
+		return fmt.Sprintf("%s token=%d", o.Kind, d.Token)
+	case StreamIDOptionData:
+		return fmt.Sprintf("%s %d", o.Kind, d.ID)
+	case UDPAssociationResumeOptionData:
+		return fmt.Sprintf("%s %d", o.Kind, d.AssociationID)
+	default:
+		return fmt.Sprintf("%s %s", o.Kind, optionValueString(o.Data))
+	}
+}
+
+// String render options in one line
+func (s OptionSet) String() string {
+	ops := make([]string, len(s.list))
+	for i, op := range s.list {
+		ops[i] = op.String()
+	}
+	return "[" + strings.Join(ops, "; ") + "]"
+}
+
+// Dump render options one per line, each line is prefixed by indent
+func (s *OptionSet) Dump(indent string) string {
+	sb := strings.Builder{}
+	s.dumpTo(&sb, indent)
+	return sb.String()
+}
+
+func (s *OptionSet) dumpTo(sb *strings.Builder, indent string) {
+	if s == nil || len(s.list) == 0 {
+		sb.WriteString(indent + "(none)\n")
+		return
+	}
+	for _, op := range s.list {
+		sb.WriteString(indent + op.String() + "\n")
+	}
+}
+
+// dump render message fields in name, value pairs, then options
+func dump(title string, fields [][2]string, ops *OptionSet) string {
+	sb := strings.Builder{}
+	sb.WriteString(title + "\n")
+	for _, f := range fields {
+		sb.WriteString("  " + f[0] + ": " + f[1] + "\n")
+	}
+	if ops != nil {
+		sb.WriteString("  Options:\n")
+		ops.dumpTo(&sb, "    ")
+	}
+	return sb.String()
+}
+
+func (r *Request) String() string {
+	return fmt.Sprintf("Request{%s %s %s}", r.CommandCode, r.Endpoint, r.Options)
+}
+
+// Dump render request in multiple lines
+func (r *Request) Dump() string {
+	return dump("Request", [][2]string{
+		{"Command", r.CommandCode.String()},
+		{"Endpoint", fmt.Sprint(r.Endpoint)},
+	}, r.Options)
+}
+
+func (a *AuthenticationReply) String() string {
+	return fmt.Sprintf("AuthenticationReply{%s %s}", a.Type, a.Options)
+}
+
+// Dump render authentication reply in multiple lines
+func (a *AuthenticationReply) Dump() string {
+	return dump("AuthenticationReply", [][2]string{
+		{"Type", a.Type.String()},
+	}, a.Options)
+}
+
+func (o *OperationReply) String() string {
+	return fmt.Sprintf("OperationReply{%s %s %s}", o.ReplyCode, o.Endpoint, o.Options)
+}
+
+// Dump render operation reply in multiple lines
+func (o *OperationReply) Dump() string {
+	return dump("OperationReply", [][2]string{
+		{"Reply", o.ReplyCode.String()},
+		{"Endpoint", fmt.Sprint(o.Endpoint)},
+	}, o.Options)
+}
+
+func (u *UDPMessage) String() string {
+	switch u.Type {
+	case UDPMessageDatagram:
+		return fmt.Sprintf("UDPMessage{%s %d %s %d bytes}", u.Type, u.AssociationID, u.Endpoint, len(u.Data))
+	case UDPMessageFragment:
+		return fmt.Sprintf("UDPMessage{%s %d %s id=%d offset=%d more=%t %d bytes}",
+			u.Type, u.AssociationID, u.Endpoint, u.FragmentID, u.FragmentOffset, u.FragmentMore, len(u.Data))
+	case UDPMessageError:
+		return fmt.Sprintf("UDPMessage{%s %d %s %s from %s}", u.Type, u.AssociationID, u.Endpoint, u.ErrorCode, u.ErrorEndpoint)
+	case UDPMessageStackOption:
+		return fmt.Sprintf("UDPMessage{%s %d %s}", u.Type, u.AssociationID, u.Options)
+	default:
+		return fmt.Sprintf("UDPMessage{%s %d}", u.Type, u.AssociationID)
+	}
+}
+
+// Dump render UDP message in multiple lines
+func (u *UDPMessage) Dump() string {
+	fields := [][2]string{
+		{"Type", u.Type.String()},
+		{"Association", fmt.Sprint(u.AssociationID)},
+	}
+	switch u.Type {
+	case UDPMessageDatagram, UDPMessageFragment:
+		fields = append(fields, [2]string{"Endpoint", fmt.Sprint(u.Endpoint)})
+		if u.Type == UDPMessageFragment {
+			fields = append(fields,
+				[2]string{"Fragment", fmt.Sprintf("id=%d offset=%d more=%t", u.FragmentID, u.FragmentOffset, u.FragmentMore)})
+		}
+		fields = append(fields, [2]string{"Data", fmt.Sprintf("%d bytes", len(u.Data))})
+	case UDPMessageError:
+		fields = append(fields,
+			[2]string{"Endpoint", fmt.Sprint(u.Endpoint)},
+			[2]string{"Error", u.ErrorCode.String()},
+			[2]string{"ErrorEndpoint", fmt.Sprint(u.ErrorEndpoint)},
+		)
+	case UDPMessageStackOption:
+		return dump("UDPMessage", fields, u.Options)
+	}
+	return dump("UDPMessage", fields, nil)
+}
@@ -35,6 +35,31 @@ var ErrOptionTooLong = common.LeveledError{
 	Base:    ErrMessageProcess,
 	Level:   lg.LvWarning,
 }
+var ErrTooManyOptions = common.LeveledError{
+	Message: "too many options",
+	Base:    ErrMessageProcess,
+	Level:   lg.LvWarning,
+}
+var ErrInitialDataTooLong = common.LeveledError{
+	Message: "initial data too long",
+	Base:    ErrMessageProcess,
+	Level:   lg.LvWarning,
+}
+var ErrDuplicateOption = common.LeveledError{
+	Message: "duplicate option",
+	Base:    ErrMessageProcess,
+	Level:   lg.LvWarning,
+}
+var ErrPadding = common.LeveledError{
+	Message: "invalid padding",
+	Base:    ErrMessageProcess,
+	Level:   lg.LvWarning,
+}
+var ErrReservedOptionKind = common.LeveledError{
+	Message: "reserved option kind",
+	Base:    ErrMessageProcess,
+	Level:   lg.LvWarning,
+}
 
 var ErrStackOptionNoLeg = common.LeveledError{
 	Message: "stack option should have at least one leg",
@@ -0,0 +1,159 @@
+package message_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/studentmain/socks6/message"
+)
+
+// seed messages are same as those exchanged in e2e tests
+
+func seedOptions() []message.Option {
+	return []message.Option{
+		{Kind: message.OptionKindAuthenticationMethodAdvertisement, Data: message.AuthenticationMethodAdvertisementOptionData{
+			InitialDataLength: 4,
+			Methods:           []byte{2},
+		}},
+		{Kind: message.OptionKindAuthenticationData, Data: message.AuthenticationDataOptionData{
+			Method: 2,
+			Data:   []byte{1, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'},
+		}},
+		{Kind: message.OptionKindSessionRequest, Data: message.SessionRequestOptionData{}},
+		{Kind: message.OptionKindTokenRequest, Data: message.TokenRequestOptionData{WindowSize: 8}},
+		{Kind: message.OptionKindStack, Data: message.BaseStackOptionData{
+			ClientLeg: true,
+			RemoteLeg: true,
+			Level:     message.StackOptionLevelIP,
+			Code:      message.StackOptionCodeTOS,
+			Data:      &message.TOSOptionData{TOS: 4},
+		}},
+	}
+}
+
+func seedRequests() [][]byte {
+	ret := [][]byte{}
+	for _, addr := range []string{"127.0.0.1:1", "[::1]:2", "example.com:3"} {
+		r := message.NewRequest()
+		r.CommandCode = message.CommandConnect
+		r.Endpoint = message.ParseAddr(addr)
+		ret = append(ret, r.Marshal())
+		r.Options.AddMany(seedOptions())
+		ret = append(ret, r.Marshal())
+	}
+	return ret
+}
+
+func FuzzParseRequestFrom(f *testing.F) {
+	for _, b := range seedRequests() {
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r, err := message.ParseRequestFrom(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		r2, err := message.ParseRequestFrom(bytes.NewReader(r.Marshal()))
+		if err != nil {
+			t.Fatalf("parse marshaled request: %v", err)
+		}
+		if !bytes.Equal(r.Marshal(), r2.Marshal()) {
+			t.Fatal("request changed after round trip")
+		}
+	})
+}
+
+func FuzzParseOptionSetFrom(f *testing.F) {
+	s := message.NewOptionSet()
+	s.AddMany(seedOptions())
+	f.Add(s.Marshal())
+	for _, op := range seedOptions() {
+		f.Add(op.Marshal())
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		s, err := message.ParseOptionSetFrom(bytes.NewReader(b), len(b))
+		if err != nil {
+			return
+		}
+		mb := s.Marshal()
+		s2, err := message.ParseOptionSetFrom(bytes.NewReader(mb), len(mb))
+		if err != nil {
+			t.Fatalf("parse marshaled options: %v", err)
+		}
+		if !bytes.Equal(mb, s2.Marshal()) {
+			t.Fatal("options changed after round trip")
+		}
+	})
+}
+
+func FuzzParseAuthenticationReplyFrom(f *testing.F) {
+	f.Add(message.NewAuthenticationReplyWithType(message.AuthenticationReplyFail).Marshal())
+	a := message.NewAuthenticationReplyWithType(message.AuthenticationReplySuccess)
+	a.Options.Add(message.Option{Kind: message.OptionKindSessionID, Data: message.SessionIDOptionData{ID: []byte{1, 2, 3, 4}}})
+	a.Options.Add(message.Option{Kind: message.OptionKindIdempotenceWindow, Data: message.IdempotenceWindowOptionData{WindowBase: 1, WindowSize: 8}})
+	f.Add(a.Marshal())
+	f.Fuzz(func(t *testing.T, b []byte) {
+		a, err := message.ParseAuthenticationReplyFrom(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		a2, err := message.ParseAuthenticationReplyFrom(bytes.NewReader(a.Marshal()))
+		if err != nil {
+			t.Fatalf("parse marshaled authentication reply: %v", err)
+		}
+		if !bytes.Equal(a.Marshal(), a2.Marshal()) {
+			t.Fatal("authentication reply changed after round trip")
+		}
+	})
+}
+
+func FuzzParseUDPMessageFrom(f *testing.F) {
+	msgs := []*message.UDPMessage{
+		{Type: message.UDPMessageAssociationInit, AssociationID: 1},
+		{Type: message.UDPMessageAssociationAck, AssociationID: 1},
+		{Type: message.UDPMessageDatagram, AssociationID: 1, Endpoint: message.ParseAddr("127.0.0.1:1"), Data: []byte("ping")},
+		{Type: message.UDPMessageDatagram, AssociationID: 1, Endpoint: message.ParseAddr("example.com:1"), Data: []byte("ping")},
+		{
+			Type:          message.UDPMessageError,
+			AssociationID: 1,
+			Endpoint:      message.ParseAddr("127.0.0.1:1"),
+			ErrorEndpoint: message.ParseAddr("[::1]:0"),
+			ErrorCode:     message.UDPErrorHostUnreachable,
+		},
+		{
+			Type:           message.UDPMessageFragment,
+			AssociationID:  1,
+			Endpoint:       message.ParseAddr("127.0.0.1:1"),
+			FragmentID:     1,
+			FragmentOffset: 4,
+			FragmentMore:   true,
+			Data:           []byte("ping"),
+		},
+	}
+	for _, m := range msgs {
+		f.Add(m.Marshal())
+	}
+	f.Add(message.NewUDPPadding(1, 16).Marshal())
+	f.Fuzz(func(t *testing.T, b []byte) {
+		u, err := message.ParseUDPMessageFrom(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		u2, err := message.ParseUDPMessageFrom(bytes.NewReader(u.Marshal()))
+		if err != nil {
+			t.Fatalf("parse marshaled udp message: %v", err)
+		}
+		if !bytes.Equal(u.Marshal(), u2.Marshal()) {
+			t.Fatal("udp message changed after round trip")
+		}
+
+		// stream parser can't check length field with datagram size, compare parsers on marshaled message
+		u3 := &message.UDPMessage{}
+		if err := message.ParseUDPMessageInto(u.Marshal(), u3); err != nil {
+			t.Fatalf("in-place parser reject marshaled udp message: %v", err)
+		}
+		if !bytes.Equal(u.Marshal(), u3.Marshal()) {
+			t.Fatal("in-place parser disagree with stream parser")
+		}
+	})
+}
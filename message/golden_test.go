@@ -0,0 +1,148 @@
+package message_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6/message"
+)
+
+// testdata/golden contains byte-exact handshakes, each file is a conversation:
+//
+//	{"description": "...", "profile": "draft-11", "messages": [{"from": "client", "type": "request", "hex": "...", "message": {...}}]}
+//
+// profile is name of draft revision used by all messages, omitted means message.DefaultProfile.
+// type is one of request, authentication-reply, operation-reply, udp and data,
+// message is JSON form of the message, data is opaque bytes between messages (initial data, method specific data, etc.)
+type goldenFile struct {
+	Description string          `json:"description"`
+	Profile     string          `json:"profile"`
+	Messages    []goldenMessage `json:"messages"`
+}
+
+type goldenMessage struct {
+	From    string          `json:"from"`
+	Type    string          `json:"type"`
+	Hex     string          `json:"hex"`
+	Message json.RawMessage `json:"message"`
+}
+
+type goldenCodec struct {
+	parse func(c *message.ParseConfig, b *bytes.Reader) (interface{ Marshal() []byte }, error)
+	new   func() interface{ Marshal() []byte }
+}
+
+var goldenCodecs = map[string]goldenCodec{
+	"request": {
+		parse: func(c *message.ParseConfig, b *bytes.Reader) (interface{ Marshal() []byte }, error) {
+			return c.ParseRequestFrom(b)
+		},
+		new: func() interface{ Marshal() []byte } { return message.NewRequest() },
+	},
+	"authentication-reply": {
+		parse: func(c *message.ParseConfig, b *bytes.Reader) (interface{ Marshal() []byte }, error) {
+			return c.ParseAuthenticationReplyFrom(b)
+		},
+		new: func() interface{ Marshal() []byte } { return message.NewAuthenticationReply() },
+	},
+	"operation-reply": {
+		parse: func(c *message.ParseConfig, b *bytes.Reader) (interface{ Marshal() []byte }, error) {
+			return c.ParseOperationReplyFrom(b)
+		},
+		new: func() interface{ Marshal() []byte } { return message.NewOperationReply() },
+	},
+	"udp": {
+		parse: func(c *message.ParseConfig, b *bytes.Reader) (interface{ Marshal() []byte }, error) {
+			return c.ParseUDPMessageFrom(b)
+		},
+		new: func() interface{ Marshal() []byte } { return &message.UDPMessage{} },
+	},
+}
+
+// goldenProfileOf return address of message's draft revision field, JSON form doesn't carry it
+func goldenProfileOf(m interface{ Marshal() []byte }) **message.Profile {
+	switch m := m.(type) {
+	case *message.Request:
+		return &m.Profile
+	case *message.AuthenticationReply:
+		return &m.Profile
+	case *message.OperationReply:
+		return &m.Profile
+	case *message.UDPMessage:
+		return &m.Profile
+	}
+	panic("unknown message")
+}
+
+// goldenProfile find profile by name, empty name means DefaultProfile
+func goldenProfile(name string) (*message.Profile, bool) {
+	if name == "" {
+		return nil, true
+	}
+	for _, p := range message.KnownProfiles {
+		if p.Name == name {
+			if p == message.DefaultProfile {
+				return nil, true
+			}
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+func TestGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "golden", "*.json"))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, files)
+	for _, fn := range files {
+		t.Run(filepath.Base(fn), func(t *testing.T) {
+			b, err := os.ReadFile(fn)
+			assert.NoError(t, err)
+			f := goldenFile{}
+			assert.NoError(t, json.Unmarshal(b, &f))
+			assert.NotEmpty(t, f.Description)
+			profile, ok := goldenProfile(f.Profile)
+			if !assert.True(t, ok, "unknown profile %s", f.Profile) {
+				return
+			}
+			c := &message.ParseConfig{Profiles: message.KnownProfiles}
+			for i, m := range f.Messages {
+				wire, err := hex.DecodeString(m.Hex)
+				assert.NoError(t, err, "message %d", i)
+				if m.Type == "data" {
+					continue
+				}
+				codec, ok := goldenCodecs[m.Type]
+				if !assert.True(t, ok, "message %d unknown type %s", i, m.Type) {
+					continue
+				}
+
+				// wire -> message -> wire
+				r := bytes.NewReader(wire)
+				parsed, err := codec.parse(c, r)
+				if !assert.NoError(t, err, "message %d", i) {
+					continue
+				}
+				assert.Zero(t, r.Len(), "message %d not fully consumed", i)
+				assert.Equal(t, wire, parsed.Marshal(), "message %d", i)
+				assert.Equal(t, profile, *goldenProfileOf(parsed), "message %d", i)
+
+				// wire -> message -> json
+				j, err := json.Marshal(parsed)
+				assert.NoError(t, err, "message %d", i)
+				assert.JSONEq(t, string(m.Message), string(j), "message %d", i)
+
+				// json -> message -> wire
+				decoded := codec.new()
+				assert.NoError(t, json.Unmarshal(m.Message, decoded), "message %d", i)
+				*goldenProfileOf(decoded) = profile
+				assert.Equal(t, wire, decoded.Marshal(), "message %d", i)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package message
+
+import "encoding/json"
+
+// MarshalText implements encoding.TextMarshaler, address is encoded as host:port
+func (a *SocksAddr) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, see NewAddr
+func (a *SocksAddr) UnmarshalText(b []byte) error {
+	addr, err := NewAddr(string(b))
+	if err != nil {
+		return err
+	}
+	*a = *addr
+	return nil
+}
+
+// jsonOption is JSON representation of option, name is informative and ignored when decoding
+type jsonOption struct {
+	Kind OptionKind `json:"kind"`
+	Name string     `json:"name,omitempty"`
+	Data []byte     `json:"data"`
+}
+
+// MarshalJSON implements json.Marshaler, options are encoded as array of kind and wireformat data
+func (s *OptionSet) MarshalJSON() ([]byte, error) {
+	ops := make([]jsonOption, len(s.list))
+	for i, op := range s.list {
+		ops[i] = jsonOption{
+			Kind: op.Kind,
+			Name: op.Kind.String(),
+			Data: op.Data.Marshal(),
+		}
+	}
+	return json.Marshal(ops)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, option data is parsed by DefaultOptionRegistry
+func (s *OptionSet) UnmarshalJSON(b []byte) error {
+	ops := []jsonOption{}
+	if err := json.Unmarshal(b, &ops); err != nil {
+		return err
+	}
+	*s = *NewOptionSet()
+	for _, op := range ops {
+		if len(op.Data)+4 > MaxOptionSize {
+			return ErrOptionTooLong
+		}
+		if err := defaultParseConfig.checkOptionData(op.Kind, op.Data); err != nil {
+			return err
+		}
+		d, err := DefaultOptionRegistry.Parser(op.Kind)(op.Data)
+		if err != nil {
+			return err
+		}
+		s.Add(Option{Kind: op.Kind, Length: uint16(len(op.Data) + 4), Data: d})
+	}
+	return nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler, missing fields are set as NewRequest
+func (r *Request) UnmarshalJSON(b []byte) error {
+	type request Request
+	v := request(*NewRequest())
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*r = Request(v)
+	return nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler, missing fields are set as NewAuthenticationReply
+func (a *AuthenticationReply) UnmarshalJSON(b []byte) error {
+	type authenticationReply AuthenticationReply
+	v := authenticationReply(*NewAuthenticationReply())
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*a = AuthenticationReply(v)
+	return nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler, missing fields are set as NewOperationReply
+func (o *OperationReply) UnmarshalJSON(b []byte) error {
+	type operationReply OperationReply
+	v := operationReply(*NewOperationReply())
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*o = OperationReply(v)
+	return nil
+}
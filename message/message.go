@@ -22,9 +22,11 @@ const (
 )
 
 type Request struct {
-	CommandCode CommandCode
-	Endpoint    *SocksAddr
-	Options     *OptionSet
+	CommandCode CommandCode `json:"command"`
+	Endpoint    *SocksAddr  `json:"endpoint"`
+	Options     *OptionSet  `json:"options"`
+	// Profile is draft revision of the message, nil means DefaultProfile
+	Profile *Profile `json:"-"`
 }
 
 func NewRequest() *Request {
@@ -37,6 +39,17 @@ func NewRequest() *Request {
 	}
 }
 func ParseRequestFrom(b io.Reader) (*Request, error) {
+	return defaultParseConfig.ParseRequestFrom(b)
+}
+
+// ParseRequestFrom parses b as request with config c, error is wrapped in ParseError
+func (c *ParseConfig) ParseRequestFrom(b io.Reader) (*Request, error) {
+	rr := &recordReader{r: b}
+	m, err := c.parseRequestFrom(rr)
+	return m, rr.wrap("request", err)
+}
+
+func (c *ParseConfig) parseRequestFrom(b io.Reader) (*Request, error) {
 	lg.Debug("read request")
 	r := &Request{}
 	buf := internal.BytesPool64k.Rent()
@@ -47,9 +60,11 @@ func ParseRequestFrom(b io.Reader) (*Request, error) {
 	}
 	lg.Debug("read request version", buf[0])
 
-	if buf[0] != protocolVersion {
-		return r, NewErrVersionMismatch(int(buf[0]), buf[:1])
+	profile, ok := c.profile(buf[0])
+	if !ok {
+		return r, NewErrVersionMismatch(int(buf[0]), []byte{buf[0]})
 	}
+	r.Profile = profile
 	// ver cc opLen2
 	if _, err := io.ReadFull(b, buf[1:4]); err != nil {
 		return nil, err
@@ -59,39 +74,50 @@ func ParseRequestFrom(b io.Reader) (*Request, error) {
 	r.CommandCode = CommandCode(buf[1])
 	optLen := binary.BigEndian.Uint16(buf[2:])
 
-	addr, _, _, err := ParseSocksAddr6From(b)
+	addr, pad, _, err := parseSocksAddr6From(b, 260, c.Strict)
 	if err != nil {
 		return nil, err
 	}
+	if err := c.checkAddressPadding(pad); err != nil {
+		return nil, err
+	}
 	r.Endpoint = addr
 	lg.Debug("read request addr", addr)
 
-	ops, err := ParseOptionSetFrom(b, int(optLen))
+	ops, err := c.ParseOptionSetFrom(b, int(optLen))
 	if err != nil {
 		return nil, err
 	}
+	if err := c.checkInitialDataLength(ops); err != nil {
+		return nil, err
+	}
 	r.Options = ops
 	lg.Debug("read request option", ops)
 	return r, nil
 }
-func (r *Request) Marshal() (buf []byte) {
+func (r *Request) Marshal() []byte {
+	return r.AppendTo(nil)
+}
+
+// AppendTo append request's wireformat to b and return the extended buffer
+func (r *Request) AppendTo(b []byte) []byte {
 	lg.Debug("serialize request")
-	ops := []byte{}
+	start := len(b)
+	b = append(b, r.Profile.version(), byte(r.CommandCode), 0, 0)
+	b = r.Endpoint.AppendTo6(b, 0)
+	opStart := len(b)
 	if r.Options != nil {
-		ops = r.Options.Marshal()
+		b = r.Options.AppendTo(b)
 	}
-	b := bytes.NewBuffer(buf)
+	binary.BigEndian.PutUint16(b[start+2:], overflowCheck(len(b)-opStart))
 
-	b.WriteByte(protocolVersion)
-	b.WriteByte(byte(r.CommandCode))
-	binary.Write(b, binary.BigEndian, uint16(len(ops)))
-
-	b.Write(r.Endpoint.Marshal6(0))
-	b.Write(ops)
+	lg.Debugf("serialize request %+v to %+v", r, b[start:])
+	return b
+}
 
-	ret := b.Bytes()
-	lg.Debugf("serialize request %+v to %+v", r, ret)
-	return b.Bytes()
+// MarshalTo write request's wireformat to w in one Write call, without allocating a buffer
+func (r *Request) MarshalTo(w io.Writer) (int, error) {
+	return marshalTo(w, r.AppendTo)
 }
 
 func ParseRequest5From(b io.Reader) (*Request, error) {
@@ -148,8 +174,10 @@ const (
 )
 
 type AuthenticationReply struct {
-	Type    AuthenticationReplyType
-	Options *OptionSet
+	Type    AuthenticationReplyType `json:"type"`
+	Options *OptionSet              `json:"options"`
+	// Profile is draft revision of the message, nil means DefaultProfile
+	Profile *Profile `json:"-"`
 }
 
 func NewAuthenticationReply() *AuthenticationReply {
@@ -163,22 +191,37 @@ func NewAuthenticationReplyWithType(typ AuthenticationReplyType) *Authentication
 	return ar
 }
 func (a *AuthenticationReply) Marshal() []byte {
-	lg.Debug("serialize auth reply", a)
-
-	ops := a.Options.Marshal()
-	b := bytes.Buffer{}
+	return a.AppendTo(nil)
+}
 
-	b.WriteByte(protocolVersion)
-	b.WriteByte(byte(a.Type))
-	binary.Write(&b, binary.BigEndian, uint16(len(ops)))
+// AppendTo append authentication reply's wireformat to b and return the extended buffer
+func (a *AuthenticationReply) AppendTo(b []byte) []byte {
+	lg.Debug("serialize auth reply", a)
+	start := len(b)
+	b = append(b, a.Profile.version(), byte(a.Type), 0, 0)
+	b = a.Options.AppendTo(b)
+	binary.BigEndian.PutUint16(b[start+2:], overflowCheck(len(b)-start-4))
 
-	b.Write(ops)
+	lg.Debugf("serialize auth reply %+v to %+v", a, b[start:])
+	return b
+}
 
-	ret := b.Bytes()
-	lg.Debugf("serialize auth reply %+v to %+v", a, ret)
-	return ret
+// MarshalTo write authentication reply's wireformat to w in one Write call, without allocating a buffer
+func (a *AuthenticationReply) MarshalTo(w io.Writer) (int, error) {
+	return marshalTo(w, a.AppendTo)
 }
 func ParseAuthenticationReplyFrom(b io.Reader) (*AuthenticationReply, error) {
+	return defaultParseConfig.ParseAuthenticationReplyFrom(b)
+}
+
+// ParseAuthenticationReplyFrom parses b as authentication reply with config c, error is wrapped in ParseError
+func (c *ParseConfig) ParseAuthenticationReplyFrom(b io.Reader) (*AuthenticationReply, error) {
+	rr := &recordReader{r: b}
+	m, err := c.parseAuthenticationReplyFrom(rr)
+	return m, rr.wrap("authentication reply", err)
+}
+
+func (c *ParseConfig) parseAuthenticationReplyFrom(b io.Reader) (*AuthenticationReply, error) {
 	lg.Debug("read auth reply")
 
 	a := &AuthenticationReply{}
@@ -190,12 +233,14 @@ func ParseAuthenticationReplyFrom(b io.Reader) (*AuthenticationReply, error) {
 		return nil, err
 	}
 	lg.Debug("read auth result optionsize", buf[:4])
-	if buf[0] != protocolVersion {
+	profile, ok := c.profile(buf[0])
+	if !ok {
 		return nil, NewErrVersionMismatch(int(buf[0]), nil)
 	}
+	a.Profile = profile
 	a.Type = AuthenticationReplyType(buf[1])
 	opsLen := int(binary.BigEndian.Uint16(buf[2:]))
-	ops, err := ParseOptionSetFrom(b, opsLen)
+	ops, err := c.ParseOptionSetFrom(b, opsLen)
 	if err != nil {
 		return nil, err
 	}
@@ -221,9 +266,11 @@ const (
 )
 
 type OperationReply struct {
-	ReplyCode ReplyCode
-	Endpoint  *SocksAddr
-	Options   *OptionSet
+	ReplyCode ReplyCode  `json:"reply"`
+	Endpoint  *SocksAddr `json:"endpoint"`
+	Options   *OptionSet `json:"options"`
+	// Profile is draft revision of the message, nil means DefaultProfile
+	Profile *Profile `json:"-"`
 }
 
 func NewOperationReply() *OperationReply {
@@ -241,23 +288,39 @@ func NewOperationReplyWithCode(code ReplyCode) *OperationReply {
 	return rep
 }
 func (o *OperationReply) Marshal() []byte {
-	lg.Debug("serialize op reply", o)
-
-	ops := o.Options.Marshal()
-
-	b := bytes.Buffer{}
+	return o.AppendTo(nil)
+}
 
-	b.WriteByte(protocolVersion)
-	b.WriteByte(byte(o.ReplyCode))
-	binary.Write(&b, binary.BigEndian, uint16(len(ops)))
+// AppendTo append operation reply's wireformat to b and return the extended buffer
+func (o *OperationReply) AppendTo(b []byte) []byte {
+	lg.Debug("serialize op reply", o)
+	start := len(b)
+	b = append(b, o.Profile.version(), byte(o.ReplyCode), 0, 0)
+	b = o.Endpoint.AppendTo6(b, 0)
+	opStart := len(b)
+	b = o.Options.AppendTo(b)
+	binary.BigEndian.PutUint16(b[start+2:], overflowCheck(len(b)-opStart))
+
+	lg.Debugf("serialize op reply %+v to %+v", o, b[start:])
+	return b
+}
 
-	b.Write(o.Endpoint.Marshal6(0))
-	b.Write(ops)
-	ret := b.Bytes()
-	lg.Debugf("serialize op reply %+v to %+v", o, ret)
-	return ret
+// MarshalTo write operation reply's wireformat to w in one Write call, without allocating a buffer
+func (o *OperationReply) MarshalTo(w io.Writer) (int, error) {
+	return marshalTo(w, o.AppendTo)
 }
 func ParseOperationReplyFrom(b io.Reader) (*OperationReply, error) {
+	return defaultParseConfig.ParseOperationReplyFrom(b)
+}
+
+// ParseOperationReplyFrom parses b as operation reply with config c, error is wrapped in ParseError
+func (c *ParseConfig) ParseOperationReplyFrom(b io.Reader) (*OperationReply, error) {
+	rr := &recordReader{r: b}
+	m, err := c.parseOperationReplyFrom(rr)
+	return m, rr.wrap("operation reply", err)
+}
+
+func (c *ParseConfig) parseOperationReplyFrom(b io.Reader) (*OperationReply, error) {
 	lg.Debug("read op reply")
 
 	r := &OperationReply{}
@@ -267,21 +330,26 @@ func ParseOperationReplyFrom(b io.Reader) (*OperationReply, error) {
 	if _, err := io.ReadFull(b, buf[:4]); err != nil {
 		return nil, err
 	}
-	if buf[0] != protocolVersion {
+	profile, ok := c.profile(buf[0])
+	if !ok {
 		return r, NewErrVersionMismatch(int(buf[0]), nil)
 	}
+	r.Profile = profile
 	r.ReplyCode = ReplyCode(buf[1])
 	optLen := binary.BigEndian.Uint16(buf[2:])
 	lg.Debug("read op reply command optionsize", buf[:4])
 
-	addr, _, _, err := ParseSocksAddr6From(b)
+	addr, pad, _, err := parseSocksAddr6From(b, 260, c.Strict)
 	if err != nil {
 		return nil, err
 	}
+	if err := c.checkAddressPadding(pad); err != nil {
+		return nil, err
+	}
 	r.Endpoint = addr
 	lg.Debug("read op reply addr", addr)
 
-	ops, err := ParseOptionSetFrom(b, int(optLen))
+	ops, err := c.ParseOptionSetFrom(b, int(optLen))
 	if err != nil {
 		return nil, err
 	}
@@ -338,6 +406,15 @@ const (
 	UDPMessageError
 )
 
+// UDPMessageFragment is a piece of datagram, it's a non-standard experimental extension not defined in draft.
+// Code is taken from top of the range, so it won't collide with types defined by later drafts.
+// Only sent when UDPFragmentSize is enabled, peer must understand it
+const UDPMessageFragment UDPHeaderType = 0xf0
+
+// UDPMessageStackOption change association's stack options after established, it's a non-standard experimental extension
+// not defined in draft, code is taken next to UDPMessageFragment
+const UDPMessageStackOption UDPHeaderType = 0xf1
+
 type UDPErrorType byte
 
 const (
@@ -349,59 +426,89 @@ const (
 )
 
 type UDPMessage struct {
-	Type          UDPHeaderType
-	AssociationID uint64
+	Type          UDPHeaderType `json:"type"`
+	AssociationID uint64        `json:"association"`
 	// dgram & icmp
-	Endpoint *SocksAddr
+	Endpoint *SocksAddr `json:"endpoint,omitempty"`
 	// icmp
-	ErrorEndpoint *SocksAddr
-	ErrorCode     UDPErrorType
-	// dgram
-	Data []byte
+	ErrorEndpoint *SocksAddr   `json:"errorEndpoint,omitempty"`
+	ErrorCode     UDPErrorType `json:"errorCode,omitempty"`
+	// dgram & fragment
+	Data []byte `json:"data,omitempty"`
+	// fragment
+	FragmentID     uint16 `json:"fragmentID,omitempty"`
+	FragmentOffset uint16 `json:"fragmentOffset,omitempty"` // offset of Data in original datagram
+	FragmentMore   bool   `json:"fragmentMore,omitempty"`   // more fragment follows
+	// stack option
+	Options *OptionSet `json:"options,omitempty"`
+	// Profile is draft revision of the message, nil means DefaultProfile
+	Profile *Profile `json:"-"`
 }
 
 func (u *UDPMessage) Marshal() []byte {
+	return u.AppendTo(nil)
+}
+
+// AppendTo append UDP message's wireformat to b and return the extended buffer
+func (u *UDPMessage) AppendTo(b []byte) []byte {
 	lg.Debug("serialize udpmsg", u)
-	b := bytes.Buffer{}
+	start := len(b)
+	b = append(b, u.Profile.version(), byte(u.Type), 0, 0)
+	b = appendUint64(b, u.AssociationID)
 
 	switch u.Type {
 	case UDPMessageAssociationInit, UDPMessageAssociationAck:
 		lg.Debug("serialize udpmsg intack")
-		b.WriteByte(protocolVersion)
-		b.WriteByte(byte(u.Type))
-		binary.Write(&b, binary.BigEndian, uint16(12))
-		binary.Write(&b, binary.BigEndian, u.AssociationID)
 	case UDPMessageDatagram:
 		lg.Debug("serialize udpmsg dgram")
-		addr := u.Endpoint.Marshal6(0)
-		totalLen := 12 + len(addr) + len(u.Data)
-		b.WriteByte(protocolVersion)
-		b.WriteByte(byte(u.Type))
-		binary.Write(&b, binary.BigEndian, uint16(totalLen))
-		binary.Write(&b, binary.BigEndian, u.AssociationID)
-
-		b.Write(addr)
-		b.Write(u.Data)
+		b = u.Endpoint.AppendTo6(b, 0)
+		b = append(b, u.Data...)
+	case UDPMessageFragment:
+		lg.Debug("serialize udpmsg fragment")
+		flag := byte(0)
+		if u.FragmentMore {
+			flag |= udpFragmentFlagMore
+		}
+		b = append(b,
+			byte(u.FragmentID>>8), byte(u.FragmentID),
+			byte(u.FragmentOffset>>8), byte(u.FragmentOffset),
+			flag, 0)
+		b = u.Endpoint.AppendTo6(b, 0)
+		b = append(b, u.Data...)
 	case UDPMessageError:
 		lg.Debug("serialize udpmsg error")
-		addr := u.Endpoint.Marshal6(0)
-		eaddr := u.ErrorEndpoint.Marshal6(byte(u.ErrorCode))
-		totalLen := 12 + len(addr) + len(eaddr)
+		b = u.Endpoint.AppendTo6(b, 0)
+		b = u.ErrorEndpoint.AppendTo6(b, byte(u.ErrorCode))
+	case UDPMessageStackOption:
+		lg.Debug("serialize udpmsg stack option")
+		if u.Options != nil {
+			b = u.Options.AppendTo(b)
+		}
+	}
+	binary.BigEndian.PutUint16(b[start+2:], uint16(len(b)-start))
+	lg.Debugf("serialize udpmsg %v to %v", u, b[start:])
 
-		b.WriteByte(protocolVersion)
-		b.WriteByte(byte(u.Type))
-		binary.Write(&b, binary.BigEndian, uint16(totalLen))
+	return b
+}
 
-		binary.Write(&b, binary.BigEndian, u.AssociationID)
+// MarshalTo write UDP message's wireformat to w in one Write call, without allocating a buffer
+func (u *UDPMessage) MarshalTo(w io.Writer) (int, error) {
+	return marshalTo(w, u.AppendTo)
+}
 
-		b.Write(addr)
-		b.Write(eaddr)
-	}
-	ret := b.Bytes()
-	lg.Debugf("serialize udpmsg %v to %v", u, ret)
+// marshalTo write message serialized by appendTo to w, using pooled buffer
+func marshalTo(w io.Writer, appendTo func([]byte) []byte) (int, error) {
+	buf := internal.BytesPool64k.Rent()
+	defer internal.BytesPool64k.Return(buf)
+	return w.Write(appendTo(buf[:0]))
+}
 
-	return ret
+func appendUint64(b []byte, v uint64) []byte {
+	return append(b,
+		byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32),
+		byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
 }
+
 func (u *UDPMessage) Marshal5() []byte {
 	lg.Debug("serialize udpmsg5", u)
 	b := bytes.Buffer{}
@@ -433,6 +540,17 @@ func GetAssociationID(b []byte) uint64 {
 }
 
 func ParseUDPMessageFrom(b io.Reader) (*UDPMessage, error) {
+	return defaultParseConfig.ParseUDPMessageFrom(b)
+}
+
+// ParseUDPMessageFrom parses b as UDP message with config c, error is wrapped in ParseError
+func (c *ParseConfig) ParseUDPMessageFrom(b io.Reader) (*UDPMessage, error) {
+	rr := &recordReader{r: b}
+	m, err := c.parseUDPMessageFrom(rr)
+	return m, rr.wrap("udp message", err)
+}
+
+func (c *ParseConfig) parseUDPMessageFrom(b io.Reader) (*UDPMessage, error) {
 	lg.Debug("read udpmsg")
 	u := &UDPMessage{}
 	buf := internal.BytesPool64k.Rent()
@@ -440,29 +558,61 @@ func ParseUDPMessageFrom(b io.Reader) (*UDPMessage, error) {
 	if _, err := io.ReadFull(b, buf[:12]); err != nil {
 		return nil, err
 	}
-	if buf[0] != protocolVersion {
+	profile, ok := c.profile(buf[0])
+	if !ok {
 		return nil, NewErrVersionMismatch(int(buf[0]), nil)
 	}
+	u.Profile = profile
 	lg.Debug("read udpmsg header", buf[:12])
 
 	totalLen := binary.BigEndian.Uint16(buf[2:])
 	remainLen := int(totalLen) - 12
 	u.Type = UDPHeaderType(buf[1])
 	u.AssociationID = binary.BigEndian.Uint64(buf[4:])
+	if err := checkUDPHeaderType(u.Type); err != nil {
+		return nil, err
+	}
 
 	if u.Type == UDPMessageAssociationInit || u.Type == UDPMessageAssociationAck {
+		return u, c.checkRemain(remainLen)
+	}
+	if u.Type == UDPMessageStackOption {
+		ops, err := c.ParseOptionSetFrom(b, remainLen)
+		if err != nil {
+			return nil, err
+		}
+		u.Options = ops
 		return u, nil
 	}
 
-	addr, _, l, err := ParseSocksAddr6FromWithLimit(b, remainLen)
+	if u.Type == UDPMessageFragment {
+		if remainLen < udpFragmentHeaderLen {
+			return nil, ErrFormat.WithVerbose("fragment header too short")
+		}
+		if _, err := io.ReadFull(b, buf[:udpFragmentHeaderLen]); err != nil {
+			return nil, err
+		}
+		u.FragmentID = binary.BigEndian.Uint16(buf)
+		u.FragmentOffset = binary.BigEndian.Uint16(buf[2:])
+		u.FragmentMore = buf[4]&udpFragmentFlagMore > 0
+		remainLen -= udpFragmentHeaderLen
+	}
+
+	addr, pad, l, err := parseSocksAddr6From(b, remainLen, c.Strict)
 	if err != nil {
 		return nil, err
 	}
+	if err := c.checkAddressPadding(pad); err != nil {
+		return nil, err
+	}
 	u.Endpoint = addr
 	remainLen -= l
 	lg.Debug("read udpmsg addr", addr)
 
-	if u.Type == UDPMessageDatagram {
+	if u.Type == UDPMessageDatagram || u.Type == UDPMessageFragment {
+		if remainLen < 0 {
+			return nil, ErrFormat.WithVerbose("udp message length too short")
+		}
 		if _, err = io.ReadFull(b, buf[:remainLen]); err != nil {
 			return nil, err
 		}
@@ -471,16 +621,110 @@ func ParseUDPMessageFrom(b io.Reader) (*UDPMessage, error) {
 		return u, nil
 	}
 
-	eaddr, uerr, _, err := ParseSocksAddr6FromWithLimit(b, remainLen)
+	eaddr, uerr, l, err := parseSocksAddr6From(b, remainLen, c.Strict)
 	if err != nil {
 		return nil, err
 	}
 	u.ErrorCode = UDPErrorType(uerr)
 	u.ErrorEndpoint = eaddr
 	lg.Debug("read udpmsg error", uerr, eaddr)
+	if err := c.checkUDPErrorType(u.ErrorCode); err != nil {
+		return nil, err
+	}
 
-	return u, nil
+	return u, c.checkRemain(remainLen - l)
+}
+
+// ParseUDPMessageInto parses b as UDP message into u, so u can be reused for many messages.
+// All fields of u are overwritten, Data of datagram and fragment refer to b instead of a copy.
+func ParseUDPMessageInto(b []byte, u *UDPMessage) error {
+	return defaultParseConfig.ParseUDPMessageInto(b, u)
 }
+
+// ParseUDPMessageInto parses b as UDP message into u with config c, see ParseUDPMessageInto.
+// In strict mode, b must not contain bytes after the message.
+// Error is wrapped in ParseError, its offset is the start of the part failed to parse.
+func (c *ParseConfig) ParseUDPMessageInto(b []byte, u *UDPMessage) (err error) {
+	off := 0
+	defer func() {
+		if err != nil {
+			err = newParseError("udp message", b[:off], off, err)
+		}
+	}()
+	*u = UDPMessage{}
+	if len(b) < 12 {
+		return ErrBufferSize.WithVerbose("expect at least 12 bytes buffer, actual %d bytes", len(b))
+	}
+	profile, ok := c.profile(b[0])
+	if !ok {
+		return NewErrVersionMismatch(int(b[0]), nil)
+	}
+	u.Profile = profile
+	totalLen := int(binary.BigEndian.Uint16(b[2:]))
+	if totalLen < 12 || totalLen > len(b) {
+		return ErrFormat.WithVerbose("udp message length %d mismatch buffer size %d", totalLen, len(b))
+	}
+	if err := c.checkRemain(len(b) - totalLen); err != nil {
+		return err
+	}
+	u.Type = UDPHeaderType(b[1])
+	u.AssociationID = binary.BigEndian.Uint64(b[4:])
+	if err := checkUDPHeaderType(u.Type); err != nil {
+		return err
+	}
+	remain := b[12:totalLen]
+	off = 12
+
+	switch u.Type {
+	case UDPMessageAssociationInit, UDPMessageAssociationAck:
+		return c.checkRemain(len(remain))
+	case UDPMessageStackOption:
+		ops, err := c.ParseOptionSetFrom(bytes.NewReader(remain), len(remain))
+		if err != nil {
+			return err
+		}
+		u.Options = ops
+		return nil
+	case UDPMessageFragment:
+		if len(remain) < udpFragmentHeaderLen {
+			return ErrFormat.WithVerbose("fragment header too short")
+		}
+		u.FragmentID = binary.BigEndian.Uint16(remain)
+		u.FragmentOffset = binary.BigEndian.Uint16(remain[2:])
+		u.FragmentMore = remain[4]&udpFragmentFlagMore > 0
+		remain = remain[udpFragmentHeaderLen:]
+		off += udpFragmentHeaderLen
+	}
+
+	r := bytes.NewReader(remain)
+	addr, pad, l, err := parseSocksAddr6From(r, len(remain), c.Strict)
+	if err != nil {
+		return err
+	}
+	if err := c.checkAddressPadding(pad); err != nil {
+		return err
+	}
+	u.Endpoint = addr
+	remain = remain[l:]
+	off += l
+
+	if u.Type == UDPMessageDatagram || u.Type == UDPMessageFragment {
+		u.Data = remain
+		return nil
+	}
+
+	eaddr, uerr, l, err := parseSocksAddr6From(r, len(remain), c.Strict)
+	if err != nil {
+		return err
+	}
+	u.ErrorCode = UDPErrorType(uerr)
+	u.ErrorEndpoint = eaddr
+	if err := c.checkUDPErrorType(u.ErrorCode); err != nil {
+		return err
+	}
+	return c.checkRemain(len(remain) - l)
+}
+
 func ParseUDPMessage5From(b io.Reader) (*UDPMessage, error) {
 	lg.Debug("read udpmsg5")
 	u := &UDPMessage{}
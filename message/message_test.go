@@ -2,8 +2,15 @@ package message_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"io"
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/samber/lo"
 	"github.com/stretchr/testify/assert"
@@ -66,3 +73,522 @@ func TestRequest(t *testing.T) {
 		}
 	}
 }
+
+func TestUDPMessageStackOption(t *testing.T) {
+	ops := message.NewOptionSet()
+	ops.AddMany(message.StackOptionInfo{
+		message.StackOptionUDPMulticastInterface: netip.MustParseAddr("10.0.0.1"),
+	}.GetOptions(false, true))
+	msg := &message.UDPMessage{
+		Type:          message.UDPMessageStackOption,
+		AssociationID: 1,
+		Options:       ops,
+	}
+	b := msg.Marshal()
+	assert.Equal(t, []byte{0xf1, 0, 36}, b[1:4])
+
+	msg2, err := message.ParseUDPMessageFrom(bytes.NewReader(b))
+	assert.NoError(t, err)
+	assert.Equal(t, message.UDPMessageStackOption, msg2.Type)
+	assert.EqualValues(t, 1, msg2.AssociationID)
+	assert.Equal(t, netip.MustParseAddr("10.0.0.1"),
+		message.GetStackOptionInfo(msg2.Options, false)[message.StackOptionUDPMulticastInterface])
+}
+
+func TestParseUDPMessageInto(t *testing.T) {
+	msgs := []*message.UDPMessage{
+		{
+			Type:          message.UDPMessageDatagram,
+			AssociationID: 1,
+			Endpoint:      message.ParseAddr("127.0.0.1:53"),
+			Data:          []byte{1, 2, 3},
+		},
+		{
+			Type:           message.UDPMessageFragment,
+			AssociationID:  2,
+			Endpoint:       message.ParseAddr("[::1]:53"),
+			Data:           []byte{4, 5},
+			FragmentID:     3,
+			FragmentOffset: 8,
+			FragmentMore:   true,
+		},
+		{
+			Type:          message.UDPMessageError,
+			AssociationID: 3,
+			Endpoint:      message.ParseAddr("127.0.0.1:53"),
+			ErrorEndpoint: message.ParseAddr("127.0.0.2:0"),
+			ErrorCode:     message.UDPErrorHostUnreachable,
+		},
+		{
+			Type:          message.UDPMessageAssociationAck,
+			AssociationID: 4,
+		},
+	}
+	// reuse same message
+	u := &message.UDPMessage{}
+	for _, m := range msgs {
+		b := m.Marshal()
+		assert.NoError(t, message.ParseUDPMessageInto(b, u))
+		expect, err := message.ParseUDPMessageFrom(bytes.NewReader(b))
+		assert.NoError(t, err)
+		assert.Equal(t, expect, u)
+	}
+
+	b := msgs[0].Marshal()
+	assert.NoError(t, message.ParseUDPMessageInto(b, u))
+	// data is not copied
+	b[len(b)-1] = 9
+	assert.EqualValues(t, 9, u.Data[2])
+
+	assert.Error(t, message.ParseUDPMessageInto(b[:11], u))
+	assert.Error(t, message.ParseUDPMessageInto(b[:len(b)-1], u))
+}
+
+func TestUDPMessageConstructors(t *testing.T) {
+	ep := message.ParseAddr("127.0.0.1:53")
+	rep := message.ParseAddr("127.0.0.2:0")
+	msgs := []*message.UDPMessage{
+		message.NewUDPAssociationInit(1),
+		message.NewUDPAssociationAck(1),
+		message.NewUDPDatagram(1, ep, []byte{1, 2, 3}),
+		message.NewUDPError(1, ep, rep, message.UDPErrorTTLExpired),
+	}
+	for _, m := range msgs {
+		assert.NoError(t, m.Validate())
+		m2, err := message.ParseUDPMessageFrom(bytes.NewReader(m.Marshal()))
+		assert.NoError(t, err)
+		assert.Equal(t, m, m2)
+	}
+
+	m, ok := message.NewUDPErrorFromError(1, ep, rep, &net.OpError{Op: "write", Err: os.NewSyscallError("sendto", syscall.EHOSTUNREACH)})
+	assert.True(t, ok)
+	assert.Equal(t, message.UDPErrorHostUnreachable, m.ErrorCode)
+	_, ok = message.NewUDPErrorFromError(1, ep, rep, io.EOF)
+	assert.False(t, ok)
+	code, ok := message.UDPErrorTypeFromError(syscall.EMSGSIZE)
+	assert.True(t, ok)
+	assert.Equal(t, message.UDPErrorDatagramTooBig, code)
+
+	assert.ErrorIs(t, (&message.UDPMessage{Type: message.UDPMessageDatagram}).Validate(), message.ErrFormat)
+	assert.ErrorIs(t, message.NewUDPError(1, ep, rep, 0).Validate(), message.ErrEnumValue)
+	assert.ErrorIs(t, (&message.UDPMessage{Type: 9}).Validate(), message.ErrEnumValue)
+
+	// unknown type is rejected
+	b := message.NewUDPAssociationAck(1).Marshal()
+	b[1] = 9
+	_, err := message.ParseUDPMessageFrom(bytes.NewReader(b))
+	assert.ErrorIs(t, err, message.ErrEnumValue)
+	assert.ErrorIs(t, message.ParseUDPMessageInto(b, &message.UDPMessage{}), message.ErrEnumValue)
+	b[1] = 6
+	assert.ErrorIs(t, message.ParseUDPMessageInto(b, &message.UDPMessage{}), message.ErrEnumValue)
+	// unknown error type is rejected in strict mode
+	b = message.NewUDPError(1, ep, rep, 7).Marshal()
+	_, err = message.ParseUDPMessageFrom(bytes.NewReader(b))
+	assert.NoError(t, err)
+	_, err = (&message.ParseConfig{Strict: true}).ParseUDPMessageFrom(bytes.NewReader(b))
+	assert.ErrorIs(t, err, message.ErrEnumValue)
+}
+
+func TestMessageAppendTo(t *testing.T) {
+	ops := message.NewOptionSet()
+	ops.Add(message.Option{Kind: message.OptionKindSessionID, Data: message.SessionIDOptionData{ID: []byte{1, 2, 3, 4}}})
+	msgs := []interface {
+		Marshal() []byte
+		AppendTo(b []byte) []byte
+		MarshalTo(w io.Writer) (int, error)
+	}{
+		&message.Request{
+			CommandCode: message.CommandConnect,
+			Endpoint:    message.ParseAddr("example.com:80"),
+			Options:     ops,
+		},
+		&message.AuthenticationReply{
+			Type:    message.AuthenticationReplySuccess,
+			Options: ops,
+		},
+		&message.OperationReply{
+			ReplyCode: message.OperationReplySuccess,
+			Endpoint:  message.ParseAddr("[::1]:80"),
+			Options:   ops,
+		},
+		&message.UDPMessage{
+			Type:          message.UDPMessageDatagram,
+			AssociationID: 1,
+			Endpoint:      message.ParseAddr("127.0.0.1:53"),
+			Data:          []byte{1, 2, 3},
+		},
+	}
+	for _, m := range msgs {
+		expect := m.Marshal()
+		// keep existing content
+		b := m.AppendTo([]byte{0xff})
+		assert.Equal(t, append([]byte{0xff}, expect...), b)
+
+		w := &bytes.Buffer{}
+		n, err := m.MarshalTo(w)
+		assert.NoError(t, err)
+		assert.Equal(t, len(expect), n)
+		assert.Equal(t, expect, w.Bytes())
+	}
+}
+
+func TestParseConfigStrict(t *testing.T) {
+	strict := &message.ParseConfig{Strict: true}
+	req := func(pad byte, addr []byte, ops ...byte) []byte {
+		b := []byte{common.ProtocolVersion, 1, 0, byte(len(ops)), 0, 1, pad}
+		b = append(b, addr...)
+		return append(b, ops...)
+	}
+	ipv4 := []byte{byte(message.AddressTypeIPv4), 127, 0, 0, 1}
+	tests := []struct {
+		name string
+		in   []byte
+		e    error
+	}{
+		{name: "valid", in: req(0, ipv4, 0, 6, 0, 8, 0, 0, 0, 1, 1, 0xbf, 0, 8, 0xff, 0xff, 0, 0), e: nil},
+		{name: "valid domain", in: req(0, []byte{byte(message.AddressTypeDomainName), 3, 'a', 0, 0}), e: nil},
+		{name: "stack option on different leg", in: req(0, ipv4, 0, 1, 0, 8, 0xbf, 0xff, 0, 0, 0, 1, 0, 8, 0x7f, 0xff, 0, 0), e: nil},
+		{name: "address padding", in: req(1, ipv4), e: message.ErrPadding},
+		{name: "domain padding", in: req(0, []byte{byte(message.AddressTypeDomainName), 2, 'a', 0}), e: message.ErrPadding},
+		{name: "domain extra padding", in: req(0, []byte{byte(message.AddressTypeDomainName), 7, 'a', 0, 0, 0, 0, 0, 0}), e: message.ErrPadding},
+		{name: "duplicate session id", in: req(0, ipv4, 0, 6, 0, 8, 0, 0, 0, 1, 0, 6, 0, 8, 0, 0, 0, 2), e: message.ErrDuplicateOption},
+		{name: "duplicate stack option", in: req(0, ipv4, 0, 1, 0, 8, 0xff, 0xff, 0, 0, 0, 1, 0, 8, 0x7f, 0xff, 0, 1), e: message.ErrDuplicateOption},
+		{name: "option length", in: req(0, ipv4, 0xff, 0xff, 0, 5, 1), e: message.ErrBufferSize},
+		{name: "advertisement padding", in: req(0, ipv4, 0, 2, 0, 12, 0, 0, 1, 0, 2, 0, 0, 0), e: message.ErrPadding},
+	}
+	for _, tt := range tests {
+		_, err := message.ParseRequestFrom(bytes.NewReader(tt.in))
+		assert.NoError(t, err, tt.name)
+		_, err = strict.ParseRequestFrom(bytes.NewReader(tt.in))
+		if tt.e == nil {
+			assert.NoError(t, err, tt.name)
+		} else {
+			assert.ErrorIs(t, err, tt.e, tt.name)
+		}
+	}
+
+	// too short to decode
+	_, err := message.ParseRequestFrom(bytes.NewReader(req(0, ipv4, 0, 1, 0, 4)))
+	assert.ErrorIs(t, err, message.ErrBufferSize)
+
+	// option exceed options length
+	b := []byte{common.ProtocolVersion, 1, 0, 4, 0, 1, 0, byte(message.AddressTypeIPv4), 127, 0, 0, 1, 0, 6, 0, 8, 0, 0, 0, 1}
+	_, err = message.ParseRequestFrom(bytes.NewReader(b))
+	assert.NoError(t, err)
+	_, err = strict.ParseRequestFrom(bytes.NewReader(b))
+	assert.ErrorIs(t, err, message.ErrBufferSize)
+
+	// trailing bytes after UDP message
+	u := &message.UDPMessage{}
+	b = append((&message.UDPMessage{
+		Type:          message.UDPMessageDatagram,
+		AssociationID: 1,
+		Endpoint:      message.ParseAddr("127.0.0.1:53"),
+		Data:          []byte{1, 2, 3},
+	}).Marshal(), 0)
+	assert.NoError(t, message.ParseUDPMessageInto(b, u))
+	assert.ErrorIs(t, strict.ParseUDPMessageInto(b, u), message.ErrBufferSize)
+	assert.NoError(t, strict.ParseUDPMessageInto(b[:len(b)-1], u))
+}
+
+func TestParseConfigLimit(t *testing.T) {
+	b := []byte{
+		common.ProtocolVersion, 1, 0, 20,
+		0, 1, 0, byte(message.AddressTypeIPv4), 127, 0, 0, 1,
+		0, 2, 0, 8, 0x10, 0, 1, 0,
+		0, 6, 0, 8, 0, 0, 0, 1,
+		0, 10, 0, 4,
+	}
+	tests := []struct {
+		c *message.ParseConfig
+		e error
+	}{
+		{c: &message.ParseConfig{}, e: nil},
+		{c: &message.ParseConfig{MaxOptionsLength: 20, MaxOptionCount: 3, MaxInitialDataLength: 0x1000}, e: nil},
+		{c: &message.ParseConfig{MaxOptionsLength: 16}, e: message.ErrOptionTooLong},
+		{c: &message.ParseConfig{MaxOptionCount: 2}, e: message.ErrTooManyOptions},
+		{c: &message.ParseConfig{MaxInitialDataLength: 0xfff}, e: message.ErrInitialDataTooLong},
+	}
+	for _, tt := range tests {
+		_, err := tt.c.ParseRequestFrom(bytes.NewReader(b))
+		if tt.e == nil {
+			assert.NoError(t, err)
+		} else {
+			assert.ErrorIs(t, err, tt.e)
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	req := message.NewRequest()
+	req.CommandCode = message.CommandConnect
+	req.Endpoint = message.ParseAddr("127.0.0.1:80")
+	req.Options.Add(message.Option{Kind: message.OptionKindSessionID, Data: message.SessionIDOptionData{ID: []byte{0, 0, 0, 1}}})
+	req.Options.Add(message.Option{Kind: message.OptionKindStack, Data: message.BaseStackOptionData{
+		RemoteLeg: true,
+		Level:     message.StackOptionLevelTCP,
+		Code:      message.StackOptionCodeBacklog,
+		Data:      &message.BacklogOptionData{Backlog: 10},
+	}})
+	req.Options.Add(message.Option{Kind: 0xfff0, Data: &message.RawOptionData{Data: []byte{1, 2}}})
+
+	assert.Equal(t, "Request{CONNECT 127.0.0.1:80 [SessionID 00000001; Stack TCP Backlog=10 [remote]; Kind(0xfff0) 0102]}", req.String())
+	assert.Equal(t, `Request
+  Command: CONNECT
+  Endpoint: 127.0.0.1:80
+  Options:
+    SessionID 00000001
+    Stack TCP Backlog=10 [remote]
+    Kind(0xfff0) 0102
+`, req.Dump())
+
+	rep := message.NewOperationReplyWithCode(message.OperationReplyTimeout)
+	assert.Equal(t, "OperationReply{Timeout 0.0.0.0:0 []}", rep.String())
+	assert.Equal(t, `OperationReply
+  Reply: Timeout
+  Endpoint: 0.0.0.0:0
+  Options:
+    (none)
+`, rep.Dump())
+
+	u := &message.UDPMessage{
+		Type:          message.UDPMessageError,
+		AssociationID: 1,
+		Endpoint:      message.ParseAddr("127.0.0.1:53"),
+		ErrorEndpoint: message.ParseAddr("127.0.0.2:0"),
+		ErrorCode:     message.UDPErrorHostUnreachable,
+	}
+	assert.Equal(t, "UDPMessage{Error 1 127.0.0.1:53 HostUnreachable from 127.0.0.2:0}", u.String())
+	assert.Equal(t, `UDPMessage
+  Type: Error
+  Association: 1
+  Endpoint: 127.0.0.1:53
+  Error: HostUnreachable
+  ErrorEndpoint: 127.0.0.2:0
+`, u.Dump())
+	assert.Equal(t, "UDPMessage{AssociationAck 2}", (&message.UDPMessage{Type: message.UDPMessageAssociationAck, AssociationID: 2}).String())
+	assert.Equal(t, "Unknown(9)", message.CommandCode(9).String())
+}
+
+func TestJSON(t *testing.T) {
+	req := message.NewRequest()
+	req.CommandCode = message.CommandConnect
+	req.Endpoint = message.ParseAddr("[::1]:80")
+	req.Options.Add(message.Option{Kind: message.OptionKindSessionID, Data: message.SessionIDOptionData{ID: []byte{0, 0, 0, 1}}})
+	req.Options.Add(message.Option{Kind: message.OptionKindStack, Data: message.BaseStackOptionData{
+		RemoteLeg: true,
+		Level:     message.StackOptionLevelTCP,
+		Code:      message.StackOptionCodeBacklog,
+		Data:      &message.BacklogOptionData{Backlog: 10},
+	}})
+	b, err := json.Marshal(req)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"command": 1,
+		"endpoint": "[::1]:80",
+		"options": [
+			{"kind": 6, "name": "SessionID", "data": "AAAAAQ=="},
+			{"kind": 1, "name": "Stack", "data": "hAMACg=="}
+		]
+	}`, string(b))
+	req2 := &message.Request{}
+	assert.NoError(t, json.Unmarshal(b, req2))
+	assert.Equal(t, req.Marshal(), req2.Marshal())
+
+	// missing fields use default value
+	rep := &message.OperationReply{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"reply": 9}`), rep))
+	assert.Equal(t, message.NewOperationReplyWithCode(message.OperationReplyTimeout), rep)
+	arep := &message.AuthenticationReply{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"type": 1}`), arep))
+	assert.Equal(t, message.NewAuthenticationReplyWithType(message.AuthenticationReplyFail), arep)
+
+	u := &message.UDPMessage{
+		Type:          message.UDPMessageDatagram,
+		AssociationID: 1,
+		Endpoint:      message.ParseAddr("example.com:53"),
+		Data:          []byte{1, 2, 3},
+	}
+	b, err = json.Marshal(u)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"type": 3, "association": 1, "endpoint": "example.com:53", "data": "AQID"}`, string(b))
+	u2 := &message.UDPMessage{}
+	assert.NoError(t, json.Unmarshal(b, u2))
+	assert.Equal(t, u, u2)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"endpoint": "nope"}`), &message.Request{}))
+	assert.Error(t, json.Unmarshal([]byte(`{"options": [{"kind": 11, "data": "AQ=="}]}`), &message.Request{}))
+}
+
+func TestProfile(t *testing.T) {
+	req := message.NewRequest()
+	req.CommandCode = message.CommandConnect
+	req.Profile = message.ProfileDraft11
+	b := req.Marshal()
+	assert.EqualValues(t, 211, b[0])
+
+	_, err := message.ParseRequestFrom(bytes.NewReader(b))
+	assert.ErrorIs(t, err, message.ErrVersionMismatch{})
+	c := &message.ParseConfig{Profiles: []*message.Profile{message.ProfileDraft11}}
+	req2, err := c.ParseRequestFrom(bytes.NewReader(b))
+	assert.NoError(t, err)
+	assert.Equal(t, req, req2)
+	// default profile is always accepted
+	req.Profile = nil
+	req2, err = c.ParseRequestFrom(bytes.NewReader(req.Marshal()))
+	assert.NoError(t, err)
+	assert.Nil(t, req2.Profile)
+
+	arep := message.NewAuthenticationReplyWithType(message.AuthenticationReplySuccess)
+	arep.Profile = message.ProfileDraft11
+	arep2, err := c.ParseAuthenticationReplyFrom(bytes.NewReader(arep.Marshal()))
+	assert.NoError(t, err)
+	assert.Equal(t, arep, arep2)
+
+	orep := message.NewOperationReplyWithCode(message.OperationReplySuccess)
+	orep.Profile = message.ProfileDraft11
+	orep2, err := c.ParseOperationReplyFrom(bytes.NewReader(orep.Marshal()))
+	assert.NoError(t, err)
+	assert.Equal(t, orep, orep2)
+
+	u := message.NewUDPDatagram(1, message.ParseAddr("127.0.0.1:1"), make([]byte, 100))
+	u.Profile = message.ProfileDraft11
+	frags, err := u.Fragment(1, 64)
+	assert.NoError(t, err)
+	for _, f := range frags {
+		u2 := &message.UDPMessage{}
+		assert.NoError(t, c.ParseUDPMessageInto(f.Marshal(), u2))
+		assert.Equal(t, message.ProfileDraft11, u2.Profile)
+	}
+
+	p, ok := message.ProfileByVersion(common.ProtocolVersion)
+	assert.True(t, ok)
+	assert.Equal(t, message.DefaultProfile, p)
+	assert.Equal(t, "draft-11", message.ProfileDraft11.String())
+}
+
+func TestParseError(t *testing.T) {
+	req := message.NewRequest()
+	req.CommandCode = message.CommandConnect
+	b := req.Marshal()
+
+	_, err := message.ParseRequestFrom(bytes.NewReader(b[:6]))
+	pe := &message.ParseError{}
+	if assert.ErrorAs(t, err, &pe) {
+		assert.Equal(t, "request", pe.Message)
+		assert.Equal(t, 6, pe.Offset)
+		assert.Equal(t, b[:6], pe.Consumed)
+		assert.True(t, pe.Truncated())
+	}
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	_, err = message.ParseRequestFrom(bytes.NewReader(nil))
+	if assert.ErrorAs(t, err, &pe) {
+		assert.Equal(t, 0, pe.Offset)
+		assert.True(t, pe.Truncated())
+	}
+	assert.ErrorIs(t, err, io.EOF)
+
+	_, err = message.ParseOperationReplyFrom(bytes.NewReader([]byte{5, 0, 0, 0}))
+	evm := message.ErrVersionMismatch{}
+	assert.ErrorAs(t, err, &evm)
+	assert.Equal(t, 5, evm.Version)
+	if assert.ErrorAs(t, err, &pe) {
+		assert.Equal(t, "operation reply", pe.Message)
+		assert.False(t, pe.Truncated())
+	}
+
+	u := message.NewUDPDatagram(1, message.ParseAddr("127.0.0.1:1"), []byte{1})
+	ub := u.Marshal()
+	ub[15] = 9 // address type
+	err = message.ParseUDPMessageInto(ub, &message.UDPMessage{})
+	assert.ErrorIs(t, err, message.ErrAddressTypeNotSupport)
+	if assert.ErrorAs(t, err, &pe) {
+		assert.Equal(t, 12, pe.Offset)
+		assert.Equal(t, ub[:12], pe.Consumed)
+	}
+}
+
+func TestParseRequestContext(t *testing.T) {
+	req := message.NewRequest()
+	req.CommandCode = message.CommandConnect
+	b := req.Marshal()
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go c2.Write(b)
+	req2, err := message.ParseRequestContext(context.Background(), c1)
+	assert.NoError(t, err)
+	assert.Equal(t, req, req2)
+
+	go c2.Write(b[:6])
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = message.ParseRequestContext(ctx, c1)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	pe := &message.ParseError{}
+	if assert.ErrorAs(t, err, &pe) {
+		assert.Equal(t, 6, pe.Offset)
+	}
+}
+
+func TestPadding(t *testing.T) {
+	assert.Equal(t, 0, message.PaddingLength(64, 64))
+	assert.Equal(t, 0, message.PaddingLength(10, 0))
+	assert.Equal(t, 36, message.PaddingLength(28, 64))
+	assert.Equal(t, 4, message.PaddingLength(60, 64))
+
+	assert.Nil(t, message.NewPaddingOptions(0))
+	ops := message.NewPaddingOptions(0x10000)
+	if assert.Len(t, ops, 2) {
+		assert.Equal(t, message.PaddingOptionData{Length: 0xfff8}, ops[0].Data)
+		assert.Equal(t, message.PaddingOptionData{Length: 0}, ops[1].Data)
+	}
+
+	req := message.NewRequest()
+	req.CommandCode = message.CommandConnect
+	req.Options = nil
+	req.Pad(32)
+	b := req.Marshal()
+	assert.Len(t, b, 32)
+	req2, err := (&message.ParseConfig{Strict: true}).ParseRequestFrom(bytes.NewReader(b))
+	assert.NoError(t, err)
+	d, ok := message.GetTyped[message.PaddingOptionData](req2.Options, message.OptionKindPadding)
+	assert.True(t, ok)
+	assert.Equal(t, 16, d.Length)
+
+	// datagram can't be padded
+	u := message.NewUDPDatagram(1, message.ParseAddr("127.0.0.1:1"), []byte{1})
+	l := len(u.Marshal())
+	u.Pad(64)
+	assert.Len(t, u.Marshal(), l)
+	assert.Len(t, message.NewUDPPadding(1, 40).Marshal(), 52)
+}
+
+func TestOperationReplyBuilder(t *testing.T) {
+	b := message.NewOperationReplyBuilder(message.OperationReplySuccess)
+	rep := b.Build()
+	assert.Equal(t, message.NewOperationReply(), rep)
+
+	remote := message.NewStackOptionBuilder().Backlog(10).Build()
+	rep = b.BoundNetAddr(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}).
+		StackOptions(message.StackOptionInfo{}, remote).
+		Session(message.SessionReply{ID: []byte{1, 2}, OK: true}).
+		Options(message.Option{Kind: message.OptionKindMultiplex, Data: message.MultiplexOptionData{}}).
+		Profile(message.ProfileDraft11).
+		Build()
+	assert.Equal(t, message.ParseAddr("127.0.0.1:1080"), rep.Endpoint)
+	assert.Equal(t, message.ProfileDraft11, rep.Profile)
+	assert.Equal(t, remote, message.GetStackOptionInfo(rep.Options, false))
+	sr := message.GetSessionReply(rep.Options)
+	assert.Equal(t, []byte{1, 2}, sr.ID)
+	assert.True(t, sr.OK)
+	_, ok := rep.Options.GetData(message.OptionKindMultiplex)
+	assert.True(t, ok)
+
+	// built reply is a copy
+	rep.Options.Add(message.Option{Kind: message.OptionKindSessionInvalid, Data: message.SessionInvalidOptionData{}})
+	_, ok = b.Build().Options.GetData(message.OptionKindSessionInvalid)
+	assert.False(t, ok)
+}
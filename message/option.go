@@ -1,7 +1,6 @@
 package message
 
 import (
-	"bytes"
 	"encoding/binary"
 	"io"
 	"math"
@@ -32,7 +31,8 @@ const (
 	OptionKindIdempotenceRejected
 )
 
-var optionDataParseFn = map[OptionKind]func([]byte) (OptionData, error){
+// DefaultOptionRegistry is used by ParseOptionFrom and ParseOptionSetFrom, it contains all options known by this package
+var DefaultOptionRegistry = &OptionRegistry{parsers: map[OptionKind]OptionDataParser{
 	OptionKindStack: parseStackOptionData,
 
 	OptionKindAuthenticationMethodAdvertisement: parseAuthenticationMethodAdvertisementOptionData,
@@ -50,12 +50,12 @@ var optionDataParseFn = map[OptionKind]func([]byte) (OptionData, error){
 	OptionKindIdempotenceExpenditure: parseIdempotenceExpenditureOptionData,
 	OptionKindIdempotenceAccepted:    func(b []byte) (OptionData, error) { return IdempotenceAcceptedOptionData{}, assertZeroBuffer(b) },
 	OptionKindIdempotenceRejected:    func(b []byte) (OptionData, error) { return IdempotenceRejectedOptionData{}, assertZeroBuffer(b) },
-}
+}}
 
-// SetOptionDataParser set the option data parse function for given kind to fn
+// SetOptionDataParser set the option data parse function for given kind to fn in DefaultOptionRegistry
 // set fn to nil to clear parser
 func SetOptionDataParser(kind OptionKind, fn func([]byte) (OptionData, error)) {
-	optionDataParseFn[kind] = fn
+	DefaultOptionRegistry.Register(kind, fn)
 }
 
 func assertZeroBuffer(b []byte) error {
@@ -76,6 +76,11 @@ type Option struct {
 
 // ParseOptionFrom parses b as a SOCKS6 option.
 func ParseOptionFrom(b io.Reader) (Option, error) {
+	return defaultParseConfig.ParseOptionFrom(b)
+}
+
+// ParseOptionFrom parses b as a SOCKS6 option with config c.
+func (c *ParseConfig) ParseOptionFrom(b io.Reader) (Option, error) {
 	// kind2 length2
 	buf := internal.BytesPool64k.Rent()
 	defer internal.BytesPool64k.Return(buf)
@@ -83,17 +88,20 @@ func ParseOptionFrom(b io.Reader) (Option, error) {
 		return Option{}, err
 	}
 
-	l := binary.BigEndian.Uint16(buf[2:]) - 4
-
 	t := OptionKind(binary.BigEndian.Uint16(buf))
-	parseFn, ok := optionDataParseFn[t]
-	if !ok || parseFn == nil {
-		parseFn = parseRawOptionData
+	if err := c.checkOptionLength(t, binary.BigEndian.Uint16(buf[2:])); err != nil {
+		return Option{}, err
 	}
+	l := binary.BigEndian.Uint16(buf[2:]) - 4
+
+	parseFn := c.registry().Parser(t)
 	if _, err := io.ReadFull(b, buf[:l]); err != nil {
 		return Option{}, err
 	}
 	data := buf[:l]
+	if err := c.checkOptionData(t, data); err != nil {
+		return Option{}, err
+	}
 	opData, err := parseFn(data)
 	if err != nil {
 		return Option{}, err
@@ -110,21 +118,21 @@ func ParseOptionFrom(b io.Reader) (Option, error) {
 // When encoding, it will always use OptionData provided length,
 // option's Length field is ignored and updated by actual length.
 func (o *Option) Marshal() []byte {
+	return o.AppendTo(nil)
+}
+
+// AppendTo append option's binary encoding to b and return the extended buffer, see Marshal
+func (o *Option) AppendTo(b []byte) []byte {
 	data := o.Data.Marshal()
 	l := len(data) + 4
 	if l > math.MaxUint16 {
 		lg.Panic("too much option data")
 	}
 	o.Length = uint16(l)
-	buf := &bytes.Buffer{}
-	binary.Write(buf, binary.BigEndian, o.Kind)
-	binary.Write(buf, binary.BigEndian, o.Length)
-	buf.Write(data)
-	return buf.Bytes()
+	b = append(b, byte(o.Kind>>8), byte(o.Kind), byte(o.Length>>8), byte(o.Length))
+	return append(b, data...)
 }
 
-// maybe MarshalTo([]byte)
-
 type OptionData interface {
 	Marshal() []byte
 }
@@ -2,7 +2,15 @@ package message
 
 import "encoding/binary"
 
-const OptionKindStreamID OptionKind = 0xfd10
+const (
+	OptionKindStreamID OptionKind = 0xfd10
+	// OptionKindUDPAssociationResume ask server to re-attach UDP association of same session to new connection
+	OptionKindUDPAssociationResume OptionKind = 0xfd11
+	// OptionKindMultiplex ask server to multiplex streams over the connection after NOOP reply
+	OptionKindMultiplex OptionKind = 0xfd12
+	// OptionKindPadding carry meaningless bytes to hide message size, receiver ignore it
+	OptionKindPadding OptionKind = 0xfd13
+)
 
 func init() {
 	SetOptionDataParser(OptionKindStreamID, func(b []byte) (OptionData, error) {
@@ -11,6 +19,18 @@ func init() {
 		}
 		return StreamIDOptionData{ID: binary.BigEndian.Uint32(b)}, nil
 	})
+	SetOptionDataParser(OptionKindUDPAssociationResume, func(b []byte) (OptionData, error) {
+		if len(b) != 8 {
+			return nil, ErrBufferSize.WithVerbose("expect 8 bytes buffer, actual %d bytes", len(b))
+		}
+		return UDPAssociationResumeOptionData{AssociationID: binary.BigEndian.Uint64(b)}, nil
+	})
+	SetOptionDataParser(OptionKindMultiplex, func(b []byte) (OptionData, error) {
+		return MultiplexOptionData{}, assertZeroBuffer(b)
+	})
+	SetOptionDataParser(OptionKindPadding, func(b []byte) (OptionData, error) {
+		return PaddingOptionData{Length: len(b)}, nil
+	})
 }
 
 type StreamIDOptionData struct {
@@ -24,3 +44,34 @@ func (s StreamIDOptionData) Marshal() []byte {
 	binary.BigEndian.PutUint32(b, s.ID)
 	return b
 }
+
+type UDPAssociationResumeOptionData struct {
+	AssociationID uint64
+}
+
+var _ OptionData = UDPAssociationResumeOptionData{}
+
+func (s UDPAssociationResumeOptionData) Marshal() []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, s.AssociationID)
+	return b
+}
+
+type MultiplexOptionData struct{}
+
+var _ OptionData = MultiplexOptionData{}
+
+func (s MultiplexOptionData) Marshal() []byte {
+	return []byte{}
+}
+
+// PaddingOptionData is Length zero bytes, content is ignored when parsing
+type PaddingOptionData struct {
+	Length int
+}
+
+var _ OptionData = PaddingOptionData{}
+
+func (s PaddingOptionData) Marshal() []byte {
+	return make([]byte, s.Length)
+}
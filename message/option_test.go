@@ -112,6 +112,54 @@ func TestSetOptionDataParser(t *testing.T) {
 	assert.Panics(t, func() { op.Marshal() })
 }
 
+type MyUint32OptionData struct {
+	V uint32
+}
+
+func (m MyUint32OptionData) Marshal() []byte {
+	return []byte{byte(m.V >> 24), byte(m.V >> 16), byte(m.V >> 8), byte(m.V)}
+}
+
+func TestOptionRegistry(t *testing.T) {
+	r := message.NewOptionRegistry()
+	r.Register(513, func(b []byte) (message.OptionData, error) {
+		if len(b) != 4 {
+			return nil, message.ErrBufferSize
+		}
+		return MyUint32OptionData{V: uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])}, nil
+	})
+	bin := []byte{2, 1, 0, 8, 1, 2, 3, 4}
+	op, err := r.ParseOptionFrom(bytes.NewReader(bin))
+	assert.NoError(t, err)
+	assert.Equal(t, message.Option{Kind: 513, Length: 8, Data: MyUint32OptionData{V: 0x01020304}}, op)
+	assert.Equal(t, bin, op.Marshal())
+	_, err = r.ParseOptionFrom(bytes.NewReader([]byte{2, 1, 0, 6, 1, 2}))
+	assert.Error(t, err)
+
+	// registry don't affect default one
+	op, err = message.ParseOptionFrom(bytes.NewReader(bin))
+	assert.NoError(t, err)
+	assert.Equal(t, &message.RawOptionData{Data: []byte{1, 2, 3, 4}}, op.Data)
+
+	// known kinds fallback to default registry
+	ops, err := r.ParseOptionSetFrom(bytes.NewReader(append([]byte{0, 6, 0, 8, 0, 0, 0, 5}, bin...)), 16)
+	assert.NoError(t, err)
+	d, _ := ops.GetData(message.OptionKindSessionID)
+	assert.Equal(t, message.SessionIDOptionData{ID: []byte{0, 0, 0, 5}}, d)
+	d, _ = ops.GetData(513)
+	assert.Equal(t, MyUint32OptionData{V: 0x01020304}, d)
+
+	// override and clear known kinds
+	r.Register(message.OptionKindSessionID, nil)
+	op, err = r.ParseOptionFrom(bytes.NewReader([]byte{0, 6, 0, 8, 0, 0, 0, 5}))
+	assert.NoError(t, err)
+	assert.Equal(t, &message.RawOptionData{Data: []byte{0, 0, 0, 5}}, op.Data)
+	r.Unregister(message.OptionKindSessionID)
+	op, err = r.ParseOptionFrom(bytes.NewReader([]byte{0, 6, 0, 8, 0, 0, 0, 5}))
+	assert.NoError(t, err)
+	assert.Equal(t, message.SessionIDOptionData{ID: []byte{0, 0, 0, 5}}, op.Data)
+}
+
 func TestAuthenticationMethodAdvertisementOptionData(t *testing.T) {
 	optionDataTestParse(t,
 		[]byte{
@@ -284,3 +332,96 @@ func TestIdempotenceRejectedOptionData(t *testing.T) {
 			Data: message.IdempotenceRejectedOptionData{},
 		})
 }
+
+func TestUDPAssociationResumeOptionData(t *testing.T) {
+	optionDataTest(t,
+		[]byte{
+			0xfd, 0x11, 0, 12,
+			1, 2, 3, 4, 5, 6, 7, 8,
+		}, message.Option{
+			Kind: message.OptionKindUDPAssociationResume,
+			Data: message.UDPAssociationResumeOptionData{
+				AssociationID: 0x0102030405060708,
+			},
+		})
+}
+
+func TestMultiplexOptionData(t *testing.T) {
+	optionDataTest(t,
+		[]byte{
+			0xfd, 0x12, 0, 4,
+		}, message.Option{
+			Kind: message.OptionKindMultiplex,
+			Data: message.MultiplexOptionData{},
+		})
+}
+
+func TestPrivateOptionKind(t *testing.T) {
+	k := message.VendorOptionKind(message.VendorOptionExperimental, 0)
+	assert.Equal(t, message.OptionKindStreamID, k)
+	v, c, ok := message.OptionKind(0xfc52).Vendor()
+	assert.True(t, ok)
+	assert.Equal(t, message.VendorID(5), v)
+	assert.Equal(t, uint8(2), c)
+	_, _, ok = message.OptionKindStack.Vendor()
+	assert.False(t, ok)
+	assert.Equal(t, message.OptionKindPrivateMax, message.VendorOptionKind(message.MaxVendorID, 15))
+	assert.Panics(t, func() { message.VendorOptionKind(message.MaxVendorID+1, 0) })
+
+	assert.True(t, message.OptionKindSessionID.IsStandard())
+	assert.False(t, message.OptionKind(7).IsStandard())
+	assert.False(t, message.OptionKindStreamID.IsStandard())
+	assert.True(t, message.OptionKindStreamID.IsPrivate())
+
+	r := message.NewOptionRegistry()
+	assert.ErrorIs(t, r.RegisterPrivate(message.OptionKind(0x100), nil), message.ErrReservedOptionKind)
+	assert.NoError(t, r.RegisterPrivate(k, nil))
+
+	// unknown private option is kept as is
+	ops := message.NewOptionSet()
+	ops.Add(message.Option{Kind: message.OptionKindSessionRequest, Data: message.SessionRequestOptionData{}})
+	ops.Add(message.Option{Kind: 0xfe01, Data: &message.RawOptionData{Data: []byte{1, 2, 3, 4}}})
+	ops2, err := message.ParseOptionSetFrom(bytes.NewReader(ops.Marshal()), len(ops.Marshal()))
+	assert.NoError(t, err)
+	priv := ops2.Private()
+	if assert.Len(t, priv, 1) {
+		assert.Equal(t, message.OptionKind(0xfe01), priv[0].Kind)
+		assert.Equal(t, []byte{1, 2, 3, 4}, priv[0].Data.Marshal())
+	}
+}
+
+func TestAuthenticationDataChunk(t *testing.T) {
+	assert.Nil(t, message.NewAuthenticationDataOptions(1, nil))
+
+	data := make([]byte, message.MaxAuthenticationDataChunk*2+10)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	ops := message.NewAuthenticationDataOptions(3, data)
+	assert.Len(t, ops, 3)
+	s := message.NewOptionSet()
+	s.Add(message.Option{Kind: message.OptionKindAuthenticationData, Data: message.AuthenticationDataOptionData{Method: 2, Data: []byte{1}}})
+	s.AddMany(ops)
+	for _, op := range ops {
+		assert.LessOrEqual(t, len(op.Marshal()), 0xffff)
+	}
+
+	d, ok := message.GetAuthenticationData(s, 3)
+	assert.True(t, ok)
+	assert.Equal(t, data, d)
+	d, ok = message.GetAuthenticationData(s, 2)
+	assert.True(t, ok)
+	assert.Equal(t, []byte{1}, d)
+	_, ok = message.GetAuthenticationData(s, 4)
+	assert.False(t, ok)
+
+	// reassemble after parse
+	small := message.NewOptionSet()
+	small.AddMany(message.NewAuthenticationDataOptions(3, []byte{1, 2}))
+	small.AddMany(message.NewAuthenticationDataOptions(3, []byte{3}))
+	b := small.Marshal()
+	parsed, err := message.ParseOptionSetFrom(bytes.NewReader(b), len(b))
+	assert.NoError(t, err)
+	d, _ = message.GetAuthenticationData(parsed, 3)
+	assert.Equal(t, []byte{1, 2, 3}, d)
+}
@@ -0,0 +1,69 @@
+package message
+
+import (
+	"io"
+	"sync"
+)
+
+// OptionDataParser parse option data of a specific kind, b doesn't include option header.
+// Returned OptionData's Marshal should produce data accepted by same parser.
+type OptionDataParser func(b []byte) (OptionData, error)
+
+// OptionRegistry map option kinds to option data parsers.
+// Kinds not registered are looked up in parent registry, option data of unknown kinds is parsed as RawOptionData.
+type OptionRegistry struct {
+	parent *OptionRegistry
+
+	mtx     sync.RWMutex
+	parsers map[OptionKind]OptionDataParser
+}
+
+// NewOptionRegistry create an empty registry, unregistered kinds are parsed by DefaultOptionRegistry
+func NewOptionRegistry() *OptionRegistry {
+	return &OptionRegistry{
+		parent:  DefaultOptionRegistry,
+		parsers: map[OptionKind]OptionDataParser{},
+	}
+}
+
+// Register set the parser of kind, it overrides parent registry's parser.
+// Set fn to nil to parse option data of kind as RawOptionData.
+func (r *OptionRegistry) Register(kind OptionKind, fn OptionDataParser) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.parsers[kind] = fn
+}
+
+// Unregister remove the parser of kind, parent registry's parser is used after it
+func (r *OptionRegistry) Unregister(kind OptionKind) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	delete(r.parsers, kind)
+}
+
+// Parser return the parser of kind, RawOptionData's parser is returned when kind is unknown
+func (r *OptionRegistry) Parser(kind OptionKind) OptionDataParser {
+	for reg := r; reg != nil; reg = reg.parent {
+		reg.mtx.RLock()
+		fn, ok := reg.parsers[kind]
+		reg.mtx.RUnlock()
+		if !ok {
+			continue
+		}
+		if fn == nil {
+			break
+		}
+		return fn
+	}
+	return parseRawOptionData
+}
+
+// ParseOptionFrom parses b as a SOCKS6 option, option data is parsed by registered parser
+func (r *OptionRegistry) ParseOptionFrom(b io.Reader) (Option, error) {
+	return (&ParseConfig{Registry: r}).ParseOptionFrom(b)
+}
+
+// ParseOptionSetFrom parses limit bytes of b as SOCKS6 options, option data is parsed by registered parser
+func (r *OptionRegistry) ParseOptionSetFrom(b io.Reader, limit int) (*OptionSet, error) {
+	return (&ParseConfig{Registry: r}).ParseOptionSetFrom(b, limit)
+}
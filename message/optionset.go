@@ -1,10 +1,15 @@
 package message
 
 import (
-	"fmt"
+	"bytes"
 	"io"
+	"sort"
+
+	"github.com/studentmain/socks6/common/lg"
 )
 
+// OptionSet is a list of options, options are marshaled in the order they are added.
+// Use Sort to get canonical form when order of options added is not meaningful.
 type OptionSet struct {
 	perKind map[OptionKind][]Option
 	list    []Option
@@ -13,10 +18,6 @@ type OptionSet struct {
 	cache  []byte
 }
 
-func (s OptionSet) String() string {
-	return fmt.Sprintf("OptionSet%+v", s.list)
-}
-
 func NewOptionSet() *OptionSet {
 	return &OptionSet{
 		perKind: map[OptionKind][]Option{},
@@ -26,20 +27,57 @@ func NewOptionSet() *OptionSet {
 }
 
 func ParseOptionSetFrom(b io.Reader, limit int) (*OptionSet, error) {
+	return defaultParseConfig.ParseOptionSetFrom(b, limit)
+}
+
+// ParseOptionSetFrom parses limit bytes of b as SOCKS6 options with config c.
+// In strict mode, options must end exactly at limit and must not duplicate each other.
+func (c *ParseConfig) ParseOptionSetFrom(b io.Reader, limit int) (*OptionSet, error) {
 	ops := NewOptionSet()
-	if limit > MaxOptionSize {
-		return nil, ErrOptionTooLong
+	err := c.ParseOptionSetStream(b, limit, func(op Option) error {
+		if err := c.checkDuplicateOption(ops, op); err != nil {
+			return err
+		}
+		ops.Add(op)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+func ParseOptionSetStream(b io.Reader, limit int, fn func(Option) error) error {
+	return defaultParseConfig.ParseOptionSetStream(b, limit, fn)
+}
+
+// ParseOptionSetStream parses limit bytes of b as SOCKS6 options with config c,
+// and call fn on each option as soon as it's parsed instead of collecting them into an OptionSet.
+// Parsing stops at the first error returned by fn, which is returned unchanged,
+// so caller can reject a message by policy before reading all of its options.
+// Length and count limit are enforced, duplicate options are left to fn.
+func (c *ParseConfig) ParseOptionSetStream(b io.Reader, limit int, fn func(Option) error) error {
+	if limit > c.maxOptionsLength() {
+		return ErrOptionTooLong.WithVerbose("options length %d exceed limit %d", limit, c.maxOptionsLength())
 	}
 	totalLen := 0
-	for totalLen < limit {
-		op, err := ParseOptionFrom(b)
+	for n := 0; totalLen < limit; n++ {
+		op, err := c.ParseOptionFrom(b)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		totalLen += int(op.Length)
-		ops.Add(op)
+		if err := c.checkOptionCount(n); err != nil {
+			return err
+		}
+		if err := fn(op); err != nil {
+			return err
+		}
 	}
-	return ops, nil
+	if c.Strict && totalLen != limit {
+		return ErrBufferSize.WithVerbose("options length %d exceed limit %d", totalLen, limit)
+	}
+	return nil
 }
 func (s *OptionSet) Add(o Option) {
 	arr, ok := s.perKind[o.Kind]
@@ -59,19 +97,116 @@ func (s *OptionSet) Marshal() []byte {
 	if s.cached {
 		return s.cache
 	}
-	b := []byte{}
-	for _, op := range s.list {
-		opb := op.Marshal()
-		b = append(b, opb...)
-	}
+	b := s.AppendTo([]byte{})
 	s.cache = b
 	s.cached = true
 	return b
 }
+
+// AppendTo append options' wireformat to b and return the extended buffer
+func (s *OptionSet) AppendTo(b []byte) []byte {
+	if s.cached {
+		return append(b, s.cache...)
+	}
+	for _, op := range s.list {
+		b = op.AppendTo(b)
+	}
+	return b
+}
+
+// Clone return a copy of option set, options added to copy don't affect original one
+func (s *OptionSet) Clone() *OptionSet {
+	c := NewOptionSet()
+	c.AddMany(s.list)
+	return c
+}
+
+// Sort reorder options in canonical form, which is sorted by kind then by wireformat.
+// Sets with same options have same wireformat after Sort no matter how they are added.
+func (s *OptionSet) Sort() {
+	list := s.List()
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Kind != list[j].Kind {
+			return list[i].Kind < list[j].Kind
+		}
+		return bytes.Compare(list[i].Marshal(), list[j].Marshal()) < 0
+	})
+	s.reset(list)
+}
+
 func (s *OptionSet) Len() int {
 	return len(s.list)
 }
 
+// Range call fn on each option in the order they are added, stop when fn return false.
+// fn must not modify s.
+func (s *OptionSet) Range(fn func(Option) bool) {
+	for _, op := range s.list {
+		if !fn(op) {
+			return
+		}
+	}
+}
+
+// List return options in the order they are added, modify returned slice doesn't affect s
+func (s *OptionSet) List() []Option {
+	return append([]Option{}, s.list...)
+}
+
+// Remove remove all options of kind and return number of removed options
+func (s *OptionSet) Remove(kind OptionKind) int {
+	return s.RemoveF(kind, func(Option) bool { return true })
+}
+
+// RemoveF remove options of kind which fn return true and return number of removed options
+func (s *OptionSet) RemoveF(kind OptionKind, fn func(Option) bool) int {
+	if len(s.perKind[kind]) == 0 {
+		return 0
+	}
+	n := 0
+	list := make([]Option, 0, len(s.list))
+	for _, op := range s.list {
+		if op.Kind == kind && fn(op) {
+			n++
+			continue
+		}
+		list = append(list, op)
+	}
+	if n > 0 {
+		s.reset(list)
+	}
+	return n
+}
+
+// ReplaceData set data of first option of kind to data and remove other options of kind,
+// option is appended when s has no option of kind
+func (s *OptionSet) ReplaceData(kind OptionKind, data OptionData) {
+	if len(s.perKind[kind]) == 0 {
+		s.Add(Option{Kind: kind, Data: data})
+		return
+	}
+	list := make([]Option, 0, len(s.list))
+	replaced := false
+	for _, op := range s.list {
+		if op.Kind == kind {
+			if replaced {
+				continue
+			}
+			op.Data = data
+			replaced = true
+		}
+		list = append(list, op)
+	}
+	s.reset(list)
+}
+
+// reset replace options in s with list
+func (s *OptionSet) reset(list []Option) {
+	s.perKind = map[OptionKind][]Option{}
+	s.list = []Option{}
+	s.AddMany(list)
+}
+
 func (s *OptionSet) get(kind OptionKind) (Option, bool) {
 	arr, ok := s.perKind[kind]
 	if !ok {
@@ -86,6 +221,28 @@ func (s *OptionSet) GetData(kind OptionKind) (OptionData, bool) {
 	op, ok := s.get(kind)
 	return op.Data, ok
 }
+
+// GetTyped return data of first option of kind in s as T,
+// false if there is no such option or its data is not T
+func GetTyped[T OptionData](s *OptionSet, kind OptionKind) (T, bool) {
+	op, ok := s.get(kind)
+	if !ok {
+		var zero T
+		return zero, false
+	}
+	d, ok := op.Data.(T)
+	return d, ok
+}
+
+// MustGet works like GetTyped, but panic when option is not found or its data is not T
+func MustGet[T OptionData](s *OptionSet, kind OptionKind) T {
+	d, ok := GetTyped[T](s, kind)
+	if !ok {
+		lg.Panicf("option kind %s with %T data not found", kind, d)
+	}
+	return d
+}
+
 func (s *OptionSet) GetKind(kind OptionKind) []Option {
 	arr, ok := s.perKind[kind]
 	if !ok {
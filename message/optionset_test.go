@@ -1,6 +1,8 @@
 package message_test
 
 import (
+	"bytes"
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -51,3 +53,210 @@ func TestOptionSet(t *testing.T) {
 		}, ops)
 
 }
+
+func TestOptionSetClone(t *testing.T) {
+	opset := message.NewOptionSet()
+	opset.Add(message.Option{
+		Kind: message.OptionKindSessionOK,
+		Data: message.SessionOKOptionData{},
+	})
+	c := opset.Clone()
+	c.Add(message.Option{
+		Kind: message.OptionKindSessionInvalid,
+		Data: message.SessionInvalidOptionData{},
+	})
+	assert.Equal(t, 1, opset.Len())
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, []byte{0, 8, 0, 4}, opset.Marshal())
+	assert.Equal(t, []byte{0, 8, 0, 4, 0, 9, 0, 4}, c.Marshal())
+}
+
+func TestOptionSetGetTyped(t *testing.T) {
+	opset := message.NewOptionSet()
+	opset.Add(message.Option{
+		Kind: message.OptionKindTokenRequest,
+		Data: message.TokenRequestOptionData{WindowSize: 10},
+	})
+	opset.Add(message.Option{
+		Kind: 0xfd80,
+		Data: &message.RawOptionData{Data: []byte{1, 2, 3, 4}},
+	})
+
+	tr, ok := message.GetTyped[message.TokenRequestOptionData](opset, message.OptionKindTokenRequest)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(10), tr.WindowSize)
+	_, ok = message.GetTyped[message.SessionIDOptionData](opset, message.OptionKindTokenRequest)
+	assert.False(t, ok)
+	_, ok = message.GetTyped[message.SessionIDOptionData](opset, message.OptionKindSessionID)
+	assert.False(t, ok)
+
+	raw := message.MustGet[*message.RawOptionData](opset, 0xfd80)
+	assert.Equal(t, []byte{1, 2, 3, 4}, raw.Data)
+	assert.Panics(t, func() {
+		message.MustGet[message.SessionIDOptionData](opset, message.OptionKindSessionID)
+	})
+}
+
+func TestOptionSetMutation(t *testing.T) {
+	opset := message.NewOptionSet()
+	opset.AddMany([]message.Option{
+		{Kind: message.OptionKindSessionID, Data: message.SessionIDOptionData{ID: []byte{1, 2, 3, 4}}},
+		{Kind: message.OptionKindAuthenticationData, Data: message.AuthenticationDataOptionData{Method: 2, Data: []byte{1}}},
+		{Kind: message.OptionKindAuthenticationData, Data: message.AuthenticationDataOptionData{Method: 3, Data: []byte{2}}},
+		{Kind: message.OptionKindSessionOK, Data: message.SessionOKOptionData{}},
+	})
+	kinds := func() []message.OptionKind {
+		r := []message.OptionKind{}
+		opset.Range(func(o message.Option) bool {
+			r = append(r, o.Kind)
+			return true
+		})
+		return r
+	}
+	assert.Equal(t, []message.OptionKind{
+		message.OptionKindSessionID,
+		message.OptionKindAuthenticationData,
+		message.OptionKindAuthenticationData,
+		message.OptionKindSessionOK,
+	}, kinds())
+	n := 0
+	opset.Range(func(o message.Option) bool {
+		n++
+		return false
+	})
+	assert.Equal(t, 1, n)
+
+	cl := opset.Clone()
+	b := opset.Marshal()
+	assert.Equal(t, 1, opset.RemoveF(message.OptionKindAuthenticationData, func(o message.Option) bool {
+		return o.Data.(message.AuthenticationDataOptionData).Method == 3
+	}))
+	assert.Len(t, opset.GetKind(message.OptionKindAuthenticationData), 1)
+	assert.Equal(t, 1, opset.Remove(message.OptionKindAuthenticationData))
+	assert.Equal(t, 0, opset.Remove(message.OptionKindAuthenticationData))
+	assert.Equal(t, []message.OptionKind{message.OptionKindSessionID, message.OptionKindSessionOK}, kinds())
+	assert.NotEqual(t, b, opset.Marshal())
+	assert.Equal(t, b, cl.Marshal())
+
+	opset.ReplaceData(message.OptionKindSessionID, message.SessionIDOptionData{ID: []byte{5, 6, 7, 8}})
+	opset.ReplaceData(message.OptionKindTokenRequest, message.TokenRequestOptionData{WindowSize: 1})
+	assert.Equal(t, []message.OptionKind{
+		message.OptionKindSessionID,
+		message.OptionKindSessionOK,
+		message.OptionKindTokenRequest,
+	}, kinds())
+	d, _ := opset.GetData(message.OptionKindSessionID)
+	assert.Equal(t, message.SessionIDOptionData{ID: []byte{5, 6, 7, 8}}, d)
+
+	l := opset.List()
+	l[0].Kind = message.OptionKindStack
+	assert.Equal(t, message.OptionKindSessionID, opset.List()[0].Kind)
+}
+
+func TestOptionSetStream(t *testing.T) {
+	s := message.NewOptionSet()
+	s.Add(message.Option{Kind: message.OptionKindSessionRequest, Data: message.SessionRequestOptionData{}})
+	s.Add(message.Option{Kind: message.OptionKindSessionOK, Data: message.SessionOKOptionData{}})
+	s.Add(message.Option{Kind: message.OptionKindSessionInvalid, Data: message.SessionInvalidOptionData{}})
+	b := s.Marshal()
+
+	kinds := []message.OptionKind{}
+	err := message.ParseOptionSetStream(bytes.NewReader(b), len(b), func(o message.Option) error {
+		kinds = append(kinds, o.Kind)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []message.OptionKind{message.OptionKindSessionRequest, message.OptionKindSessionOK, message.OptionKindSessionInvalid}, kinds)
+
+	// stop early
+	errStop := errors.New("stop")
+	r := bytes.NewReader(b)
+	n := 0
+	err = message.ParseOptionSetStream(r, len(b), func(o message.Option) error {
+		n++
+		if o.Kind == message.OptionKindSessionOK {
+			return errStop
+		}
+		return nil
+	})
+	assert.ErrorIs(t, err, errStop)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 4, r.Len())
+
+	c := &message.ParseConfig{MaxOptionCount: 2}
+	err = c.ParseOptionSetStream(bytes.NewReader(b), len(b), func(o message.Option) error { return nil })
+	assert.ErrorIs(t, err, message.ErrTooManyOptions)
+}
+
+func TestOptionSetReset(t *testing.T) {
+	s := message.AcquireOptionSet()
+	s.Add(message.Option{Kind: message.OptionKindSessionOK, Data: message.SessionOKOptionData{}})
+	b := s.Marshal()
+	s.Reset()
+	assert.Equal(t, 0, s.Len())
+	_, ok := s.GetData(message.OptionKindSessionOK)
+	assert.False(t, ok)
+	assert.Empty(t, s.Marshal())
+	// marshaled bytes are kept by caller
+	assert.Len(t, b, 4)
+	message.ReleaseOptionSet(s)
+
+	rep := message.AcquireOperationReply(message.OperationReplyTimeout)
+	assert.Equal(t, message.OperationReplyTimeout, rep.ReplyCode)
+	rep.Endpoint = message.ParseAddr("example.com:80")
+	rep.Options.Add(message.Option{Kind: message.OptionKindSessionOK, Data: message.SessionOKOptionData{}})
+	rep.Profile = message.ProfileDraft11
+	rep.Reset()
+	assert.Equal(t, message.NewOperationReply(), rep)
+	message.ReleaseOperationReply(rep)
+
+	arep := message.AcquireAuthenticationReply(message.AuthenticationReplyFail)
+	assert.Equal(t, message.AuthenticationReplyFail, arep.Type)
+	arep.Options.Add(message.Option{Kind: message.OptionKindSessionOK, Data: message.SessionOKOptionData{}})
+	arep.Reset()
+	assert.Equal(t, message.NewAuthenticationReply(), arep)
+	message.ReleaseAuthenticationReply(arep)
+
+	req := message.AcquireRequest()
+	req.CommandCode = message.CommandConnect
+	req.Options = nil
+	message.ReleaseRequest(req)
+	assert.Equal(t, message.NewRequest(), message.AcquireRequest())
+}
+
+func TestOptionSetSort(t *testing.T) {
+	ops := []message.Option{
+		{Kind: message.OptionKindSessionID, Data: message.SessionIDOptionData{ID: []byte{2}}},
+		{Kind: message.OptionKindSessionOK, Data: message.SessionOKOptionData{}},
+		{Kind: message.OptionKindSessionID, Data: message.SessionIDOptionData{ID: []byte{1}}},
+	}
+	s1 := message.NewOptionSet()
+	s1.AddMany(ops)
+	s2 := message.NewOptionSet()
+	for i := len(ops) - 1; i >= 0; i-- {
+		s2.Add(ops[i])
+	}
+	// insertion order
+	assert.Equal(t, ops, s1.List())
+	assert.NotEqual(t, s1.Marshal(), s2.Marshal())
+
+	s1.Sort()
+	s2.Sort()
+	assert.Equal(t, s1.Marshal(), s2.Marshal())
+	assert.Equal(t, message.OptionKindSessionOK, s1.List()[2].Kind)
+	assert.Equal(t, []byte{1}, message.MustGet[message.SessionIDOptionData](s1, message.OptionKindSessionID).ID)
+
+	// stack options generated from map are in stable order
+	info := message.StackOptionInfo{
+		message.StackOptionIPTOS:  byte(1),
+		message.StackOptionIPTTL:  byte(2),
+		message.StackOptionTCPTFO: uint16(3),
+	}
+	b := message.NewOptionSet()
+	b.AddMany(info.GetOptions(true, false))
+	for i := 0; i < 10; i++ {
+		s := message.NewOptionSet()
+		s.AddMany(info.GetOptions(true, false))
+		assert.Equal(t, b.Marshal(), s.Marshal())
+	}
+}
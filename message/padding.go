@@ -0,0 +1,77 @@
+package message
+
+// maxPaddingOptionLength is the longest 4 bytes aligned option
+const maxPaddingOptionLength = 0xfffc
+
+// NewPaddingOptions return padding options with total wireformat length n,
+// n is rounded up to multiple of 4 to keep options aligned, nil when n <= 0
+func NewPaddingOptions(n int) []Option {
+	if n <= 0 {
+		return nil
+	}
+	n = (n + 3) &^ 3
+	ops := []Option{}
+	for n > 0 {
+		l := n
+		if l > maxPaddingOptionLength {
+			l = maxPaddingOptionLength
+		}
+		ops = append(ops, Option{Kind: OptionKindPadding, Data: PaddingOptionData{Length: l - 4}})
+		n -= l
+	}
+	return ops
+}
+
+// PaddingLength return padding length needed to round a message of length l up to multiple of block, 0 when block <= 0.
+// Result is multiple of 4, so it's exact only when l and block are multiple of 4.
+func PaddingLength(l int, block int) int {
+	if block <= 0 || l%block == 0 {
+		return 0
+	}
+	return (block - l%block + 3) &^ 3
+}
+
+// padOptions add padding options to ops, so a message of length l become multiple of block
+func padOptions(ops *OptionSet, l int, block int) *OptionSet {
+	n := PaddingLength(l, block)
+	if n == 0 {
+		return ops
+	}
+	if ops == nil {
+		ops = NewOptionSet()
+	}
+	ops.AddMany(NewPaddingOptions(n))
+	return ops
+}
+
+// Pad add padding options to round request's wireformat length up to multiple of block, 0 means no padding
+func (r *Request) Pad(block int) {
+	r.Options = padOptions(r.Options, len(r.Marshal()), block)
+}
+
+// Pad add padding options to round authentication reply's wireformat length up to multiple of block, 0 means no padding
+func (a *AuthenticationReply) Pad(block int) {
+	a.Options = padOptions(a.Options, len(a.Marshal()), block)
+}
+
+// Pad add padding options to round operation reply's wireformat length up to multiple of block, 0 means no padding
+func (o *OperationReply) Pad(block int) {
+	o.Options = padOptions(o.Options, len(o.Marshal()), block)
+}
+
+// Pad add padding options to round stack option message's wireformat length up to multiple of block, 0 means no padding.
+// Other message types don't carry options and are unchanged, use NewUDPPadding to send dummy message instead.
+func (u *UDPMessage) Pad(block int) {
+	if u.Type != UDPMessageStackOption {
+		return
+	}
+	u.Options = padOptions(u.Options, len(u.Marshal()), block)
+}
+
+// NewUDPPadding create a stack option message carrying only n bytes of padding options,
+// which change nothing and can be sent as dummy traffic
+func NewUDPPadding(id uint64, n int) *UDPMessage {
+	ops := NewOptionSet()
+	ops.AddMany(NewPaddingOptions(n))
+	return NewUDPStackOption(id, ops)
+}
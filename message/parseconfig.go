@@ -0,0 +1,194 @@
+package message
+
+import "bytes"
+
+// ParseConfig control how messages and options are parsed.
+// Zero value is lenient and parse option data with DefaultOptionRegistry, which is used by package level parse functions.
+type ParseConfig struct {
+	// Strict reject duplicate options, nonzero or missing padding and out-of-spec lengths,
+	// otherwise they are ignored as long as message can be decoded
+	Strict bool
+	// Registry parse option data, DefaultOptionRegistry is used when nil
+	Registry *OptionRegistry
+
+	// MaxOptionsLength limit total length of options in a message, 0 means MaxOptionSize
+	MaxOptionsLength int
+	// MaxOptionCount limit number of options in a message, 0 means no limit
+	MaxOptionCount int
+	// MaxInitialDataLength limit initial data length advertised in request, 0 means no limit
+	MaxInitialDataLength int
+
+	// Profiles are draft revisions accepted in addition to DefaultProfile,
+	// parsed message's Profile is set to the revision it use
+	Profiles []*Profile
+}
+
+var defaultParseConfig = &ParseConfig{}
+
+func (c *ParseConfig) registry() *OptionRegistry {
+	if c.Registry == nil {
+		return DefaultOptionRegistry
+	}
+	return c.Registry
+}
+
+func (c *ParseConfig) maxOptionsLength() int {
+	if c.MaxOptionsLength <= 0 || c.MaxOptionsLength > MaxOptionSize {
+		return MaxOptionSize
+	}
+	return c.MaxOptionsLength
+}
+
+// checkOptionCount check whether another option can be added after n options
+func (c *ParseConfig) checkOptionCount(n int) error {
+	if c.MaxOptionCount > 0 && n >= c.MaxOptionCount {
+		return ErrTooManyOptions.WithVerbose("more than %d options", c.MaxOptionCount)
+	}
+	return nil
+}
+
+// checkInitialDataLength check initial data length advertised in request options
+func (c *ParseConfig) checkInitialDataLength(s *OptionSet) error {
+	if c.MaxInitialDataLength <= 0 {
+		return nil
+	}
+	d, ok := GetTyped[AuthenticationMethodAdvertisementOptionData](s, OptionKindAuthenticationMethodAdvertisement)
+	if !ok {
+		return nil
+	}
+	if l := int(d.InitialDataLength); l > c.MaxInitialDataLength {
+		return ErrInitialDataTooLong.WithVerbose("initial data length %d exceed limit %d", l, c.MaxInitialDataLength)
+	}
+	return nil
+}
+
+// singletonOptionKinds can only appear once in a message
+var singletonOptionKinds = map[OptionKind]bool{
+	OptionKindAuthenticationMethodAdvertisement: true,
+	OptionKindAuthenticationMethodSelection:     true,
+	OptionKindSessionRequest:                    true,
+	OptionKindSessionID:                         true,
+	OptionKindSessionOK:                         true,
+	OptionKindSessionInvalid:                    true,
+	OptionKindSessionTeardown:                   true,
+	OptionKindTokenRequest:                      true,
+	OptionKindIdempotenceWindow:                 true,
+	OptionKindIdempotenceExpenditure:            true,
+	OptionKindIdempotenceAccepted:               true,
+	OptionKindIdempotenceRejected:               true,
+	OptionKindStreamID:                          true,
+	OptionKindUDPAssociationResume:              true,
+	OptionKindMultiplex:                         true,
+}
+
+// minOptionDataLen is minimum data length of options whose parser doesn't check it
+var minOptionDataLen = map[OptionKind]int{
+	OptionKindStack: 2,
+	OptionKindAuthenticationMethodAdvertisement: 2,
+	OptionKindAuthenticationData:                1,
+}
+
+// checkOptionLength check option length field before reading option data,
+// length shorter than header is always rejected, padding is checked in strict mode
+func (c *ParseConfig) checkOptionLength(kind OptionKind, length uint16) error {
+	if length < 4 {
+		return ErrBufferSize.WithVerbose("option kind %d length %d is shorter than header", kind, length)
+	}
+	if !c.Strict {
+		return nil
+	}
+	// authentication method data is variable length and not padded by most implementations
+	if length%4 != 0 && kind != OptionKindAuthenticationData {
+		return ErrBufferSize.WithVerbose("option kind %d length %d is not a multiple of 4", kind, length)
+	}
+	return nil
+}
+
+// checkOptionData check option data before parsing it, data too short to decode is rejected even not in strict mode
+func (c *ParseConfig) checkOptionData(kind OptionKind, d []byte) error {
+	if len(d) < minOptionDataLen[kind] {
+		return ErrBufferSize.WithVerbose("option kind %d expect at least %d bytes data, actual %d bytes", kind, minOptionDataLen[kind], len(d))
+	}
+	if !c.Strict {
+		return nil
+	}
+	if kind == OptionKindAuthenticationMethodAdvertisement {
+		// methods are padded by trailing zeros
+		methods := d[2:]
+		if i := bytes.IndexByte(methods, 0); i >= 0 && len(bytes.Trim(methods[i:], "\x00")) != 0 {
+			return ErrPadding.WithVerbose("authentication method advertisement has method after padding")
+		}
+	}
+	return nil
+}
+
+// checkDuplicateOption check whether op duplicates an option already in s, in strict mode
+func (c *ParseConfig) checkDuplicateOption(s *OptionSet, op Option) error {
+	if !c.Strict {
+		return nil
+	}
+	prev := s.GetKind(op.Kind)
+	if len(prev) == 0 {
+		return nil
+	}
+	if singletonOptionKinds[op.Kind] {
+		return ErrDuplicateOption.WithVerbose("option kind %d appear more than once", op.Kind)
+	}
+	for _, p := range prev {
+		if optionConflict(p, op) {
+			return ErrDuplicateOption.WithVerbose("option kind %d conflict with previous one, %+v", op.Kind, op.Data)
+		}
+	}
+	return nil
+}
+
+// optionConflict check whether a and b of same kind set same thing
+func optionConflict(a Option, b Option) bool {
+	switch a.Kind {
+	case OptionKindStack:
+		sa, ok1 := a.Data.(BaseStackOptionData)
+		sb, ok2 := b.Data.(BaseStackOptionData)
+		if ok1 && ok2 {
+			return sa.Level == sb.Level && sa.Code == sb.Code &&
+				((sa.ClientLeg && sb.ClientLeg) || (sa.RemoteLeg && sb.RemoteLeg))
+		}
+	case OptionKindAuthenticationData:
+		// method may split its data into many options
+		return false
+	}
+	return bytes.Equal(a.Data.Marshal(), b.Data.Marshal())
+}
+
+// checkAddressPadding check padding field before address is zero, in strict mode
+func (c *ParseConfig) checkAddressPadding(pad byte) error {
+	if c.Strict && pad != 0 {
+		return ErrPadding.WithVerbose("address padding field is %d", pad)
+	}
+	return nil
+}
+
+// checkRemain check no byte is left after message is parsed, in strict mode
+func (c *ParseConfig) checkRemain(n int) error {
+	if c.Strict && n != 0 {
+		return ErrBufferSize.WithVerbose("%d bytes left after message", n)
+	}
+	return nil
+}
+
+// checkUDPHeaderType reject UDP message of unknown type, its layout is unknown
+func checkUDPHeaderType(t UDPHeaderType) error {
+	switch t {
+	case UDPMessageAssociationInit, UDPMessageAssociationAck, UDPMessageDatagram, UDPMessageError,
+		UDPMessageStackOption, UDPMessageFragment:
+		return nil
+	}
+	return ErrEnumValue.WithVerbose("udp message type %d", t)
+}
+
+// checkUDPErrorType check error type of UDP error message is defined, in strict mode
+func (c *ParseConfig) checkUDPErrorType(t UDPErrorType) error {
+	if c.Strict && !t.Valid() {
+		return ErrEnumValue.WithVerbose("udp error type %d", t)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package message
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+func ParseRequestContext(ctx context.Context, conn net.Conn) (*Request, error) {
+	return defaultParseConfig.ParseRequestContext(ctx, conn)
+}
+
+// ParseRequestContext works like ParseRequestFrom, but stop reading conn when ctx is done,
+// so a half-open or slow client can't block it forever.
+// ctx's deadline is applied as conn's read deadline, returned ParseError wrap ctx's error when interrupted.
+func (c *ParseConfig) ParseRequestContext(ctx context.Context, conn net.Conn) (*Request, error) {
+	stop := watchReadContext(ctx, conn)
+	r, err := c.ParseRequestFrom(conn)
+	cerr := stop()
+	if cerr == nil {
+		return r, err
+	}
+	if err == nil {
+		// request is complete before interrupt, make conn usable again
+		conn.SetReadDeadline(time.Time{})
+		return r, nil
+	}
+	pe := &ParseError{}
+	if errors.As(err, &pe) {
+		pe.Err = cerr
+	}
+	return r, err
+}
+
+// watchReadContext apply ctx's deadline to conn's read deadline and interrupt conn's read when ctx is done,
+// until returned function is called. The function return ctx's error if conn is interrupted.
+func watchReadContext(ctx context.Context, conn net.Conn) func() error {
+	if ctx.Done() == nil {
+		return func() error { return nil }
+	}
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(d)
+	}
+	done := make(chan struct{})
+	interrupted := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// make pending and future read fail immediately
+			conn.SetReadDeadline(time.Unix(1, 0))
+			interrupted <- ctx.Err()
+		case <-done:
+			interrupted <- nil
+		}
+	}()
+	return func() error {
+		close(done)
+		if err := <-interrupted; err != nil {
+			return err
+		}
+		// deadline set on conn may expire before ctx is done
+		if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+			return context.DeadlineExceeded
+		}
+		conn.SetReadDeadline(time.Time{})
+		return nil
+	}
+}
@@ -0,0 +1,76 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxConsumedBytes is how many consumed bytes ParseError keeps
+const maxConsumedBytes = 64
+
+// ParseError is returned by message parsers, it record what was being parsed and where it failed.
+// Underlying error (e.g. io.EOF, ErrFormat, ErrVersionMismatch) is available via errors.Is and errors.As.
+type ParseError struct {
+	// Message is the message being parsed, e.g. "request"
+	Message string
+	// Offset is number of bytes consumed when the error occurred
+	Offset int
+	// Consumed is the first consumed bytes, at most 64 bytes
+	Consumed []byte
+	// Err is the underlying error
+	Err error
+}
+
+func newParseError(msg string, consumed []byte, offset int, err error) *ParseError {
+	if len(consumed) > maxConsumedBytes {
+		consumed = consumed[:maxConsumedBytes]
+	}
+	return &ParseError{
+		Message:  msg,
+		Offset:   offset,
+		Consumed: append([]byte(nil), consumed...),
+		Err:      err,
+	}
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse %s at offset %d: %s", e.Message, e.Offset, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Truncated check whether the error is caused by stream end before a complete message
+func (e *ParseError) Truncated() bool {
+	return errors.Is(e.Err, io.EOF) || errors.Is(e.Err, io.ErrUnexpectedEOF)
+}
+
+// recordReader count and keep first bytes read from r, to build ParseError
+type recordReader struct {
+	r    io.Reader
+	n    int
+	head [maxConsumedBytes]byte
+}
+
+func (r *recordReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if r.n < maxConsumedBytes {
+		copy(r.head[r.n:], b[:n])
+	}
+	r.n += n
+	return n, err
+}
+
+// wrap return nil if err is nil, otherwise a ParseError of msg
+func (r *recordReader) wrap(msg string, err error) error {
+	if err == nil {
+		return nil
+	}
+	l := r.n
+	if l > maxConsumedBytes {
+		l = maxConsumedBytes
+	}
+	return newParseError(msg, r.head[:l], r.n, err)
+}
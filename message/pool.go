@@ -0,0 +1,112 @@
+package message
+
+import "sync"
+
+// Message pools reduce garbage of busy servers, Acquire* return a reset object,
+// Release* reset it and put it back. Released object and anything got from it (e.g. Options) must not be used again.
+
+var (
+	requestPool             = sync.Pool{New: func() interface{} { return NewRequest() }}
+	authenticationReplyPool = sync.Pool{New: func() interface{} { return NewAuthenticationReply() }}
+	operationReplyPool      = sync.Pool{New: func() interface{} { return NewOperationReply() }}
+	optionSetPool           = sync.Pool{New: func() interface{} { return NewOptionSet() }}
+)
+
+// Reset clear s to an empty set, allocated memory is kept for reuse
+func (s *OptionSet) Reset() {
+	for k := range s.perKind {
+		delete(s.perKind, k)
+	}
+	// drop reference to option data
+	for i := range s.list {
+		s.list[i] = Option{}
+	}
+	s.list = s.list[:0]
+	s.cached = false
+	// Marshal returned cache to caller, can't reuse
+	s.cache = nil
+}
+
+// resetOptionSet reset s for reuse, or create a new one when s is nil
+func resetOptionSet(s *OptionSet) *OptionSet {
+	if s == nil {
+		return NewOptionSet()
+	}
+	s.Reset()
+	return s
+}
+
+// Reset set r to the state returned by NewRequest, its option set is reused
+func (r *Request) Reset() {
+	*r = Request{
+		Endpoint: &SocksAddr{
+			AddressType: AddressTypeIPv4,
+			Address:     []byte{0, 0, 0, 0},
+		},
+		Options: resetOptionSet(r.Options),
+	}
+}
+
+// Reset set a to the state returned by NewAuthenticationReply, its option set is reused
+func (a *AuthenticationReply) Reset() {
+	*a = AuthenticationReply{Options: resetOptionSet(a.Options)}
+}
+
+// Reset set o to the state returned by NewOperationReply, its option set is reused
+func (o *OperationReply) Reset() {
+	*o = OperationReply{
+		Endpoint: &SocksAddr{
+			AddressType: AddressTypeIPv4,
+			Address:     []byte{0, 0, 0, 0},
+		},
+		Options: resetOptionSet(o.Options),
+	}
+}
+
+// AcquireRequest return a request from pool, which is same as NewRequest
+func AcquireRequest() *Request {
+	return requestPool.Get().(*Request)
+}
+
+// ReleaseRequest put r back to pool
+func ReleaseRequest(r *Request) {
+	r.Reset()
+	requestPool.Put(r)
+}
+
+// AcquireAuthenticationReply return an authentication reply of typ from pool
+func AcquireAuthenticationReply(typ AuthenticationReplyType) *AuthenticationReply {
+	a := authenticationReplyPool.Get().(*AuthenticationReply)
+	a.Type = typ
+	return a
+}
+
+// ReleaseAuthenticationReply put a back to pool
+func ReleaseAuthenticationReply(a *AuthenticationReply) {
+	a.Reset()
+	authenticationReplyPool.Put(a)
+}
+
+// AcquireOperationReply return an operation reply of code from pool
+func AcquireOperationReply(code ReplyCode) *OperationReply {
+	o := operationReplyPool.Get().(*OperationReply)
+	o.ReplyCode = code
+	return o
+}
+
+// ReleaseOperationReply put o back to pool
+func ReleaseOperationReply(o *OperationReply) {
+	o.Reset()
+	operationReplyPool.Put(o)
+}
+
+// AcquireOptionSet return an empty option set from pool
+func AcquireOptionSet() *OptionSet {
+	return optionSetPool.Get().(*OptionSet)
+}
+
+// ReleaseOptionSet put s back to pool
+func ReleaseOptionSet(s *OptionSet) {
+	s.Reset()
+	optionSetPool.Put(s)
+}
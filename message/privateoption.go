@@ -0,0 +1,78 @@
+package message
+
+import "github.com/studentmain/socks6/common/lg"
+
+// Option kinds in private range are not assigned by the spec, vendor specific options should use them
+const (
+	OptionKindPrivateMin OptionKind = 0xfc00
+	OptionKindPrivateMax OptionKind = 0xffff
+)
+
+// IsPrivate check whether k is in private range
+func (k OptionKind) IsPrivate() bool {
+	return k >= OptionKindPrivateMin
+}
+
+// IsStandard check whether k is assigned by the spec and known by this package
+func (k OptionKind) IsStandard() bool {
+	_, ok := optionKindName[k]
+	return ok && !k.IsPrivate()
+}
+
+// VendorID identify a block of 16 option kinds in private range,
+// kinds of vendor v are 0xfc00+v*16 to 0xfc00+v*16+15, e.g. vendor 0x11 own 0xfd10-0xfd1f
+type VendorID uint8
+
+// MaxVendorID is the largest vendor id fit in private range
+const MaxVendorID VendorID = 63
+
+// VendorOptionExperimental is vendor id of experimental options defined by this package
+const VendorOptionExperimental VendorID = 0x11
+
+// VendorOptionKind return the option kind of code in vendor's block,
+// panic when vendor or code is out of range
+func VendorOptionKind(vendor VendorID, code uint8) OptionKind {
+	if vendor > MaxVendorID || code > 15 {
+		lg.Panicf("vendor option kind out of range, vendor %d code %d", vendor, code)
+	}
+	return OptionKindPrivateMin + OptionKind(vendor)<<4 + OptionKind(code)
+}
+
+// Vendor return vendor id and code of private option kind, false if k is not in private range
+func (k OptionKind) Vendor() (VendorID, uint8, bool) {
+	if !k.IsPrivate() {
+		return 0, 0, false
+	}
+	off := k - OptionKindPrivateMin
+	return VendorID(off >> 4), uint8(off & 0xf), true
+}
+
+// CheckPrivateOptionKind return error when k is outside private range, where kinds are reserved by the spec
+func CheckPrivateOptionKind(k OptionKind) error {
+	if !k.IsPrivate() {
+		return ErrReservedOptionKind.WithVerbose("option kind 0x%04x is reserved, use 0x%04x-0x%04x", uint16(k), uint16(OptionKindPrivateMin), uint16(OptionKindPrivateMax))
+	}
+	return nil
+}
+
+// RegisterPrivate works like Register, but refuse kinds outside private range,
+// so vendor options don't squat on kinds reserved by the spec
+func (r *OptionRegistry) RegisterPrivate(kind OptionKind, fn OptionDataParser) error {
+	if err := CheckPrivateOptionKind(kind); err != nil {
+		return err
+	}
+	r.Register(kind, fn)
+	return nil
+}
+
+// Private return options in private range in the order they are added.
+// Options of unknown kinds keep their original data, so they can be relayed to next hop unchanged.
+func (s *OptionSet) Private() []Option {
+	r := []Option{}
+	for _, op := range s.list {
+		if op.Kind.IsPrivate() {
+			r = append(r, op)
+		}
+	}
+	return r
+}
@@ -0,0 +1,65 @@
+package message
+
+// Profile describe wireformat of a SOCKS 6 draft revision.
+// Revisions supported by this package share message and option layout, so only version byte is kept here.
+// Review the draft diff before adding a layout difference or another revision:
+// https://author-tools.ietf.org/iddiff?url1=draft-olteanu-intarea-socks-6-11&url2=draft-olteanu-intarea-socks-6-12
+// Version byte follows common.ProtocolVersion, 2xx means based on draft xx.
+// testdata/golden/*-draft11.json pin draft-11 wireformat.
+type Profile struct {
+	// Name of the revision, e.g. "draft-12"
+	Name string
+	// Version is the version byte of messages
+	Version byte
+}
+
+var (
+	// ProfileDraft12 is draft-olteanu-intarea-socks-6-12
+	ProfileDraft12 = &Profile{Name: "draft-12", Version: 212}
+	// ProfileDraft11 is draft-olteanu-intarea-socks-6-11
+	ProfileDraft11 = &Profile{Name: "draft-11", Version: 211}
+)
+
+// DefaultProfile is used by messages without profile, its version byte is common.ProtocolVersion
+var DefaultProfile = ProfileDraft12
+
+// KnownProfiles are all revisions supported by this package, newest first
+var KnownProfiles = []*Profile{ProfileDraft12, ProfileDraft11}
+
+// ProfileByVersion return known profile with version byte v
+func ProfileByVersion(v byte) (*Profile, bool) {
+	for _, p := range KnownProfiles {
+		if p.Version == v {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+func (p *Profile) String() string {
+	if p == nil {
+		return DefaultProfile.Name
+	}
+	return p.Name
+}
+
+// version return version byte of p, nil means DefaultProfile
+func (p *Profile) version() byte {
+	if p == nil {
+		return protocolVersion
+	}
+	return p.Version
+}
+
+// profile return accepted profile of version byte v, nil profile means DefaultProfile
+func (c *ParseConfig) profile(v byte) (*Profile, bool) {
+	if v == protocolVersion {
+		return nil, true
+	}
+	for _, p := range c.Profiles {
+		if p.Version == v {
+			return p, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,58 @@
+package message
+
+import "net"
+
+// OperationReplyBuilder build a complete operation reply in one chain, e.g.
+//
+//	NewOperationReplyBuilder(OperationReplySuccess).BoundNetAddr(conn.LocalAddr()).StackOptions(client, remote).Build()
+type OperationReplyBuilder struct {
+	rep *OperationReply
+}
+
+// NewOperationReplyBuilder create a builder of reply with code, bound address is 0.0.0.0:0 until set
+func NewOperationReplyBuilder(code ReplyCode) *OperationReplyBuilder {
+	return &OperationReplyBuilder{rep: NewOperationReplyWithCode(code)}
+}
+
+// Bound set bound address, i.e. proxy's address used to fulfill the request
+func (b *OperationReplyBuilder) Bound(addr *SocksAddr) *OperationReplyBuilder {
+	if addr == nil {
+		addr = DefaultAddr
+	}
+	b.rep.Endpoint = addr
+	return b
+}
+
+// BoundNetAddr set bound address from net.Addr, e.g. local address of outbound connection, see ConvertAddr
+func (b *OperationReplyBuilder) BoundNetAddr(addr net.Addr) *OperationReplyBuilder {
+	return b.Bound(ConvertAddr(addr))
+}
+
+// StackOptions add stack options acked by proxy, client and remote are options applied on each leg
+func (b *OperationReplyBuilder) StackOptions(client StackOptionInfo, remote StackOptionInfo) *OperationReplyBuilder {
+	return b.Options(GetCombinedStackOptions(client, remote)...)
+}
+
+// Session add session and token options
+func (b *OperationReplyBuilder) Session(s SessionReply) *OperationReplyBuilder {
+	return b.Options(s.Options()...)
+}
+
+// Options add other options
+func (b *OperationReplyBuilder) Options(ops ...Option) *OperationReplyBuilder {
+	b.rep.Options.AddMany(ops)
+	return b
+}
+
+// Profile set draft revision of reply, nil means DefaultProfile
+func (b *OperationReplyBuilder) Profile(p *Profile) *OperationReplyBuilder {
+	b.rep.Profile = p
+	return b
+}
+
+// Build return a copy of reply set by builder
+func (b *OperationReplyBuilder) Build() *OperationReply {
+	r := *b.rep
+	r.Options = b.rep.Options.Clone()
+	return &r
+}
@@ -0,0 +1,119 @@
+package message
+
+// SessionRequest is session and token options sent by client in request
+type SessionRequest struct {
+	// Request ask proxy to open a new session
+	Request bool
+	// ID of existing session, nil when not using session
+	ID []byte
+	// Teardown ask proxy to close session ID
+	Teardown bool
+
+	// TokenWindow is requested idempotence token window size, 0 means not requested
+	TokenWindow uint32
+	// SpendToken is set when Token is spent by this request
+	SpendToken bool
+	Token      uint32
+}
+
+// GetSessionRequest extract session and token options from request options
+func GetSessionRequest(ops *OptionSet) SessionRequest {
+	s := SessionRequest{}
+	_, s.Request = ops.GetData(OptionKindSessionRequest)
+	if d, ok := GetTyped[SessionIDOptionData](ops, OptionKindSessionID); ok {
+		s.ID = d.ID
+	}
+	_, s.Teardown = ops.GetData(OptionKindSessionTeardown)
+	if d, ok := GetTyped[TokenRequestOptionData](ops, OptionKindTokenRequest); ok {
+		s.TokenWindow = d.WindowSize
+	}
+	if d, ok := GetTyped[IdempotenceExpenditureOptionData](ops, OptionKindIdempotenceExpenditure); ok {
+		s.SpendToken = true
+		s.Token = d.Token
+	}
+	return s
+}
+
+// Options return options represent s
+func (s SessionRequest) Options() []Option {
+	ops := []Option{}
+	if s.Request {
+		ops = append(ops, Option{Kind: OptionKindSessionRequest, Data: SessionRequestOptionData{}})
+	}
+	if s.ID != nil {
+		ops = append(ops, Option{Kind: OptionKindSessionID, Data: SessionIDOptionData{ID: s.ID}})
+	}
+	if s.Teardown {
+		ops = append(ops, Option{Kind: OptionKindSessionTeardown, Data: SessionTeardownOptionData{}})
+	}
+	if s.TokenWindow > 0 {
+		ops = append(ops, Option{Kind: OptionKindTokenRequest, Data: TokenRequestOptionData{WindowSize: s.TokenWindow}})
+	}
+	if s.SpendToken {
+		ops = append(ops, Option{Kind: OptionKindIdempotenceExpenditure, Data: IdempotenceExpenditureOptionData{Token: s.Token}})
+	}
+	return ops
+}
+
+// SessionReply is session and token options sent by proxy in reply
+type SessionReply struct {
+	// ID of session opened by proxy, nil when no session is opened
+	ID []byte
+	// OK is set when session is opened or accepted
+	OK bool
+	// Invalid is set when session is rejected or closed
+	Invalid bool
+
+	// TokenAccepted and TokenRejected is result of spent token
+	TokenAccepted bool
+	TokenRejected bool
+	// Window is set when proxy allocate or move token window
+	Window     bool
+	WindowBase uint32
+	WindowSize uint32
+}
+
+// GetSessionReply extract session and token options from reply options
+func GetSessionReply(ops *OptionSet) SessionReply {
+	s := SessionReply{}
+	if d, ok := GetTyped[SessionIDOptionData](ops, OptionKindSessionID); ok {
+		s.ID = d.ID
+	}
+	_, s.OK = ops.GetData(OptionKindSessionOK)
+	_, s.Invalid = ops.GetData(OptionKindSessionInvalid)
+	_, s.TokenAccepted = ops.GetData(OptionKindIdempotenceAccepted)
+	_, s.TokenRejected = ops.GetData(OptionKindIdempotenceRejected)
+	if w, ok := GetTyped[IdempotenceWindowOptionData](ops, OptionKindIdempotenceWindow); ok {
+		s.Window = true
+		s.WindowBase = w.WindowBase
+		s.WindowSize = w.WindowSize
+	}
+	return s
+}
+
+// Options return options represent s
+func (s SessionReply) Options() []Option {
+	ops := []Option{}
+	if s.ID != nil {
+		ops = append(ops, Option{Kind: OptionKindSessionID, Data: SessionIDOptionData{ID: s.ID}})
+	}
+	if s.OK {
+		ops = append(ops, Option{Kind: OptionKindSessionOK, Data: SessionOKOptionData{}})
+	}
+	if s.Invalid {
+		ops = append(ops, Option{Kind: OptionKindSessionInvalid, Data: SessionInvalidOptionData{}})
+	}
+	if s.TokenAccepted {
+		ops = append(ops, Option{Kind: OptionKindIdempotenceAccepted, Data: IdempotenceAcceptedOptionData{}})
+	}
+	if s.TokenRejected {
+		ops = append(ops, Option{Kind: OptionKindIdempotenceRejected, Data: IdempotenceRejectedOptionData{}})
+	}
+	if s.Window {
+		ops = append(ops, Option{Kind: OptionKindIdempotenceWindow, Data: IdempotenceWindowOptionData{
+			WindowBase: s.WindowBase,
+			WindowSize: s.WindowSize,
+		}})
+	}
+	return ops
+}
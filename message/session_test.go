@@ -0,0 +1,45 @@
+package message_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6/message"
+)
+
+func TestSessionRequest(t *testing.T) {
+	tests := []message.SessionRequest{
+		{},
+		{Request: true, TokenWindow: 16},
+		{ID: []byte{1, 2, 3, 4}, SpendToken: true, Token: 5},
+		{ID: []byte{1, 2, 3, 4}, Teardown: true},
+	}
+	for _, tt := range tests {
+		ops := message.NewOptionSet()
+		ops.AddMany(tt.Options())
+		b := ops.Marshal()
+		parsed, err := message.ParseOptionSetFrom(bytes.NewReader(b), len(b))
+		assert.NoError(t, err)
+		assert.Equal(t, tt, message.GetSessionRequest(parsed))
+	}
+	assert.Len(t, message.SessionRequest{Request: true, TokenWindow: 16}.Options(), 2)
+}
+
+func TestSessionReply(t *testing.T) {
+	tests := []message.SessionReply{
+		{},
+		{ID: []byte{1, 2, 3, 4}, OK: true, Window: true, WindowBase: 10, WindowSize: 8},
+		{OK: true, TokenAccepted: true},
+		{OK: true, TokenRejected: true},
+		{Invalid: true},
+	}
+	for _, tt := range tests {
+		ops := message.NewOptionSet()
+		ops.AddMany(tt.Options())
+		b := ops.Marshal()
+		parsed, err := message.ParseOptionSetFrom(bytes.NewReader(b), len(b))
+		assert.NoError(t, err)
+		assert.Equal(t, tt, message.GetSessionReply(parsed))
+	}
+}
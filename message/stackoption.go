@@ -2,6 +2,8 @@ package message
 
 import (
 	"encoding/binary"
+	"net"
+	"net/netip"
 
 	"github.com/studentmain/socks6/common/arrayx"
 )
@@ -32,6 +34,12 @@ const (
 	//lv5
 	StackOptionCodeUDPError   StackOptionCode = 1
 	StackOptionCodePortParity StackOptionCode = 2
+	// multicast options are not defined in draft
+	StackOptionCodeMulticastJoin      StackOptionCode = 3
+	StackOptionCodeMulticastLeave     StackOptionCode = 4
+	StackOptionCodeMulticastInterface StackOptionCode = 5
+	// max payload option is not defined in draft
+	StackOptionCodeMaxPayload StackOptionCode = 6
 )
 const (
 	// lv1
@@ -46,6 +54,12 @@ const (
 	// lv5
 	StackOptionUDPUDPError   = int(StackOptionLevelUDP)*256 + int(StackOptionCodeUDPError)
 	StackOptionUDPPortParity = int(StackOptionLevelUDP)*256 + int(StackOptionCodePortParity)
+
+	StackOptionUDPMulticastJoin      = int(StackOptionLevelUDP)*256 + int(StackOptionCodeMulticastJoin)
+	StackOptionUDPMulticastLeave     = int(StackOptionLevelUDP)*256 + int(StackOptionCodeMulticastLeave)
+	StackOptionUDPMulticastInterface = int(StackOptionLevelUDP)*256 + int(StackOptionCodeMulticastInterface)
+
+	StackOptionUDPMaxPayload = int(StackOptionLevelUDP)*256 + int(StackOptionCodeMaxPayload)
 )
 
 var stackOptionParseFn = map[int]func([]byte) (StackOptionData, error){
@@ -74,6 +88,13 @@ var stackOptionParseFn = map[int]func([]byte) (StackOptionData, error){
 		return parseBoolStackOption(b, &UDPErrorOptionData{})
 	},
 	StackOptionUDPPortParity: parsePortParityOptionData,
+
+	StackOptionUDPMulticastJoin:      parseMulticastGroupOptionData,
+	StackOptionUDPMulticastLeave:     parseMulticastGroupOptionData,
+	StackOptionUDPMulticastInterface: parseMulticastInterfaceOptionData,
+	StackOptionUDPMaxPayload: func(b []byte) (StackOptionData, error) {
+		return parseUint16StackOption(b, &MaxPayloadOptionData{})
+	},
 }
 
 // SetStackOptionDataParser set the stack option data parse function for given level and code to fn
@@ -165,6 +186,9 @@ const (
 )
 
 func parseBoolStackOption(d []byte, o boolStackOption) (StackOptionData, error) {
+	if len(d) < 1 {
+		return nil, ErrBufferSize.WithVerbose("expect 1 bytes, actual %d", len(d))
+	}
 	val := d[0] == stackOptionTrue
 	if !val && d[0] != stackOptionFalse {
 		return nil, ErrEnumValue.WithVerbose("expect 1-2, actual %d", d[0])
@@ -179,6 +203,9 @@ type boolStackOption interface {
 }
 
 func parseUint8StackOption(d []byte, o uint8StackOption) (StackOptionData, error) {
+	if len(d) < 1 {
+		return nil, ErrBufferSize.WithVerbose("expect 1 bytes, actual %d", len(d))
+	}
 	o.SetUint8(d[0])
 	return o, nil
 }
@@ -189,6 +216,9 @@ type uint8StackOption interface {
 }
 
 func parseUint16StackOption(d []byte, o uint16StackOption) (StackOptionData, error) {
+	if len(d) < 2 {
+		return nil, ErrBufferSize.WithVerbose("expect 2 bytes, actual %d", len(d))
+	}
 	o.SetUint16(binary.BigEndian.Uint16(d))
 	return o, nil
 }
@@ -400,6 +430,9 @@ type PortParityOptionData struct {
 }
 
 func parsePortParityOptionData(d []byte) (StackOptionData, error) {
+	if len(d) < 2 {
+		return nil, ErrBufferSize.WithVerbose("expect 2 bytes, actual %d", len(d))
+	}
 	o := PortParityOptionData{}
 	val := d[1] == stackOptionTrue
 	if !val && d[1] != stackOptionFalse {
@@ -430,3 +463,118 @@ func (t *PortParityOptionData) SetData(d interface{}) {
 	t.Parity = dd.Parity
 	t.Reserve = dd.Reserve
 }
+
+// group(b16) interface(b16) reserved(i16)
+// IPv4 address is encoded as IPv4-mapped IPv6 address, unspecified interface means default
+
+// MulticastGroupOptionData request proxy to join or leave a multicast group on UDP association's socket
+type MulticastGroupOptionData struct {
+	Group     netip.Addr
+	Interface netip.Addr // address of proxy's interface, zero value means default interface
+}
+
+// NewMulticastGroupOptionData create MulticastGroupOptionData, nil ifaddr means default interface
+func NewMulticastGroupOptionData(group net.IP, ifaddr net.IP) MulticastGroupOptionData {
+	g, _ := netip.AddrFromSlice(group)
+	i, _ := netip.AddrFromSlice(ifaddr)
+	return MulticastGroupOptionData{
+		Group:     g.Unmap(),
+		Interface: i.Unmap(),
+	}
+}
+
+func parseMulticastGroupOptionData(d []byte) (StackOptionData, error) {
+	if len(d) < 32 {
+		return nil, ErrBufferSize.WithVerbose("expect 32 bytes, actual %d", len(d))
+	}
+	return &MulticastGroupOptionData{
+		Group:     parseMulticastAddr(d),
+		Interface: parseMulticastAddr(d[16:]),
+	}, nil
+}
+func (t MulticastGroupOptionData) Len() uint16 {
+	return 34
+}
+func (t MulticastGroupOptionData) Marshal() []byte {
+	b := make([]byte, 34)
+	putMulticastAddr(b, t.Group)
+	putMulticastAddr(b[16:], t.Interface)
+	return b
+}
+func (t MulticastGroupOptionData) GetData() interface{} {
+	return t
+}
+func (t *MulticastGroupOptionData) SetData(d interface{}) {
+	dd := d.(MulticastGroupOptionData)
+	t.Group = dd.Group
+	t.Interface = dd.Interface
+}
+
+// interface(b16) reserved(i16)
+
+// MulticastInterfaceOptionData set outgoing interface of multicast datagram
+type MulticastInterfaceOptionData struct {
+	Interface netip.Addr // address of proxy's interface, zero value means default interface
+}
+
+func parseMulticastInterfaceOptionData(d []byte) (StackOptionData, error) {
+	if len(d) < 16 {
+		return nil, ErrBufferSize.WithVerbose("expect 16 bytes, actual %d", len(d))
+	}
+	return &MulticastInterfaceOptionData{Interface: parseMulticastAddr(d)}, nil
+}
+func (t MulticastInterfaceOptionData) Len() uint16 {
+	return 18
+}
+func (t MulticastInterfaceOptionData) Marshal() []byte {
+	b := make([]byte, 18)
+	putMulticastAddr(b, t.Interface)
+	return b
+}
+func (t MulticastInterfaceOptionData) GetData() interface{} {
+	return t.Interface
+}
+func (t *MulticastInterfaceOptionData) SetData(d interface{}) {
+	t.Interface = d.(netip.Addr)
+}
+
+// MaxPayloadOptionData is max datagram payload size of UDP association,
+// client request a limit with it and proxy reply the limit in effect
+type MaxPayloadOptionData struct {
+	MaxPayload uint16
+}
+
+func (t *MaxPayloadOptionData) SetUint16(b uint16) {
+	t.MaxPayload = b
+}
+
+func (t MaxPayloadOptionData) Len() uint16 {
+	return 2
+}
+func (t MaxPayloadOptionData) Marshal() []byte {
+	b := []byte{0, 0}
+	binary.BigEndian.PutUint16(b, t.MaxPayload)
+	return b
+}
+func (t MaxPayloadOptionData) GetData() interface{} {
+	return t.MaxPayload
+}
+func (t *MaxPayloadOptionData) SetData(d interface{}) {
+	t.MaxPayload = d.(uint16)
+}
+
+func parseMulticastAddr(b []byte) netip.Addr {
+	a := netip.AddrFrom16(*(*[16]byte)(b[:16])).Unmap()
+	if a.IsUnspecified() {
+		return netip.Addr{}
+	}
+	return a
+}
+
+func putMulticastAddr(b []byte, a netip.Addr) {
+	if !a.IsValid() {
+		return
+	}
+	a16 := a.As16()
+	copy(b, a16[:])
+}
@@ -1,6 +1,9 @@
 package message_test
 
 import (
+	"bytes"
+	"net"
+	"net/netip"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -341,3 +344,130 @@ func TestPortParityOptionData(t *testing.T) {
 			Reserve: true,
 		})
 }
+
+func TestMulticastGroupOptionData(t *testing.T) {
+	g := message.NewMulticastGroupOptionData(net.ParseIP("239.1.2.3"), nil)
+	assert.Equal(t, netip.MustParseAddr("239.1.2.3"), g.Group)
+	assert.False(t, g.Interface.IsValid())
+	optionDataTest(t,
+		[]byte{
+			0, 1, 0, 40,
+			legLevel(false, true, 5), 3,
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 239, 1, 2, 3,
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+			0, 0,
+		}, message.Option{
+			Kind: message.OptionKindStack,
+			Data: message.BaseStackOptionData{
+				ClientLeg: false,
+				RemoteLeg: true,
+				Level:     message.StackOptionLevelUDP,
+				Code:      message.StackOptionCodeMulticastJoin,
+				Data:      &g,
+			},
+		})
+	g2 := message.NewMulticastGroupOptionData(net.ParseIP("ff02::1"), net.ParseIP("192.168.1.1"))
+	stackOptionDataTest(t, &g, g, g2)
+}
+
+func TestMulticastInterfaceOptionData(t *testing.T) {
+	optionDataTest(t,
+		[]byte{
+			0, 1, 0, 24,
+			legLevel(false, true, 5), 5,
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 10, 0, 0, 1,
+			0, 0,
+		}, message.Option{
+			Kind: message.OptionKindStack,
+			Data: message.BaseStackOptionData{
+				ClientLeg: false,
+				RemoteLeg: true,
+				Level:     message.StackOptionLevelUDP,
+				Code:      message.StackOptionCodeMulticastInterface,
+				Data: &message.MulticastInterfaceOptionData{
+					Interface: netip.MustParseAddr("10.0.0.1"),
+				},
+			},
+		})
+	stackOptionDataTest(t,
+		&message.MulticastInterfaceOptionData{},
+		netip.Addr{},
+		netip.MustParseAddr("fe80::1"))
+}
+
+func TestMaxPayloadOptionData(t *testing.T) {
+	optionDataTest(t,
+		[]byte{
+			0, 1, 0, 8,
+			legLevel(false, true, 5), 6, 0x05, 0xdc,
+		}, message.Option{
+			Kind: message.OptionKindStack,
+			Data: message.BaseStackOptionData{
+				ClientLeg: false,
+				RemoteLeg: true,
+				Level:     message.StackOptionLevelUDP,
+				Code:      message.StackOptionCodeMaxPayload,
+				Data: &message.MaxPayloadOptionData{
+					MaxPayload: 1500,
+				},
+			},
+		})
+	stackOptionDataTest(t,
+		&message.MaxPayloadOptionData{
+			MaxPayload: 1500,
+		}, uint16(1500), uint16(512))
+}
+
+func TestStackOptionBuilder(t *testing.T) {
+	group := netip.MustParseAddr("224.0.0.251")
+	info := message.NewStackOptionBuilder().
+		TOS(4).
+		HappyEyeball(true).
+		TTL(64).
+		NoFragment(true).
+		TFO(1400).
+		Multipath(false).
+		Backlog(10).
+		UDPError(true).
+		PortParity(message.StackPortParityOptionParityEven, true).
+		MulticastJoin(group, netip.Addr{}).
+		MaxPayload(512).
+		Build()
+
+	// round trip via wireformat
+	ops := message.NewOptionSet()
+	ops.AddMany(info.GetOptions(false, true))
+	parsed, err := message.ParseOptionSetFrom(bytes.NewReader(ops.Marshal()), len(ops.Marshal()))
+	assert.NoError(t, err)
+	info = message.GetStackOptionInfo(parsed, false)
+
+	tos, ok := info.TOS()
+	assert.True(t, ok)
+	assert.EqualValues(t, 4, tos)
+	he, _ := info.HappyEyeball()
+	assert.True(t, he)
+	ttl, _ := info.TTL()
+	assert.EqualValues(t, 64, ttl)
+	nf, _ := info.NoFragment()
+	assert.True(t, nf)
+	tfo, _ := info.TFO()
+	assert.EqualValues(t, 1400, tfo)
+	mp, ok := info.Multipath()
+	assert.True(t, ok)
+	assert.False(t, mp)
+	bl, _ := info.Backlog()
+	assert.EqualValues(t, 10, bl)
+	ue, _ := info.UDPError()
+	assert.True(t, ue)
+	pp, _ := info.PortParity()
+	assert.Equal(t, message.PortParityOptionData{Parity: message.StackPortParityOptionParityEven, Reserve: true}, pp)
+	mj, _ := info.MulticastJoin()
+	assert.Equal(t, group, mj.Group)
+	mpl, _ := info.MaxPayload()
+	assert.EqualValues(t, 512, mpl)
+
+	_, ok = info.MulticastInterface()
+	assert.False(t, ok)
+	_, ok = info.MulticastLeave()
+	assert.False(t, ok)
+}
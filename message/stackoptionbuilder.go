@@ -0,0 +1,166 @@
+package message
+
+import "net/netip"
+
+// StackOptionBuilder build StackOptionInfo with typed setters, e.g.
+//
+//	NewStackOptionBuilder().Backlog(10).TFO(1400).Build()
+type StackOptionBuilder struct {
+	info StackOptionInfo
+}
+
+func NewStackOptionBuilder() *StackOptionBuilder {
+	return &StackOptionBuilder{info: StackOptionInfo{}}
+}
+
+func (b *StackOptionBuilder) set(id int, v interface{}) *StackOptionBuilder {
+	b.info[id] = v
+	return b
+}
+
+// TOS set IP type of service
+func (b *StackOptionBuilder) TOS(v byte) *StackOptionBuilder {
+	return b.set(StackOptionIPTOS, v)
+}
+
+// HappyEyeball set whether proxy use happy eyeball when connect to domain name
+func (b *StackOptionBuilder) HappyEyeball(v bool) *StackOptionBuilder {
+	return b.set(StackOptionIPHappyEyeball, v)
+}
+
+// TTL set IP time to live
+func (b *StackOptionBuilder) TTL(v byte) *StackOptionBuilder {
+	return b.set(StackOptionIPTTL, v)
+}
+
+// NoFragment set IP don't fragment
+func (b *StackOptionBuilder) NoFragment(v bool) *StackOptionBuilder {
+	return b.set(StackOptionIPNoFragment, v)
+}
+
+// TFO set TCP fast open payload size
+func (b *StackOptionBuilder) TFO(payloadSize uint16) *StackOptionBuilder {
+	return b.set(StackOptionTCPTFO, payloadSize)
+}
+
+// Multipath set whether MPTCP is used
+func (b *StackOptionBuilder) Multipath(v bool) *StackOptionBuilder {
+	return b.set(StackOptionTCPMultipath, v)
+}
+
+// Backlog set BIND listener backlog
+func (b *StackOptionBuilder) Backlog(v uint16) *StackOptionBuilder {
+	return b.set(StackOptionTCPBacklog, v)
+}
+
+// UDPError set whether proxy relay ICMP error of UDP association
+func (b *StackOptionBuilder) UDPError(v bool) *StackOptionBuilder {
+	return b.set(StackOptionUDPUDPError, v)
+}
+
+// PortParity set UDP association port parity, and whether next port is reserved
+func (b *StackOptionBuilder) PortParity(parity byte, reserve bool) *StackOptionBuilder {
+	return b.set(StackOptionUDPPortParity, PortParityOptionData{Parity: parity, Reserve: reserve})
+}
+
+// MulticastJoin join multicast group on interface, zero value interface means default
+func (b *StackOptionBuilder) MulticastJoin(group netip.Addr, iface netip.Addr) *StackOptionBuilder {
+	return b.set(StackOptionUDPMulticastJoin, MulticastGroupOptionData{Group: group.Unmap(), Interface: iface.Unmap()})
+}
+
+// MulticastLeave leave multicast group on interface, zero value interface means default
+func (b *StackOptionBuilder) MulticastLeave(group netip.Addr, iface netip.Addr) *StackOptionBuilder {
+	return b.set(StackOptionUDPMulticastLeave, MulticastGroupOptionData{Group: group.Unmap(), Interface: iface.Unmap()})
+}
+
+// MulticastInterface set outgoing interface of multicast datagram, zero value means default
+func (b *StackOptionBuilder) MulticastInterface(iface netip.Addr) *StackOptionBuilder {
+	return b.set(StackOptionUDPMulticastInterface, iface.Unmap())
+}
+
+// MaxPayload set max UDP datagram payload size
+func (b *StackOptionBuilder) MaxPayload(v uint16) *StackOptionBuilder {
+	return b.set(StackOptionUDPMaxPayload, v)
+}
+
+// Build return a copy of options set by builder
+func (b *StackOptionBuilder) Build() StackOptionInfo {
+	ret := StackOptionInfo{}
+	ret.Combine(b.info)
+	return ret
+}
+
+// Options return options set by builder applied on given legs
+func (b *StackOptionBuilder) Options(clientLeg bool, remoteLeg bool) []Option {
+	return b.info.GetOptions(clientLeg, remoteLeg)
+}
+
+func stackOptionValue[T any](s StackOptionInfo, id int) (T, bool) {
+	v, ok := s[id].(T)
+	return v, ok
+}
+
+// TOS return IP type of service
+func (s StackOptionInfo) TOS() (byte, bool) {
+	return stackOptionValue[byte](s, StackOptionIPTOS)
+}
+
+// HappyEyeball return whether proxy use happy eyeball
+func (s StackOptionInfo) HappyEyeball() (bool, bool) {
+	return stackOptionValue[bool](s, StackOptionIPHappyEyeball)
+}
+
+// TTL return IP time to live
+func (s StackOptionInfo) TTL() (byte, bool) {
+	return stackOptionValue[byte](s, StackOptionIPTTL)
+}
+
+// NoFragment return IP don't fragment
+func (s StackOptionInfo) NoFragment() (bool, bool) {
+	return stackOptionValue[bool](s, StackOptionIPNoFragment)
+}
+
+// TFO return TCP fast open payload size
+func (s StackOptionInfo) TFO() (uint16, bool) {
+	return stackOptionValue[uint16](s, StackOptionTCPTFO)
+}
+
+// Multipath return whether MPTCP is used
+func (s StackOptionInfo) Multipath() (bool, bool) {
+	return stackOptionValue[bool](s, StackOptionTCPMultipath)
+}
+
+// Backlog return BIND listener backlog
+func (s StackOptionInfo) Backlog() (uint16, bool) {
+	return stackOptionValue[uint16](s, StackOptionTCPBacklog)
+}
+
+// UDPError return whether proxy relay ICMP error of UDP association
+func (s StackOptionInfo) UDPError() (bool, bool) {
+	return stackOptionValue[bool](s, StackOptionUDPUDPError)
+}
+
+// PortParity return UDP association port parity and reservation
+func (s StackOptionInfo) PortParity() (PortParityOptionData, bool) {
+	return stackOptionValue[PortParityOptionData](s, StackOptionUDPPortParity)
+}
+
+// MulticastJoin return multicast group to join
+func (s StackOptionInfo) MulticastJoin() (MulticastGroupOptionData, bool) {
+	return stackOptionValue[MulticastGroupOptionData](s, StackOptionUDPMulticastJoin)
+}
+
+// MulticastLeave return multicast group to leave
+func (s StackOptionInfo) MulticastLeave() (MulticastGroupOptionData, bool) {
+	return stackOptionValue[MulticastGroupOptionData](s, StackOptionUDPMulticastLeave)
+}
+
+// MulticastInterface return outgoing interface of multicast datagram
+func (s StackOptionInfo) MulticastInterface() (netip.Addr, bool) {
+	return stackOptionValue[netip.Addr](s, StackOptionUDPMulticastInterface)
+}
+
+// MaxPayload return max UDP datagram payload size
+func (s StackOptionInfo) MaxPayload() (uint16, bool) {
+	return stackOptionValue[uint16](s, StackOptionUDPMaxPayload)
+}
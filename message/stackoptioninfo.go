@@ -1,5 +1,7 @@
 package message
 
+import "sort"
+
 type StackOptionInfo map[int]interface{}
 
 func getStackOptions(options *OptionSet, clientLeg bool) []Option {
@@ -72,6 +74,12 @@ func getOptionFromData(id int, data interface{}, clientLeg bool, remoteLeg bool)
 		sod = &PortParityOptionData{}
 	case StackOptionTCPBacklog:
 		sod = &BacklogOptionData{}
+	case StackOptionUDPMulticastJoin, StackOptionUDPMulticastLeave:
+		sod = &MulticastGroupOptionData{}
+	case StackOptionUDPMulticastInterface:
+		sod = &MulticastInterfaceOptionData{}
+	case StackOptionUDPMaxPayload:
+		sod = &MaxPayloadOptionData{}
 	}
 	sod.SetData(data)
 	lv, code := SplitStackOptionID(id)
@@ -90,21 +98,25 @@ func getOptionFromData(id int, data interface{}, clientLeg bool, remoteLeg bool)
 
 func (s StackOptionInfo) GetOptions(clientLeg bool, remoteLeg bool) []Option {
 	r := []Option{}
-	for id, dt := range s {
-		op := getOptionFromData(id, dt, clientLeg, remoteLeg)
+	for _, id := range s.ids() {
+		op := getOptionFromData(id, s[id], clientLeg, remoteLeg)
 		r = append(r, op)
 	}
 	return r
 }
 
-func GetCombinedStackOptions(client StackOptionInfo, remote StackOptionInfo) []Option {
-	keys := make([]int, 0, len(client)+len(remote))
-	for k := range client {
-		keys = append(keys, k)
-	}
-	for k := range remote {
-		keys = append(keys, k)
+// ids return stack option ids in s in ascending order, so options generated from s are in stable order
+func (s StackOptionInfo) ids() []int {
+	ids := make([]int, 0, len(s))
+	for id := range s {
+		ids = append(ids, id)
 	}
+	sort.Ints(ids)
+	return ids
+}
+
+func GetCombinedStackOptions(client StackOptionInfo, remote StackOptionInfo) []Option {
+	keys := append(client.ids(), remote.ids()...)
 
 	ret := make([]Option, 0)
 	for _, k := range keys {
@@ -0,0 +1,45 @@
+package message
+
+// fragment id(2) offset(2) flag(1) reserved(1)
+const udpFragmentHeaderLen = 6
+
+const udpFragmentFlagMore byte = 0x80
+
+// Fragment split datagram message into fragments with given id,
+// each marshalled fragment is no longer than maxSize.
+// Return the message itself when it's short enough or it's not a datagram.
+func (u *UDPMessage) Fragment(id uint16, maxSize int) ([]*UDPMessage, error) {
+	if u.Type != UDPMessageDatagram {
+		return []*UDPMessage{u}, nil
+	}
+	addrLen := len(u.Endpoint.Marshal6(0))
+	if 12+addrLen+len(u.Data) <= maxSize {
+		return []*UDPMessage{u}, nil
+	}
+	chunk := maxSize - 12 - udpFragmentHeaderLen - addrLen
+	if chunk <= 0 {
+		return nil, ErrBufferSize.WithVerbose("fragment size %d can't hold any data", maxSize)
+	}
+	if len(u.Data) > 0xffff {
+		return nil, ErrBufferSize.WithVerbose("datagram too long")
+	}
+
+	ret := []*UDPMessage{}
+	for off := 0; off < len(u.Data); off += chunk {
+		end := off + chunk
+		if end > len(u.Data) {
+			end = len(u.Data)
+		}
+		ret = append(ret, &UDPMessage{
+			Type:           UDPMessageFragment,
+			AssociationID:  u.AssociationID,
+			Endpoint:       u.Endpoint,
+			Data:           u.Data[off:end],
+			FragmentID:     id,
+			FragmentOffset: uint16(off),
+			FragmentMore:   end < len(u.Data),
+			Profile:        u.Profile,
+		})
+	}
+	return ret, nil
+}
@@ -0,0 +1,79 @@
+package message_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6/common/rnd"
+	"github.com/studentmain/socks6/message"
+)
+
+func TestUDPMessageFragment(t *testing.T) {
+	data := rnd.RandBytes(1000)
+	msg := &message.UDPMessage{
+		Type:          message.UDPMessageDatagram,
+		AssociationID: 1234,
+		Endpoint:      message.ParseAddr("127.0.0.1:1"),
+		Data:          data,
+	}
+
+	// short enough
+	frags, err := msg.Fragment(1, 2000)
+	assert.NoError(t, err)
+	assert.Equal(t, []*message.UDPMessage{msg}, frags)
+
+	// too small to hold data
+	_, err = msg.Fragment(1, 20)
+	assert.Error(t, err)
+
+	frags, err = msg.Fragment(5, 300)
+	assert.NoError(t, err)
+	assert.Len(t, frags, 4)
+
+	reassembled := []byte{}
+	for i, f := range frags {
+		b := f.Marshal()
+		assert.LessOrEqual(t, len(b), 300)
+
+		f2, err := message.ParseUDPMessageFrom(bytes.NewReader(b))
+		assert.NoError(t, err)
+		assert.Equal(t, message.UDPMessageFragment, f2.Type)
+		assert.EqualValues(t, 1234, f2.AssociationID)
+		assert.EqualValues(t, 5, f2.FragmentID)
+		assert.EqualValues(t, len(reassembled), f2.FragmentOffset)
+		assert.Equal(t, i != len(frags)-1, f2.FragmentMore)
+		assert.Equal(t, msg.Endpoint, f2.Endpoint)
+		reassembled = append(reassembled, f2.Data...)
+	}
+	assert.Equal(t, data, reassembled)
+}
+
+func TestUDPMessageFragmentParse(t *testing.T) {
+	f := &message.UDPMessage{
+		Type:           message.UDPMessageFragment,
+		AssociationID:  1,
+		Endpoint:       message.ParseAddr("127.0.0.1:1"),
+		Data:           []byte{1, 2, 3},
+		FragmentID:     0x0102,
+		FragmentOffset: 0x0304,
+		FragmentMore:   true,
+	}
+	b := f.Marshal()
+	// experimental type code
+	assert.Equal(t, byte(0xf0), b[1])
+	assert.Equal(t, []byte{0x01, 0x02, 0x03, 0x04, 0x80, 0}, b[12:18])
+	assert.Equal(t, f, lo.Must1(message.ParseUDPMessageFrom(bytes.NewReader(b))))
+
+	// unassigned type
+	b2 := append([]byte{}, b...)
+	b2[1] = 5
+	_, err := message.ParseUDPMessageFrom(bytes.NewReader(b2))
+	assert.Error(t, err)
+
+	// truncated fragment header
+	b[3] = 14
+	_, err = message.ParseUDPMessageFrom(bytes.NewReader(b))
+	assert.Error(t, err)
+}
@@ -0,0 +1,104 @@
+package message
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/studentmain/socks6/common"
+)
+
+// NewUDPAssociationInit create association init message, sent by proxy when association is created
+func NewUDPAssociationInit(id uint64) *UDPMessage {
+	return &UDPMessage{Type: UDPMessageAssociationInit, AssociationID: id}
+}
+
+// NewUDPAssociationAck create association ack message, sent by proxy when first datagram is received
+func NewUDPAssociationAck(id uint64) *UDPMessage {
+	return &UDPMessage{Type: UDPMessageAssociationAck, AssociationID: id}
+}
+
+// NewUDPDatagram create datagram message, endpoint is destination when sent by client, or source when sent by proxy
+func NewUDPDatagram(id uint64, endpoint *SocksAddr, data []byte) *UDPMessage {
+	return &UDPMessage{
+		Type:          UDPMessageDatagram,
+		AssociationID: id,
+		Endpoint:      endpoint,
+		Data:          data,
+	}
+}
+
+// NewUDPError create error message about datagram sent to endpoint, reporter is the host reported the error
+func NewUDPError(id uint64, endpoint *SocksAddr, reporter *SocksAddr, code UDPErrorType) *UDPMessage {
+	return &UDPMessage{
+		Type:          UDPMessageError,
+		AssociationID: id,
+		Endpoint:      endpoint,
+		ErrorEndpoint: reporter,
+		ErrorCode:     code,
+	}
+}
+
+// NewUDPErrorFromError create error message from error returned by socket operation, see UDPErrorTypeFromError.
+// Return false when err can't be represented as UDP error.
+func NewUDPErrorFromError(id uint64, endpoint *SocksAddr, reporter *SocksAddr, err error) (*UDPMessage, bool) {
+	code, ok := UDPErrorTypeFromError(err)
+	if !ok {
+		return nil, false
+	}
+	return NewUDPError(id, endpoint, reporter, code), true
+}
+
+// NewUDPStackOption create stack option message, which change association's stack options
+func NewUDPStackOption(id uint64, ops *OptionSet) *UDPMessage {
+	return &UDPMessage{
+		Type:          UDPMessageStackOption,
+		AssociationID: id,
+		Options:       ops,
+	}
+}
+
+// UDPErrorTypeFromError convert errno in err to UDP error type, false if errno has no corresponding type
+func UDPErrorTypeFromError(err error) (UDPErrorType, bool) {
+	errno := syscall.Errno(0)
+	if !errors.As(err, &errno) {
+		return 0, false
+	}
+	switch common.ConvertSocketErrno(errno) {
+	case syscall.ENETUNREACH:
+		return UDPErrorNetworkUnreachable, true
+	case syscall.EHOSTUNREACH:
+		return UDPErrorHostUnreachable, true
+	case syscall.EMSGSIZE:
+		return UDPErrorDatagramTooBig, true
+	}
+	return 0, false
+}
+
+// Valid check whether t is defined
+func (t UDPErrorType) Valid() bool {
+	return t >= UDPErrorNetworkUnreachable && t <= UDPErrorDatagramTooBig
+}
+
+// Validate check whether fields required by message type are set
+func (u *UDPMessage) Validate() error {
+	switch u.Type {
+	case UDPMessageAssociationInit, UDPMessageAssociationAck:
+		return nil
+	case UDPMessageDatagram, UDPMessageFragment:
+		if u.Endpoint == nil {
+			return ErrFormat.WithVerbose("%s message has no endpoint", u.Type)
+		}
+		return nil
+	case UDPMessageError:
+		if u.Endpoint == nil || u.ErrorEndpoint == nil {
+			return ErrFormat.WithVerbose("error message has no endpoint or reporter")
+		}
+		if !u.ErrorCode.Valid() {
+			return ErrEnumValue.WithVerbose("udp error type %d", u.ErrorCode)
+		}
+		return nil
+	case UDPMessageStackOption:
+		return nil
+	}
+	return ErrEnumValue.WithVerbose("udp message type %d", u.Type)
+}
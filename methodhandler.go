@@ -1,14 +1,15 @@
 package socks6
 
 import (
-	"bytes"
 	"context"
+	"io"
 	"net"
 	"time"
 
 	"github.com/studentmain/socks6/common"
 	"github.com/studentmain/socks6/common/lg"
 	"github.com/studentmain/socks6/common/nt"
+	"github.com/studentmain/socks6/internal/socket"
 	"github.com/studentmain/socks6/message"
 )
 
@@ -18,7 +19,29 @@ func (s *ServerWorker) NoopHandler(
 ) {
 	defer cc.Conn.Close()
 	lg.Trace(cc.ConnId(), "noop")
-	cc.WriteReplyCode(message.OperationReplySuccess)
+	_, multiplex := cc.Request.Options.GetData(message.OptionKindMultiplex)
+	// only session can be shared by streams
+	if !s.EnableMultiplex || !multiplex || cc.Session == nil || cc.MuxConn != nil {
+		cc.WriteReplyCode(message.OperationReplySuccess)
+		return
+	}
+	rep := message.NewOperationReplyBuilder(message.OperationReplySuccess).
+		Options(message.Option{Kind: message.OptionKindMultiplex, Data: message.MultiplexOptionData{}}).
+		Build()
+	if err := cc.WriteOperationReply(rep); err != nil {
+		return
+	}
+	lg.Trace(cc.ConnId(), "multiplexed")
+	if s.MultiplexFunc == nil {
+		s.ServeMuxConn(ctx, nt.NewStreamMux(cc.Conn, false))
+		return
+	}
+	mc, err := s.MultiplexFunc(cc.Conn)
+	if err != nil {
+		lg.Warning(cc.ConnId(), "can't create multiplexed connection", err)
+		return
+	}
+	s.ServeMuxConn(ctx, mc)
 }
 
 func (s *ServerWorker) ConnectHandler(
@@ -31,8 +54,26 @@ func (s *ServerWorker) ConnectHandler(
 
 	lg.Trace(cc.ConnId(), "dial to", cc.Destination())
 
-	rconn, remoteAppliedOpt, err := s.Outbound.Dial(ctx, remoteOpt, cc.Destination())
-	code := getReplyCode(err)
+	if err := s.DestinationGuard.checkDestination(ctx, cc.Destination()); err != nil {
+		lg.Warningf("%s dial to %s refused by destination guard", cc.ConnId(), cc.Destination())
+		cc.WriteReplyCode(s.getReplyCode(err))
+		return
+	}
+
+	// domain may resolve to another address during dial, check it before connect
+	ctx = withDestinationCheck(ctx, s.DestinationGuard)
+	var rconn net.Conn
+	var remoteAppliedOpt message.StackOptionInfo
+	var err error
+	// send initial data along with connection establishment when possible
+	idd, initialDataSent := s.Outbound.(InitialDataDialer)
+	initialDataSent = initialDataSent && len(cc.InitialData) > 0
+	if initialDataSent {
+		rconn, remoteAppliedOpt, err = idd.DialWithInitialData(ctx, remoteOpt, cc.Destination(), cc.InitialData)
+	} else {
+		rconn, remoteAppliedOpt, err = s.Outbound.Dial(ctx, remoteOpt, cc.Destination())
+	}
+	code := s.getReplyCode(err)
 
 	if code != message.OperationReplySuccess {
 		lg.Warningf("%s dial to %s failed %+v", cc.ConnId(), cc.Destination(), err)
@@ -40,18 +81,34 @@ func (s *ServerWorker) ConnectHandler(
 		return
 	}
 	defer rconn.Close()
+	// outbound may not check address before connect
+	if s.DestinationGuard != nil && !s.DestinationGuard.allowedNetAddr(rconn.RemoteAddr()) {
+		lg.Warningf("%s remote address %s refused by destination guard", cc.ConnId(), rconn.RemoteAddr())
+		cc.WriteReplyCode(s.getReplyCode(ErrNotAllowedByRule))
+		return
+	}
 
 	lg.Trace(cc.ConnId(), "remote conn established")
-	if _, err := rconn.Write(cc.InitialData); err != nil {
+	if p := s.captureOf(cc); p != nil {
+		c := newCaptureConn(rconn, p, cc.Conn.RemoteAddr())
+		if initialDataSent {
+			c.flow.data(true, cc.InitialData)
+		}
+		rconn = c
+	}
+	if initialDataSent {
+		lg.Trace(cc.ConnId(), "initial data sent with connection establishment")
+	} else if _, err := rconn.Write(cc.InitialData); err != nil {
 		// it will fail again at relay()
 		lg.Info(cc.ConnId(), "can't write initdata to remote connection")
 	}
 
-	appliedOpt := message.GetCombinedStackOptions(clientAppliedOpt, remoteAppliedOpt)
-	options := message.NewOptionSet()
-	options.AddMany(appliedOpt)
+	rep := message.NewOperationReplyBuilder(code).
+		BoundNetAddr(rconn.LocalAddr()).
+		StackOptions(clientAppliedOpt, remoteAppliedOpt).
+		Build()
 	// it will fail again at relay() too
-	if err := cc.WriteReply(code, rconn.LocalAddr(), options); err != nil {
+	if err := cc.WriteOperationReply(rep); err != nil {
 		lg.Warning(cc.ConnId(), "can't write reply", err)
 	}
 
@@ -87,13 +144,17 @@ func (s *ServerWorker) BindHandler(
 	remoteOpt := message.GetStackOptionInfo(cc.Request.Options, false)
 	iBacklog, backlogged := remoteOpt[message.StackOptionTCPBacklog]
 
-	listener, remoteAppliedOpt, err := s.Outbound.Listen(ctx, remoteOpt, cc.Destination())
-	lg.Info(cc.ConnId(), "bind at", listener.Addr())
-	code := getReplyCode(err)
+	listener, remoteAppliedOpt, err := bindWithPolicy(s.BindPolicy, cc.Destination(),
+		func(addr *message.SocksAddr) (net.Listener, message.StackOptionInfo, error) {
+			return s.Outbound.Listen(ctx, remoteOpt, addr)
+		})
+	code := s.getReplyCode(err)
 	if code != message.OperationReplySuccess {
+		lg.Warningf("%s bind at %s failed %+v", cc.ConnId(), cc.Destination(), err)
 		cc.WriteReplyCode(code)
 		return
 	}
+	lg.Info(cc.ConnId(), "bind at", listener.Addr())
 
 	// add backlog option to notify client
 	if backlogged {
@@ -108,11 +169,11 @@ func (s *ServerWorker) BindHandler(
 		})
 	}
 
-	appliedOpt := message.GetCombinedStackOptions(message.StackOptionInfo{}, remoteAppliedOpt)
-	options := message.NewOptionSet()
-	options.AddMany(appliedOpt)
-
-	if err = cc.WriteReply(code, listener.Addr(), options); err != nil {
+	rep := message.NewOperationReplyBuilder(code).
+		BoundNetAddr(listener.Addr()).
+		StackOptions(message.StackOptionInfo{}, remoteAppliedOpt).
+		Build()
+	if err = cc.WriteOperationReply(rep); err != nil {
 		lg.Error(cc.ConnId(), "can't write reply", err)
 		return
 	}
@@ -152,9 +213,12 @@ func (s *ServerWorker) BindHandler(
 						defer cconn.Close()
 
 						// reply remote address without handshake
-						rep := message.NewOperationReply()
-						rep.Endpoint = message.ConvertAddr(rconn.RemoteAddr())
+						rep := message.NewOperationReplyBuilder(message.OperationReplySuccess).
+							BoundNetAddr(rconn.RemoteAddr()).
+							Profile(cc.profile()).
+							Build()
 						cc.setStreamId(rep)
+						rep.Pad(cc.padding)
 						_, err = cconn.Write(rep.Marshal())
 						if err != nil {
 							return
@@ -164,6 +228,13 @@ func (s *ServerWorker) BindHandler(
 					}(rconn)
 				}
 			}()
+			// close listener when control stream is closed
+			go func() {
+				io.Copy(io.Discard, cc.Conn)
+				bl.Close()
+				cc.Conn.Close()
+			}()
+			return
 		}
 	}
 	// non backlogged path
@@ -184,7 +255,7 @@ func (s *ServerWorker) BindHandler(
 	lg.Trace(cc.ConnId(), "waiting inbound connection")
 	rconn, err := listener.Accept()
 	listener.Close()
-	code2 := getReplyCode(err)
+	code2 := s.getReplyCode(err)
 	if code2 != message.OperationReplySuccess {
 		cc.WriteReplyCode(code2)
 		lg.Warning(cc.ConnId(), "can't accept inbound connection", err)
@@ -208,6 +279,13 @@ func (s *ServerWorker) UdpAssociateHandler(
 
 	defer closeConn.Defer()
 
+	if rd, ok := message.GetTyped[message.UDPAssociationResumeOptionData](cc.Request.Options, message.OptionKindUDPAssociationResume); ok {
+		if s.resumeUdpAssociation(cc, rd.AssociationID) {
+			closeConn.Cancel()
+		}
+		return
+	}
+
 	destStr := cc.Destination().String()
 	rid, reserved := s.reservedUdpAddr.Load(destStr)
 	// already reserved
@@ -216,8 +294,8 @@ func (s *ServerWorker) UdpAssociateHandler(
 		if !ok {
 			lg.Warning("reserve port exist after association delete")
 		} else {
-			// not same session, fail
-			if !bytes.Equal(rua.cc.Session, cc.Session) {
+			// not same session or client, fail
+			if rua.owner != udpAssociationOwner(cc) {
 				cc.WriteReplyCode(message.OperationReplyConnectionRefused)
 				return
 			}
@@ -225,52 +303,46 @@ func (s *ServerWorker) UdpAssociateHandler(
 	}
 
 	// reserve check pass
+	// check quota
+	owner := udpAssociationOwner(cc)
+	ok, canReserve := s.acquireUdpQuota(owner)
+	if !ok {
+		lg.Warningf("%s udp association quota of %s exceeded", cc.ConnId(), owner)
+		cc.WriteReplyCode(message.OperationReplyNotAllowedByRule)
+		return
+	}
+	reservedSlot := 0
+	if canReserve {
+		reservedSlot = 1
+	}
+	// return slots if association is not started
+	releaseQuota := common.NewCancellableDefer(func() {
+		s.releaseUdpQuota(owner, 1, reservedSlot)
+	})
+	defer releaseQuota.Defer()
+
 	remoteOpt := message.GetStackOptionInfo(cc.Request.Options, false)
-	pc, remoteAppliedOpt, err := s.Outbound.ListenPacket(ctx, remoteOpt, cc.Destination())
-	code := getReplyCode(err)
+	var pc, pair net.PacketConn
+	var remoteAppliedOpt message.StackOptionInfo
+	var err error
+	if held := s.takeReservedPort(destStr); held != nil {
+		// reserved by previous association
+		pc = held
+		remoteAppliedOpt = socket.SetPacketConnOpt(pc, remoteOpt)
+	} else {
+		pc, remoteAppliedOpt, pair, err = s.listenPacketWithParity(ctx, cc.Destination(), remoteOpt, canReserve)
+	}
+	code := s.getReplyCode(err)
 	if code != message.OperationReplySuccess {
 		cc.WriteReplyCode(code)
 		return
 	}
-	var reservedAddr net.Addr
-	// reserve port
-	if ippod, ok := remoteOpt[message.StackOptionUDPPortParity]; ok {
-		appliedPpod := message.PortParityOptionData{
-			Reserve: true,
-			Parity:  message.StackPortParityOptionParityNo,
-		}
-		// calculate port to reserve
-		ppod := ippod.(message.PortParityOptionData)
-		if ppod.Reserve {
-			s6a := message.ConvertAddr(pc.LocalAddr())
-			if s6a.Port&1 == 0 {
-				s6a.Port += 1
-				appliedPpod.Parity = message.StackPortParityOptionParityEven
-			} else {
-				s6a.Port -= 1
-				appliedPpod.Parity = message.StackPortParityOptionParityOdd
-			}
-			reservedAddr = s6a
-		}
-		// check and create reply option
-		if !nt.UdpPortAvaliable(reservedAddr) {
-			reservedAddr = nil
-			appliedPpod.Reserve = false
-		} else {
-			remoteAppliedOpt.Add(message.BaseStackOptionData{
-				RemoteLeg: true,
-				Level:     message.StackOptionLevelUDP,
-				Code:      message.StackOptionCodePortParity,
-				Data:      &appliedPpod,
-			})
-		}
-	}
 	// check icmp option
 	icmpOn := false
 	if s.EnableICMP {
 		if iicmp, ok := remoteOpt[message.StackOptionUDPUDPError]; ok {
-			i := iicmp.(message.UDPErrorOptionData)
-			if i.Availability {
+			// without raw ICMP socket, errors are read from socket error queue
+			if iicmp.(bool) && (!s.icmpRecvErr || socket.EnableRecvErr(pc)) {
 				icmpOn = true
 				remoteAppliedOpt.Add(message.BaseStackOptionData{
 					RemoteLeg: true,
@@ -284,19 +356,96 @@ func (s *ServerWorker) UdpAssociateHandler(
 		}
 	}
 
-	so := message.GetCombinedStackOptions(message.StackOptionInfo{}, remoteAppliedOpt)
-	opset := message.NewOptionSet()
-	opset.AddMany(so)
-	cc.WriteReply(message.OperationReplySuccess, pc.LocalAddr(), opset)
+	// multicast group and interface
+	remoteAppliedOpt.Combine(applyMulticastOption(pc, remoteOpt))
+
+	maxPayload := s.udpMaxPayload(remoteOpt)
+	if maxPayload > 0 {
+		if remoteAppliedOpt == nil {
+			remoteAppliedOpt = message.StackOptionInfo{}
+		}
+		remoteAppliedOpt[message.StackOptionUDPMaxPayload] = uint16(maxPayload)
+	}
+
+	cc.WriteOperationReply(message.NewOperationReplyBuilder(message.OperationReplySuccess).
+		BoundNetAddr(pc.LocalAddr()).
+		StackOptions(message.StackOptionInfo{}, remoteAppliedOpt).
+		Build())
 	// start association
-	assoc := newUdpAssociation(cc, pc, reservedAddr, s.AddressDependentFiltering, icmpOn)
-	s.udpAssociation.Store(assoc.id, assoc)
+	assoc := newUdpAssociation(cc, pc, pair, s.udpFiltering(cc), icmpOn, s.DestinationGuard)
+	if o, ok := s.Outbound.(InternetServerOutbound); ok {
+		assoc.resolveAddr = o.resolveAddr
+	}
+	assoc.fragmentSize = s.UDPFragmentSize
+	assoc.maxPayload = maxPayload
+	assoc.parse = s.parseConfig()
+	assoc.rateLimiter = newUdpRateLimiter(s.UDPRateLimit)
+	assoc.ownerRateLimiter = s.udpOwnerRateLimiter(owner)
+	if p, ok := s.captures.Load(owner); ok && p != nil {
+		assoc.setCapture(p)
+	}
+	assoc.recvErr = icmpOn && s.icmpRecvErr
+	assoc.resumeTimeout = s.UDPResumeTimeout
+	if s.EnableUDPOffload {
+		assoc.enableOffload()
+	}
+	if canReserve && assoc.pair == "" {
+		// no port reserved
+		s.releaseUdpQuota(owner, 0, 1)
+	}
+	releaseQuota.Cancel()
+	assoc.releaseQuota = func(assoc, reserved int) {
+		s.releaseUdpQuota(owner, assoc, reserved)
+	}
+	s.registerUdpAssociation(assoc)
+	s.indexUdpAssociation(assoc)
 	lg.Trace("start udp assoc", assoc.id)
-	if reservedAddr != nil {
-		s.reservedUdpAddr.Store(reservedAddr.String(), assoc.id)
+	if assoc.pair != "" {
+		s.reservedUdpAddr.Store(assoc.pair, assoc.id)
 	}
 	closeConn.Cancel()
 
 	go assoc.handleTcpUp(ctx)
 	go assoc.handleUdpDown(ctx)
 }
+
+// udpMaxPayload decide association's max payload size from UDPMaxPayload and client's request, 0 means no limit
+func (s *ServerWorker) udpMaxPayload(opt message.StackOptionInfo) int {
+	max := s.UDPMaxPayload
+	if max > 0xffff {
+		max = 0xffff
+	}
+	if imp, ok := opt[message.StackOptionUDPMaxPayload]; ok {
+		req := int(imp.(uint16))
+		if req > 0 && (max <= 0 || req < max) {
+			max = req
+		}
+	}
+	return max
+}
+
+// resumeUdpAssociation re-attach UDP association held by client's session to cc,
+// return false when association can't be resumed
+func (s *ServerWorker) resumeUdpAssociation(cc SocksConn, id uint64) bool {
+	if s.UDPResumeTimeout <= 0 || cc.Session == nil {
+		cc.WriteReplyCode(message.OperationReplyNotAllowedByRule)
+		return false
+	}
+	ua, ok := s.udpAssociation.Load(id)
+	if !ok || !ua.alive || ua.owner != udpAssociationOwner(cc) {
+		lg.Info(cc.ConnId(), "can't resume udp assoc", id)
+		cc.WriteReplyCode(message.OperationReplyConnectionRefused)
+		return false
+	}
+	rep := message.NewOperationReplyBuilder(message.OperationReplySuccess).
+		BoundNetAddr(ua.udp.LocalAddr()).
+		Options(message.Option{
+			Kind: message.OptionKindUDPAssociationResume,
+			Data: message.UDPAssociationResumeOptionData{AssociationID: id},
+		}).
+		Build()
+	if err := cc.WriteOperationReply(rep); err != nil {
+		return false
+	}
+	return ua.resumeWith(cc)
+}
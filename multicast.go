@@ -0,0 +1,106 @@
+package socks6
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+
+	"github.com/studentmain/socks6/common/lg"
+	"github.com/studentmain/socks6/message"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// applyMulticastOption join/leave multicast group and set outgoing multicast interface on pc,
+// return options which took effect
+func applyMulticastOption(pc net.PacketConn, opt message.StackOptionInfo) message.StackOptionInfo {
+	applied := message.StackOptionInfo{}
+	if iifa, ok := opt[message.StackOptionUDPMulticastInterface]; ok {
+		ifa := iifa.(netip.Addr)
+		if err := setMulticastInterface(pc, ifa); err != nil {
+			lg.Info("set multicast interface", err)
+		} else {
+			applied[message.StackOptionUDPMulticastInterface] = ifa
+		}
+	}
+	if ijoin, ok := opt[message.StackOptionUDPMulticastJoin]; ok {
+		g := ijoin.(message.MulticastGroupOptionData)
+		if err := changeMulticastGroup(pc, g, true); err != nil {
+			lg.Info("join multicast group", err)
+		} else {
+			applied[message.StackOptionUDPMulticastJoin] = g
+		}
+	}
+	if ileave, ok := opt[message.StackOptionUDPMulticastLeave]; ok {
+		g := ileave.(message.MulticastGroupOptionData)
+		if err := changeMulticastGroup(pc, g, false); err != nil {
+			lg.Info("leave multicast group", err)
+		} else {
+			applied[message.StackOptionUDPMulticastLeave] = g
+		}
+	}
+	return applied
+}
+
+func changeMulticastGroup(pc net.PacketConn, g message.MulticastGroupOptionData, join bool) error {
+	if !g.Group.IsMulticast() {
+		return errors.New("not a multicast group")
+	}
+	ifi, err := findInterfaceByAddr(g.Interface)
+	if err != nil {
+		return err
+	}
+	group := &net.UDPAddr{IP: g.Group.AsSlice()}
+	if g.Group.Is4() {
+		p := ipv4.NewPacketConn(pc)
+		if join {
+			return p.JoinGroup(ifi, group)
+		}
+		return p.LeaveGroup(ifi, group)
+	}
+	p := ipv6.NewPacketConn(pc)
+	if join {
+		return p.JoinGroup(ifi, group)
+	}
+	return p.LeaveGroup(ifi, group)
+}
+
+func setMulticastInterface(pc net.PacketConn, ifa netip.Addr) error {
+	ifi, err := findInterfaceByAddr(ifa)
+	if err != nil {
+		return err
+	}
+	la, ok := pc.LocalAddr().(*net.UDPAddr)
+	if ok && la.IP.To4() == nil {
+		return ipv6.NewPacketConn(pc).SetMulticastInterface(ifi)
+	}
+	return ipv4.NewPacketConn(pc).SetMulticastInterface(ifi)
+}
+
+// findInterfaceByAddr find interface which has address a, zero value means default interface (nil)
+func findInterfaceByAddr(a netip.Addr) (*net.Interface, error) {
+	if !a.IsValid() {
+		return nil, nil
+	}
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, ifi := range ifs {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipn, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ip, ok := netip.AddrFromSlice(ipn.IP); ok && ip.Unmap() == a {
+				ifi := ifi
+				return &ifi, nil
+			}
+		}
+	}
+	return nil, errors.New("no interface has address " + a.String())
+}
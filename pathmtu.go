@@ -0,0 +1,82 @@
+package socks6
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// learned path MTU expire after it, same as linux default
+	pathMTUTimeout = 10 * time.Minute
+	// max remote hosts tracked per association
+	maxPathMTUEntries = 1024
+	// smallest MTU allowed by IPv4, smaller report is bogus
+	minPathMTU = 68
+)
+
+type pathMTUEntry struct {
+	mtu     int
+	updated time.Time
+}
+
+// pathMTUCache track effective MTU towards remote hosts, learned from ICMP PacketTooBig
+type pathMTUCache struct {
+	mtx sync.Mutex
+	m   map[string]pathMTUEntry
+}
+
+func newPathMTUCache() *pathMTUCache {
+	return &pathMTUCache{
+		m: map[string]pathMTUEntry{},
+	}
+}
+
+// update record MTU towards ip
+func (c *pathMTUCache) update(ip net.IP, mtu int) {
+	if mtu < minPathMTU {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if len(c.m) >= maxPathMTUEntries {
+		c.expire()
+	}
+	if len(c.m) >= maxPathMTUEntries {
+		return
+	}
+	c.m[ip.String()] = pathMTUEntry{
+		mtu:     mtu,
+		updated: time.Now(),
+	}
+}
+
+// maxPayload return max UDP payload size can be sent to ip without fragmentation, 0 when unknown
+func (c *pathMTUCache) maxPayload(ip net.IP) int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	e, ok := c.m[ip.String()]
+	if !ok {
+		return 0
+	}
+	if time.Since(e.updated) > pathMTUTimeout {
+		delete(c.m, ip.String())
+		return 0
+	}
+	// ip header + udp header
+	overhead := 20 + 8
+	if ip.To4() == nil {
+		overhead = 40 + 8
+	}
+	return e.mtu - overhead
+}
+
+func (c *pathMTUCache) expire() {
+	for k, e := range c.m {
+		if time.Since(e.updated) > pathMTUTimeout {
+			delete(c.m, k)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package socks6
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/studentmain/socks6/message"
+)
+
+// pcapng block types, see draft-tuexen-opsawg-pcapng
+const (
+	pcapngBlockSectionHeader  uint32 = 0x0A0D0D0A
+	pcapngBlockInterfaceDesc  uint32 = 1
+	pcapngBlockEnhancedPacket uint32 = 6
+
+	pcapngByteOrderMagic uint32 = 0x1A2B3C4D
+	pcapLinkTypeRaw      uint16 = 101 // raw IPv4 or IPv6 packet
+)
+
+const (
+	ipProtoTCP byte = 6
+	ipProtoUDP byte = 17
+
+	tcpFlagFIN byte = 0x01
+	tcpFlagSYN byte = 0x02
+	tcpFlagPSH byte = 0x08
+	tcpFlagACK byte = 0x10
+)
+
+const (
+	pcapMaxUDPPayload = 0xffff - 40 - 8 // fit in both IPv4 and IPv6 packet
+	pcapMaxTCPSegment = 32768           // longer TCP payload is split
+
+	// synthetic TCP connection start with these sequence number
+	pcapTCPInitialSeqClient uint32 = 1000
+	pcapTCPInitialSeqRemote uint32 = 2000
+)
+
+// PcapWriter write relayed payload to pcapng file.
+// IP, UDP and TCP headers are synthesized, so the capture show traffic between client and remote as if no proxy exists.
+// It's safe for concurrent use.
+type PcapWriter struct {
+	mtx sync.Mutex
+	w   io.Writer
+	err error // first write error, nothing is written after it
+}
+
+// NewPcapWriter write pcapng section header to w and return writer for packets
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	p := &PcapWriter{w: w}
+
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb, pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint16(shb[6:], 0)
+	// section length unknown
+	binary.LittleEndian.PutUint64(shb[8:], 0xffff_ffff_ffff_ffff)
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb, pcapLinkTypeRaw)
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.writeBlock(pcapngBlockSectionHeader, shb)
+	p.writeBlock(pcapngBlockInterfaceDesc, idb)
+	return p, p.err
+}
+
+// writeBlock write a pcapng block, caller must hold mtx
+func (p *PcapWriter) writeBlock(typ uint32, body []byte) {
+	if p.err != nil {
+		return
+	}
+	total := 12 + (len(body)+3)&^3
+	b := make([]byte, total)
+	binary.LittleEndian.PutUint32(b, typ)
+	binary.LittleEndian.PutUint32(b[4:], uint32(total))
+	copy(b[8:], body)
+	binary.LittleEndian.PutUint32(b[total-4:], uint32(total))
+	_, p.err = p.w.Write(b)
+}
+
+func (p *PcapWriter) writePacket(pkt []byte) error {
+	// interface id(4) timestamp(8) captured length(4) original length(4) data
+	body := make([]byte, 20+len(pkt))
+	// default timestamp resolution is microsecond
+	ts := uint64(time.Now().UnixMicro())
+	binary.LittleEndian.PutUint32(body[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(pkt)))
+	copy(body[20:], pkt)
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.writeBlock(pcapngBlockEnhancedPacket, body)
+	return p.err
+}
+
+// writeUDP write a datagram from src to dst, payload longer than max UDP payload is truncated
+func (p *PcapWriter) writeUDP(src, dst net.Addr, payload []byte) error {
+	if len(payload) > pcapMaxUDPPayload {
+		payload = payload[:pcapMaxUDPPayload]
+	}
+	sip, sport := pcapEndpoint(src)
+	dip, dport := pcapEndpoint(dst)
+	udp := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint16(udp, sport)
+	binary.BigEndian.PutUint16(udp[2:], dport)
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[8:], payload)
+	return p.writePacket(pcapIPPacket(sip, dip, ipProtoUDP, udp, 6))
+}
+
+// writeTCP write a TCP segment from src to dst
+func (p *PcapWriter) writeTCP(src, dst net.Addr, seq, ack uint32, flags byte, payload []byte) error {
+	sip, sport := pcapEndpoint(src)
+	dip, dport := pcapEndpoint(dst)
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp, sport)
+	binary.BigEndian.PutUint16(tcp[2:], dport)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4 // header length in 32bit words
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff) // window
+	copy(tcp[20:], payload)
+	return p.writePacket(pcapIPPacket(sip, dip, ipProtoTCP, tcp, 16))
+}
+
+// pcapEndpoint convert addr to IP and port, domain name become unspecified address
+func pcapEndpoint(a net.Addr) (net.IP, uint16) {
+	sa := message.ConvertAddr(a)
+	if sa.AddressType == message.AddressTypeDomainName {
+		return net.IPv4zero, sa.Port
+	}
+	return net.IP(sa.Address), sa.Port
+}
+
+// pcapIPPacket wrap transport layer data in IP header and fill transport checksum at csumOffset.
+// IPv4 is used when both address are IPv4, otherwise IPv4 address is mapped to IPv6.
+func pcapIPPacket(src, dst net.IP, proto byte, transport []byte, csumOffset int) []byte {
+	s4, d4 := src.To4(), dst.To4()
+	if s4 != nil && d4 != nil {
+		ip := make([]byte, 20+len(transport))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(len(ip)))
+		// DF
+		ip[6] = 0x40
+		ip[8] = 64 // ttl
+		ip[9] = proto
+		copy(ip[12:], s4)
+		copy(ip[16:], d4)
+		binary.BigEndian.PutUint16(ip[10:], inetChecksumFinish(inetChecksum(0, ip[:20])))
+
+		pseudo := inetChecksum(inetChecksum(0, s4), d4)
+		pseudo += uint32(proto) + uint32(len(transport))
+		setTransportChecksum(transport, csumOffset, pseudo)
+		copy(ip[20:], transport)
+		return ip
+	}
+
+	s16, d16 := src.To16(), dst.To16()
+	if s16 == nil {
+		s16 = net.IPv6unspecified
+	}
+	if d16 == nil {
+		d16 = net.IPv6unspecified
+	}
+	ip := make([]byte, 40+len(transport))
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(transport)))
+	ip[6] = proto
+	ip[7] = 64 // hop limit
+	copy(ip[8:], s16)
+	copy(ip[24:], d16)
+
+	pseudo := inetChecksum(inetChecksum(0, s16), d16)
+	pseudo += uint32(proto) + uint32(len(transport))
+	setTransportChecksum(transport, csumOffset, pseudo)
+	copy(ip[40:], transport)
+	return ip
+}
+
+func setTransportChecksum(b []byte, offset int, pseudo uint32) {
+	csum := inetChecksumFinish(inetChecksum(pseudo, b))
+	// zero UDP checksum means no checksum
+	if csum == 0 {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(b[offset:], csum)
+}
+
+// inetChecksum add b to one's complement sum, only last part can have odd length
+func inetChecksum(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func inetChecksumFinish(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// pcapTCPFlow synthesize TCP segments for payload relayed between client and remote
+type pcapTCPFlow struct {
+	p      *PcapWriter
+	client net.Addr
+	remote net.Addr
+
+	mtx       sync.Mutex
+	clientSeq uint32 // next sequence number sent by client
+	remoteSeq uint32
+}
+
+// newPcapTCPFlow write handshake of synthetic TCP connection
+func newPcapTCPFlow(p *PcapWriter, client, remote net.Addr) *pcapTCPFlow {
+	f := &pcapTCPFlow{
+		p:         p,
+		client:    client,
+		remote:    remote,
+		clientSeq: pcapTCPInitialSeqClient + 1,
+		remoteSeq: pcapTCPInitialSeqRemote + 1,
+	}
+	p.writeTCP(client, remote, pcapTCPInitialSeqClient, 0, tcpFlagSYN, nil)
+	p.writeTCP(remote, client, pcapTCPInitialSeqRemote, f.clientSeq, tcpFlagSYN|tcpFlagACK, nil)
+	p.writeTCP(client, remote, f.clientSeq, f.remoteSeq, tcpFlagACK, nil)
+	return f
+}
+
+// data write payload sent by client when up, or by remote
+func (f *pcapTCPFlow) data(up bool, b []byte) {
+	for len(b) > 0 {
+		n := len(b)
+		if n > pcapMaxTCPSegment {
+			n = pcapMaxTCPSegment
+		}
+		f.segment(up, tcpFlagPSH|tcpFlagACK, b[:n])
+		b = b[n:]
+	}
+}
+
+// fin write FIN sent by client when up, or by remote
+func (f *pcapTCPFlow) fin(up bool) {
+	f.segment(up, tcpFlagFIN|tcpFlagACK, nil)
+}
+
+func (f *pcapTCPFlow) segment(up bool, flags byte, b []byte) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	n := uint32(len(b))
+	if flags&tcpFlagFIN != 0 {
+		n++
+	}
+	if up {
+		f.p.writeTCP(f.client, f.remote, f.clientSeq, f.remoteSeq, flags, b)
+		f.clientSeq += n
+	} else {
+		f.p.writeTCP(f.remote, f.client, f.remoteSeq, f.clientSeq, flags, b)
+		f.remoteSeq += n
+	}
+}
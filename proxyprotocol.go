@@ -0,0 +1,43 @@
+package socks6
+
+import (
+	"net"
+)
+
+// proxyProtocolSignature is signature of PROXY protocol v2 header
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolHeader build a PROXY protocol v2 header of TCP connection from src to dst,
+// LOCAL command without address is used when src or dst is unknown
+func proxyProtocolHeader(src, dst net.Addr) []byte {
+	b := append([]byte{}, proxyProtocolSignature...)
+	sip, sport, ok1 := addrIPPort(src)
+	dip, dport, ok2 := addrIPPort(dst)
+	if !ok1 || !ok2 {
+		// version 2, LOCAL, UNSPEC
+		return append(b, 0x20, 0x00, 0, 0)
+	}
+	if sip.To4() != nil && dip.To4() != nil {
+		// version 2, PROXY, TCP over IPv4
+		b = append(b, 0x21, 0x11, 0, 12)
+		b = append(b, sip.To4()...)
+		b = append(b, dip.To4()...)
+	} else {
+		// version 2, PROXY, TCP over IPv6, IPv4 address is mapped
+		b = append(b, 0x21, 0x21, 0, 36)
+		b = append(b, sip.To16()...)
+		b = append(b, dip.To16()...)
+	}
+	return append(b, byte(sport>>8), byte(sport), byte(dport>>8), byte(dport))
+}
+
+// addrIPPort extract IP and port from TCP or UDP address
+func addrIPPort(addr net.Addr) (net.IP, int, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port, a.IP != nil
+	case *net.UDPAddr:
+		return a.IP, a.Port, a.IP != nil
+	}
+	return nil, 0, false
+}
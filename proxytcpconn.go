@@ -2,6 +2,8 @@ package socks6
 
 import (
 	"net"
+
+	"github.com/studentmain/socks6/message"
 )
 
 // netConn is net.Conn, but private
@@ -12,10 +14,28 @@ type addrPair struct {
 	remote net.Addr
 }
 
+// ReplyMetadata report proxy's operation reply, it's implemented by connections and listeners created by Client,
+// e.g. client can learn external address and port allocated by proxy
+type ReplyMetadata interface {
+	// ProxyBindAddr return address bound by proxy for remote leg
+	ProxyBindAddr() net.Addr
+	// StackOptions return proxy-remote leg stack options applied by proxy
+	StackOptions() message.StackOptionInfo
+	// ReplyOptions return all options in proxy's operation reply
+	ReplyOptions() *message.OptionSet
+}
+
+var _ ReplyMetadata = &ProxyTCPConn{}
+var _ ReplyMetadata = &ProxyTCPListener{}
+var _ ReplyMetadata = &ProxyUDPConn{}
+
 // ProxyTCPConn represents a proxied TCP connection, implements net.Conn
 type ProxyTCPConn struct {
 	netConn
 	addrPair
+	stackOpt message.StackOptionInfo
+	replyOpt *message.OptionSet
+	meter    *trafficMeter
 }
 
 var _ net.Conn = &ProxyTCPConn{}
@@ -26,10 +46,51 @@ func (t *ProxyTCPConn) RemoteAddr() net.Addr {
 	return t.remote
 }
 
+// ProxyLocalAddr return address bound by proxy for remote leg, which is reported in proxy's reply.
+// RemoteAddr is the requested address, it's a domain name unless resolved locally
 func (t *ProxyTCPConn) ProxyLocalAddr() net.Addr {
 	return t.local
 }
 
+// ProxyBindAddr is same as ProxyLocalAddr
+func (t *ProxyTCPConn) ProxyBindAddr() net.Addr {
+	return t.local
+}
+
+// ProxyRemoteAddr return client-proxy connection's proxy side address
 func (t *ProxyTCPConn) ProxyRemoteAddr() net.Addr {
-	return t.remote
+	return t.netConn.RemoteAddr()
+}
+
+// StackOptions return proxy-remote leg stack options applied by proxy
+func (t *ProxyTCPConn) StackOptions() message.StackOptionInfo {
+	return t.stackOpt
+}
+
+// ReplyOptions return all options in proxy's operation reply
+func (t *ProxyTCPConn) ReplyOptions() *message.OptionSet {
+	return t.replyOpt
+}
+
+// Stats return traffic counters of the connection
+func (t *ProxyTCPConn) Stats() ConnStats {
+	return t.meter.stats()
+}
+
+func (t *ProxyTCPConn) Read(b []byte) (int, error) {
+	n, err := t.netConn.Read(b)
+	t.meter.addReceived(n)
+	return n, err
+}
+
+func (t *ProxyTCPConn) Write(b []byte) (int, error) {
+	n, err := t.netConn.Write(b)
+	t.meter.addSent(n)
+	return n, err
+}
+
+func (t *ProxyTCPConn) Close() error {
+	err := t.netConn.Close()
+	t.meter.closed()
+	return err
 }
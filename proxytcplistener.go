@@ -3,12 +3,17 @@ package socks6
 import (
 	"context"
 	"net"
+	"os"
 	"sync"
+	"time"
 
-	"github.com/studentmain/socks6/common"
+	"github.com/studentmain/socks6/common/lg"
 	"github.com/studentmain/socks6/message"
 )
 
+// ProxyTCPListener is a SOCKS 6 BIND listener, implements net.Listener.
+// When proxy backlog the listener, incoming connections are accepted from proxy in background by new BIND requests,
+// up to backlog connections are kept ready for Accept, and Accept can be called concurrently.
 type ProxyTCPListener struct {
 	netConn netConn
 	bind    net.Addr
@@ -17,69 +22,230 @@ type ProxyTCPListener struct {
 	client *Client
 	// options, used for accept
 	op *message.OptionSet
-	// accept call lock
+	// stack options applied by proxy
+	stackOpt message.StackOptionInfo
+	// options in proxy's operation reply
+	replyOpt *message.OptionSet
+	// protect used and deadline
 	lock sync.Mutex
-	// already accepted
+	// already accepted, only when not backlogged
 	used bool
 
-	qch chan net.Conn
+	// operation replies for incoming connections, read from netConn
+	incoming chan *message.OperationReply
+	// closed when listener is closed or control connection failed
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error // why listener is closed
+
+	deadline        time.Time
+	deadlineChanged chan struct{} // closed when deadline changed
+
+	// backlogged connections accepted from proxy, or from streams opened by proxy
+	ready chan net.Conn
+	// requested over multiplexed connection, backlogged connections are streams opened by proxy with stream id sid
+	mux bool
+	sid uint32
 }
 
 var _ net.Listener = &ProxyTCPListener{}
 
+// start read operation replies from proxy
+func (t *ProxyTCPListener) start() {
+	size := int(t.backlog)
+	if size == 0 {
+		size = 1
+	}
+	t.incoming = make(chan *message.OperationReply, size)
+	t.ready = make(chan net.Conn, size)
+	t.closed = make(chan struct{})
+	t.deadlineChanged = make(chan struct{})
+	go t.readLoop()
+	if t.backlog > 0 && !t.mux {
+		go t.refillLoop()
+	}
+}
+
+func (t *ProxyTCPListener) readLoop() {
+	for {
+		oprep, err := t.client.parseConfig().ParseOperationReplyFrom(t.netConn)
+		if err != nil {
+			t.closeWithError(err)
+			return
+		}
+		select {
+		case t.incoming <- oprep:
+		case <-t.closed:
+			return
+		}
+		// not backlogged, only 1 connection is accepted
+		if t.backlog == 0 {
+			return
+		}
+	}
+}
+
+// refillLoop accept backlogged connections in background, in the order proxy notified
+func (t *ProxyTCPListener) refillLoop() {
+	for {
+		select {
+		case oprep := <-t.incoming:
+			t.refill(oprep)
+		case <-t.closed:
+			return
+		}
+	}
+}
+
+// refill accept backlogged connection notified by oprep with another BIND request, and keep it ready for Accept.
+// Proxy notify next connection after this one is accepted from it, so backlog is kept full.
+func (t *ProxyTCPListener) refill(oprep *message.OperationReply) {
+	if oprep.ReplyCode != message.OperationReplySuccess {
+		lg.Warning("backlogged bind failed", t.bind, convertReplyError(oprep.ReplyCode))
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-t.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	subListener, err := t.client.BindRequest(ctx, t.bind, t.op)
+	if err != nil {
+		lg.Warning("can't accept backlogged connection", t.bind, err)
+		return
+	}
+	defer subListener.Close()
+	conn, err := subListener.AcceptContext(ctx)
+	if err != nil {
+		lg.Warning("can't accept backlogged connection", t.bind, err)
+		return
+	}
+	// wait for Accept when backlog is full
+	select {
+	case t.ready <- conn:
+	case <-t.closed:
+		conn.Close()
+	}
+}
+
 func (t *ProxyTCPListener) Accept() (net.Conn, error) {
 	return t.AcceptContext(context.Background())
 }
 
 func (t *ProxyTCPListener) AcceptContext(ctx context.Context) (net.Conn, error) {
-	if t.used {
-		return nil, &net.OpError{}
+	netErr := net.OpError{
+		Op:   "accept",
+		Net:  "socks6",
+		Addr: t.bind,
+	}
+	t.lock.Lock()
+	used := t.used
+	t.lock.Unlock()
+	if used {
+		netErr.Err = net.ErrClosed
+		return nil, &netErr
 	}
 
-	// quic enabled
-	if t.qch != nil {
-		conn, ok := <-t.qch
-		if !ok {
-			return nil, &net.OpError{}
-		}
+	oprep, conn, err := t.waitIncoming(ctx)
+	if err != nil {
+		netErr.Err = err
+		return nil, &netErr
+	}
+	// backlogged
+	if conn != nil {
 		return conn, nil
 	}
 
 	t.lock.Lock()
-
-	unlock := common.NewCancellableDefer(func() {
-		t.lock.Unlock()
-	})
-	defer unlock.Defer()
-
-	// read oprep2
-	oprep, err := message.ParseOperationReplyFrom(t.netConn)
-	if err != nil {
-		return nil, err
+	defer t.lock.Unlock()
+	select {
+	case <-t.closed:
+		// control connection is closed
+		netErr.Err = t.err
+		return nil, &netErr
+	default:
+	}
+	if t.used {
+		netErr.Err = net.ErrClosed
+		return nil, &netErr
+	}
+	if oprep.ReplyCode != message.OperationReplySuccess {
+		netErr.Err = convertReplyError(oprep.ReplyCode)
+		return nil, &netErr
 	}
-	cconn := ProxyTCPConn{
+	t.used = true
+	return &ProxyTCPConn{
+		netConn: t.netConn,
 		addrPair: addrPair{
 			local:  t.bind,
 			remote: oprep.Endpoint,
 		},
-	}
-	if t.backlog == 0 {
-		t.used = true
-		cconn.netConn = t.netConn
-		return &cconn, nil
-	} else {
-		// unlock asap, BindRequest is time consuming
-		unlock.Cancel()
+		stackOpt: t.stackOpt,
+		replyOpt: t.replyOpt,
+		meter:    t.client.newTrafficMeter(message.CommandBind, oprep.Endpoint),
+	}, nil
+}
+
+// waitIncoming wait for operation reply of incoming connection, or accepted connection when backlogged
+func (t *ProxyTCPListener) waitIncoming(ctx context.Context) (*message.OperationReply, net.Conn, error) {
+	for {
+		t.lock.Lock()
+		deadline := t.deadline
+		changed := t.deadlineChanged
 		t.lock.Unlock()
 
-		subListener, err := t.client.BindRequest(ctx, t.bind, t.op)
-		if err != nil {
-			return nil, err
+		// incoming connections are accepted by refillLoop when backlogged
+		incoming := t.incoming
+		if t.backlog > 0 {
+			incoming = nil
+		}
+		var timeout <-chan time.Time
+		stop := func() bool { return false }
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return nil, nil, os.ErrDeadlineExceeded
+			}
+			timer := time.NewTimer(d)
+			timeout = timer.C
+			stop = timer.Stop
+		}
+
+		select {
+		case oprep := <-incoming:
+			stop()
+			return oprep, nil, nil
+		case conn := <-t.ready:
+			stop()
+			return nil, conn, nil
+		case <-t.closed:
+			stop()
+			return nil, nil, t.err
+		case <-ctx.Done():
+			stop()
+			return nil, nil, ctx.Err()
+		case <-timeout:
+			return nil, nil, os.ErrDeadlineExceeded
+		case <-changed:
+			stop()
 		}
-		return subListener.AcceptContext(ctx)
 	}
 }
 
+// SetDeadline set deadline of Accept, zero value means no deadline
+func (t *ProxyTCPListener) SetDeadline(d time.Time) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.deadline = d
+	close(t.deadlineChanged)
+	t.deadlineChanged = make(chan struct{})
+	return nil
+}
+
 // [localaddr]----netConn----[[proxyremoteaddr][addr]]<--
 
 func (t *ProxyTCPListener) Addr() net.Addr {
@@ -94,6 +260,40 @@ func (t *ProxyTCPListener) ProxyRemoteAddr() net.Addr {
 	return t.netConn.RemoteAddr()
 }
 
+// ProxyBindAddr return address bound by proxy, same as Addr
+func (t *ProxyTCPListener) ProxyBindAddr() net.Addr {
+	return t.bind
+}
+
+// StackOptions return proxy-remote leg stack options applied by proxy
+func (t *ProxyTCPListener) StackOptions() message.StackOptionInfo {
+	return t.stackOpt
+}
+
+// ReplyOptions return all options in proxy's operation reply
+func (t *ProxyTCPListener) ReplyOptions() *message.OptionSet {
+	return t.replyOpt
+}
+
+// Close stop accepting, pending Accept calls return error.
+// Proxy close the backlogged listener, connections already accepted are not affected.
 func (t *ProxyTCPListener) Close() error {
-	return t.netConn.Close()
+	t.closeWithError(net.ErrClosed)
+	return nil
+}
+
+func (t *ProxyTCPListener) closeWithError(err error) {
+	t.closeOnce.Do(func() {
+		t.lock.Lock()
+		t.err = err
+		close(t.closed)
+		// control connection become accepted connection
+		if !t.used {
+			t.netConn.Close()
+		}
+		t.lock.Unlock()
+		if t.mux && t.backlog > 0 {
+			t.client.setMuxBind(t.sid, nil)
+		}
+	})
 }
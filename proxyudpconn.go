@@ -2,10 +2,13 @@ package socks6
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"math/rand"
 	"net"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -16,31 +19,52 @@ import (
 	"github.com/studentmain/socks6/message"
 )
 
+// udpReconnectTimeout limit time used to resume association after connection lost
+const udpReconnectTimeout = 10 * time.Second
+
 // ProxyUDPConn represents a SOCKS 6 UDP client "connection", implements net.PacketConn, net.Conn
 type ProxyUDPConn struct {
+	connMtx    sync.RWMutex // protect origConn and dataConn, they are replaced when association is resumed
 	origConn   net.Conn     // original tcp conn
 	dataConn   nt.SeqPacket // data conn
+	gen        uint32       // increased when connections are replaced
+	fbGen      uint32       // generation created by falling back to stream, see fallbackToStream
+	reconnMtx  sync.Mutex
+	closed     uint32
 	overTcp    bool
 	expectAddr net.Addr // expected remote addr
 	icmp       bool     // accept icmp error report
 
+	onError func(*UDPError)                   // called when error report received, optional
+	udpErr  common.SyncMap[string, *UDPError] // error report not returned by WriteTo yet, by destination
+
 	assocId uint64
 
 	parseLock sync.Mutex // needn't write lock, write message is finished in 1 write, but read message is in many read
 	rbind     net.Addr   // remote bind addr
+	reserved  net.Addr   // adjacent port reserved by proxy
 
 	acked   bool
 	ackwg   sync.WaitGroup
 	lastErr error // todo actually use lastErr ?
 
-	c Client
+	reasm        *udpReassembler
+	fragmentSize int    // fragment outgoing datagram longer than it, 0 to disable
+	fragmentID   uint32 // next fragment id, only lower 16 bits are used
+	maxPayload   int    // max payload size accepted by proxy, 0 means no limit
+	noSession    bool   // created without session, can't be resumed
+	stackOpt     message.StackOptionInfo
+	replyOpt     *message.OptionSet // options in proxy's operation reply
+	meter        *trafficMeter
+
+	c *Client
 }
 
-// init setup association
-func (u *ProxyUDPConn) init() error {
+// init setup association on connections, then use them for association
+func (u *ProxyUDPConn) init(orig net.Conn, data nt.SeqPacket) error {
 	// read assoc init
 	// assoc init is always from orig conn
-	a, err := message.ParseUDPMessageFrom(u.origConn)
+	a, err := u.c.parseConfig().ParseUDPMessageFrom(orig)
 	if err != nil {
 		return err
 	}
@@ -52,12 +76,18 @@ func (u *ProxyUDPConn) init() error {
 	// set client quic mux filter if necessary
 	if !u.overTcp && u.c.QUIC {
 		msp := &muxSeqPacket{
-			SeqPacket: u.dataConn,
+			SeqPacket: data,
 			ch:        make(chan nt.Datagram, 64),
 		}
-		u.dataConn = msp
+		data = msp
 		u.c.qudpconn.Store(u.assocId, msp)
 	}
+	u.connMtx.Lock()
+	u.origConn = orig
+	u.dataConn = data
+	gen := atomic.AddUint32(&u.gen, 1)
+	u.acked = false
+	u.connMtx.Unlock()
 
 	// needn't wait for ACK before read data
 	// only server can send data (not true when using raw UDP, but why you use it?)
@@ -65,12 +95,116 @@ func (u *ProxyUDPConn) init() error {
 	// ack is send over tcp:
 	// 1. won't lost
 	// 2. can be slower than data over udp
-	go u.rexmitFirstPacket()
-	u.readAck()
+	go u.rexmitFirstPacket(data, gen)
+	u.readAck(orig, gen)
+	if !u.overTcp && !u.c.QUIC && u.c.UDPFallbackTimeout > 0 {
+		go func() {
+			<-time.After(u.c.UDPFallbackTimeout)
+			u.fallbackToStream(gen)
+		}()
+	}
+	return nil
+}
+
+// fallbackToStream send datagram over control connection instead, when association of generation gen
+// is not acknowledged yet. Proxy establish association on the connection which send first datagram
+func (u *ProxyUDPConn) fallbackToStream(gen uint32) {
+	u.connMtx.Lock()
+	if u.acked || u.gen != gen || atomic.LoadUint32(&u.closed) != 0 {
+		u.connMtx.Unlock()
+		return
+	}
+	lg.Info("udp association not acknowledged, fallback to stream", u.assocId)
+	old := u.dataConn
+	u.overTcp = true
+	u.dataConn = nt.WrapNetConnUDP(u.origConn)
+	atomic.StoreUint32(&u.fbGen, atomic.AddUint32(&u.gen, 1))
+	data := u.dataConn
+	u.connMtx.Unlock()
+	// interrupt pending operations on datagram connection, they are retried on stream
+	old.Close()
+
+	msg := message.NewUDPDatagram(u.assocId, message.AddrIPv4Zero, []byte{})
+	msg.Profile = u.c.Profile
+	if err := data.Reply(msg.Marshal()); err != nil {
+		u.connLost(gen+1, err)
+	}
+}
+
+// fellBack check whether connections of generation gen are replaced by fallbackToStream
+func (u *ProxyUDPConn) fellBack(gen uint32) bool {
+	return atomic.LoadUint32(&u.fbGen) == gen+1
+}
+
+// conns return connections currently used and their generation
+func (u *ProxyUDPConn) conns() (net.Conn, nt.SeqPacket, uint32) {
+	u.connMtx.RLock()
+	defer u.connMtx.RUnlock()
+	return u.origConn, u.dataConn, u.gen
+}
+
+// reconnect resume association from a new connection, when connections of generation gen are lost.
+// It's noop when they are already replaced.
+func (u *ProxyUDPConn) reconnect(gen uint32) error {
+	u.reconnMtx.Lock()
+	defer u.reconnMtx.Unlock()
+	if atomic.LoadUint32(&u.gen) != gen {
+		return nil
+	}
+	if atomic.LoadUint32(&u.closed) != 0 {
+		return net.ErrClosed
+	}
+	if !u.c.AutoReconnect || !u.c.UseSession || u.noSession {
+		return errors.New("reconnect disabled")
+	}
+	lg.Info("udp association connection lost, resuming", u.assocId)
+
+	ctx, cancel := context.WithTimeout(context.Background(), udpReconnectTimeout)
+	defer cancel()
+	opset := message.NewOptionSet()
+	opset.Add(message.Option{
+		Kind: message.OptionKindUDPAssociationResume,
+		Data: message.UDPAssociationResumeOptionData{AssociationID: u.assocId},
+	})
+	sconn, dconn, _, err := u.c.udpAssociate(ctx, nil, opset)
+	if err != nil {
+		lg.Warning("can't resume udp association", u.assocId, err)
+		return err
+	}
+	id := u.assocId
+	oldOrig, oldData, _ := u.conns()
+	stopWatch := watchContext(ctx, sconn)
+	err = u.init(sconn, dconn)
+	if cerr := stopWatch(); cerr != nil {
+		err = cerr
+	}
+	if err == nil && u.assocId != id {
+		err = ErrAssociationMismatch
+	}
+	if err != nil {
+		sconn.Close()
+		dconn.Close()
+		return err
+	}
+	oldOrig.Close()
+	oldData.Close()
+	// closed during reconnect
+	if atomic.LoadUint32(&u.closed) != 0 {
+		u.Close()
+		return net.ErrClosed
+	}
 	return nil
 }
 
-func (u *ProxyUDPConn) rexmitFirstPacket() {
+// connLost reconnect when connections of generation gen are lost, close association when it's impossible
+func (u *ProxyUDPConn) connLost(gen uint32, err error) {
+	if u.reconnect(gen) != nil {
+		u.lastErr = err
+		u.Close()
+	}
+}
+
+func (u *ProxyUDPConn) rexmitFirstPacket(data nt.SeqPacket, gen uint32) {
 	<-time.After(5 * time.Second)
 
 	// it's possible to have a "smart fallback"
@@ -81,27 +215,22 @@ func (u *ProxyUDPConn) rexmitFirstPacket() {
 		// randomized timeout to somehow mitigate it
 		ms := time.Duration(rand.Intn(5000)+5000) * time.Millisecond
 		<-time.After(ms)
-		if u.acked {
+		if u.acked || atomic.LoadUint32(&u.gen) != gen {
 			break
 		}
 
-		msg := message.UDPMessage{
-			Type:          message.UDPMessageDatagram,
-			AssociationID: u.assocId,
-			Endpoint:      message.AddrIPv4Zero,
-			Data:          []byte{},
-		}
-		err := u.dataConn.Reply(msg.Marshal())
+		msg := message.NewUDPDatagram(u.assocId, message.AddrIPv4Zero, []byte{})
+		msg.Profile = u.c.Profile
+		err := data.Reply(msg.Marshal())
 		if err != nil {
-			u.lastErr = err
-			u.Close()
+			u.connLost(gen, err)
 			return
 		}
 	}
 	u.lastErr = errors.New("timeout")
 }
 
-func (u *ProxyUDPConn) readAck() {
+func (u *ProxyUDPConn) readAck(orig net.Conn, gen uint32) {
 	// block TCP read
 	// lock when init
 	u.parseLock.Lock()
@@ -110,7 +239,7 @@ func (u *ProxyUDPConn) readAck() {
 		// to avoid goroutine shedule cause lock delayed
 		defer u.parseLock.Unlock()
 
-		ack, err := message.ParseUDPMessageFrom(u.origConn)
+		ack, err := u.c.parseConfig().ParseUDPMessageFrom(orig)
 		failed := true
 		if err != nil {
 			u.lastErr = err
@@ -124,7 +253,9 @@ func (u *ProxyUDPConn) readAck() {
 		u.acked = true
 
 		if failed {
-			u.Close()
+			if atomic.LoadUint32(&u.gen) == gen {
+				u.Close()
+			}
 			return
 		}
 
@@ -133,10 +264,9 @@ func (u *ProxyUDPConn) readAck() {
 			go func() {
 				buf := make([]byte, 256)
 				for {
-					_, err := u.origConn.Read(buf)
+					_, err := orig.Read(buf)
 					if err != nil {
-						u.lastErr = err
-						u.Close()
+						u.connLost(gen, err)
 						return
 					}
 				}
@@ -177,49 +307,48 @@ func (u *ProxyUDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
 		Source: u.LocalAddr(),
 		Addr:   u.ProxyRemoteAddr(),
 	}
-	// read message
-	h := message.UDPMessage{}
-	if u.overTcp {
-		u.parseLock.Lock()
-		defer u.parseLock.Unlock()
-
-		// here, orig conn is data conn without seqpacket wrapper
-		// only read need to operate with stream
-		h2, err := message.ParseUDPMessageFrom(u.origConn)
-		h = *h2
+	// read message, until a complete datagram is received
+	var h *message.UDPMessage
+	for h == nil {
+		_, _, gen := u.conns()
+		h2, err := u.readMessage()
 		if err != nil {
+			if u.fellBack(gen) {
+				continue
+			}
+			if u.reconnect(gen) == nil {
+				cd.Cancel()
+				err = ErrAssociationReconnected
+			}
 			netErr.Err = err
 			return 0, nil, &netErr
 		}
-	} else {
-		// good old "UDP packet size" problem
-		// also cause some radar "reflection" (UDP is known for it's low RCS, so not a big problem)
-		// UDP allow 64k, path MTU usually not, but IP fragmentation exist, but IP fragmentation bad
-		buf := internal.BytesPool4k.Rent()
-		defer internal.BytesPool4k.Return(buf)
-
-		d, err := u.dataConn.NextDatagram()
-		if err != nil {
-			netErr.Err = err
+		// silently drop to avoid DoS? is it possible or necessary (it's only possible in plaintext)?
+		if h2.AssociationID != u.assocId {
+			netErr.Err = ErrAssociationMismatch
 			return 0, nil, &netErr
 		}
-		h2, err := message.ParseUDPMessageFrom(bytes.NewReader(d.Data()))
-		h = *h2
-		if err != nil {
-			netErr.Err = err
-			return 0, nil, err
+		if h2.Type == message.UDPMessageFragment {
+			h = u.reasm.add(h2)
+		} else {
+			h = h2
+		}
+		if h == nil || h.Type != message.UDPMessageError {
+			continue
+		}
+		// like UDP socket, error report won't close connection,
+		// connected socket return it, otherwise it's returned by next WriteTo to same destination
+		ue := u.errorReport(h)
+		if ue != nil && u.expectAddr != nil && ue.Endpoint.String() == message.ConvertAddr(u.expectAddr).String() {
+			u.udpErr.Delete(ue.Endpoint.String())
+			cd.Cancel()
+			netErr.Err = ue
+			return 0, nil, &netErr
 		}
+		h = nil
 	}
 
-	// silently drop to avoid DoS? is it possible or necessary (it's only possible in plaintext)?
-	if h.AssociationID != u.assocId {
-		netErr.Err = ErrAssociationMismatch
-		return 0, nil, &netErr
-	}
-	if h.Type == message.UDPMessageError && u.icmp {
-		netErr.Err = convertIcmpError(h)
-		return 0, nil, &netErr
-	} else if h.Type != message.UDPMessageDatagram {
+	if h.Type != message.UDPMessageDatagram {
 		netErr.Err = ErrUnexpectedMessage
 		return 0, nil, &netErr
 	}
@@ -241,9 +370,33 @@ func (u *ProxyUDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
 	}
 
 	cd.Cancel()
+	u.meter.addReceivedDatagram(n)
 	return n, addr, nil
 }
 
+// readMessage read a UDP message from data conn
+func (u *ProxyUDPConn) readMessage() (*message.UDPMessage, error) {
+	if u.overTcp {
+		u.parseLock.Lock()
+		defer u.parseLock.Unlock()
+
+		// here, orig conn is data conn without seqpacket wrapper
+		// only read need to operate with stream
+		orig, _, _ := u.conns()
+		return u.c.parseConfig().ParseUDPMessageFrom(orig)
+	}
+	// good old "UDP packet size" problem
+	// also cause some radar "reflection" (UDP is known for it's low RCS, so not a big problem)
+	// UDP allow 64k, path MTU usually not, but IP fragmentation exist, but IP fragmentation bad
+	// fragment message to avoid it
+	_, data, _ := u.conns()
+	d, err := data.NextDatagram()
+	if err != nil {
+		return nil, err
+	}
+	return u.c.parseConfig().ParseUDPMessageFrom(bytes.NewReader(d.Data()))
+}
+
 // Write implements net.Conn
 func (u *ProxyUDPConn) Write(p []byte) (int, error) {
 	if u.expectAddr == nil {
@@ -270,26 +423,104 @@ func (u *ProxyUDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
 		return 0, &netErr
 	}
 
-	h := message.UDPMessage{
-		Type:          message.UDPMessageDatagram,
-		AssociationID: u.assocId,
-		Endpoint:      message.ConvertAddr(addr),
-		Data:          p,
+	h := message.NewUDPDatagram(u.assocId, message.ConvertAddr(addr), p)
+	h.Profile = u.c.Profile
+	if u.maxPayload > 0 && len(p) > u.maxPayload {
+		netErr.Err = syscall.EMSGSIZE
+		return 0, &netErr
 	}
-
-	err := u.dataConn.Reply(h.Marshal())
-	if err != nil {
-		netErr.Err = err
-		u.Close()
+	// report error caused by previous datagram
+	if ue, ok := u.udpErr.Load(h.Endpoint.String()); ok {
+		u.udpErr.Delete(h.Endpoint.String())
+		netErr.Err = ue
 		return 0, &netErr
 	}
+	msgs := []*message.UDPMessage{h}
+	if u.fragmentSize > 0 && !u.overTcp {
+		frags, err := h.Fragment(u.nextFragmentID(), u.fragmentSize)
+		if err != nil {
+			netErr.Err = err
+			return 0, &netErr
+		}
+		msgs = frags
+	}
+
+	buf := internal.BytesPool64k.Rent()
+	defer internal.BytesPool64k.Return(buf)
+	_, data, gen := u.conns()
+	for i := 0; i < len(msgs); i++ {
+		err := data.Reply(msgs[i].AppendTo(buf[:0]))
+		if err != nil {
+			if u.fellBack(gen) {
+				// send from interrupted message
+				_, data, gen = u.conns()
+				i--
+				continue
+			}
+			if u.reconnect(gen) == nil {
+				netErr.Err = ErrAssociationReconnected
+				return 0, &netErr
+			}
+			netErr.Err = err
+			u.Close()
+			return 0, &netErr
+		}
+	}
+	u.meter.addSentDatagram(len(p))
 	return len(p), nil
 }
 
+// nextFragmentID allocate a fragment id, WriteTo can be called concurrently
+func (u *ProxyUDPConn) nextFragmentID() uint16 {
+	return uint16(atomic.AddUint32(&u.fragmentID, 1))
+}
+
+// JoinGroup ask proxy to join multicast group on interface with address ifaddr, nil ifaddr means default interface.
+// Result isn't reported, add the option to UDPAssociateRequest when confirmation is needed.
+func (u *ProxyUDPConn) JoinGroup(group net.IP, ifaddr net.IP) error {
+	return u.setStackOption(message.StackOptionUDPMulticastJoin, message.NewMulticastGroupOptionData(group, ifaddr))
+}
+
+// LeaveGroup ask proxy to leave multicast group joined by JoinGroup
+func (u *ProxyUDPConn) LeaveGroup(group net.IP, ifaddr net.IP) error {
+	return u.setStackOption(message.StackOptionUDPMulticastLeave, message.NewMulticastGroupOptionData(group, ifaddr))
+}
+
+// SetMulticastInterface ask proxy to send multicast datagram via interface with address ifaddr
+func (u *ProxyUDPConn) SetMulticastInterface(ifaddr net.IP) error {
+	a, _ := netip.AddrFromSlice(ifaddr)
+	return u.setStackOption(message.StackOptionUDPMulticastInterface, a.Unmap())
+}
+
+// setStackOption send a stack option message via original connection
+func (u *ProxyUDPConn) setStackOption(id int, data interface{}) error {
+	ops := message.NewOptionSet()
+	ops.AddMany(message.StackOptionInfo{id: data}.GetOptions(false, true))
+	h := message.NewUDPStackOption(u.assocId, ops)
+	h.Profile = u.c.Profile
+	orig, _, _ := u.conns()
+	if _, err := orig.Write(h.Marshal()); err != nil {
+		return &net.OpError{
+			Op:     "setsockopt",
+			Net:    "socks6",
+			Source: u.LocalAddr(),
+			Addr:   u.ProxyRemoteAddr(),
+			Err:    err,
+		}
+	}
+	return nil
+}
+
 func (u *ProxyUDPConn) Close() error {
+	atomic.StoreUint32(&u.closed, 1)
 	u.acked = true
-	e1 := u.origConn.Close()
-	e2 := u.dataConn.Close()
+	orig, data, _ := u.conns()
+	e1 := orig.Close()
+	e2 := data.Close()
+	if _, ok := data.(*muxSeqPacket); ok {
+		u.c.qudpconn.Delete(u.assocId)
+	}
+	u.meter.closed()
 	if e1 != nil {
 		return e1
 	}
@@ -298,31 +529,118 @@ func (u *ProxyUDPConn) Close() error {
 
 // LocalAddr return client-proxy connection's client side address
 func (u *ProxyUDPConn) LocalAddr() net.Addr {
-	return u.dataConn.LocalAddr()
+	_, data, _ := u.conns()
+	return data.LocalAddr()
 }
 
 func (u *ProxyUDPConn) RemoteAddr() net.Addr {
 	return u.expectAddr
 }
 
+// AssociationID return association's id, which is used to resume association from another connection
+func (u *ProxyUDPConn) AssociationID() uint64 {
+	return u.assocId
+}
+
+// StackOptions return proxy-remote leg stack options applied by proxy
+func (u *ProxyUDPConn) StackOptions() message.StackOptionInfo {
+	return u.stackOpt
+}
+
+// Stats return traffic counters of the association, datagrams interrupted by reconnection are not counted
+func (u *ProxyUDPConn) Stats() ConnStats {
+	return u.meter.stats()
+}
+
+// ReplyOptions return all options in proxy's operation reply
+func (u *ProxyUDPConn) ReplyOptions() *message.OptionSet {
+	return u.replyOpt
+}
+
+// MaxPayload return max datagram payload size accepted by proxy, 0 means no limit
+func (u *ProxyUDPConn) MaxPayload() int {
+	return u.maxPayload
+}
+
 // ProxyBindAddr return proxy's outbound address
 func (u *ProxyUDPConn) ProxyBindAddr() net.Addr {
 	return u.rbind
 }
 
+// ReservedAddr return proxy's port reserved for follow-up association, nil if nothing is reserved.
+// Pass it to UDPAssociateRequest to use it.
+func (u *ProxyUDPConn) ReservedAddr() net.Addr {
+	return u.reserved
+}
+
 // ProxyRemoteAddr return client-proxy connection's proxy side address
 func (u *ProxyUDPConn) ProxyRemoteAddr() net.Addr {
-	return u.dataConn.RemoteAddr()
+	_, data, _ := u.conns()
+	return data.RemoteAddr()
 }
 
+// deadlines are not kept after association is resumed
+
 func (u *ProxyUDPConn) SetDeadline(t time.Time) error {
-	return u.dataConn.SetDeadline(t)
+	_, data, _ := u.conns()
+	return data.SetDeadline(t)
 }
 func (u *ProxyUDPConn) SetReadDeadline(t time.Time) error {
-	return u.dataConn.SetReadDeadline(t)
+	_, data, _ := u.conns()
+	return data.SetReadDeadline(t)
 }
 func (u *ProxyUDPConn) SetWriteDeadline(t time.Time) error {
-	return u.dataConn.SetWriteDeadline(t)
+	_, data, _ := u.conns()
+	return data.SetWriteDeadline(t)
+}
+
+// errorReport convert error report to UDPError, notify error handler and remember it for WriteTo,
+// nil when error report is not requested
+func (u *ProxyUDPConn) errorReport(h *message.UDPMessage) *UDPError {
+	if !u.icmp || h.Endpoint == nil {
+		return nil
+	}
+	ue := &UDPError{
+		Code:     h.ErrorCode,
+		Endpoint: h.Endpoint,
+		Err:      convertIcmpError(*h),
+	}
+	if h.ErrorEndpoint != nil {
+		ue.Reporter = h.ErrorEndpoint
+	}
+	u.udpErr.Store(h.Endpoint.String(), ue)
+	if u.onError != nil {
+		u.onError(ue)
+	}
+	return ue
+}
+
+// UDPError is an error report relayed by proxy, e.g. ICMP destination unreachable, implements net.Error
+type UDPError struct {
+	Code     message.UDPErrorType
+	Endpoint net.Addr // destination of datagram which caused error
+	Reporter net.Addr // host reported the error, can be nil
+	Err      error    // corresponding system error, e.g. syscall.EHOSTUNREACH
+}
+
+func (e *UDPError) Error() string {
+	s := "udp error to " + e.Endpoint.String()
+	if e.Reporter != nil {
+		s += " reported by " + e.Reporter.String()
+	}
+	return s + ": " + e.Err.Error()
+}
+
+func (e *UDPError) Unwrap() error {
+	return e.Err
+}
+
+func (e *UDPError) Timeout() bool {
+	return false
+}
+
+func (e *UDPError) Temporary() bool {
+	return true
 }
 
 func convertIcmpError(msg message.UDPMessage) error {
@@ -334,8 +652,7 @@ func convertIcmpError(msg message.UDPMessage) error {
 	case message.UDPErrorTTLExpired:
 		return ErrTTLExpired
 	case message.UDPErrorDatagramTooBig:
-		return syscall.E2BIG
+		return syscall.EMSGSIZE
 	}
-	lg.Panic("not implemented icmp error conversion")
-	return nil
+	return ErrUnexpectedMessage
 }
@@ -0,0 +1,74 @@
+package socks6
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/studentmain/socks6/message"
+)
+
+// RetryPolicy retry CONNECT requests failed with transient reply code, with exponential backoff.
+// Retries are bounded by request's context.
+type RetryPolicy struct {
+	// max retries after first attempt
+	MaxRetries int
+	// delay before first retry, doubled after each retry, 100ms when it's 0
+	Backoff time.Duration
+	// max delay between retries, 5s when it's 0
+	MaxBackoff time.Duration
+	// reply codes considered transient, Timeout and NetworkUnreachable when it's empty
+	ReplyCodes []message.ReplyCode
+}
+
+var defaultRetryReplyCodes = []message.ReplyCode{
+	message.OperationReplyTimeout,
+	message.OperationReplyNetworkUnreachable,
+}
+
+// retryable check whether request failed with err can be retried, after n retries
+func (r *RetryPolicy) retryable(err error, n int) bool {
+	if r == nil || n >= r.MaxRetries {
+		return false
+	}
+	re := &ReplyError{}
+	if !errors.As(err, &re) {
+		return false
+	}
+	codes := r.ReplyCodes
+	if len(codes) == 0 {
+		codes = defaultRetryReplyCodes
+	}
+	for _, c := range codes {
+		if c == re.Code {
+			return true
+		}
+	}
+	return false
+}
+
+// wait sleep before retry n, return false when ctx is done
+func (r *RetryPolicy) wait(ctx context.Context, n int) bool {
+	d := r.Backoff
+	if d == 0 {
+		d = 100 * time.Millisecond
+	}
+	limit := r.MaxBackoff
+	if limit == 0 {
+		limit = 5 * time.Second
+	}
+	for i := 0; i < n && d < limit; i++ {
+		d *= 2
+	}
+	if d > limit {
+		d = limit
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
+	"net/http"
+	"os"
+	"sync"
 
 	"github.com/lucas-clemente/quic-go"
 	"github.com/pion/dtls/v2"
@@ -13,18 +16,61 @@ import (
 	"github.com/studentmain/socks6/common/lg"
 	"github.com/studentmain/socks6/common/nt"
 	"github.com/studentmain/socks6/internal"
+	"github.com/studentmain/socks6/internal/socket"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/net/icmp"
 )
 
-// Server is a SOCKS 6 over TCP/TLS/UDP/DTLS server
+// Server is a SOCKS 6 over TCP/TLS/UDP/DTLS/QUIC/SCTP server
 // zero value is a cleartext only server with default server worker
 type Server struct {
 	Address       string
 	CleartextPort uint16
 	EncryptedPort uint16
+	// QUICPort is UDP port of SOCKS 6 over QUIC, each stream carry a request and datagrams carry UDP messages.
+	// Require TlsConfig or CertificateSource, QUIC is disabled when it's 0
+	QUICPort uint16
+	// HTTPPort is TCP port of cleartext HTTP server accept SOCKS 6 over WebSocket and HTTP/1.1 Upgrade,
+	// usually behind a CDN or reverse proxy which terminate TLS. HTTP is disabled when it's 0
+	HTTPPort uint16
+	// UnixSocket is path of unix socket listener for local clients, e.g. authenticated by auth.PeerCredServerAuthenticationMethod,
+	// stale socket file is removed. Unix socket is disabled when it's empty
+	UnixSocket string
+	// SCTP listen SCTP on cleartext port, each association carry UDP messages as SCTP messages like DTLS.
+	// Only supported on linux with SCTP enabled kernel
+	SCTP bool
+	// ICMPListenIPv4 and ICMPListenIPv6 are local addresses of raw ICMP sockets used when a worker enable ICMP,
+	// nil means wildcard address. Windows doesn't deliver ICMP to wildcard socket, default address is guessed instead.
+	// When raw socket can't be opened, ICMP errors are read from UDP sockets on linux, otherwise ICMP is disabled
+	ICMPListenIPv4 net.IP
+	ICMPListenIPv6 net.IP
+	// ListenOption is socket options of TCP, TLS, HTTP and UDP listener, e.g. SO_REUSEPORT for multi-process scaling
+	ListenOption ListenOption
+	// Transport wrap connections accepted by TCP and TLS listener, e.g. obfuscation, nil to disable.
+	// TLS handshake is done over wrapped connection
+	Transport Transport
 
+	// TlsConfig is used by TLS and QUIC listener, e.g. for certificates, ALPN and client certificate verification
 	TlsConfig *tls.Config
-	Worker    *ServerWorker
+	// CertificateSource provide TLS and QUIC listener's certificate on each handshake, e.g. reload from files or obtain by ACME,
+	// TlsConfig's certificates are not used when it's set. DTLS listener doesn't support it and use certificates in TlsConfig
+	CertificateSource CertificateSource
+	// FallbackHandler serve TLS connection negotiated an ALPN protocol other than SOCKS 6, e.g. "h2" and "http/1.1",
+	// so encrypted port looks like a normal HTTPS server. Connection without ALPN is served as SOCKS 6.
+	// TlsConfig's NextProtos is "socks6", "h2" and "http/1.1" when it's empty. nil means all connections are SOCKS 6
+	FallbackHandler func(ctx context.Context, conn net.Conn)
+	// DatagramTLSConfig is used by DTLS listener, e.g. for PSK, cipher suites and MTU,
+	// when nil, it's converted from TlsConfig
+	DatagramTLSConfig *dtls.Config
+	Worker            *ServerWorker
+	// per listener workers, e.g. cleartext listener require authentication while encrypted one verify client certificate,
+	// Worker is used when nil. Stream and datagram listeners of same port share a worker, so UDP association works
+	CleartextWorker *ServerWorker // TCP, UDP and SCTP listener
+	EncryptedWorker *ServerWorker // TLS and DTLS listener
+	QUICWorker      *ServerWorker
+	HTTPWorker      *ServerWorker
+	UnixWorker      *ServerWorker
 
 	// listeners
 
@@ -34,74 +80,253 @@ type Server struct {
 	dtls  net.Listener
 	icmp4 net.PacketConn
 	icmp6 net.PacketConn
-	quic  quic.Listener
+	quic  quic.EarlyListener
+	http  net.Listener
+	sctp  net.Listener
+	unix  net.Listener
 
 	listeners []canClose
+
+	cancel   context.CancelFunc
+	done     chan struct{}
+	doneOnce sync.Once
+	errMtx   sync.Mutex
+	err      error
 }
 
+// ListenOption is socket options of listener, e.g. SO_REUSEPORT, TCP keepalive and TCP_DEFER_ACCEPT
+type ListenOption = socket.ListenOption
+
 type canClose interface {
 	Close() error
 }
 
-func (s *Server) Start(ctx context.Context) {
+// Start start listeners in background, server is stopped by Stop, cancelling ctx or a listener failure.
+// When a listener can't be created, server is stopped and the error is returned, it's reported by Err too
+func (s *Server) Start(ctx context.Context) error {
 	lg.Info("start SOCKS 6 listener")
 	if s.Worker == nil {
 		s.Worker = NewServerWorker()
 	}
 	s.listeners = []canClose{}
+	ctx, s.cancel = context.WithCancel(ctx)
+	done := s.doneChan()
 
-	if s.CleartextPort == 0 && s.EncryptedPort == 0 {
+	err := s.startListeners(ctx)
+	if err != nil {
+		lg.Error("can't start listener", err)
+		s.setErr(err)
+		s.cancel()
+	} else {
+		for _, w := range s.workers() {
+			go w.ClearUnusedResource(ctx)
+		}
+	}
+	go func() {
+		<-ctx.Done()
+		lg.Info("closing all listeners")
+		for _, v := range s.listeners {
+			err := v.Close()
+			if err != nil {
+				lg.Warning("error when close listener", err)
+			}
+		}
+		for _, w := range s.workers() {
+			w.Shutdown()
+		}
+		close(done)
+	}()
+	return err
+}
+
+// startListeners start enabled listeners, stop at first listener which can't be created
+func (s *Server) startListeners(ctx context.Context) error {
+	if s.CleartextPort == 0 && s.EncryptedPort == 0 && s.QUICPort == 0 && s.HTTPPort == 0 && s.UnixSocket == "" {
 		s.CleartextPort = common.CleartextPort
 		s.EncryptedPort = common.EncryptedPort
 	}
 
 	if s.CleartextPort != 0 {
 		cleartextEndpoint := net.JoinHostPort(s.Address, fmt.Sprintf("%d", s.CleartextPort))
-		s.startTCP(ctx, cleartextEndpoint)
-		s.startUDP(ctx, cleartextEndpoint)
+		if err := s.startTCP(ctx, cleartextEndpoint); err != nil {
+			return err
+		}
+		if err := s.startUDP(ctx, cleartextEndpoint); err != nil {
+			return err
+		}
+		if s.SCTP {
+			s.startSCTP(ctx, cleartextEndpoint)
+		}
 	}
 
-	if s.EncryptedPort != 0 && s.TlsConfig != nil {
+	tlsConfig := s.tlsConfig()
+	if s.EncryptedPort != 0 && (tlsConfig != nil || s.DatagramTLSConfig != nil) {
 		encryptedEndpoint := net.JoinHostPort(s.Address, fmt.Sprintf("%d", s.EncryptedPort))
-		s.startTLS(ctx, encryptedEndpoint)
-		s.startDTLS(ctx, encryptedEndpoint)
+		if tlsConfig != nil {
+			if err := s.startTLS(ctx, encryptedEndpoint, s.streamTLSConfig(tlsConfig)); err != nil {
+				return err
+			}
+		}
+		if dtlsConfig := s.datagramTLSConfig(); dtlsConfig != nil {
+			if err := s.startDTLS(ctx, encryptedEndpoint, dtlsConfig); err != nil {
+				return err
+			}
+		} else {
+			lg.Info("DTLS server disabled, no certificate in TlsConfig")
+		}
+	}
+
+	if s.QUICPort != 0 && tlsConfig != nil {
+		if err := s.startQUIC(ctx, net.JoinHostPort(s.Address, fmt.Sprintf("%d", s.QUICPort)), tlsConfig); err != nil {
+			return err
+		}
 	}
 
-	if s.Worker.EnableICMP {
+	if s.HTTPPort != 0 {
+		if err := s.startHTTP(ctx, net.JoinHostPort(s.Address, fmt.Sprintf("%d", s.HTTPPort))); err != nil {
+			return err
+		}
+	}
+
+	if s.UnixSocket != "" {
+		if err := s.startUnix(ctx, s.UnixSocket); err != nil {
+			return err
+		}
+	}
+
+	if lo.SomeBy(s.workers(), func(w *ServerWorker) bool { return w.EnableICMP }) {
 		s.startICMP(ctx)
 	}
-	go s.Worker.ClearUnusedResource(ctx)
+	return nil
+}
+
+// Stop close all listeners and shutdown workers, then wait until server is stopped,
+// return first fatal error like Err
+func (s *Server) Stop() error {
+	if s.cancel == nil {
+		return nil
+	}
+	s.cancel()
+	<-s.done
+	return s.Err()
+}
+
+// Done return a channel which is closed after server is stopped, it can be waited before Start
+func (s *Server) Done() <-chan struct{} {
+	return s.doneChan()
+}
+
+func (s *Server) doneChan() chan struct{} {
+	s.doneOnce.Do(func() {
+		s.done = make(chan struct{})
+	})
+	return s.done
+}
+
+// Err return first fatal error which stopped server, i.e. a listener failed,
+// nil when server is running or stopped normally
+func (s *Server) Err() error {
+	s.errMtx.Lock()
+	defer s.errMtx.Unlock()
+	return s.err
+}
+
+// stopListener handle error which stopped a listener, it's fatal and stop server unless server is stopping
+func (s *Server) stopListener(ctx context.Context, name string, err error) {
+	if ctx.Err() != nil {
+		lg.Info("stop", name, "server")
+		return
+	}
+	lg.Error("stop", name, "server", err)
+	s.setErr(fmt.Errorf("%s server: %w", name, err))
+	s.cancel()
+}
+
+// setErr record err as fatal error when it's the first one
+func (s *Server) setErr(err error) {
+	s.errMtx.Lock()
+	defer s.errMtx.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *Server) startTCP(ctx context.Context, addr string) error {
+	l, err := socket.Listen(ctx, "tcp", addr, s.ListenOption)
+	if err != nil {
+		return fmt.Errorf("TCP server: %w", err)
+	}
+	s.tcp = l
+	if s.Transport != nil {
+		s.tcp = s.Transport.WrapListener(s.tcp)
+	}
+	lg.Infof("start TCP server at %s", s.tcp.Addr())
+	s.listeners = append(s.listeners, s.tcp)
 	go func() {
-		<-ctx.Done()
-		lg.Info("closing all listeners")
-		for _, v := range s.listeners {
-			err := v.Close()
+		for {
+			conn, err := s.tcp.Accept()
 			if err != nil {
-				lg.Warning("error when close listener", err)
+				s.stopListener(ctx, "TCP", err)
+				return
 			}
+			go s.listenerWorker(s.CleartextWorker).ServeStream(ctx, conn)
 		}
 	}()
+	return nil
 }
 
-func (s *Server) startTCP(ctx context.Context, addr string) {
-	addr2 := lo.Must1(net.ResolveTCPAddr("tcp", addr))
-	s.tcp = lo.Must1(net.ListenTCP("tcp", addr2))
-	lg.Infof("start TCP server at %s", s.tcp.Addr())
-	s.listeners = append(s.listeners, s.tcp)
+func (s *Server) startUnix(ctx context.Context, path string) error {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("unix socket server: %w", err)
+	}
+	s.unix = l
+	lg.Infof("start unix socket server at %s", s.unix.Addr())
+	s.listeners = append(s.listeners, s.unix)
 	go func() {
 		for {
-			conn, err := s.tcp.Accept()
+			conn, err := s.unix.Accept()
 			if err != nil {
-				lg.Error("stop TCP server", err)
+				s.stopListener(ctx, "unix socket", err)
 				return
 			}
-			go s.Worker.ServeStream(ctx, conn)
+			go s.listenerWorker(s.UnixWorker).ServeStream(ctx, conn)
 		}
 	}()
+	return nil
+}
+
+// listenerWorker return worker of a listener, which is w or Worker when w is nil
+func (s *Server) listenerWorker(w *ServerWorker) *ServerWorker {
+	if w != nil {
+		return w
+	}
+	return s.Worker
+}
+
+// workers return distinct workers used by listeners
+func (s *Server) workers() []*ServerWorker {
+	return lo.Uniq([]*ServerWorker{
+		s.listenerWorker(s.CleartextWorker),
+		s.listenerWorker(s.EncryptedWorker),
+		s.listenerWorker(s.QUICWorker),
+		s.listenerWorker(s.HTTPWorker),
+		s.listenerWorker(s.UnixWorker),
+	})
 }
 
-func (s *Server) startTLS(ctx context.Context, addr string) {
-	s.tls = lo.Must1(tls.Listen("tcp", addr, s.TlsConfig))
+func (s *Server) startTLS(ctx context.Context, addr string, conf *tls.Config) error {
+	l, err := socket.Listen(ctx, "tcp", addr, s.ListenOption)
+	if err != nil {
+		return fmt.Errorf("TLS server: %w", err)
+	}
+	if s.Transport != nil {
+		l = s.Transport.WrapListener(l)
+	}
+	s.tls = tls.NewListener(l, conf)
 	lg.Infof("start TLS server at %s", s.tls.Addr())
 	s.listeners = append(s.listeners, s.tls)
 
@@ -109,35 +334,110 @@ func (s *Server) startTLS(ctx context.Context, addr string) {
 		for {
 			conn, err := s.tls.Accept()
 			if err != nil {
-				lg.Error("stop TLS server", err)
+				s.stopListener(ctx, "TLS", err)
 				return
 			}
-			go s.Worker.ServeStream(ctx, conn)
+			go s.serveTLS(ctx, conn)
 		}
 	}()
+	return nil
+}
+
+// streamTLSConfig return TLS config of TLS listener,
+// which can negotiate fallback protocols and answer ACME TLS-ALPN-01 challenge
+func (s *Server) streamTLSConfig(conf *tls.Config) *tls.Config {
+	conf = conf.Clone()
+	if s.FallbackHandler != nil && len(conf.NextProtos) == 0 {
+		conf.NextProtos = []string{common.TLSProtocol, "h2", "http/1.1"}
+	}
+	if _, ok := s.CertificateSource.(*autocert.Manager); ok {
+		conf.NextProtos = append(conf.NextProtos, acme.ALPNProto)
+	}
+	return conf
 }
 
-func (s *Server) startUDP(ctx context.Context, addr string) {
-	addr2 := lo.Must1(net.ResolveUDPAddr("udp", addr))
-	s.udp = lo.Must1(net.ListenUDP("udp", addr2))
+// serveTLS route TLS connection by ALPN protocol when FallbackHandler is set
+func (s *Server) serveTLS(ctx context.Context, conn net.Conn) {
+	worker := s.listenerWorker(s.EncryptedWorker)
+	tc, ok := conn.(*tls.Conn)
+	if s.FallbackHandler == nil || !ok {
+		worker.ServeStream(ctx, conn)
+		return
+	}
+	hctx := ctx
+	if worker.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		hctx, cancel = context.WithTimeout(ctx, worker.RequestTimeout)
+		defer cancel()
+	}
+	if err := tc.HandshakeContext(hctx); err != nil {
+		lg.Debug(conn3Tuple(conn), "TLS handshake failed", err)
+		conn.Close()
+		return
+	}
+	switch p := tc.ConnectionState().NegotiatedProtocol; p {
+	case "", common.TLSProtocol:
+		worker.ServeStream(ctx, conn)
+	case acme.ALPNProto:
+		// challenge is answered during handshake
+		conn.Close()
+	default:
+		lg.Debug(conn3Tuple(conn), "fallback protocol", p)
+		s.FallbackHandler(ctx, conn)
+	}
+}
+
+func (s *Server) startHTTP(ctx context.Context, addr string) error {
+	l, err := socket.Listen(ctx, "tcp", addr, s.ListenOption)
+	if err != nil {
+		return fmt.Errorf("HTTP server: %w", err)
+	}
+	s.http = l
+	lg.Infof("start HTTP server at %s", s.http.Addr())
+	s.listeners = append(s.listeners, s.http)
+
+	hs := http.Server{
+		Handler: s.listenerWorker(s.HTTPWorker).HTTPHandler(),
+		BaseContext: func(l net.Listener) context.Context {
+			return ctx
+		},
+	}
+	go func() {
+		err := hs.Serve(s.http)
+		s.stopListener(ctx, "HTTP", err)
+	}()
+	return nil
+}
+
+func (s *Server) startUDP(ctx context.Context, addr string) error {
+	pc, err := socket.ListenPacket(ctx, "udp", addr, s.ListenOption)
+	if err != nil {
+		return fmt.Errorf("UDP server: %w", err)
+	}
+	s.udp = pc
 	lg.Infof("start UDP server at %s", s.udp.LocalAddr())
 	s.listeners = append(s.listeners, s.udp)
 
 	go func() {
 		defer s.udp.Close()
-		buf := internal.BytesPool4k.Rent()
-		defer internal.BytesPool4k.Return(buf)
 
 		for {
-			dgram, err := nt.ReadUDPDatagram(s.udp)
+			// buffer is returned after datagram is processed
+			buf := internal.BytesPool4k.Rent()
+			dgram, err := nt.ReadUDPDatagramTo(s.udp, buf)
 			if err != nil {
-				lg.Error("stop UDP server", err)
+				internal.BytesPool4k.Return(buf)
+				s.stopListener(ctx, "UDP", err)
 				return
 			}
 
-			go s.Worker.ServeDatagram(ctx, dgram)
+			go func() {
+				defer internal.BytesPool4k.Return(buf)
+				s.listenerWorker(s.CleartextWorker).ServeDatagram(ctx, dgram)
+			}()
 		}
 	}()
+	return nil
 }
 
 func createDTLSConfig(t tls.Config) dtls.Config {
@@ -168,10 +468,29 @@ func createDTLSConfig(t tls.Config) dtls.Config {
 	}
 }
 
-func (s *Server) startDTLS(ctx context.Context, addr string) {
-	addr2 := lo.Must1(net.ResolveUDPAddr("udp", addr))
-	dtlsConfig := createDTLSConfig(*s.TlsConfig)
-	s.dtls = lo.Must1(dtls.Listen("udp", addr2, &dtlsConfig))
+// datagramTLSConfig return DTLS config converted from TlsConfig when DatagramTLSConfig is nil,
+// nil when there is no certificate to convert
+func (s *Server) datagramTLSConfig() *dtls.Config {
+	if s.DatagramTLSConfig != nil {
+		return s.DatagramTLSConfig
+	}
+	if s.TlsConfig == nil || (s.CertificateSource != nil && len(s.TlsConfig.Certificates) == 0) {
+		return nil
+	}
+	c := createDTLSConfig(*s.TlsConfig)
+	return &c
+}
+
+func (s *Server) startDTLS(ctx context.Context, addr string, dtlsConfig *dtls.Config) error {
+	addr2, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return fmt.Errorf("DTLS server: %w", err)
+	}
+	l, err := dtls.Listen("udp", addr2, dtlsConfig)
+	if err != nil {
+		return fmt.Errorf("DTLS server: %w", err)
+	}
+	s.dtls = l
 	lg.Infof("start DTLS server at %s", s.dtls.Addr())
 	s.listeners = append(s.listeners, s.dtls)
 
@@ -179,7 +498,7 @@ func (s *Server) startDTLS(ctx context.Context, addr string) {
 		for {
 			conn, err := s.dtls.Accept()
 			if err != nil {
-				lg.Error("stop DTLS server", err)
+				s.stopListener(ctx, "DTLS", err)
 				return
 			}
 			go func() {
@@ -188,41 +507,80 @@ func (s *Server) startDTLS(ctx context.Context, addr string) {
 				buf := internal.BytesPool4k.Rent()
 				defer internal.BytesPool4k.Return(buf)
 				ds := nt.WrapNetConnUDP(conn)
-				s.Worker.ServeSeqPacket(ctx, ds)
+				s.listenerWorker(s.EncryptedWorker).ServeSeqPacket(ctx, ds)
+			}()
+		}
+	}()
+	return nil
+}
+
+func (s *Server) startSCTP(ctx context.Context, addr string) {
+	l, err := socket.ListenSCTP(addr)
+	if err != nil {
+		lg.Warning("SCTP server disabled", err)
+		return
+	}
+	s.sctp = l
+	lg.Infof("start SCTP server at %s", s.sctp.Addr())
+	s.listeners = append(s.listeners, s.sctp)
+
+	go func() {
+		for {
+			conn, err := s.sctp.Accept()
+			if err != nil {
+				s.stopListener(ctx, "SCTP", err)
+				return
+			}
+			go func() {
+				defer conn.Close()
+				s.listenerWorker(s.CleartextWorker).ServeSeqPacket(ctx, nt.WrapSCTPConn(conn))
 			}()
 		}
 	}()
 }
 
-func (s *Server) startQUIC(ctx context.Context, addr string) {
-	s.quic = lo.Must1(quic.ListenAddr(addr, s.TlsConfig, &quic.Config{}))
+func (s *Server) startQUIC(ctx context.Context, addr string, conf *tls.Config) error {
+	// accept 0-RTT data when client resume TLS session
+	l, err := quic.ListenAddrEarly(addr, quicTLSConfig(conf), &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		return fmt.Errorf("QUIC server: %w", err)
+	}
+	s.quic = l
 	lg.Infof("start QUIC server at %s", s.quic.Addr())
 	s.listeners = append(s.listeners, s.quic)
 	go func() {
 		for {
 			conn, err := s.quic.Accept(ctx)
 			if err != nil {
-				lg.Error("stop QUIC server", err)
+				s.stopListener(ctx, "QUIC", err)
 				return
 			}
 			qmc := nt.WrapQUICConn(conn)
-			go s.Worker.ServeMuxConn(ctx, qmc)
+			go s.listenerWorker(s.QUICWorker).ServeMuxConn(ctx, qmc)
 		}
 	}()
+	return nil
+}
+
+// quicTLSConfig return a copy of TLS config with SOCKS 6 ALPN protocol ID when it's unset
+func quicTLSConfig(t *tls.Config) *tls.Config {
+	conf := t.Clone()
+	if len(conf.NextProtos) == 0 {
+		conf.NextProtos = []string{common.QUICProtocol}
+	}
+	return conf
 }
 
 func (s *Server) startICMP(ctx context.Context) {
-	i4, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	i4, err := s.listenICMP(4)
 	if err != nil {
-		s.Worker.EnableICMP = false
-		lg.Warning("can't listen ICMPv4 packet", err)
+		s.fallbackICMP("can't listen ICMPv4 packet", err)
 		return
 	}
-	i6, err := icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	i6, err := s.listenICMP(6)
 	if err != nil {
 		i4.Close()
-		s.Worker.EnableICMP = false
-		lg.Warning("can't listen ICMPv6 packet", err)
+		s.fallbackICMP("can't listen ICMPv6 packet", err)
 		return
 	}
 	s.icmp4 = i4
@@ -230,6 +588,7 @@ func (s *Server) startICMP(ctx context.Context) {
 	s.listeners = append(s.listeners, s.icmp4)
 	s.listeners = append(s.listeners, s.icmp6)
 
+	var fallback sync.Once
 	fn := func(c net.PacketConn, ipv int) {
 		b := internal.BytesPool4k.Rent()
 		defer internal.BytesPool4k.Return(b)
@@ -244,7 +603,16 @@ func (s *Server) startICMP(ctx context.Context) {
 		for {
 			n, addr, err := c.ReadFrom(b)
 			if err != nil {
-				lg.Error(err)
+				if ctx.Err() != nil {
+					lg.Info("stop ICMP listener")
+					return
+				}
+				// ICMP forwarding is optional, keep server running without raw socket
+				fallback.Do(func() {
+					s.icmp4.Close()
+					s.icmp6.Close()
+					s.fallbackICMP("can't read ICMP packet", err)
+				})
 				return
 			}
 			msg, err := icmp.ParseMessage(protov, b[:n])
@@ -257,9 +625,50 @@ func (s *Server) startICMP(ctx context.Context) {
 				lg.Warning("ICMP ReadFrom returned a non IP address")
 				continue
 			}
-			go s.Worker.ForwardICMP(ctx, msg, ip, ipv)
+			// association is looked up in each worker
+			for _, w := range s.workers() {
+				if w.EnableICMP {
+					go w.ForwardICMP(ctx, msg, ip, ipv)
+				}
+			}
 		}
 	}
 	go fn(s.icmp4, 4)
 	go fn(s.icmp6, 6)
 }
+
+// listenICMP open raw ICMP socket of IP version ver
+func (s *Server) listenICMP(ver int) (*icmp.PacketConn, error) {
+	if ver == 4 {
+		addr, err := icmpListenAddress(4, s.ICMPListenIPv4)
+		if err != nil {
+			return nil, err
+		}
+		return icmp.ListenPacket("ip4:icmp", addr)
+	}
+	addr, err := icmpListenAddress(6, s.ICMPListenIPv6)
+	if err != nil {
+		return nil, err
+	}
+	return icmp.ListenPacket("ip6:ipv6-icmp", addr)
+}
+
+// fallbackICMP use per association socket error queue when raw ICMP socket is not available,
+// disable ICMP forwarding if it's not supported either
+func (s *Server) fallbackICMP(msg string, err error) {
+	if socket.IsPermissionError(err) {
+		lg.Warning(msg, "raw socket require root or CAP_NET_RAW (administrator on windows)", err)
+	} else {
+		lg.Warning(msg, err)
+	}
+	for _, w := range s.workers() {
+		if !socket.RecvErrSupported {
+			w.EnableICMP = false
+		} else if w.EnableICMP {
+			w.icmpRecvErr = true
+		}
+	}
+	if socket.RecvErrSupported {
+		lg.Info("ICMP forwarding fallback to socket error queue")
+	}
+}
@@ -1,13 +1,13 @@
 package socks6
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/studentmain/socks6/auth"
@@ -26,6 +26,18 @@ type CommandHandler func(
 
 // todo socket like api?
 
+// UDPFilteringMode control which remote datagram is forwarded to client, see RFC 4787
+type UDPFilteringMode int
+
+const (
+	// UDPFilteringEndpointIndependent forward datagram from any remote (Full Cone)
+	UDPFilteringEndpointIndependent UDPFilteringMode = iota
+	// UDPFilteringAddressDependent forward datagram from address client sent to (Restricted Cone)
+	UDPFilteringAddressDependent
+	// UDPFilteringAddressAndPortDependent forward datagram from address and port client sent to (Port Restricted Cone)
+	UDPFilteringAddressAndPortDependent
+)
+
 // ServerWorker is a customizeable SOCKS 6 server
 type ServerWorker struct {
 	Authenticator auth.ServerAuthenticator
@@ -47,6 +59,10 @@ type ServerWorker struct {
 	//
 	// when true, use Address Dependent filtering (Restricted Cone)
 	AddressDependentFiltering bool
+	// UDPFiltering select filtering mode, stricter one of it and AddressDependentFiltering is used
+	UDPFiltering UDPFilteringMode
+	// UDPFilteringPolicy select filtering mode per association, override worker's mode when not nil
+	UDPFilteringPolicy func(cc SocksConn) UDPFilteringMode
 
 	// require request message fully received in first packet
 	//
@@ -58,9 +74,91 @@ type ServerWorker struct {
 	IgnoreFragmentedRequest bool
 	EnableICMP              bool
 
+	// EnableMultiplex allow session client to multiplex requests over one connection,
+	// client request it by NOOP with Multiplex option
+	EnableMultiplex bool
+	// MultiplexFunc create multiplexed connection over connection requested multiplex,
+	// e.g. yamux server session wrapped by nt.WrapStreamSession, or smux server session wrapped by nt.WrapTypedStreamSession.
+	// Client must use same multiplexer.
+	// nil means nt.NewStreamMux
+	MultiplexFunc func(conn net.Conn) (nt.MultiplexedConn, error)
+
+	// MaxUDPAssociationPerClient limit simultaneous UDP associations held by one session or client, 0 means unlimited
+	MaxUDPAssociationPerClient int
+	// MaxReservedUDPPortPerClient limit port reserved by one session or client, 0 means unlimited
+	MaxReservedUDPPortPerClient int
+
+	// UDPFragmentSize is max UDP message size sent to client over datagram channel,
+	// longer datagram is fragmented. 0 disable fragmentation, client must support it when enabled.
+	// Fragment is a non-standard experimental message type, only understood by this implementation
+	UDPFragmentSize int
+
+	// UDPMaxPayload is max datagram payload size accepted from client, client may request a smaller one.
+	// Oversized datagram is dropped and reported as DatagramTooBig when UDP error is enabled. 0 means no limit
+	UDPMaxPayload int
+
+	// UDPRateLimit limit traffic of each UDP association, excess datagram is dropped. Zero value means no limit
+	UDPRateLimit UDPRateLimit
+	// UDPRateLimitPerClient limit total traffic of UDP associations held by one session or client
+	UDPRateLimitPerClient UDPRateLimit
+
+	// EnableUDPOffload use UDP GSO/GRO on association socket to reduce per packet cost, linux only
+	EnableUDPOffload bool
+
+	// UDPResumeTimeout is how long UDP association of a session is kept after its control connection lost,
+	// client can re-attach it from a new connection of same session in the meantime. 0 disable resume
+	UDPResumeTimeout time.Duration
+
+	// DestinationGuard refuse CONNECT and UDP traffic to internal network, nil means no restriction
+	DestinationGuard *DestinationGuard
+
+	// ReplyCodeMapper convert error returned by Outbound to operation reply code,
+	// return false to fallback to default conversion
+	ReplyCodeMapper func(err error) (message.ReplyCode, bool)
+
+	// BindPolicy restrict local address and port used by BIND and UDP ASSOCIATE,
+	// nil means client can use any address
+	BindPolicy *BindPolicy
+
+	// ParseConfig control how request and UDP message from client are parsed and limit their size,
+	// nil means lenient without extra limit
+	ParseConfig *message.ParseConfig
+	// Padding round auth and operation replies up to multiple of Padding bytes with padding options,
+	// hide their actual size from observer. 0 disable padding
+	Padding int
+
+	// RequestTimeout is how long to wait for a complete request, slow or half-open client is disconnected after it.
+	// 0 means no limit, NewServerWorker set it to 30 seconds
+	RequestTimeout time.Duration
+	// HandshakeTimeout is how long a stream connection can take from accept to operation reply,
+	// including request, initial data, authentication and command specific process before reply, e.g. connecting remote.
+	// Laggard connection is closed after it. 0 means no limit, RequestTimeout still applies
+	HandshakeTimeout time.Duration
+
+	// AcceptLimit limit new stream connections by source IP and pending handshakes, zero value means no limit
+	AcceptLimit AcceptLimit
+
+	// RelayPrivateOptions attach options in private range of client request to context passed to Outbound,
+	// see WithRequestOptions, so an Outbound relaying via Client forward them to next proxy unchanged
+	RelayPrivateOptions bool
+
 	backlogWorker   common.SyncMap[string, *backlogBindWorker] // map[string]*bl
 	reservedUdpAddr common.SyncMap[string, uint64]             // map[string]uint64
+	udpQuotaMtx     sync.Mutex                                 // protect udpQuota
+	udpQuota        map[string]*udpQuotaUsage                  // owner -> associations and reserved ports held
 	udpAssociation  common.SyncMap[uint64, *udpAssociation]    // map[uint64]*ua
+	udpAssocByAddr  common.SyncMap[string, uint64]             // association's local address -> id, used by ICMP dispatch
+
+	udpAssocIDMtx      sync.Mutex                              // serialize association id allocation and removal
+	udpAssocQuarantine common.SyncMap[uint64, time.Time]       // removed association id -> time it can be reused
+	udpOwnerLimiter    common.SyncMap[string, *udpRateLimiter] // association owner -> rate limiter shared by its associations
+	captures           common.SyncMap[string, *PcapWriter]     // owner -> capture of its traffic
+
+	acceptLimiter    common.SyncMap[string, *acceptRateLimiter] // source IP -> connection rate limiter
+	acceptBan        common.SyncMap[string, time.Time]          // source IP -> time ban expires
+	pendingHandshake int32                                      // stream connections haven't finished handshake
+
+	icmpRecvErr bool // raw ICMP socket unavailable, read ICMP error from UDP socket
 }
 
 // ServerOutbound is a group of function called by ServerWorker when a connection or listener is needed to fullfill client request
@@ -70,25 +168,178 @@ type ServerOutbound interface {
 	ListenPacket(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.PacketConn, message.StackOptionInfo, error)
 }
 
+// InitialDataDialer is an optional interface for ServerOutbound,
+// which send client's initial data during connection establishment, e.g. as TFO payload
+type InitialDataDialer interface {
+	// DialWithInitialData works like Dial, data must be written to remote when returned connection is usable
+	DialWithInitialData(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr, data []byte) (net.Conn, message.StackOptionInfo, error)
+}
+
 // InternetServerOutbound implements ServerOutbound, create a internet connection/listener
 type InternetServerOutbound struct {
 	DefaultIPv4        net.IP         // address used when udp association request didn't provide an address
 	DefaultIPv6        net.IP         // address used when udp association request didn't provide an address
 	MulticastInterface *net.Interface // address
+
+	// DualStackUDP bind UDP association requested unspecified address to a dual-stack wildcard socket,
+	// so it can relay to both IPv4 and IPv6 destinations, DefaultIPv4 and DefaultIPv6 are not used.
+	// Fallback to IPv4 wildcard when IPv6 is unavailable.
+	DualStackUDP bool
+
+	// Transparent make outbound connection originate from client's address (TPROXY),
+	// so destination see the real client address instead of proxy's address.
+	//
+	// Only works on linux, require CAP_NET_ADMIN and policy routing which deliver reply to proxy.
+	Transparent bool
+
+	// Hosts pin domain name to address, it's consulted before DNS.
+	// Key is lower case domain name in punycode encoded format.
+	Hosts map[string]net.IP
+
+	// ListenOption is socket options of BIND listeners, e.g. keepalive of accepted connections
+	ListenOption ListenOption
+
+	// UDPPortMin and UDPPortMax restrict local port used by UDP association (inclusive),
+	// 0 means no limit on that side
+	UDPPortMin uint16
+	UDPPortMax uint16
+
+	// LinkLocalZone is IPv6 zone (interface name) applied to link-local destination,
+	// SOCKS 6 wireformat can't carry zone so such destination is unreachable without it
+	LinkLocalZone string
+
+	// ProxyProtocol select requested destinations which receive a PROXY protocol v2 header before any data of CONNECT,
+	// the header carry SOCKS client's address, so upstream service behind it can see original client. nil means none
+	ProxyProtocol func(addr *message.SocksAddr) bool
+}
+
+// useProxyProtocol check whether PROXY protocol header should be sent to addr
+func (i InternetServerOutbound) useProxyProtocol(addr *message.SocksAddr) bool {
+	return i.ProxyProtocol != nil && i.ProxyProtocol(addr)
+}
+
+// udpPortPolicy return policy enforce UDP port range, nil when not limited
+func (i InternetServerOutbound) udpPortPolicy() *BindPolicy {
+	if i.UDPPortMin == 0 && i.UDPPortMax == 0 {
+		return nil
+	}
+	return &BindPolicy{MinPort: i.UDPPortMin, MaxPort: i.UDPPortMax}
+}
+
+// udpPortAllowed check whether port is in UDP port range
+func (i InternetServerOutbound) udpPortAllowed(port uint16) bool {
+	p := i.udpPortPolicy()
+	if p == nil {
+		return true
+	}
+	min, max := p.portRange()
+	return port >= min && port <= max
+}
+
+// lookupHosts replace domain name in addr with address pinned in Hosts
+func (i InternetServerOutbound) lookupHosts(addr *message.SocksAddr) *message.SocksAddr {
+	if addr.AddressType != message.AddressTypeDomainName || len(i.Hosts) == 0 {
+		return addr
+	}
+	name := strings.TrimSuffix(strings.ToLower(string(addr.Address)), ".")
+	ip, ok := i.Hosts[name]
+	if !ok {
+		return addr
+	}
+	return message.ConvertAddr(&net.TCPAddr{IP: ip, Port: int(addr.Port)})
+}
+
+// resolveAddr apply Hosts and LinkLocalZone to addr
+func (i InternetServerOutbound) resolveAddr(addr *message.SocksAddr) *message.SocksAddr {
+	addr = i.lookupHosts(addr)
+	if i.LinkLocalZone == "" || addr.AddressType != message.AddressTypeIPv6 || addr.Zone != "" {
+		return addr
+	}
+	ip := net.IP(addr.Address)
+	if !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() {
+		return addr
+	}
+	zoned := *addr
+	zoned.Zone = i.LinkLocalZone
+	return &zoned
+}
+
+// checkInternetAddr reject address types registered by message.RegisterAddressType, they are not reachable on Internet
+func checkInternetAddr(addr *message.SocksAddr) error {
+	if addr.AddressType.IsCustom() {
+		return message.ErrAddressTypeNotSupport.WithVerbose("address type %d needs a custom outbound", addr.AddressType)
+	}
+	return nil
 }
 
 func (i InternetServerOutbound) Dial(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.Conn, message.StackOptionInfo, error) {
-	return socket.DialWithOption(ctx, *addr, option)
+	if err := checkInternetAddr(addr); err != nil {
+		return nil, nil, err
+	}
+	header := i.useProxyProtocol(addr)
+	addr = i.resolveAddr(addr)
+	return i.dial(ctx, option, addr, header, nil)
+}
+
+// dial connect to resolved addr, then write PROXY protocol header when requested and data
+func (i InternetServerOutbound) dial(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr, header bool, data []byte) (net.Conn, message.StackOptionInfo, error) {
+	var conn net.Conn
+	var applied message.StackOptionInfo
+	var err error
+	src := ClientAddrFromContext(ctx)
+	check := DestinationCheckFromContext(ctx)
+	if i.Transparent && src != nil {
+		conn, applied, err = socket.DialTransparentWithOption(ctx, src, *addr, option, check)
+	} else {
+		conn, applied, err = socket.DialWithOption(ctx, *addr, option, check)
+	}
+	if err != nil {
+		return nil, applied, err
+	}
+	if header {
+		data = append(proxyProtocolHeader(src, conn.RemoteAddr()), data...)
+	}
+	if len(data) == 0 {
+		return conn, applied, nil
+	}
+	if _, err := conn.Write(data); err != nil {
+		conn.Close()
+		return nil, applied, err
+	}
+	return conn, applied, nil
+}
+func (i InternetServerOutbound) DialWithInitialData(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr, data []byte) (net.Conn, message.StackOptionInfo, error) {
+	if err := checkInternetAddr(addr); err != nil {
+		return nil, nil, err
+	}
+	header := i.useProxyProtocol(addr)
+	addr = i.resolveAddr(addr)
+	// header is written after connection established, TFO is not used
+	if (i.Transparent && ClientAddrFromContext(ctx) != nil) || header {
+		return i.dial(ctx, option, addr, header, data)
+	}
+	return socket.DialWithInitialData(ctx, *addr, option, data, DestinationCheckFromContext(ctx))
 }
 func (i InternetServerOutbound) Listen(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.Listener, message.StackOptionInfo, error) {
-	return socket.ListenerWithOption(ctx, *addr, option)
+	if err := checkInternetAddr(addr); err != nil {
+		return nil, nil, err
+	}
+	addr = i.resolveAddr(addr)
+	return socket.ListenerWithOption(ctx, *addr, option, i.ListenOption)
 }
 func (i InternetServerOutbound) ListenPacket(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.PacketConn, message.StackOptionInfo, error) {
+	if err := checkInternetAddr(addr); err != nil {
+		return nil, nil, err
+	}
+	addr = i.resolveAddr(addr)
 	mcast := false
+	dual := false
 	if addr.AddressType != message.AddressTypeDomainName {
 		ip := net.IP(addr.Address)
 		if ip.IsMulticast() {
 			mcast = true
+		} else if ip.IsUnspecified() && i.DualStackUDP {
+			dual = true
 		} else if ip.IsUnspecified() {
 			if addr.AddressType == message.AddressTypeIPv4 {
 				addr.Address = i.DefaultIPv4
@@ -99,17 +350,29 @@ func (i InternetServerOutbound) ListenPacket(ctx context.Context, option message
 	} else {
 		return nil, nil, message.ErrAddressTypeNotSupport
 	}
-	ua, err := net.ResolveUDPAddr("udp", addr.String())
+	p, _, err := bindWithPolicy(i.udpPortPolicy(), addr,
+		func(addr *message.SocksAddr) (*net.UDPConn, message.StackOptionInfo, error) {
+			ua, err := net.ResolveUDPAddr("udp", addr.String())
+			if err != nil {
+				return nil, nil, err
+			}
+			if mcast {
+				p, err := net.ListenMulticastUDP("udp", i.MulticastInterface, ua)
+				return p, nil, err
+			}
+			if dual && ua.IP.IsUnspecified() {
+				// wildcard without address family is dual-stack
+				p, err := net.ListenUDP("udp", &net.UDPAddr{Port: ua.Port})
+				return p, nil, err
+			}
+			// todo what's going on? why 0.0.0.0 not work?
+			p, err := net.ListenUDP("udp", ua)
+			return p, nil, err
+		})
 	if err != nil {
-		return nil, nil, err
+		return nil, message.StackOptionInfo{}, err
 	}
-	if mcast {
-		p, err2 := net.ListenMulticastUDP("udp", i.MulticastInterface, ua)
-		return p, message.StackOptionInfo{}, err2
-	}
-	// todo what's going on? why 0.0.0.0 not work?
-	p, err := net.ListenUDP("udp", ua)
-	return p, message.StackOptionInfo{}, err
+	return p, socket.SetPacketConnOpt(p, option), nil
 }
 
 // NewServerWorker create a standard SOCKS 6 server
@@ -124,9 +387,20 @@ func NewServerWorker() *ServerWorker {
 			DefaultIPv4: nt.GuessDefaultIPv4(),
 			DefaultIPv6: nt.GuessDefaultIPv6(),
 		},
-		backlogWorker:   common.NewSyncMap[string, *backlogBindWorker](),
-		reservedUdpAddr: common.NewSyncMap[string, uint64](),
-		udpAssociation:  common.NewSyncMap[uint64, *udpAssociation](),
+		DestinationGuard: &DestinationGuard{},
+		RequestTimeout:   30 * time.Second,
+		backlogWorker:    common.NewSyncMap[string, *backlogBindWorker](),
+		reservedUdpAddr:  common.NewSyncMap[string, uint64](),
+		udpQuota:         map[string]*udpQuotaUsage{},
+		udpAssociation:   common.NewSyncMap[uint64, *udpAssociation](),
+		udpAssocByAddr:   common.NewSyncMap[string, uint64](),
+
+		udpAssocQuarantine: common.NewSyncMap[uint64, time.Time](),
+		udpOwnerLimiter:    common.NewSyncMap[string, *udpRateLimiter](),
+		captures:           common.NewSyncMap[string, *PcapWriter](),
+
+		acceptLimiter: common.NewSyncMap[string, *acceptRateLimiter](),
+		acceptBan:     common.NewSyncMap[string, time.Time](),
 	}
 
 	r.CommandHandlers = map[message.CommandCode]CommandHandler{
@@ -190,13 +464,51 @@ func (s *ServerWorker) ServeStream(
 	ctx context.Context,
 	conn net.Conn,
 ) {
+	done, ok := s.admitStream(conn)
+	if !ok {
+		return
+	}
+	replied := s.handshakeTimer(conn)
+	defer replied()
 	cc, cmd, ar := s.handshakeStream(ctx, conn, nil)
+	done()
 	if ar == nil || cc == nil || !ar.Success {
 		conn.Close()
 		return
 	}
+	cc.replied = replied
 	defer s.Authenticator.SessionConnClose(ar.SessionID)
-	s.CommandHandlers[cmd](ctx, *cc)
+	s.CommandHandlers[cmd](s.commandContext(withClientAddr(ctx, conn.RemoteAddr()), cc), *cc)
+}
+
+// handshakeTimer close conn after HandshakeTimeout, returned function stop the timer when operation reply is written
+func (s *ServerWorker) handshakeTimer(conn net.Conn) func() {
+	if s.HandshakeTimeout <= 0 {
+		return func() {}
+	}
+	t := time.AfterFunc(s.HandshakeTimeout, func() {
+		lg.Info(conn3Tuple(conn), "handshake timeout")
+		conn.Close()
+	})
+	return func() { t.Stop() }
+}
+
+// commandContext return context passed to command handler of cc
+func (s *ServerWorker) commandContext(ctx context.Context, cc *SocksConn) context.Context {
+	if !s.RelayPrivateOptions || cc.Request == nil {
+		return ctx
+	}
+	ops := []message.Option{}
+	for _, op := range cc.Request.Options.Private() {
+		// padding is between client and this proxy only
+		if op.Kind != message.OptionKindPadding {
+			ops = append(ops, op)
+		}
+	}
+	if len(ops) > 0 {
+		return WithRequestOptions(ctx, ops...)
+	}
+	return ctx
 }
 
 // handshakeStream process handshake stage,
@@ -214,14 +526,20 @@ func (s *ServerWorker) handshakeStream(
 	ccid := conn3Tuple(conn)
 
 	lg.Trace(ccid, "start processing")
-	// create a wrapper reader if necessary
-	var conn1 io.Reader = conn
+	var req *message.Request
+	var err error
 	if s.IgnoreFragmentedRequest && prevAuth != nil {
 		lg.Debug("ignore fragmented request")
-		conn1 = &nt.NetBufferOnlyReader{Conn: conn}
+		req, err = s.parseConfig().ParseRequestFrom(&nt.NetBufferOnlyReader{Conn: conn})
+	} else {
+		rctx := ctx
+		if s.RequestTimeout > 0 {
+			var cancel context.CancelFunc
+			rctx, cancel = context.WithTimeout(ctx, s.RequestTimeout)
+			defer cancel()
+		}
+		req, err = s.parseConfig().ParseRequestContext(rctx, conn)
 	}
-
-	req, err := message.ParseRequestFrom(conn1)
 	if err != nil {
 		closeConn.Cancel()
 		s.handleRequestError(ctx, conn, err)
@@ -231,8 +549,8 @@ func (s *ServerWorker) handshakeStream(
 	lg.Debugf("%s requested %+v", ccid, req)
 
 	var initData []byte
-	if am, ok := req.Options.GetData(message.OptionKindAuthenticationMethodAdvertisement); ok {
-		initDataLen := int(am.(message.AuthenticationMethodAdvertisementOptionData).InitialDataLength)
+	if am, ok := message.GetTyped[message.AuthenticationMethodAdvertisementOptionData](req.Options, message.OptionKindAuthenticationMethodAdvertisement); ok {
+		initDataLen := int(am.InitialDataLength)
 		initData = make([]byte, initDataLen)
 		if _, err = io.ReadFull(conn, initData); err != nil {
 			lg.Warningf("%s can't read %d bytes initdata: %s", ccid, initDataLen, err)
@@ -254,6 +572,26 @@ func (s *ServerWorker) handshakeStream(
 		lg.Trace(ccid, "authenticate success")
 	} else {
 		lg.Debug("authn skipped")
+		// client still wait for auth reply
+		reply := setAuthMethodInfo(message.AcquireAuthenticationReply(message.AuthenticationReplySuccess), *prevAuth)
+		defer message.ReleaseAuthenticationReply(reply)
+		reply.Profile = req.Profile
+		reply.Pad(s.Padding)
+		if _, err := conn.Write(reply.Marshal()); err != nil {
+			lg.Warning(ccid, "can't write auth reply", err)
+			return nil, 0, nil
+		}
+	}
+
+	// token is spent once, replayed request is rejected by authenticator
+	tokenSpent := false
+	if prevAuth == nil {
+		ops := message.NewOptionSet()
+		ops.AddMany(authResult.AdditionalOptions)
+		tokenSpent = message.GetSessionReply(ops).TokenAccepted
+	}
+	if !s.waitHandshake(ctx, conn, req, tokenSpent) {
+		return nil, 0, nil
 	}
 
 	cc := SocksConn{
@@ -262,15 +600,19 @@ func (s *ServerWorker) handshakeStream(
 		ClientId:    authResult.ClientName,
 		Session:     authResult.SessionID,
 		InitialData: initData,
+		padding:     s.Padding,
 	}
 
-	if sid, ok := req.Options.GetData(message.OptionKindStreamID); ok {
-		sidVal := sid.(message.StreamIDOptionData).ID
-		cc.StreamId = sidVal
+	if sid, ok := message.GetTyped[message.StreamIDOptionData](req.Options, message.OptionKindStreamID); ok {
+		cc.StreamId = sid.ID
 	}
 	if s.Rule != nil && !s.Rule(cc) {
 		lg.Info(ccid, "not allowed by rule")
-		conn.Write(message.NewOperationReplyWithCode(message.OperationReplyNotAllowedByRule).Marshal())
+		rep := message.AcquireOperationReply(message.OperationReplyNotAllowedByRule)
+		defer message.ReleaseOperationReply(rep)
+		rep.Profile = req.Profile
+		rep.Pad(s.Padding)
+		conn.Write(rep.Marshal())
 		return nil, req.CommandCode, authResult
 	}
 
@@ -278,7 +620,11 @@ func (s *ServerWorker) handshakeStream(
 	_, ok := s.CommandHandlers[req.CommandCode]
 	if !ok {
 		lg.Warning(ccid, "command not supported", req.CommandCode)
-		conn.Write(message.NewOperationReplyWithCode(message.OperationReplyCommandNotSupported).Marshal())
+		rep := message.AcquireOperationReply(message.OperationReplyCommandNotSupported)
+		defer message.ReleaseOperationReply(rep)
+		rep.Profile = req.Profile
+		rep.Pad(s.Padding)
+		conn.Write(rep.Marshal())
 		return nil, req.CommandCode, authResult
 	}
 	lg.Trace(ccid, "start command specific process", req.CommandCode)
@@ -288,6 +634,31 @@ func (s *ServerWorker) handshakeStream(
 	return &cc, req.CommandCode, authResult
 }
 
+// waitHandshake block until handshake complete when req is received in 0-RTT data and may be replayed,
+// requests spent a token and NOOP are processed immediately.
+// Return false when ctx is done or connection is closed first, e.g. handshake failed
+func (s *ServerWorker) waitHandshake(ctx context.Context, conn net.Conn, req *message.Request, tokenSpent bool) bool {
+	done, closed, ok := nt.HandshakeDone(conn)
+	if !ok || tokenSpent || req.CommandCode == message.CommandNoop {
+		return true
+	}
+	select {
+	case <-done:
+		return true
+	default:
+	}
+	lg.Debug(conn3Tuple(conn), "request in 0-RTT data, wait for handshake")
+	select {
+	case <-done:
+		return true
+	case <-closed:
+		lg.Debug(conn3Tuple(conn), "connection closed before handshake complete")
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
 func (s *ServerWorker) handleRequestError(
 	ctx context.Context,
 	conn net.Conn,
@@ -307,10 +678,23 @@ func (s *ServerWorker) handleRequestError(
 		conn.Write(message.NewAuthenticationReplyWithType(message.AuthenticationReplyFail).Marshal())
 		conn.Write(message.NewOperationReplyWithCode(message.OperationReplyAddressNotSupported).Marshal())
 		return
-	} else {
+	}
+	pe := &message.ParseError{}
+	if !errors.As(err, &pe) {
 		lg.Warning(conn3Tuple(conn), "can't parse request", err)
 		return
 	}
+	if pe.Offset == 0 && pe.Truncated() {
+		// e.g. port scan, health check
+		lg.Debug(conn3Tuple(conn), "closed before request")
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		lg.Infof("%s request timeout, %d bytes received", conn3Tuple(conn), pe.Offset)
+		return
+	}
+	lg.Warning(conn3Tuple(conn), "can't parse request", err)
+	lg.Debugf("%s consumed request bytes %x", conn3Tuple(conn), pe.Consumed)
 }
 
 func (s *ServerWorker) authn(
@@ -325,7 +709,11 @@ func (s *ServerWorker) authn(
 	if result1.Success {
 		// one stage auth, success
 		auth = *result1
-		reply := setAuthMethodInfo(message.NewAuthenticationReplyWithType(message.AuthenticationReplySuccess), *result1)
+		reply := setAuthMethodInfo(message.AcquireAuthenticationReply(message.AuthenticationReplySuccess), *result1)
+		defer message.ReleaseAuthenticationReply(reply)
+		reply.Options.AddMany(result1.AdditionalOptions)
+		reply.Profile = req.Profile
+		reply.Pad(s.Padding)
 		lg.Debugf("%s authenticate %+v, %+v", ccid, auth, reply)
 		if _, err := conn.Write(reply.Marshal()); err != nil {
 			lg.Warning(ccid, "can't write auth reply", err)
@@ -333,14 +721,22 @@ func (s *ServerWorker) authn(
 		}
 	} else if !result1.Continue {
 		// one stage auth, can't continue
-		reply := message.NewAuthenticationReplyWithType(message.AuthenticationReplyFail)
+		reply := message.AcquireAuthenticationReply(message.AuthenticationReplyFail)
+		defer message.ReleaseAuthenticationReply(reply)
+		// e.g. session invalid and token rejected
+		reply.Options.AddMany(result1.AdditionalOptions)
+		reply.Profile = req.Profile
+		reply.Pad(s.Padding)
 		if _, err := conn.Write(reply.Marshal()); err != nil {
 			lg.Warning(ccid, "can't write reply", err)
 			return nil
 		}
 	} else {
 		// two stage auth
-		reply1 := setAuthMethodInfo(message.NewAuthenticationReplyWithType(message.AuthenticationReplyFail), *result1)
+		reply1 := setAuthMethodInfo(message.AcquireAuthenticationReply(message.AuthenticationReplyFail), *result1)
+		defer message.ReleaseAuthenticationReply(reply1)
+		reply1.Profile = req.Profile
+		reply1.Pad(s.Padding)
 		if _, err := conn.Write(reply1.Marshal()); err != nil {
 			lg.Warning(ccid, "can't write auth reply 1", err)
 			return nil
@@ -351,16 +747,24 @@ func (s *ServerWorker) authn(
 		result2, err := s.Authenticator.ContinueAuthenticate(sac, *req)
 		if err != nil {
 			lg.Warning(ccid, "auth stage 2 error", err)
-			conn.Write(message.NewAuthenticationReplyWithType(message.AuthenticationReplyFail).Marshal())
+			reply := message.AcquireAuthenticationReply(message.AuthenticationReplyFail)
+			defer message.ReleaseAuthenticationReply(reply)
+			reply.Profile = req.Profile
+			reply.Pad(s.Padding)
+			conn.Write(reply.Marshal())
 			return nil
 		}
 		auth = *result2
-		reply := setAuthMethodInfo(message.NewAuthenticationReply(), *result2)
+		reply := setAuthMethodInfo(message.AcquireAuthenticationReply(message.AuthenticationReplyFail), *result2)
+		defer message.ReleaseAuthenticationReply(reply)
+		reply.Options.AddMany(result2.AdditionalOptions)
+		reply.Profile = req.Profile
 		if result2.Success {
 			reply.Type = message.AuthenticationReplySuccess
 		} else {
 			reply.Type = message.AuthenticationReplyFail
 		}
+		reply.Pad(s.Padding)
 		lg.Debugf("%s auth stage 2 done %+v , %+v", ccid, auth, reply)
 		if _, err = conn.Write(reply.Marshal()); err != nil {
 			lg.Warning(ccid, "can't write auth reply 2", err)
@@ -379,7 +783,12 @@ func (s *ServerWorker) ServeSeqPacket(
 		lg.Warning("serve seqpacket first datagram", err)
 		return
 	}
-	assoc, h := s.handleFirstDatagram(ctx, d0)
+	// message is reused for every datagram
+	h := &message.UDPMessage{}
+	assoc := s.handleFirstDatagram(ctx, d0, h)
+	if assoc == nil {
+		return
+	}
 	assoc.handleUdpUp(ctx, socksDatagram{
 		msg:    h,
 		src:    d0.RemoteAddr(),
@@ -392,8 +801,7 @@ func (s *ServerWorker) ServeSeqPacket(
 			lg.Warning("serve seqpacket datagram", err)
 			return
 		}
-		h, err := message.ParseUDPMessageFrom(bytes.NewReader(d.Data()))
-		if err != nil {
+		if err := s.parseConfig().ParseUDPMessageInto(d.Data(), h); err != nil {
 			lg.Warning(err)
 			return
 		}
@@ -409,7 +817,12 @@ func (s *ServerWorker) ServeDatagram(
 	ctx context.Context,
 	dgram nt.Datagram,
 ) {
-	assoc, h := s.handleFirstDatagram(ctx, dgram)
+	h := udpMessagePool.Get().(*message.UDPMessage)
+	defer udpMessagePool.Put(h)
+	assoc := s.handleFirstDatagram(ctx, dgram, h)
+	if assoc == nil {
+		return
+	}
 	assoc.handleUdpUp(ctx, socksDatagram{
 		msg:    h,
 		src:    dgram.RemoteAddr(),
@@ -417,23 +830,25 @@ func (s *ServerWorker) ServeDatagram(
 	})
 }
 
+// handleFirstDatagram parse datagram into h and find its association, nil when not found or expired
 func (s *ServerWorker) handleFirstDatagram(
 	ctx context.Context,
 	dgram nt.Datagram,
-) (*udpAssociation, *message.UDPMessage) {
-	h, err := message.ParseUDPMessageFrom(bytes.NewReader(dgram.Data()))
-	if err != nil {
+	h *message.UDPMessage,
+) *udpAssociation {
+	if err := s.parseConfig().ParseUDPMessageInto(dgram.Data(), h); err != nil {
 		evm := message.ErrVersionMismatch{}
 		if errors.As(err, &evm) && s.DatagramVersionErrorHandler != nil {
 			s.DatagramVersionErrorHandler(ctx, evm, dgram)
 		}
-		return nil, nil
+		return nil
 	}
-	assoc, ok := s.udpAssociation.Load(h.AssociationID)
-	if !ok {
-		return nil, nil
+	assoc, err := s.lookupDatagramAssociation(h.AssociationID)
+	if err != nil {
+		lg.Info(dgram.RemoteAddr(), "datagram rejected, association", h.AssociationID, err)
+		return nil
 	}
-	return assoc, h
+	return assoc
 }
 
 func (s *ServerWorker) ForwardICMP(ctx context.Context, msg *icmp.Message, ip *net.IPAddr, ver int) {
@@ -449,20 +864,60 @@ func (s *ServerWorker) ForwardICMP(ctx context.Context, msg *icmp.Message, ip *n
 	if proto != 17 {
 		return
 	}
-	// todo faster way to find corresponding assoc
-	s.udpAssociation.Range(func(key uint64, value *udpAssociation) bool {
-		ua := value
-		// icmp disabled
-		if !ua.icmpOn {
-			return true
+	mtu := 0
+	if ptb, ok := msg.Body.(*icmp.PacketTooBig); ok {
+		mtu = ptb.MTU
+	}
+	ua, ok := s.lookupUdpAssociationByAddr(ipSrc)
+	// icmp disabled
+	if !ok || !ua.icmpOn {
+		return
+	}
+	if mtu > 0 {
+		ua.pmtu.update(net.IP(ipDst.Address), mtu)
+	}
+	ua.handleIcmpDown(ctx, code, ipSrc, ipDst, reporter)
+}
+
+// indexUdpAssociation make association can be found by its local address
+func (s *ServerWorker) indexUdpAssociation(ua *udpAssociation) {
+	s.udpAssocByAddr.Store(message.ConvertAddr(ua.udp.LocalAddr()).String(), ua.id)
+}
+
+// parseConfig return config used to parse client's message
+func (s *ServerWorker) parseConfig() *message.ParseConfig {
+	if s.ParseConfig == nil {
+		return &message.ParseConfig{}
+	}
+	return s.ParseConfig
+}
+
+// unindexUdpAssociation remove association from local address index,
+// address may already be reused by another association
+func (s *ServerWorker) unindexUdpAssociation(ua *udpAssociation) {
+	key := message.ConvertAddr(ua.udp.LocalAddr()).String()
+	if id, ok := s.udpAssocByAddr.Load(key); ok && id == ua.id {
+		s.udpAssocByAddr.Delete(key)
+	}
+}
+
+// lookupUdpAssociationByAddr find association bound to addr, wildcard address is matched by port
+func (s *ServerWorker) lookupUdpAssociationByAddr(addr *message.SocksAddr) (*udpAssociation, bool) {
+	keys := []string{
+		addr.String(),
+		message.ConvertAddr(&net.UDPAddr{IP: net.IPv4zero, Port: int(addr.Port)}).String(),
+		message.ConvertAddr(&net.UDPAddr{IP: net.IPv6unspecified, Port: int(addr.Port)}).String(),
+	}
+	for _, k := range keys {
+		id, ok := s.udpAssocByAddr.Load(k)
+		if !ok {
+			continue
 		}
-		// not same origin
-		if ua.udp.LocalAddr().String() != ipSrc.String() {
-			return true
+		if ua, ok := s.udpAssociation.Load(id); ok && ua.alive {
+			return ua, true
 		}
-		ua.handleIcmpDown(ctx, code, ipSrc, ipDst, reporter)
-		return true
-	})
+	}
+	return nil, false
 }
 
 func (s *ServerWorker) ServeMuxConn(
@@ -480,7 +935,8 @@ func (s *ServerWorker) ServeMuxConn(
 	}
 	defer s.Authenticator.SessionConnClose(auth0.SessionID)
 	sc0.MuxConn = mux
-	go s.CommandHandlers[cmd0](ctx, *sc0)
+	ctx = withClientAddr(ctx, mux.RemoteAddr())
+	go s.CommandHandlers[cmd0](s.commandContext(ctx, sc0), *sc0)
 
 	if umux, ok := mux.(nt.SeqPacket); ok {
 		go func() {
@@ -502,12 +958,37 @@ func (s *ServerWorker) ServeMuxConn(
 		go func() {
 			// authn skipped
 			sc, cmd, _ := s.handshakeStream(ctx, c, auth0)
+			if sc == nil {
+				return
+			}
 			sc.MuxConn = mux
-			s.CommandHandlers[cmd](ctx, *sc)
+			s.CommandHandlers[cmd](s.commandContext(ctx, sc), *sc)
 		}()
 	}
 }
 
+// udpFiltering return filtering mode used by client's association
+func (s *ServerWorker) udpFiltering(cc SocksConn) UDPFilteringMode {
+	if s.UDPFilteringPolicy != nil {
+		return s.UDPFilteringPolicy(cc)
+	}
+	if s.AddressDependentFiltering && s.UDPFiltering < UDPFilteringAddressDependent {
+		return UDPFilteringAddressDependent
+	}
+	return s.UDPFiltering
+}
+
+// udpPortReservable check whether addr can be reserved as UDP association's pair port
+func (s *ServerWorker) udpPortReservable(addr *message.SocksAddr) bool {
+	if s.BindPolicy != nil && !s.BindPolicy.Allowed(addr) {
+		return false
+	}
+	if o, ok := s.Outbound.(InternetServerOutbound); ok && !o.udpPortAllowed(addr.Port) {
+		return false
+	}
+	return true
+}
+
 // todo request clear resource by resource themselves
 
 // ClearUnusedResource clear no longer used resources (UDP associations, etc.)
@@ -523,25 +1004,46 @@ func (s *ServerWorker) ClearUnusedResource(ctx context.Context) {
 		case <-ctx2.Done():
 			return
 		}
+		s.clearUnusedResource()
+	}
+}
 
-		s.backlogWorker.Range(func(key string, value *backlogBindWorker) bool {
-			bl := value
-			if bl.alive {
-				return true
-			}
-			s.backlogWorker.Delete(key)
+func (s *ServerWorker) clearUnusedResource() {
+	s.backlogWorker.Range(func(key string, value *backlogBindWorker) bool {
+		bl := value
+		if bl.alive {
 			return true
-		})
-		s.udpAssociation.Range(func(key uint64, value *udpAssociation) bool {
-			ua := value
-			if ua.alive {
-				return true
-			}
-			s.udpAssociation.Delete(key)
-			s.reservedUdpAddr.Delete(ua.pair)
+		}
+		s.backlogWorker.Delete(key)
+		return true
+	})
+	s.udpAssociation.Range(func(key uint64, value *udpAssociation) bool {
+		ua := value
+		if ua.alive {
 			return true
-		})
-	}
+		}
+		s.removeUdpAssociation(ua)
+		s.unindexUdpAssociation(ua)
+		s.reservedUdpAddr.Delete(ua.pair)
+		return true
+	})
+	s.expireUdpAssociationQuarantine()
+	s.clearUdpOwnerRateLimiter()
+	s.clearAcceptLimit()
+}
+
+// Shutdown close UDP associations and backlogged BIND listeners, which outlive client's connection.
+// Other connections are closed by cancelling context passed to Serve* methods
+func (s *ServerWorker) Shutdown() {
+	s.backlogWorker.Range(func(key string, value *backlogBindWorker) bool {
+		value.close(ErrServerClosed)
+		return true
+	})
+	s.udpAssociation.Range(func(key uint64, value *udpAssociation) bool {
+		value.exit()
+		return true
+	})
+	s.clearUnusedResource()
 }
 
 func setAuthMethodInfo(arep *message.AuthenticationReply, result auth.ServerAuthenticationResult) *message.AuthenticationReply {
@@ -553,14 +1055,6 @@ func setAuthMethodInfo(arep *message.AuthenticationReply, result auth.ServerAuth
 			},
 		})
 	}
-	if result.MethodData != nil {
-		arep.Options.Add(message.Option{
-			Kind: message.OptionKindAuthenticationData,
-			Data: message.AuthenticationDataOptionData{
-				Method: result.SelectedMethod,
-				Data:   result.MethodData,
-			},
-		})
-	}
+	arep.Options.AddMany(message.NewAuthenticationDataOptions(result.SelectedMethod, result.MethodData))
 	return arep
 }
@@ -0,0 +1,251 @@
+package socks6
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/studentmain/socks6/common/lg"
+	"github.com/studentmain/socks6/message"
+)
+
+// sharedQueueSize is datagram count buffered for each PacketConn, more datagrams are dropped
+const sharedQueueSize = 64
+
+// SharedUDPAssociation multiplex several PacketConn over one UDP association, to use fewer associations
+// when application open many short-lived UDP sockets.
+// Datagrams are demultiplexed by remote address, each remote address is used by only one PacketConn at a time,
+// it's released when the PacketConn is closed. Datagrams from remote address not used by any PacketConn are dropped.
+type SharedUDPAssociation struct {
+	conn *ProxyUDPConn
+
+	mtx    sync.Mutex
+	owners map[string]*sharedPacketConn // remote address -> PacketConn using it
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error // why association is closed
+}
+
+// ShareUDPAssociation start an UDP association, PacketConns sharing it are created by NewPacketConn
+func (c *Client) ShareUDPAssociation(ctx context.Context) (*SharedUDPAssociation, error) {
+	pc, err := c.UDPAssociateRequest(ctx, message.AddrIPv4Zero, requestOptions(ctx))
+	if err != nil {
+		return nil, err
+	}
+	s := &SharedUDPAssociation{
+		conn:   pc,
+		owners: map[string]*sharedPacketConn{},
+		closed: make(chan struct{}),
+	}
+	go s.readLoop()
+	return s, nil
+}
+
+// NewPacketConn create a PacketConn using the association, it's closed when association is closed
+func (s *SharedUDPAssociation) NewPacketConn() (net.PacketConn, error) {
+	v := &sharedPacketConn{
+		s:               s,
+		ch:              make(chan sharedDatagram, sharedQueueSize),
+		closed:          make(chan struct{}),
+		deadlineChanged: make(chan struct{}),
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	select {
+	case <-s.closed:
+		return nil, &net.OpError{Op: "listen", Net: "socks6", Addr: s.conn.ProxyBindAddr(), Err: s.err}
+	default:
+	}
+	return v, nil
+}
+
+// Conn return the underlying association
+func (s *SharedUDPAssociation) Conn() *ProxyUDPConn {
+	return s.conn
+}
+
+// Close close the association and all PacketConns using it
+func (s *SharedUDPAssociation) Close() error {
+	s.closeWithError(net.ErrClosed)
+	return nil
+}
+
+func (s *SharedUDPAssociation) closeWithError(err error) {
+	s.closeOnce.Do(func() {
+		s.mtx.Lock()
+		s.err = err
+		close(s.closed)
+		s.mtx.Unlock()
+		s.conn.Close()
+	})
+}
+
+func (s *SharedUDPAssociation) readLoop() {
+	buf := make([]byte, 0xffff)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, ErrAssociationReconnected) {
+				continue
+			}
+			s.closeWithError(err)
+			return
+		}
+		s.mtx.Lock()
+		v := s.owners[message.ConvertAddr(addr).String()]
+		s.mtx.Unlock()
+		if v == nil {
+			lg.Debug("shared udp association drop datagram from", addr)
+			continue
+		}
+		select {
+		case v.ch <- sharedDatagram{data: append([]byte{}, buf[:n]...), addr: addr}:
+		default:
+			lg.Debug("shared udp association queue full, drop datagram from", addr)
+		}
+	}
+}
+
+// use let v use remote address key, fail when it's used by other PacketConn
+func (s *SharedUDPAssociation) use(v *sharedPacketConn, key string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if o, ok := s.owners[key]; ok {
+		return o == v
+	}
+	s.owners[key] = v
+	return true
+}
+
+// release remote addresses used by v
+func (s *SharedUDPAssociation) release(v *sharedPacketConn) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for k, o := range s.owners {
+		if o == v {
+			delete(s.owners, k)
+		}
+	}
+}
+
+type sharedDatagram struct {
+	data []byte
+	addr net.Addr
+}
+
+// sharedPacketConn is a PacketConn using SharedUDPAssociation
+type sharedPacketConn struct {
+	s  *SharedUDPAssociation
+	ch chan sharedDatagram
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	lock            sync.Mutex
+	deadline        time.Time     // read deadline
+	deadlineChanged chan struct{} // closed when deadline changed
+}
+
+var _ net.PacketConn = &sharedPacketConn{}
+
+func (v *sharedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	netErr := net.OpError{
+		Op:     "readfrom",
+		Net:    "socks6",
+		Source: v.LocalAddr(),
+		Addr:   v.s.conn.ProxyRemoteAddr(),
+	}
+	for {
+		v.lock.Lock()
+		deadline := v.deadline
+		changed := v.deadlineChanged
+		v.lock.Unlock()
+
+		var timeout <-chan time.Time
+		stop := func() bool { return false }
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				netErr.Err = os.ErrDeadlineExceeded
+				return 0, nil, &netErr
+			}
+			timer := time.NewTimer(d)
+			timeout = timer.C
+			stop = timer.Stop
+		}
+
+		select {
+		case d := <-v.ch:
+			stop()
+			return copy(p, d.data), d.addr, nil
+		case <-v.closed:
+			stop()
+			netErr.Err = net.ErrClosed
+			return 0, nil, &netErr
+		case <-v.s.closed:
+			stop()
+			netErr.Err = v.s.err
+			return 0, nil, &netErr
+		case <-timeout:
+			netErr.Err = os.ErrDeadlineExceeded
+			return 0, nil, &netErr
+		case <-changed:
+			stop()
+		}
+	}
+}
+
+func (v *sharedPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	netErr := net.OpError{
+		Op:     "writeto",
+		Net:    "socks6",
+		Source: v.LocalAddr(),
+		Addr:   v.s.conn.ProxyRemoteAddr(),
+	}
+	select {
+	case <-v.closed:
+		netErr.Err = net.ErrClosed
+		return 0, &netErr
+	default:
+	}
+	if !v.s.use(v, message.ConvertAddr(addr).String()) {
+		netErr.Err = ErrDestinationInUse
+		return 0, &netErr
+	}
+	return v.s.conn.WriteTo(p, addr)
+}
+
+// Close release remote addresses used by the PacketConn, association is not closed
+func (v *sharedPacketConn) Close() error {
+	v.closeOnce.Do(func() {
+		close(v.closed)
+		v.s.release(v)
+	})
+	return nil
+}
+
+// LocalAddr return client-proxy connection's client side address
+func (v *sharedPacketConn) LocalAddr() net.Addr {
+	return v.s.conn.LocalAddr()
+}
+
+// write deadline is not supported, datagrams are sent by shared association
+
+func (v *sharedPacketConn) SetDeadline(t time.Time) error {
+	return v.SetReadDeadline(t)
+}
+func (v *sharedPacketConn) SetReadDeadline(t time.Time) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.deadline = t
+	close(v.deadlineChanged)
+	v.deadlineChanged = make(chan struct{})
+	return nil
+}
+func (v *sharedPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -1,6 +1,7 @@
 package socks6
 
 import (
+	"context"
 	"net"
 
 	"github.com/studentmain/socks6/common/nt"
@@ -17,6 +18,9 @@ type SocksConn struct {
 	Session     []byte // the session this connection belongs to
 	StreamId    uint32 // stream id provided by client
 	InitialData []byte // client's initial data
+
+	padding int    // reply padding block size, see ServerWorker.Padding
+	replied func() // called when operation reply is written, optional
 }
 
 // Destination is endpoint included in client's request
@@ -31,36 +35,60 @@ func (c SocksConn) ConnId() string {
 
 // WriteReplyCode see WriteReply
 func (c SocksConn) WriteReplyCode(code message.ReplyCode) error {
-	return c.WriteReply(code, message.DefaultAddr, message.NewOptionSet())
+	return c.WriteReply(code, message.DefaultAddr, nil)
 }
 
 // WriteReplyAddr see WriteReply
 func (c SocksConn) WriteReplyAddr(code message.ReplyCode, ep net.Addr) error {
-	return c.WriteReply(code, ep, message.NewOptionSet())
+	return c.WriteReply(code, ep, nil)
 }
 
-// WriteReply write operation reply with given parameter to client
+// WriteReply write operation reply with given parameter to client, opt can be nil
 func (c SocksConn) WriteReply(code message.ReplyCode, ep net.Addr, opt *message.OptionSet) error {
-	oprep := message.NewOperationReplyWithCode(code)
+	oprep := message.AcquireOperationReply(code)
+	defer message.ReleaseOperationReply(oprep)
 	oprep.Endpoint = message.ConvertAddr(ep)
-	oprep.Options = opt
-	c.setSessionId(oprep)
-	c.setStreamId(oprep)
-	_, e := c.Conn.Write(oprep.Marshal())
+	if opt != nil {
+		opt.Range(func(o message.Option) bool {
+			oprep.Options.Add(o)
+			return true
+		})
+	}
+	return c.WriteOperationReply(oprep)
+}
+
+// WriteOperationReply write rep to client, e.g. built by message.OperationReplyBuilder.
+// Draft revision, session id and stream id of c are set on rep
+func (c SocksConn) WriteOperationReply(rep *message.OperationReply) error {
+	rep.Profile = c.profile()
+	c.setSessionId(rep)
+	c.setStreamId(rep)
+	rep.Pad(c.padding)
+	_, e := c.Conn.Write(rep.Marshal())
+	if c.replied != nil {
+		c.replied()
+	}
 	return e
 }
 
+// profile return draft revision used by client, nil means message.DefaultProfile
+func (c SocksConn) profile() *message.Profile {
+	if c.Request == nil {
+		return nil
+	}
+	return c.Request.Profile
+}
+
 // setSessionId append session id option to operation reply when id is not null
 func (c SocksConn) setSessionId(oprep *message.OperationReply) *message.OperationReply {
 	if c.Session == nil {
 		return oprep
 	}
-	oprep.Options.Add(message.Option{
-		Kind: message.OptionKindSessionID,
-		Data: message.SessionIDOptionData{
-			ID: c.Session,
-		},
-	})
+	// already set by handler
+	if _, ok := oprep.Options.GetData(message.OptionKindSessionID); ok {
+		return oprep
+	}
+	oprep.Options.AddMany(message.SessionReply{ID: c.Session}.Options())
 	return oprep
 }
 
@@ -76,3 +104,17 @@ func (c SocksConn) setStreamId(oprep *message.OperationReply) *message.Operation
 	})
 	return oprep
 }
+
+type clientAddrKey struct{}
+
+// withClientAddr attach client's address to context, used by ServerOutbound
+func withClientAddr(ctx context.Context, addr net.Addr) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+// ClientAddrFromContext return the SOCKS client address which is served by ServerWorker,
+// ServerOutbound can use it to decide how to create outbound connection
+func ClientAddrFromContext(ctx context.Context) net.Addr {
+	a, _ := ctx.Value(clientAddrKey{}).(net.Addr)
+	return a
+}
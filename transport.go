@@ -0,0 +1,58 @@
+package socks6
+
+import (
+	"net"
+
+	"github.com/studentmain/socks6/common/lg"
+)
+
+// Transport wrap stream connections between client and proxy, e.g. obfuscation layers and custom framings.
+// Server wrap its TCP and TLS listener, Client wrap connections it dialed to Server, both side must use same transport.
+// TLS is applied on top of transport
+type Transport interface {
+	// WrapListener wrap a listener of server, Accept shouldn't block on handshake of a single connection
+	WrapListener(l net.Listener) net.Listener
+	// WrapConn wrap a connection dialed by client
+	WrapConn(conn net.Conn) (net.Conn, error)
+}
+
+// ConnTransport is a Transport wrap each connection by function,
+// e.g. shadowsocks2021.NewSSConn with a fixed key
+type ConnTransport struct {
+	// Server wrap connection accepted by server
+	Server func(conn net.Conn) (net.Conn, error)
+	// Client wrap connection dialed by client
+	Client func(conn net.Conn) (net.Conn, error)
+}
+
+var _ Transport = ConnTransport{}
+
+func (t ConnTransport) WrapListener(l net.Listener) net.Listener {
+	return connTransportListener{Listener: l, wrap: t.Server}
+}
+
+func (t ConnTransport) WrapConn(conn net.Conn) (net.Conn, error) {
+	return t.Client(conn)
+}
+
+// connTransportListener wrap accepted connections, connection failed to wrap is dropped
+type connTransportListener struct {
+	net.Listener
+	wrap func(conn net.Conn) (net.Conn, error)
+}
+
+func (l connTransportListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		wc, err := l.wrap(conn)
+		if err != nil {
+			lg.Debug(conn3Tuple(conn), "can't wrap connection", err)
+			conn.Close()
+			continue
+		}
+		return wc, nil
+	}
+}
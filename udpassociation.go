@@ -2,14 +2,18 @@ package socks6
 
 import (
 	"context"
+	"encoding/hex"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/studentmain/socks6/common"
 	"github.com/studentmain/socks6/common/arrayx"
 	"github.com/studentmain/socks6/common/lg"
-	"github.com/studentmain/socks6/common/rnd"
 	"github.com/studentmain/socks6/internal"
+	"github.com/studentmain/socks6/internal/socket"
 	"github.com/studentmain/socks6/message"
 )
 
@@ -17,82 +21,174 @@ import (
 type DatagramDownlink func(b []byte) error
 
 type socksDatagram struct {
-	msg    *message.UDPMessage
+	msg    *message.UDPMessage // may be reused after handled, don't retain it or its data
 	src    net.Addr
 	freply DatagramDownlink
 }
 
-// udpAssociation contain UDP association state
-type udpAssociation struct {
-	id  uint64
-	udp net.PacketConn
+// udpMessagePool reuse UDP message parsed from client's datagram
+var udpMessagePool = sync.Pool{
+	New: func() any {
+		return &message.UDPMessage{}
+	},
+}
 
+// udpControl is association state bound to control connection, it's replaced as a whole when association resumed
+type udpControl struct {
 	cc          SocksConn
 	acceptTcp   bool   // whether to accept datagram over tcp
 	acceptDgram string // which client address is accepted
 	assocOk     bool   // first datagram received
-	icmpOn      bool
+	downlink    func(b []byte) error
+}
+
+// udpAssociation contain UDP association state
+type udpAssociation struct {
+	id  uint64
+	udp net.PacketConn
+
+	ctl    udpControl
+	ctlMtx sync.RWMutex // protect ctl, uplink, downlink and resume access it concurrently
+	icmpOn bool
+
+	pair     string         // reserved port
+	pairConn net.PacketConn // socket hold reserved port until another association take it
+	pairMtx  sync.Mutex
+
+	allowedRemote common.SyncMap[string, any] // allowed remote host, or host and port
+	filtering     UDPFilteringMode            // when not endpoint independent, only datagram from allowedRemote will send to client
+	guard         *DestinationGuard           // refuse datagram to internal destination
+
+	resolveAddr func(*message.SocksAddr) *message.SocksAddr // pinned address and link-local zone lookup, optional
+
+	reasm        *udpReassembler
+	fragmentSize int // fragment downlink datagram longer than it, 0 to disable
+	maxPayload   int // drop uplink datagram longer than it, 0 means no limit
+
+	parse *message.ParseConfig // parse UDP message sent over control connection
+
+	rateLimiter      *udpRateLimiter // limit of this association, optional
+	ownerRateLimiter *udpRateLimiter // limit shared by associations of same owner, optional
+
+	pcap       atomic.Value // *PcapWriter, relayed datagrams are captured when set
+	fragmentID uint32       // last downlink fragment id, only lower 16 bits are used
+
+	pmtu *pathMTUCache // MTU towards remote hosts
+
+	gro   bool            // udp socket may return coalesced datagrams
+	batch *udpBatchWriter // send uplink datagram with GSO, optional
 
-	pair     string // reserved port
-	downlink func(b []byte) error
+	owner   string // session or client which hold association
+	recvErr bool   // ICMP error is read from udp socket
+	alive   bool
 
-	allowedRemote common.SyncMap[string, any] // allowed remote host
-	addrFilter    bool                        // when true, only datagram from allowedRemote will send to client
+	releaseQuota func(assoc, reserved int) // return association and reserved port slots to owner's quota, optional
+	exitOnce     sync.Once
 
-	alive bool
+	resume        chan SocksConn // new control connection which re-attach association
+	resumeTimeout time.Duration  // how long to wait for re-attach after control connection lost, 0 to disable
+
+	counter *udpAssociationCounter
 }
 
 func newUdpAssociation(
 	cc SocksConn,
 	udp net.PacketConn,
-	pair net.Addr,
-	addrFilter bool,
+	pair net.PacketConn,
+	filtering UDPFilteringMode,
 	icmpOn bool,
+	guard *DestinationGuard,
 ) *udpAssociation {
-	id := rnd.RandUint64()
 	ps := ""
 	if pair != nil {
-		ps = pair.String()
+		ps = message.ConvertAddr(pair.LocalAddr()).String()
 	}
 	return &udpAssociation{
-		id:  id,
 		udp: udp,
 
-		cc:          cc,
-		acceptTcp:   false,
-		assocOk:     false,
-		acceptDgram: "......",
-		pair:        ps,
-		icmpOn:      icmpOn,
+		ctl: udpControl{
+			cc:          cc,
+			acceptTcp:   false,
+			assocOk:     false,
+			acceptDgram: "......",
+		},
+		pair:     ps,
+		pairConn: pair,
+		icmpOn:   icmpOn,
 
-		addrFilter:    addrFilter,
+		filtering:     filtering,
 		allowedRemote: common.NewSyncMap[string, any](),
+		guard:         guard,
+		reasm:         newUdpReassembler(),
+		pmtu:          newPathMTUCache(),
+		parse:         &message.ParseConfig{},
+
+		owner:   udpAssociationOwner(cc),
+		alive:   true,
+		counter: newUdpAssociationCounter(),
+		resume:  make(chan SocksConn, 1),
 	}
 }
 
-// handleTcpUp process UDP association setup and read messages from initial TCP connection
-func (u *udpAssociation) handleTcpUp(ctx context.Context) {
-	defer u.exit()
-	// send assoc init message
-	assocInit := message.UDPMessage{
-		Type:          message.UDPMessageAssociationInit,
-		AssociationID: u.id,
+// udpAssociationOwner identify who hold the association,
+// session is preferred, then authenticated client id and client address
+func udpAssociationOwner(cc SocksConn) string {
+	if cc.Session != nil {
+		return "session " + hex.EncodeToString(cc.Session)
 	}
-	if _, err := u.cc.Conn.Write(assocInit.Marshal()); err != nil {
-		lg.Warning(err)
+	if cc.ClientId != "" {
+		return "client " + cc.ClientId
+	}
+	host, _, err := net.SplitHostPort(cc.Conn.RemoteAddr().String())
+	if err != nil {
+		host = cc.Conn.RemoteAddr().String()
+	}
+	return "address " + host
+}
+
+// enableOffload turn on UDP GSO/GRO when supported by udp socket
+func (u *udpAssociation) enableOffload() {
+	uc, ok := u.udp.(*net.UDPConn)
+	if !ok || !socket.UDPOffloadSupported {
 		return
 	}
+	u.gro = socket.EnableUDPGRO(uc)
+	u.batch = newUdpBatchWriter(uc)
+}
+
+// handleTcpUp process UDP association setup and read messages from TCP connection,
+// association outlive lost connection when it can be resumed
+func (u *udpAssociation) handleTcpUp(ctx context.Context) {
+	defer u.exit()
 	// check for assoc established in ??? seconds
 	// and close assoc if not established
 	go func() {
 		<-time.After(120 * time.Second)
-		if !u.assocOk {
+		if !u.control().assocOk {
 			u.exit()
 		}
 	}()
+	for {
+		u.serveControl(ctx)
+		if !u.waitResume(ctx) {
+			return
+		}
+	}
+}
+
+// serveControl send association init message and read messages from control connection, until connection fail
+func (u *udpAssociation) serveControl(ctx context.Context) {
+	cc := u.control().cc
+	// send assoc init message
+	assocInit := message.NewUDPAssociationInit(u.id)
+	assocInit.Profile = cc.profile()
+	if _, err := cc.Conn.Write(assocInit.Marshal()); err != nil {
+		lg.Warning(err)
+		return
+	}
 	// read loop
 	for {
-		msg, err := message.ParseUDPMessageFrom(u.cc.Conn)
+		msg, err := u.parse.ParseUDPMessageFrom(cc.Conn)
 		if err != nil {
 			u.reportErr(err)
 			return
@@ -101,138 +197,404 @@ func (u *udpAssociation) handleTcpUp(ctx context.Context) {
 			u.reportErr(ErrAssociationMismatch)
 			return
 		}
+		if msg.Type == message.UDPMessageFragment {
+			if msg = u.reasm.add(msg); msg == nil {
+				continue
+			}
+		}
 
 		switch msg.Type {
 		// switch-case, in case client can send other message in the future
 		case message.UDPMessageDatagram:
-			// assoc is not established yet
-			if !u.assocOk {
-				u.assocOk = true
-				u.acceptTcp = true
-				u.ack()
-				u.downlink = func(b []byte) error {
-					_, err := u.cc.Conn.Write(b)
-					return err
-				}
-			}
 			// assoc is not on tcp
-			if !u.acceptTcp {
-				lg.Error(u.cc.ConnId(), "should send association ack via tcp first")
+			if !u.establishTcp(cc) {
+				lg.Error(cc.ConnId(), "should send association ack via tcp first")
 				return
 			}
+			if u.maxPayload > 0 && len(msg.Data) > u.maxPayload {
+				u.counter.drop()
+				u.datagramTooBig(ctx, msg.Endpoint)
+				continue
+			}
+			if !u.allowRate(len(msg.Data)) {
+				u.counter.drop()
+				continue
+			}
 			// todo report critical error
-			if err := u.send(msg); err != nil {
+			if err := u.send(ctx, msg); err != nil {
 				u.reportErr(err)
 			}
+		case message.UDPMessageStackOption:
+			u.applyStackOption(cc, msg.Options)
+		}
+	}
+}
+
+// control return snapshot of control connection state
+func (u *udpAssociation) control() udpControl {
+	u.ctlMtx.RLock()
+	defer u.ctlMtx.RUnlock()
+	return u.ctl
+}
+
+// establishTcp establish association over control connection cc if not established yet,
+// return whether datagram over tcp is accepted
+func (u *udpAssociation) establishTcp(cc SocksConn) bool {
+	u.ctlMtx.Lock()
+	defer u.ctlMtx.Unlock()
+	if !u.ctl.assocOk {
+		u.ctl.assocOk = true
+		u.ctl.acceptTcp = true
+		u.ack(cc)
+		u.ctl.downlink = func(b []byte) error {
+			_, err := cc.Conn.Write(b)
+			return err
 		}
 	}
+	return u.ctl.acceptTcp
+}
+
+// establishUdp establish association over udp if not established yet, freply is downlink to client's address src,
+// return control connection and whether datagram from src is accepted
+func (u *udpAssociation) establishUdp(src string, freply DatagramDownlink) (SocksConn, bool) {
+	u.ctlMtx.Lock()
+	defer u.ctlMtx.Unlock()
+	if !u.ctl.assocOk {
+		u.ctl.assocOk = true
+		u.ctl.acceptDgram = src
+		u.ack(u.ctl.cc)
+		u.ctl.downlink = freply
+	}
+	return u.ctl.cc, u.ctl.acceptDgram == src
+}
+
+// waitResume close lost control connection and wait for client re-attach association from another connection of session,
+// return false when association should exit
+func (u *udpAssociation) waitResume(ctx context.Context) bool {
+	cc := u.control().cc
+	cc.Conn.Close()
+	if u.resumeTimeout <= 0 || cc.Session == nil || !u.alive {
+		return false
+	}
+	lg.Debug(cc.ConnId(), "wait for udp assoc resume", u.id)
+	select {
+	case cc = <-u.resume:
+	case <-time.After(u.resumeTimeout):
+		return false
+	case <-ctx.Done():
+		return false
+	}
+	// client's endpoint is likely changed, establish association again
+	u.ctlMtx.Lock()
+	u.ctl = udpControl{
+		cc:          cc,
+		acceptTcp:   false,
+		assocOk:     false,
+		acceptDgram: "......",
+	}
+	u.ctlMtx.Unlock()
+	lg.Trace(cc.ConnId(), "udp assoc resumed", u.id)
+	return true
+}
+
+// resumeWith hand over association to new control connection,
+// old connection is closed in case it still look alive, e.g. client's address changed
+func (u *udpAssociation) resumeWith(cc SocksConn) bool {
+	old := u.control().cc.Conn
+	select {
+	case u.resume <- cc:
+	default:
+		// another connection is resuming
+		return false
+	}
+	old.Close()
+	return true
+}
+
+// applyStackOption change association socket's stack options, only multicast options are supported
+func (u *udpAssociation) applyStackOption(cc SocksConn, ops *message.OptionSet) {
+	if ops == nil {
+		return
+	}
+	opt := message.GetStackOptionInfo(ops, false)
+	applied := applyMulticastOption(u.udp, opt)
+	lg.Debug(cc.ConnId(), "stack option applied", applied)
 }
 
 // handleUdpUp process a messages from UDP
 func (u *udpAssociation) handleUdpUp(ctx context.Context, cp socksDatagram) {
 	msg := cp.msg
-	if msg.Type != message.UDPMessageDatagram {
-		return
-	}
 	if msg.AssociationID != u.id {
 		u.reportErr(ErrAssociationMismatch)
 		return
 	}
+	if !u.alive {
+		u.reportErr(ErrAssociationExpired)
+		return
+	}
+	if msg.Type == message.UDPMessageFragment {
+		// fragment is kept until reassembled
+		msg.Data = arrayx.Dup(msg.Data)
+		if msg = u.reasm.add(msg); msg == nil {
+			return
+		}
+	}
+	if msg.Type != message.UDPMessageDatagram {
+		return
+	}
 	// start assoc if necessary
-	if !u.assocOk {
-		u.assocOk = true
-		u.acceptDgram = cp.src.String()
-		u.ack()
-		u.downlink = cp.freply
-	}
-	if u.acceptDgram != cp.src.String() {
-		lg.Error(u.cc.ConnId(), "should send association ack via udp first")
+	if cc, ok := u.establishUdp(cp.src.String(), cp.freply); !ok {
+		lg.Error(cc.ConnId(), "should send association ack via udp first")
+		return
+	}
+	if u.maxPayload > 0 && len(msg.Data) > u.maxPayload {
+		u.counter.drop()
+		u.datagramTooBig(ctx, msg.Endpoint)
+		return
+	}
+	if !u.allowRate(len(msg.Data)) {
+		u.counter.drop()
 		return
 	}
-	if err := u.send(msg); err != nil {
+	if err := u.send(ctx, msg); err != nil {
 		u.reportErr(err)
 	}
 }
 
 // handleUdpDown read UDP packet from remote
 func (u *udpAssociation) handleUdpDown(ctx context.Context) {
-	buf := internal.BytesPool4k.Rent()
-	defer internal.BytesPool4k.Return(buf)
+	pool := internal.BytesPool4k
+	if u.gro {
+		// coalesced datagrams can be up to 64k
+		pool = internal.BytesPool64k
+	}
+	buf := pool.Rent()
+	defer pool.Return(buf)
+	oob := make([]byte, socket.GROBufferSize)
+	// message is marshaled before next read, so it and buffer can be reused
+	msg := message.NewUDPDatagram(u.id, nil, nil)
 	for {
-		l, a, err := u.udp.ReadFrom(buf)
-		// restricted cone nat
-		if u.addrFilter {
+		l, segSize, a, err := u.readFrom(buf, oob)
+		if err != nil && u.recvErr && socket.IsICMPErrno(err) {
+			u.handleSocketError(ctx)
+			continue
+		}
+		if err != nil {
+			lg.Error("udp read", err)
+			return
+		}
+		// (port) restricted cone nat
+		if u.filtering != UDPFilteringEndpointIndependent {
 			sa := message.ConvertAddr(a)
 			if sa.AddressType == message.AddressTypeDomainName {
 				lg.Info("can't filter remote UDP packet by domain name")
 				continue
 			}
-			if _, ok := u.allowedRemote.Load(net.IP(sa.Address).String()); !ok {
+			if _, ok := u.allowedRemote.Load(u.filterKey(net.IP(sa.Address), sa.Port)); !ok {
+				u.counter.drop()
 				continue
 			}
 		}
-		if err != nil {
-			lg.Error("udp read", err)
-			return
-		}
-		msg := &message.UDPMessage{
-			Type:          message.UDPMessageDatagram,
-			AssociationID: u.id,
-
-			Endpoint: message.ConvertAddr(a),
-			Data:     arrayx.Dup(buf[:l]),
-		}
-		if !u.assocOk || u.downlink == nil {
+		ctl := u.control()
+		if !ctl.assocOk || ctl.downlink == nil {
+			u.counter.drop()
 			continue
 		}
-		if err := u.downlink(msg.Marshal()); err != nil {
-			lg.Error("udp downlink", err)
+		msg.Endpoint = message.ConvertAddr(a)
+		for _, b := range splitSegment(buf[:l], segSize) {
+			if !u.allowRate(len(b)) {
+				u.counter.drop()
+				continue
+			}
+			msg.Data = b
+			if err := u.sendDown(ctl, msg); err != nil {
+				u.counter.drop()
+				lg.Error("udp downlink", err)
+				continue
+			}
+			u.counter.down(a, len(b))
+			if p := u.capture(); p != nil {
+				p.writeUDP(a, ctl.cc.Conn.RemoteAddr(), b)
+			}
 		}
 	}
 }
 
+// filterKey return allowedRemote key of remote endpoint according to filtering mode
+func (u *udpAssociation) filterKey(ip net.IP, port uint16) string {
+	if u.filtering == UDPFilteringAddressAndPortDependent {
+		return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+	}
+	return ip.String()
+}
+
+// readFrom read datagram from udp socket, segSize is non-zero when GRO coalesced datagrams
+func (u *udpAssociation) readFrom(buf []byte, oob []byte) (n int, segSize int, addr net.Addr, err error) {
+	if !u.gro {
+		n, addr, err = u.udp.ReadFrom(buf)
+		return n, 0, addr, err
+	}
+	n, segSize, ua, err := socket.ReadMsgGRO(u.udp.(*net.UDPConn), buf, oob)
+	if ua == nil {
+		return n, segSize, nil, err
+	}
+	return n, segSize, ua, err
+}
+
+// sendDown write datagram message to client via ctl's downlink, fragment it when necessary
+func (u *udpAssociation) sendDown(ctl udpControl, msg *message.UDPMessage) error {
+	// downlink don't keep buffer after return
+	buf := internal.BytesPool64k.Rent()
+	defer internal.BytesPool64k.Return(buf)
+	msg.Profile = ctl.cc.profile()
+	// stream won't need fragment
+	if u.fragmentSize <= 0 || ctl.acceptTcp {
+		return ctl.downlink(msg.AppendTo(buf[:0]))
+	}
+	// sendDown is called by downlink and ICMP error handler concurrently
+	frags, err := msg.Fragment(uint16(atomic.AddUint32(&u.fragmentID, 1)), u.fragmentSize)
+	if err != nil {
+		return err
+	}
+	for _, f := range frags {
+		if err := ctl.downlink(f.AppendTo(buf[:0])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleSocketError read ICMP error from udp socket's error queue and send it to client
+func (u *udpAssociation) handleSocketError(ctx context.Context) {
+	se, err := socket.ReadSocketError(u.udp)
+	if err != nil {
+		lg.Debug("read socket error", err)
+		return
+	}
+	code, reporter, ok := se.UDPError()
+	if !ok || se.Destination == nil {
+		return
+	}
+	if code == message.UDPErrorDatagramTooBig && se.MTU > 0 {
+		u.pmtu.update(se.Destination.IP, se.MTU)
+	}
+	src := message.ConvertAddr(u.udp.LocalAddr())
+	u.handleIcmpDown(ctx, code, src, message.ConvertAddr(se.Destination), reporter)
+}
+
 // handleIcmpDown send an socks 6 icmp message to client
 func (u *udpAssociation) handleIcmpDown(ctx context.Context, code message.UDPErrorType, src, dst, reporter *message.SocksAddr) {
-	uh := message.UDPMessage{
-		Type:          message.UDPMessageError,
-		AssociationID: u.id,
-		Endpoint:      dst,
-		ErrorEndpoint: reporter,
-		ErrorCode:     code,
-	}
-	if err := u.send(&uh); err != nil {
+	uh := message.NewUDPError(u.id, dst, reporter, code)
+	ctl := u.control()
+	if !ctl.assocOk || ctl.downlink == nil {
+		return
+	}
+	if err := u.sendDown(ctl, uh); err != nil {
 		u.reportErr(err)
 	}
 }
 
+// datagramTooBig tell client datagram to dst is dropped because it exceed path MTU or max payload size
+func (u *udpAssociation) datagramTooBig(ctx context.Context, dst *message.SocksAddr) {
+	if !u.icmpOn {
+		lg.Debug("drop datagram too big", dst)
+		return
+	}
+	local := message.ConvertAddr(u.udp.LocalAddr())
+	u.handleIcmpDown(ctx, message.UDPErrorDatagramTooBig, local, dst, local)
+}
+
 // send write client udp message to remote
-func (u *udpAssociation) send(msg *message.UDPMessage) error {
-	a, err := net.ResolveUDPAddr("udp", msg.Endpoint.String())
+func (u *udpAssociation) send(ctx context.Context, msg *message.UDPMessage) error {
+	ep := msg.Endpoint
+	if u.resolveAddr != nil {
+		ep = u.resolveAddr(ep)
+	}
+	a, err := net.ResolveUDPAddr("udp", ep.String())
+	if err != nil {
+		u.counter.drop()
+		return err
+	}
+	if u.guard != nil && !u.guard.AllowedIP(a.IP) {
+		u.counter.drop()
+		return ErrNotAllowedByRule
+	}
 
-	if u.addrFilter {
-		u.allowedRemote.Store(a.IP.String(), nil)
+	if u.filtering != UDPFilteringEndpointIndependent {
+		u.allowedRemote.Store(u.filterKey(a.IP, uint16(a.Port)), nil)
+	}
+	if max := u.pmtu.maxPayload(a.IP); max > 0 && len(msg.Data) > max {
+		u.counter.drop()
+		u.datagramTooBig(ctx, msg.Endpoint)
+		return nil
 	}
 
+	if u.batch != nil {
+		// written asynchronously, data may be reused when returned
+		err = u.batch.write(arrayx.Dup(msg.Data), a)
+	} else {
+		_, err = u.udp.WriteTo(msg.Data, a)
+	}
 	if err != nil {
+		u.counter.drop()
+		if socket.IsMessageTooLong(err) {
+			// DF is set and kernel already know path MTU
+			u.datagramTooBig(ctx, msg.Endpoint)
+			return nil
+		}
 		return err
 	}
-	_, err = u.udp.WriteTo(msg.Data, a)
+	u.counter.up(a, len(msg.Data))
+	if p := u.capture(); p != nil {
+		p.writeUDP(u.control().cc.Conn.RemoteAddr(), a, msg.Data)
+	}
+	return nil
+}
+
+// ack send assoc ack message via control connection cc
+func (u *udpAssociation) ack(cc SocksConn) error {
+	h := message.NewUDPAssociationAck(u.id)
+	h.Profile = cc.profile()
+	_, err := cc.Conn.Write(h.Marshal())
 	return err
 }
 
-// ack send assoc ack message
-func (u *udpAssociation) ack() error {
-	h := message.UDPMessage{
-		Type:          message.UDPMessageAssociationAck,
-		AssociationID: u.id,
+// takePair give up reserved port, so another association can use it
+func (u *udpAssociation) takePair() net.PacketConn {
+	u.pairMtx.Lock()
+	defer u.pairMtx.Unlock()
+	p := u.pairConn
+	if p != nil {
+		u.quotaReleased(0, 1)
+	}
+	u.pairConn = nil
+	u.pair = ""
+	return p
+}
+
+// quotaReleased return slots to owner's quota
+func (u *udpAssociation) quotaReleased(assoc, reserved int) {
+	if u.releaseQuota != nil {
+		u.releaseQuota(assoc, reserved)
 	}
-	_, err := u.cc.Conn.Write(h.Marshal())
-	return err
 }
 
 func (u *udpAssociation) exit() {
 	u.alive = false
-	u.cc.Conn.Close()
+	u.exitOnce.Do(func() {
+		u.quotaReleased(1, 0)
+	})
+	u.pairMtx.Lock()
+	if u.pairConn != nil {
+		u.pairConn.Close()
+		u.pairConn = nil
+		u.quotaReleased(0, 1)
+	}
+	u.pairMtx.Unlock()
+	if u.batch != nil {
+		u.batch.stop()
+	}
+	u.control().cc.Conn.Close()
 	u.udp.Close()
 }
 
@@ -0,0 +1,69 @@
+package socks6
+
+import (
+	"time"
+
+	"github.com/studentmain/socks6/common/lg"
+	"github.com/studentmain/socks6/common/rnd"
+)
+
+// id of removed association can't be used by new association in this period,
+// so late datagram of old association won't be delivered to new one
+const udpAssociationIDQuarantine = 10 * time.Minute
+
+// registerUdpAssociation allocate an unused id for association and store it
+func (s *ServerWorker) registerUdpAssociation(ua *udpAssociation) {
+	s.udpAssocIDMtx.Lock()
+	defer s.udpAssocIDMtx.Unlock()
+	for {
+		id := rnd.RandUint64()
+		if _, used := s.udpAssociation.Load(id); used {
+			lg.Debug("udp association id collision", id)
+			continue
+		}
+		if s.udpAssociationQuarantined(id) {
+			lg.Debug("udp association id in quarantine", id)
+			continue
+		}
+		ua.id = id
+		s.udpAssociation.Store(id, ua)
+		return
+	}
+}
+
+// removeUdpAssociation delete association and quarantine its id
+func (s *ServerWorker) removeUdpAssociation(ua *udpAssociation) {
+	s.udpAssocIDMtx.Lock()
+	defer s.udpAssocIDMtx.Unlock()
+	s.udpAssociation.Delete(ua.id)
+	s.udpAssocQuarantine.Store(ua.id, time.Now().Add(udpAssociationIDQuarantine))
+}
+
+func (s *ServerWorker) udpAssociationQuarantined(id uint64) bool {
+	end, ok := s.udpAssocQuarantine.Load(id)
+	return ok && time.Now().Before(end)
+}
+
+// expireUdpAssociationQuarantine allow id to be used again after quarantine
+func (s *ServerWorker) expireUdpAssociationQuarantine() {
+	now := time.Now()
+	s.udpAssocQuarantine.Range(func(key uint64, value time.Time) bool {
+		if now.After(value) {
+			s.udpAssocQuarantine.Delete(key)
+		}
+		return true
+	})
+}
+
+// lookupDatagramAssociation find alive association for client's datagram,
+// error tell why datagram is rejected
+func (s *ServerWorker) lookupDatagramAssociation(id uint64) (*udpAssociation, error) {
+	ua, ok := s.udpAssociation.Load(id)
+	if ok && ua.alive {
+		return ua, nil
+	}
+	if ok || s.udpAssociationQuarantined(id) {
+		return nil, ErrAssociationExpired
+	}
+	return nil, ErrAssociationMismatch
+}
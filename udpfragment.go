@@ -0,0 +1,117 @@
+package socks6
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/studentmain/socks6/message"
+)
+
+const (
+	// max incomplete datagrams per association
+	maxPendingReassembly = 16
+	// incomplete datagram is dropped after timeout
+	reassemblyTimeout = 15 * time.Second
+	// max fragments of a datagram
+	maxFragmentCount = 64
+)
+
+// udpReassembler rebuild datagram from fragments
+type udpReassembler struct {
+	mtx     sync.Mutex
+	pending map[uint16]*udpReassembly
+}
+
+type udpReassembly struct {
+	endpoint *message.SocksAddr
+	parts    map[uint16][]byte // offset -> data
+	total    int               // datagram length, -1 when last fragment not received
+	received int
+	created  time.Time
+}
+
+func newUdpReassembler() *udpReassembler {
+	return &udpReassembler{
+		pending: map[uint16]*udpReassembly{},
+	}
+}
+
+// add a fragment, return reassembled datagram message when all fragments arrived
+func (r *udpReassembler) add(msg *message.UDPMessage) *message.UDPMessage {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.expire()
+
+	end := int(msg.FragmentOffset) + len(msg.Data)
+	if end > 0xffff {
+		delete(r.pending, msg.FragmentID)
+		return nil
+	}
+
+	ra, ok := r.pending[msg.FragmentID]
+	if !ok {
+		if len(r.pending) >= maxPendingReassembly {
+			return nil
+		}
+		ra = &udpReassembly{
+			endpoint: msg.Endpoint,
+			parts:    map[uint16][]byte{},
+			total:    -1,
+			created:  time.Now(),
+		}
+		r.pending[msg.FragmentID] = ra
+	}
+	if _, dup := ra.parts[msg.FragmentOffset]; dup {
+		return nil
+	}
+	if len(ra.parts) >= maxFragmentCount {
+		delete(r.pending, msg.FragmentID)
+		return nil
+	}
+	ra.parts[msg.FragmentOffset] = msg.Data
+	ra.received += len(msg.Data)
+	if !msg.FragmentMore {
+		ra.total = end
+	}
+	if ra.total < 0 || ra.received < ra.total {
+		return nil
+	}
+
+	delete(r.pending, msg.FragmentID)
+	data, ok := ra.assemble()
+	if !ok {
+		return nil
+	}
+	dgram := message.NewUDPDatagram(msg.AssociationID, ra.endpoint, data)
+	dgram.Profile = msg.Profile
+	return dgram
+}
+
+// expire drop timed out reassembly
+func (r *udpReassembler) expire() {
+	for id, ra := range r.pending {
+		if time.Since(ra.created) > reassemblyTimeout {
+			delete(r.pending, id)
+		}
+	}
+}
+
+// assemble concat all parts, fail when parts are overlapped or missing
+func (ra *udpReassembly) assemble() ([]byte, bool) {
+	offsets := make([]int, 0, len(ra.parts))
+	for off := range ra.parts {
+		offsets = append(offsets, int(off))
+	}
+	sort.Ints(offsets)
+
+	data := make([]byte, 0, ra.total)
+	for _, off := range offsets {
+		if off != len(data) {
+			return nil, false
+		}
+		data = append(data, ra.parts[uint16(off)]...)
+	}
+	return data, len(data) == ra.total
+}
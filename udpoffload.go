@@ -0,0 +1,155 @@
+package socks6
+
+import (
+	"net"
+	"sync"
+
+	"github.com/studentmain/socks6/common/lg"
+	"github.com/studentmain/socks6/internal/socket"
+)
+
+const (
+	// kernel limit of segments per GSO send
+	maxGSOSegments = 64
+	// max payload of a GSO send
+	maxGSOPayload = 65000
+)
+
+type udpOutDatagram struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+// udpBatchWriter send datagrams in background,
+// consecutive datagrams with same destination and size are coalesced into one GSO send
+type udpBatchWriter struct {
+	conn *net.UDPConn
+	gso  bool
+
+	ch       chan udpOutDatagram
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newUdpBatchWriter(conn *net.UDPConn) *udpBatchWriter {
+	w := &udpBatchWriter{
+		conn: conn,
+		gso:  socket.UDPOffloadSupported,
+		ch:   make(chan udpOutDatagram, maxGSOSegments*2),
+		done: make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// write queue a datagram, b must not be modified after call
+func (w *udpBatchWriter) write(b []byte, addr *net.UDPAddr) error {
+	select {
+	case w.ch <- udpOutDatagram{data: b, addr: addr}:
+		return nil
+	case <-w.done:
+		return net.ErrClosed
+	}
+}
+
+func (w *udpBatchWriter) stop() {
+	w.stopOnce.Do(func() {
+		close(w.done)
+	})
+}
+
+func (w *udpBatchWriter) run() {
+	batch := make([]udpOutDatagram, 0, maxGSOSegments)
+	buf := make([]byte, 0, maxGSOPayload)
+	for {
+		select {
+		case d := <-w.ch:
+			batch = append(batch[:0], d)
+		case <-w.done:
+			return
+		}
+		// take whatever already queued, without waiting
+	drain:
+		for len(batch) < maxGSOSegments {
+			select {
+			case d := <-w.ch:
+				batch = append(batch, d)
+			default:
+				break drain
+			}
+		}
+		buf = w.flush(batch, buf)
+	}
+}
+
+// flush send batch, return buf for reuse
+func (w *udpBatchWriter) flush(batch []udpOutDatagram, buf []byte) []byte {
+	for i := 0; i < len(batch); {
+		n := w.runLength(batch[i:])
+		if n == 1 || !w.gso {
+			w.writeOne(batch[i])
+			i++
+			continue
+		}
+
+		buf = buf[:0]
+		for _, d := range batch[i : i+n] {
+			buf = append(buf, d.data...)
+		}
+		if err := socket.WriteMsgGSO(w.conn, buf, len(batch[i].data), batch[i].addr); err != nil {
+			// e.g. NIC without checksum offload, don't try again
+			lg.Info("udp gso send failed, fallback", err)
+			w.gso = false
+			for _, d := range batch[i : i+n] {
+				w.writeOne(d)
+			}
+		}
+		i += n
+	}
+	return buf
+}
+
+// runLength count datagrams can be sent with first one in a GSO send,
+// they must have same destination and size, except last one can be shorter
+func (w *udpBatchWriter) runLength(batch []udpOutDatagram) int {
+	seg := len(batch[0].data)
+	if seg == 0 {
+		return 1
+	}
+	total := seg
+	n := 1
+	for n < len(batch) && n < maxGSOSegments {
+		d := batch[n]
+		if len(d.data) == 0 || len(d.data) > seg || total+len(d.data) > maxGSOPayload {
+			break
+		}
+		if !d.addr.IP.Equal(batch[0].addr.IP) || d.addr.Port != batch[0].addr.Port {
+			break
+		}
+		total += len(d.data)
+		n++
+		if len(d.data) < seg {
+			break
+		}
+	}
+	return n
+}
+
+func (w *udpBatchWriter) writeOne(d udpOutDatagram) {
+	if _, err := w.conn.WriteTo(d.data, d.addr); err != nil {
+		lg.Debug("udp send", err)
+	}
+}
+
+// splitSegment split GRO coalesced datagrams, segSize 0 means b is a single datagram
+func splitSegment(b []byte, segSize int) [][]byte {
+	if segSize <= 0 || segSize >= len(b) {
+		return [][]byte{b}
+	}
+	ret := make([][]byte, 0, (len(b)+segSize-1)/segSize)
+	for len(b) > segSize {
+		ret = append(ret, b[:segSize])
+		b = b[segSize:]
+	}
+	return append(ret, b)
+}
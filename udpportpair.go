@@ -0,0 +1,116 @@
+package socks6
+
+import (
+	"context"
+	"net"
+
+	"github.com/studentmain/socks6/common/lg"
+	"github.com/studentmain/socks6/message"
+)
+
+// how many times to bind when looking for a port with requested parity and free adjacent port
+const maxParityAttempt = 16
+
+// listenPacketWithParity bind association socket, honor port parity option when present.
+// When reservation is requested and allowed, adjacent port of the pair is bound and returned as pair.
+func (s *ServerWorker) listenPacketWithParity(
+	ctx context.Context,
+	addr *message.SocksAddr,
+	opt message.StackOptionInfo,
+	canReserve bool,
+) (pc net.PacketConn, applied message.StackOptionInfo, pair net.PacketConn, err error) {
+	listen := func() (net.PacketConn, message.StackOptionInfo, error) {
+		return bindWithPolicy(s.BindPolicy, addr,
+			func(addr *message.SocksAddr) (net.PacketConn, message.StackOptionInfo, error) {
+				return s.Outbound.ListenPacket(ctx, opt, addr)
+			})
+	}
+	ippod, ok := opt[message.StackOptionUDPPortParity]
+	if !ok {
+		pc, applied, err = listen()
+		return pc, applied, nil, err
+	}
+	ppod := ippod.(message.PortParityOptionData)
+	// explicit port can't be changed, so only one attempt
+	fixed := addr.Port != 0
+	for i := 0; i < maxParityAttempt; i++ {
+		pc, applied, err = listen()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		last := fixed || i == maxParityAttempt-1
+		port := message.ConvertAddr(pc.LocalAddr()).Port
+		if !parityMatch(port, ppod.Parity) && !last {
+			pc.Close()
+			continue
+		}
+		if ppod.Reserve && canReserve {
+			pair = s.bindPairPort(ctx, pc.LocalAddr())
+			if pair == nil && !last {
+				pc.Close()
+				continue
+			}
+		}
+		break
+	}
+
+	parity := byte(message.StackPortParityOptionParityOdd)
+	if message.ConvertAddr(pc.LocalAddr()).Port&1 == 0 {
+		parity = message.StackPortParityOptionParityEven
+	}
+	if applied == nil {
+		applied = message.StackOptionInfo{}
+	}
+	applied[message.StackOptionUDPPortParity] = message.PortParityOptionData{
+		Parity:  parity,
+		Reserve: pair != nil,
+	}
+	return pc, applied, pair, nil
+}
+
+func parityMatch(port uint16, parity byte) bool {
+	switch parity {
+	case message.StackPortParityOptionParityEven:
+		return port&1 == 0
+	case message.StackPortParityOptionParityOdd:
+		return port&1 == 1
+	}
+	return true
+}
+
+// bindPairPort bind the other port of pair, even port pair with next port and odd port pair with previous port
+func (s *ServerWorker) bindPairPort(ctx context.Context, local net.Addr) net.PacketConn {
+	a := message.ConvertAddr(local)
+	if a.Port&1 == 0 {
+		if a.Port == 0xffff {
+			return nil
+		}
+		a.Port++
+	} else {
+		a.Port--
+	}
+	if a.Port == 0 || !s.udpPortReservable(a) {
+		return nil
+	}
+	p, _, err := s.Outbound.ListenPacket(ctx, message.StackOptionInfo{}, a)
+	if err != nil {
+		lg.Debug("can't bind pair port", a, err)
+		return nil
+	}
+	return p
+}
+
+// takeReservedPort hand over socket reserved at addr to new association, nil if nothing is reserved.
+// Caller should check reservation belong to client.
+func (s *ServerWorker) takeReservedPort(addr string) net.PacketConn {
+	rid, ok := s.reservedUdpAddr.Load(addr)
+	if !ok {
+		return nil
+	}
+	s.reservedUdpAddr.Delete(addr)
+	rua, ok := s.udpAssociation.Load(rid)
+	if !ok {
+		return nil
+	}
+	return rua.takePair()
+}
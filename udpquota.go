@@ -0,0 +1,54 @@
+package socks6
+
+// udpQuotaUsage is UDP associations and reserved ports held by an owner
+type udpQuotaUsage struct {
+	assoc    int
+	reserved int
+}
+
+// acquireUdpQuota take an association slot of owner before association is created, so concurrent requests can't exceed
+// MaxUDPAssociationPerClient, ok is false when quota is exhausted. reserve report whether a reserved port slot is taken too.
+// Slots are returned by releaseUdpQuota
+func (s *ServerWorker) acquireUdpQuota(owner string) (ok bool, reserve bool) {
+	s.udpQuotaMtx.Lock()
+	defer s.udpQuotaMtx.Unlock()
+	u, exist := s.udpQuota[owner]
+	if !exist {
+		u = &udpQuotaUsage{}
+	}
+	if s.MaxUDPAssociationPerClient > 0 && u.assoc >= s.MaxUDPAssociationPerClient {
+		return false, false
+	}
+	u.assoc++
+	if s.MaxReservedUDPPortPerClient <= 0 || u.reserved < s.MaxReservedUDPPortPerClient {
+		u.reserved++
+		reserve = true
+	}
+	s.udpQuota[owner] = u
+	return true, reserve
+}
+
+// releaseUdpQuota return association and reserved port slots to owner
+func (s *ServerWorker) releaseUdpQuota(owner string, assoc, reserved int) {
+	s.udpQuotaMtx.Lock()
+	defer s.udpQuotaMtx.Unlock()
+	u, ok := s.udpQuota[owner]
+	if !ok {
+		return
+	}
+	u.assoc -= assoc
+	u.reserved -= reserved
+	if u.assoc <= 0 && u.reserved <= 0 {
+		delete(s.udpQuota, owner)
+	}
+}
+
+// udpQuotaUsage return alive associations and reserved ports held by owner
+func (s *ServerWorker) udpQuotaUsage(owner string) (assoc int, reserved int) {
+	s.udpQuotaMtx.Lock()
+	defer s.udpQuotaMtx.Unlock()
+	if u, ok := s.udpQuota[owner]; ok {
+		return u.assoc, u.reserved
+	}
+	return 0, 0
+}
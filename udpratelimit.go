@@ -0,0 +1,147 @@
+package socks6
+
+import (
+	"sync"
+	"time"
+)
+
+// UDPRateLimit is max packets and bytes per second relayed, both direction counted.
+// Zero field means no limit on it. Short burst up to 1 second of rate is allowed.
+type UDPRateLimit struct {
+	PacketsPerSecond int
+	BytesPerSecond   int
+}
+
+// udpRateLimiter is token buckets of a UDP association or all associations of a client,
+// nil limiter allow everything
+type udpRateLimiter struct {
+	mtx     sync.Mutex
+	packets tokenBucket
+	bytes   tokenBucket
+}
+
+func newUdpRateLimiter(limit UDPRateLimit) *udpRateLimiter {
+	if limit.PacketsPerSecond <= 0 && limit.BytesPerSecond <= 0 {
+		return nil
+	}
+	now := time.Now()
+	return &udpRateLimiter{
+		packets: newTokenBucket(limit.PacketsPerSecond, now),
+		bytes:   newTokenBucket(limit.BytesPerSecond, now),
+	}
+}
+
+// allowBoth take tokens for a datagram of n bytes from both limiters, or from neither of them when any is exhausted.
+// return false when datagram should be dropped. a is locked before b, callers must keep the order
+func allowBoth(n int, a, b *udpRateLimiter) bool {
+	a.lock()
+	defer a.unlock()
+	b.lock()
+	defer b.unlock()
+	now := time.Now()
+	if !a.enough(n, now) || !b.enough(n, now) {
+		return false
+	}
+	a.take(n)
+	b.take(n)
+	return true
+}
+
+func (l *udpRateLimiter) lock() {
+	if l != nil {
+		l.mtx.Lock()
+	}
+}
+
+func (l *udpRateLimiter) unlock() {
+	if l != nil {
+		l.mtx.Unlock()
+	}
+}
+
+// enough refill buckets and check if a datagram of n bytes can pass, l must be locked
+func (l *udpRateLimiter) enough(n int, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	l.packets.fill(now)
+	l.bytes.fill(now)
+	return l.packets.enough(1) && l.bytes.enough(n)
+}
+
+// take tokens for a datagram of n bytes, l must be locked
+func (l *udpRateLimiter) take(n int) {
+	if l == nil {
+		return
+	}
+	l.packets.take(1)
+	l.bytes.take(n)
+}
+
+// tokenBucket hold at most 1 second of tokens, rate 0 means no limit
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int, now time.Time) tokenBucket {
+	if rate < 0 {
+		rate = 0
+	}
+	return tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) fill(now time.Time) {
+	if b.rate == 0 {
+		return
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+// enough check if n tokens can be taken, full bucket allow anything so large datagram can pass a low limit
+func (b *tokenBucket) enough(n int) bool {
+	return b.rate == 0 || b.tokens >= float64(n) || b.tokens >= b.rate
+}
+
+// take n tokens, bucket can go into debt
+func (b *tokenBucket) take(n int) {
+	if b.rate == 0 {
+		return
+	}
+	b.tokens -= float64(n)
+}
+
+// udpOwnerRateLimiter return rate limiter shared by all associations of owner
+func (s *ServerWorker) udpOwnerRateLimiter(owner string) *udpRateLimiter {
+	l := newUdpRateLimiter(s.UDPRateLimitPerClient)
+	if l == nil {
+		return nil
+	}
+	l, _ = s.udpOwnerLimiter.LoadOrStore(owner, l)
+	return l
+}
+
+// clearUdpOwnerRateLimiter forget rate limiter of clients without UDP association
+func (s *ServerWorker) clearUdpOwnerRateLimiter() {
+	s.udpOwnerLimiter.Range(func(key string, value *udpRateLimiter) bool {
+		if n, _ := s.udpQuotaUsage(key); n == 0 {
+			s.udpOwnerLimiter.Delete(key)
+		}
+		return true
+	})
+}
+
+// allowRate check datagram of n bytes against association's and its owner's rate limit,
+// tokens are taken only when both allow it
+func (u *udpAssociation) allowRate(n int) bool {
+	return allowBoth(n, u.rateLimiter, u.ownerRateLimiter)
+}
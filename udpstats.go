@@ -0,0 +1,155 @@
+package socks6
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// max remote endpoints remembered by association statistics
+const maxTrackedRemote = 64
+
+// UDPAssociationStats is a snapshot of UDP association's state and counters
+type UDPAssociationStats struct {
+	ID          uint64
+	Owner       string   // session or client which hold association
+	ClientAddr  net.Addr // address of client's control connection
+	LocalAddr   net.Addr // proxy's address used to communicate with remote
+	Established bool     // first datagram received
+	OverTCP     bool     // datagram is sent over control connection
+
+	UpDatagrams   uint64 // client to remote
+	UpBytes       uint64
+	DownDatagrams uint64 // remote to client
+	DownBytes     uint64
+	Dropped       uint64 // datagrams dropped by filter, rule or error, both direction
+
+	Created      time.Time
+	LastActivity time.Time
+	Remotes      map[string]time.Time // remote endpoint seen and last time seen, limited to 64 endpoints
+}
+
+// udpAssociationCounter hold UDP association's statistics
+type udpAssociationCounter struct {
+	// accessed atomically, keep them first for alignment
+	upDatagrams   uint64
+	upBytes       uint64
+	downDatagrams uint64
+	downBytes     uint64
+	dropped       uint64
+	lastActivity  int64 // unix nano
+
+	created time.Time
+
+	mtx     sync.Mutex
+	remotes map[string]time.Time
+}
+
+func newUdpAssociationCounter() *udpAssociationCounter {
+	now := time.Now()
+	return &udpAssociationCounter{
+		created:      now,
+		lastActivity: now.UnixNano(),
+		remotes:      map[string]time.Time{},
+	}
+}
+
+func (c *udpAssociationCounter) up(remote net.Addr, n int) {
+	atomic.AddUint64(&c.upDatagrams, 1)
+	atomic.AddUint64(&c.upBytes, uint64(n))
+	c.seen(remote)
+}
+
+func (c *udpAssociationCounter) down(remote net.Addr, n int) {
+	atomic.AddUint64(&c.downDatagrams, 1)
+	atomic.AddUint64(&c.downBytes, uint64(n))
+	c.seen(remote)
+}
+
+func (c *udpAssociationCounter) drop() {
+	atomic.AddUint64(&c.dropped, 1)
+}
+
+// seen update last activity and remember remote endpoint
+func (c *udpAssociationCounter) seen(remote net.Addr) {
+	now := time.Now()
+	atomic.StoreInt64(&c.lastActivity, now.UnixNano())
+	if remote == nil {
+		return
+	}
+	key := remote.String()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if _, ok := c.remotes[key]; !ok && len(c.remotes) >= maxTrackedRemote {
+		c.forgetOldest()
+	}
+	c.remotes[key] = now
+}
+
+func (c *udpAssociationCounter) forgetOldest() {
+	keys := make([]string, 0, len(c.remotes))
+	for k := range c.remotes {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return c.remotes[keys[i]].Before(c.remotes[keys[j]])
+	})
+	delete(c.remotes, keys[0])
+}
+
+// stats create a snapshot of association
+func (u *udpAssociation) stats() UDPAssociationStats {
+	c := u.counter
+	ctl := u.control()
+	st := UDPAssociationStats{
+		ID:          u.id,
+		Owner:       u.owner,
+		ClientAddr:  ctl.cc.Conn.RemoteAddr(),
+		LocalAddr:   u.udp.LocalAddr(),
+		Established: ctl.assocOk,
+		OverTCP:     ctl.acceptTcp,
+
+		UpDatagrams:   atomic.LoadUint64(&c.upDatagrams),
+		UpBytes:       atomic.LoadUint64(&c.upBytes),
+		DownDatagrams: atomic.LoadUint64(&c.downDatagrams),
+		DownBytes:     atomic.LoadUint64(&c.downBytes),
+		Dropped:       atomic.LoadUint64(&c.dropped),
+
+		Created:      c.created,
+		LastActivity: time.Unix(0, atomic.LoadInt64(&c.lastActivity)),
+		Remotes:      map[string]time.Time{},
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for k, v := range c.remotes {
+		st.Remotes[k] = v
+	}
+	return st
+}
+
+// UDPAssociationStats return statistics of all alive UDP associations
+func (s *ServerWorker) UDPAssociationStats() []UDPAssociationStats {
+	ret := []UDPAssociationStats{}
+	s.udpAssociation.Range(func(key uint64, value *udpAssociation) bool {
+		if value.alive {
+			ret = append(ret, value.stats())
+		}
+		return true
+	})
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Created.Before(ret[j].Created)
+	})
+	return ret
+}
+
+// LookupUDPAssociation return statistics of UDP association with given id
+func (s *ServerWorker) LookupUDPAssociation(id uint64) (UDPAssociationStats, bool) {
+	ua, ok := s.udpAssociation.Load(id)
+	if !ok {
+		return UDPAssociationStats{}, false
+	}
+	return ua.stats(), true
+}
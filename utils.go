@@ -3,10 +3,10 @@ package socks6
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"os"
 	"sync"
 	"syscall"
 	"time"
@@ -130,11 +130,39 @@ func relayOneDirection(c1, c2 net.Conn, timeout time.Duration) error {
 	}
 }
 
+// getReplyCode convert outbound error to socks6 error code, ReplyCodeMapper is tried first
+func (s *ServerWorker) getReplyCode(err error) message.ReplyCode {
+	if err != nil && s.ReplyCodeMapper != nil {
+		if code, ok := s.ReplyCodeMapper(err); ok {
+			return code
+		}
+	}
+	return getReplyCode(err)
+}
+
 // getReplyCode convert dial error to socks6 error code
 func getReplyCode(err error) message.ReplyCode {
 	if err == nil {
 		return message.OperationReplySuccess
 	}
+	if errors.Is(err, ErrNotAllowedByRule) {
+		return message.OperationReplyNotAllowedByRule
+	}
+	if errors.Is(err, message.ErrAddressTypeNotSupport) {
+		return message.OperationReplyAddressNotSupported
+	}
+	// name resolution failed
+	dnsErr := &net.DNSError{}
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return message.OperationReplyTimeout
+		}
+		return message.OperationReplyHostUnreachable
+	}
+	errno := syscall.Errno(0)
+	if errors.As(err, &errno) {
+		return getErrnoReplyCode(errno)
+	}
 	netErr, ok := err.(net.Error)
 	if !ok {
 		lg.Warning(err)
@@ -143,32 +171,28 @@ func getReplyCode(err error) message.ReplyCode {
 	if netErr.Timeout() {
 		return message.OperationReplyTimeout
 	}
-	opErr, ok := netErr.(*net.OpError)
-	if !ok {
-		return message.OperationReplyServerFailure
-	}
+	return message.OperationReplyServerFailure
+}
 
-	switch t := opErr.Err.(type) {
-	case *os.SyscallError:
-		errno, ok := t.Err.(syscall.Errno)
-		if !ok {
-			return message.OperationReplyServerFailure
-		}
-		// windows use windows.WSAExxxx error code, so this is necessary
-		switch common.ConvertSocketErrno(errno) {
-		case syscall.ENETUNREACH:
-			return message.OperationReplyNetworkUnreachable
-		case syscall.EHOSTUNREACH:
-			return message.OperationReplyHostUnreachable
-		case syscall.ECONNREFUSED:
-			return message.OperationReplyConnectionRefused
-		case syscall.ETIMEDOUT:
-			return message.OperationReplyTimeout
-		default:
-			return message.OperationReplyServerFailure
-		}
+// getErrnoReplyCode convert socket errno to socks6 error code
+func getErrnoReplyCode(errno syscall.Errno) message.ReplyCode {
+	// windows use windows.WSAExxxx error code, so this is necessary
+	switch common.ConvertSocketErrno(errno) {
+	case syscall.ENETUNREACH, syscall.ENETDOWN:
+		return message.OperationReplyNetworkUnreachable
+	case syscall.EHOSTUNREACH, syscall.EHOSTDOWN:
+		return message.OperationReplyHostUnreachable
+	case syscall.ECONNREFUSED:
+		return message.OperationReplyConnectionRefused
+	case syscall.ETIMEDOUT:
+		return message.OperationReplyTimeout
+	case syscall.EACCES, syscall.EPERM:
+		return message.OperationReplyNotAllowedByRule
+	case syscall.EAFNOSUPPORT, syscall.EADDRNOTAVAIL:
+		return message.OperationReplyAddressNotSupported
+	default:
+		return message.OperationReplyServerFailure
 	}
-	return message.OperationReplyServerFailure
 }
 
 func convertICMPError(msg *icmp.Message, ip *net.IPAddr, ver int,
@@ -192,6 +216,9 @@ func convertICMPError(msg *icmp.Message, ip *net.IPAddr, ver int,
 				code = message.UDPErrorNetworkUnreachable
 			case 1:
 				code = message.UDPErrorHostUnreachable
+			case 4:
+				// fragmentation needed
+				code = message.UDPErrorDatagramTooBig
 			default:
 				return 0, nil, nil
 			}
@@ -236,7 +263,7 @@ func convertICMPError(msg *icmp.Message, ip *net.IPAddr, ver int,
 			hdr = m2.Data
 		case ipv6.ICMPTypePacketTooBig:
 			code = message.UDPErrorDatagramTooBig
-			m2 := msg.Body.(*icmp.TimeExceeded)
+			m2 := msg.Body.(*icmp.PacketTooBig)
 			hdr = m2.Data
 		}
 	}